@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/GiGurra/boa/pkg/boa"
 	"github.com/google/uuid"
 	"github.com/kivra/gocc/cmd/benchmark"
+	"github.com/kivra/gocc/pkg/audit"
+	"github.com/kivra/gocc/pkg/cluster"
 	"github.com/kivra/gocc/pkg/config"
 	"github.com/kivra/gocc/pkg/limiter/limiter_api"
 	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
 	"github.com/kivra/gocc/pkg/logging"
 	"github.com/kivra/gocc/pkg/server"
+	"github.com/kivra/gocc/pkg/server/binary_proto"
 	endpoints2 "github.com/kivra/gocc/pkg/server/endpoints"
+	"github.com/kivra/gocc/pkg/server/envoy_rls"
+	"github.com/kivra/gocc/pkg/server/resp"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"github.com/kivra/gocc/pkg/tracing"
 	"github.com/spf13/cobra"
 	"log/slog"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -33,8 +42,16 @@ func main() {
 			" - optionally: ?maxRequests=200 sets max requests per window for the key.",
 			" - optionally: ?maxRequestsInQueue=400 sets max requests in queue for the key after the window is full.",
 			"- DELETE to /rate/:key/:requestId to decrement the rate limiter for a key.",
+			"- any method to /auth for reverse proxy auth requests (nginx auth_request, traefik forwardAuth). Keys are built from forwarded headers.",
+			"- optionally (--resp): the redis protocol, with redis-cell's CL.THROTTLE and GOCC.ASK|RELEASE|DEBUG commands.",
+			"- optionally (--binary): a compact binary protocol with pipelining, see pkg/server/binary_proto for a go client.",
 			"- GET to /healthz to check if the server is up.",
 			"- GET to /debug|/debug/:key introspect the state of limiters.",
+			"- GET to /keys lists keys a page at a time, with ?prefix=, ?regex=, ?sort=key|denied|waiting|approved, ?limit=, ?cursor= and ?fields=.",
+			"- GET to /events?key=|prefix=|regex= streams approvals, denials, queue changes and window resets as server-sent events.",
+			"- GET to /cluster|/cluster/owner/:key shows the instances, their health and rings, and which instance owns a key.",
+			"- GET to /metrics for prometheus metrics, unless --metrics=false.",
+			"- optionally (--admin-api): /admin/keys/:key to override, reset, drain or expire a key at runtime.",
 		}, "\n"),
 		Params:      cfg,
 		ParamEnrich: boa.ParamEnricherDefault,
@@ -46,8 +63,10 @@ func main() {
 }
 
 type AppHandle struct {
-	Port  int
-	Close func()
+	Port          int
+	FrontendPorts map[string]int
+	SocketPaths   map[string]string
+	Close         func()
 }
 
 func StartApplication(
@@ -78,14 +97,79 @@ func StartApplication(
 			fmt.Sprintf("             globalCfg.LogLevel: %v", globalCfg.LogLevel.Value()),
 			fmt.Sprintf("    globalCfg.LogIncludesSource: %v", globalCfg.LogIncludesSource.Value()),
 			fmt.Sprintf("         globalCfg.InstanceUrls: %v", globalCfg.InstanceUrls.Value()),
+			fmt.Sprintf("              globalCfg.SelfUrl: %v", globalCfg.SelfUrl.Value()),
+			fmt.Sprintf("             globalCfg.EnvoyRls: %v", globalCfg.EnvoyRls.Value()),
+			fmt.Sprintf("         globalCfg.EnvoyRlsPort: %v", globalCfg.EnvoyRlsPort.Value()),
+			fmt.Sprintf("  globalCfg.EnvoyRlsKeyTemplate: %v", globalCfg.EnvoyRlsKeyTemplate.Value()),
+			fmt.Sprintf("globalCfg.ForwardAuthKeyTemplates: %v", globalCfg.ForwardAuthKeyTemplates.Value()),
+			fmt.Sprintf("globalCfg.ForwardAuthDenyStatus: %v", globalCfg.ForwardAuthDenyStatus.Value()),
+			fmt.Sprintf("                 globalCfg.Resp: %v", globalCfg.Resp.Value()),
+			fmt.Sprintf("             globalCfg.RespPort: %v", globalCfg.RespPort.Value()),
+			fmt.Sprintf("               globalCfg.Binary: %v", globalCfg.Binary.Value()),
+			fmt.Sprintf("           globalCfg.BinaryPort: %v", globalCfg.BinaryPort.Value()),
+			fmt.Sprintf("        globalCfg.UnixSocketDir: %v", globalCfg.UnixSocketDir.Value()),
+			fmt.Sprintf("       globalCfg.UnixSocketMode: %v", globalCfg.UnixSocketMode.Value()),
+			fmt.Sprintf("       globalCfg.UnixSocketOnly: %v", globalCfg.UnixSocketOnly.Value()),
+			fmt.Sprintf("          globalCfg.TlsCertFile: %v", globalCfg.TlsCertFile.Value()),
+			fmt.Sprintf("           globalCfg.TlsKeyFile: %v", globalCfg.TlsKeyFile.Value()),
+			fmt.Sprintf("      globalCfg.TlsClientCaFile: %v", globalCfg.TlsClientCaFile.Value()),
+			fmt.Sprintf("            globalCfg.TlsCaFile: %v", globalCfg.TlsCaFile.Value()),
+			fmt.Sprintf("             globalCfg.AdminApi: %v", globalCfg.AdminApi.Value()),
+			fmt.Sprintf("              globalCfg.Metrics: %v", globalCfg.Metrics.Value()),
+			fmt.Sprintf("         globalCfg.VirtualNodes: %v", globalCfg.VirtualNodes.Value()),
+			fmt.Sprintf("            globalCfg.Discovery: %v", globalCfg.Discovery.Value()),
+			fmt.Sprintf("        globalCfg.DiscoveryName: %v", globalCfg.DiscoveryName.Value()),
+			fmt.Sprintf("globalCfg.DiscoveryIntervalMillis: %v", globalCfg.DiscoveryIntervalMillis.Value()),
+			fmt.Sprintf("globalCfg.PeerHealthCheckMillis: %v", globalCfg.PeerHealthCheckMillis.Value()),
+			fmt.Sprintf("       globalCfg.PeerDownPolicy: %v", globalCfg.PeerDownPolicy.Value()),
+			fmt.Sprintf(" globalCfg.PeerDownLocalPercent: %v", globalCfg.PeerDownLocalPercent.Value()),
+			fmt.Sprintf("       globalCfg.PeerApiKey set: %v", globalCfg.PeerApiKey.Value() != ""),
+			fmt.Sprintf("        globalCfg.PeerTransport: %v", globalCfg.PeerTransport.Value()),
+			fmt.Sprintf("       globalCfg.PeerBinaryPort: %v", globalCfg.PeerBinaryPort.Value()),
+			fmt.Sprintf("    globalCfg.ReplicationFactor: %v", globalCfg.ReplicationFactor.Value()),
+			fmt.Sprintf("    globalCfg.ReplicationMillis: %v", globalCfg.ReplicationMillis.Value()),
+			fmt.Sprintf(" globalCfg.SplitRebalanceMillis: %v", globalCfg.SplitRebalanceMillis.Value()),
+			fmt.Sprintf("         globalCfg.OtlpEndpoint: %v", globalCfg.OtlpEndpoint.Value()),
+			fmt.Sprintf("             globalCfg.AuditLog: %v", globalCfg.AuditLog.Value()),
+			fmt.Sprintf("    globalCfg.AuditLogMaxSizeMb: %v", globalCfg.AuditLogMaxSizeMb.Value()),
+			fmt.Sprintf("     globalCfg.AuditLogMaxFiles: %v", globalCfg.AuditLogMaxFiles.Value()),
 		}, "\n"))
 
+		if endpoint := globalCfg.OtlpEndpoint.Value(); endpoint != "" {
+			slog.Info("Exporting traces over otlp", slog.String("endpoint", endpoint))
+			shutdownTracing, err := tracing.Setup(endpoint, AppName)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to set up tracing: %v", err))
+			}
+			defer func() { _ = shutdownTracing(context.Background()) }()
+		}
+
 		// Check if we should run distributed mode
 		validCfg, err := globalCfg.ValidateInstanceUrls()
 		if err != nil {
 			panic(fmt.Sprintf("Failed to parse instance urls: %v", err))
 		}
+		if err := validCfg.LoadTls(); err != nil {
+			panic(fmt.Sprintf("Failed to load tls files: %v", err))
+		}
+		defer validCfg.Tls.Close()
+		if validCfg.Tls != nil {
+			slog.Info("Serving tls on all tcp ports", slog.Bool("mtls", globalCfg.TlsClientCaFile.Value() != ""))
+		}
+
+		discoverySource, err := validCfg.DiscoverySource()
+		if err != nil {
+			panic(fmt.Sprintf("Failed to set up discovery: %v", err))
+		}
+		if discoverySource != nil {
+			stopDiscovery := validCfg.Cluster.Follow(discoverySource, time.Duration(globalCfg.DiscoveryIntervalMillis.Value())*time.Millisecond)
+			defer stopDiscovery()
+		}
+
 		if validCfg.DistributedMode() {
+			validCfg.Health = cluster.NewHealthChecker(validCfg.Cluster, endpoints2.ProbePeer(validCfg))
+			stopHealthChecks := validCfg.Health.Follow(time.Duration(globalCfg.PeerHealthCheckMillis.Value()) * time.Millisecond)
+			defer stopHealthChecks()
 			slog.Info("Service is starting in distributed mode")
 		} else {
 			slog.Info("Service is starting in single instance mode")
@@ -94,33 +178,138 @@ func StartApplication(
 		slog.Info("Checking config file", slog.String("configFile", globalCfg.ConfigFile.Value()))
 		initConfigFromFile, configFileChangeMonitor := config.MonitorConfigFromFile(globalCfg.ConfigFile.Value())
 		defer configFileChangeMonitor.Close()
+		configChanges := config.FanOut(configFileChangeMonitor.Changes(), 3)
+		validCfg.FromFile = config.FollowCfgFromFile(initConfigFromFile, configChanges[2])
+
+		auditLog, err := audit.Open(globalCfg.AuditLog.Value(), globalCfg.AuditLogMaxSizeMb.Value(), globalCfg.AuditLogMaxFiles.Value())
+		if err != nil {
+			panic(fmt.Sprintf("Failed to open audit log: %v", err))
+		}
+		defer auditLog.Close() // after the limiter manager, deferred below, has been closed
+		if auditLog != nil {
+			slog.Info("Writing decisions to the audit log", slog.String("auditLog", globalCfg.AuditLog.Value()))
+		}
 
 		slog.Info("Starting limiter manager set")
-		limiterManager := limiter_manager.NewManagerSet(
+		limiterManager := limiter_manager.NewManagerSetWithAudit(
 			toLimiterConfig(globalCfg),
 			initConfigFromFile,
-			configFileChangeMonitor.Changes(),
+			configChanges[0],
 			limiter_manager.DefaultSharding,
+			auditLog,
 		)
 		defer limiterManager.Close()
 
+		auth, err := tenant_auth.New(initConfigFromFile, configChanges[1])
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load tenants: %v", err))
+		}
+		defer auth.Close()
+		if auth.Enabled() {
+			slog.Info("Tenant auth is enabled, requests must carry tenant credentials")
+		}
+
+		if validCfg.DistributedMode() {
+			if globalCfg.PeerApiKey.Value() == "" {
+				panic("Distributed mode requires --peer-api-key, for instances to authenticate to each other")
+			}
+			endpoints2.HandOffMovedKeys(validCfg, limiterManager)
+			if globalCfg.PeerTransport.Value() == config.PeerTransportBinary {
+				if !globalCfg.Binary.Value() || globalCfg.UnixSocketOnly.Value() {
+					panic("--peer-transport=binary requires --binary on a tcp port, the binary protocol port is where other instances forward to")
+				}
+				peers := binary_proto.NewPeerForwarder(validCfg)
+				defer peers.Close()
+				validCfg.Peers = peers
+				slog.Info("Forwarding requests to the owners of keys over the binary protocol")
+			}
+			validCfg.Quotas = cluster.NewQuotas()
+			stopRebalancing := endpoints2.RebalanceSplitKeys(validCfg)
+			defer stopRebalancing()
+			if globalCfg.ReplicationFactor.Value() > 0 {
+				validCfg.Replicas = cluster.NewReplicas()
+				stopReplication := endpoints2.ReplicateKeys(validCfg, limiterManager)
+				defer stopReplication() // before the limiter manager, deferred above, is closed
+				endpoints2.RecoverReplicatedKeys(validCfg, limiterManager)
+				slog.Info(fmt.Sprintf("Replicating keys to %d other instances", globalCfg.ReplicationFactor.Value()))
+			}
+		}
+
 		slog.Info(fmt.Sprintf("Creating server of type %v", globalCfg.ServerType.Value()))
 		srv := server.CreateNew(globalCfg, logger)
 		defer func() { _ = srv.Close() }()
 
 		slog.Info("Setting up routes")
 
-		srv.POST("/rate/:key", endpoints2.HandleRateRequest(validCfg, limiterManager))
-		srv.GET("/rate/:key", endpoints2.HandleRateRequest(validCfg, limiterManager))
-		srv.DELETE("/rate/:key/:id", endpoints2.HandleReleaseRequest(validCfg, limiterManager))
+		routes := []endpoints2.Route{
+			{Method: http.MethodPost, Path: "/rate/:key", Handler: endpoints2.HandleRateRequest(validCfg, limiterManager, auth)},
+			{Method: http.MethodGet, Path: "/rate/:key", Handler: endpoints2.HandleRateRequest(validCfg, limiterManager, auth)},
+			{Method: http.MethodDelete, Path: "/rate/:key/:id", Handler: endpoints2.HandleReleaseRequest(validCfg, limiterManager, auth)},
+
+			{Path: "/auth", Handler: endpoints2.HandleForwardAuthRequest(validCfg, limiterManager, auth)},
+
+			{Method: http.MethodGet, Path: "/debug", Handler: endpoints2.HandleDebugRequest(limiterManager, auth)},
+			{Method: http.MethodGet, Path: "/debug/:key", Handler: endpoints2.HandleDebugRequest(limiterManager, auth)},
+			{Method: http.MethodGet, Path: "/keys", Handler: endpoints2.HandleKeyListRequest(limiterManager, auth)},
+			{Method: http.MethodGet, Path: "/events", Handler: endpoints2.HandleEventsRequest(limiterManager, auth)},
+			{Method: http.MethodGet, Path: "/cluster", Handler: endpoints2.HandleClusterStatusRequest(validCfg, limiterManager, auth)},
+			{Method: http.MethodGet, Path: "/cluster/members", Handler: endpoints2.HandleClusterMembersRequest(validCfg, auth)},
+			{Method: http.MethodGet, Path: "/cluster/owner/:key", Handler: endpoints2.HandleClusterOwnerRequest(validCfg, auth)},
+
+			{Method: http.MethodGet, Path: "/healthz", Handler: endpoints2.HandleHealthRequest(validCfg, limiterManager)},
+		}
+
+		if validCfg.DistributedMode() {
+			// Only other instances make these requests
+			routes = append(routes,
+				endpoints2.Route{Method: http.MethodPost, Path: "/cluster/handoff", Handler: endpoints2.HandleClusterHandoffRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/cluster/replicate", Handler: endpoints2.HandleClusterReplicateRequest(validCfg, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/cluster/replicas", Handler: endpoints2.HandleClusterReplicasRequest(validCfg, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/cluster/lend", Handler: endpoints2.HandleClusterLendRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/cluster/repay", Handler: endpoints2.HandleClusterRepayRequest(validCfg, limiterManager, auth)},
+			)
+		}
+
+		if globalCfg.AdminApi.Value() {
+			if !auth.Enabled() {
+				panic("--admin-api requires tenant auth, with an admin tenant, in the configuration file")
+			}
+			routes = append(routes,
+				endpoints2.Route{Method: http.MethodGet, Path: "/admin/keys/:key", Handler: endpoints2.HandleAdminGetKeyRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodPut, Path: "/admin/keys/:key/override", Handler: endpoints2.HandleAdminSetOverrideRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodDelete, Path: "/admin/keys/:key/override", Handler: endpoints2.HandleAdminClearOverrideRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/admin/keys/:key/reset", Handler: endpoints2.HandleAdminResetRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/admin/keys/:key/drain", Handler: endpoints2.HandleAdminDrainQueueRequest(validCfg, limiterManager, auth)},
+				endpoints2.Route{Method: http.MethodPost, Path: "/admin/keys/:key/expire", Handler: endpoints2.HandleAdminExpireRequest(validCfg, limiterManager, auth)},
+			)
+		}
 
-		srv.GET("/debug", endpoints2.HandleDebugRequest(limiterManager))
-		srv.GET("/debug/:key", endpoints2.HandleDebugRequest(limiterManager))
+		if globalCfg.Metrics.Value() {
+			routes = append(routes, endpoints2.Route{Method: http.MethodGet, Path: "/metrics", Handler: endpoints2.HandleMetricsRequest})
+		}
 
-		srv.GET("/healthz", endpoints2.HandleHealthRequest)
+		var frontends []server.Frontend
+		if globalCfg.EnvoyRls.Value() {
+			if validCfg.DistributedMode() {
+				panic("--envoy-rls decides all keys on the instance that gets them, and can't be used in distributed mode")
+			}
+			slog.Info("Creating envoy rate limit service frontend")
+			frontends = append(frontends, envoy_rls.New(validCfg, limiterManager, auth))
+		}
+		if globalCfg.Resp.Value() {
+			if validCfg.DistributedMode() {
+				panic("--resp decides all keys on the instance that gets them, and can't be used in distributed mode")
+			}
+			slog.Info("Creating redis protocol (RESP) frontend")
+			frontends = append(frontends, resp.New(validCfg, limiterManager, auth))
+		}
+		if globalCfg.Binary.Value() {
+			slog.Info("Creating binary protocol frontend")
+			frontends = append(frontends, binary_proto.New(validCfg, limiterManager, auth))
+		}
 
 		slog.Info("Starting http server")
-		server.StartListening(globalCfg, srv, appCreatedCh)
+		server.StartListening(validCfg, srv, routes, appCreatedCh, frontends...)
 	}()
 
 	select {
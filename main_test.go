@@ -1,24 +1,56 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	rlcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/kivra/gocc/pkg/audit"
+	"github.com/kivra/gocc/pkg/cluster"
 	"github.com/kivra/gocc/pkg/config"
 	"github.com/kivra/gocc/pkg/config/experimental/svc_discovery"
+	"github.com/kivra/gocc/pkg/hash_ring"
 	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_events"
+	"github.com/kivra/gocc/pkg/server/binary_proto"
+	endpoints2 "github.com/kivra/gocc/pkg/server/endpoints"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"github.com/kivra/gocc/pkg/tracing"
+	"github.com/redis/go-redis/v9"
 	"github.com/samber/lo"
 	lop "github.com/samber/lo/parallel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"io"
 	"log/slog"
+	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func newDefaultTestCfg() *config.GlobalCfg {
+func newDefaultTestCfg(serverType string) *config.GlobalCfg {
 	cfg := config.NewGlobalCfg()
 	cfg.WindowMillis.Default = lo.ToPtr(1000)
 	cfg.MaxRequests.Default = lo.ToPtr(100)
@@ -27,510 +59,2521 @@ func newDefaultTestCfg() *config.GlobalCfg {
 	cfg.RequestsCanModQueue.Default = lo.ToPtr(true)
 	cfg.LogIncludesSource.Default = lo.ToPtr(false)
 	cfg.InstanceUrls.Default = lo.ToPtr([]string{})
-	cfg.ServerType.Default = lo.ToPtr("echo-http2")
+	cfg.SelfUrl.Default = lo.ToPtr("")
+	cfg.ServerType.Default = lo.ToPtr(serverType)
 	cfg.ConfigFile.Default = lo.ToPtr("")
 	cfg.Port.Default = lo.ToPtr(0)
 	cfg.LogFormat.Default = lo.ToPtr("json")
 	cfg.LogLevel.Default = lo.ToPtr("WARN")
+	cfg.EnvoyRls.Default = lo.ToPtr(false)
+	cfg.Resp.Default = lo.ToPtr(false)
+	cfg.Binary.Default = lo.ToPtr(false)
+	cfg.UnixSocketDir.Default = lo.ToPtr("")
+	cfg.UnixSocketMode.Default = lo.ToPtr("0660")
+	cfg.UnixSocketOnly.Default = lo.ToPtr(false)
+	cfg.ForwardAuthKeyTemplates.Default = lo.ToPtr([]string{"{client-ip}"})
+	cfg.ForwardAuthDenyStatus.Default = lo.ToPtr(429)
+	cfg.TlsCertFile.Default = lo.ToPtr("")
+	cfg.TlsKeyFile.Default = lo.ToPtr("")
+	cfg.TlsClientCaFile.Default = lo.ToPtr("")
+	cfg.TlsCaFile.Default = lo.ToPtr("")
+	cfg.AdminApi.Default = lo.ToPtr(false)
+	cfg.Metrics.Default = lo.ToPtr(true)
+	cfg.OtlpEndpoint.Default = lo.ToPtr("")
+	cfg.VirtualNodes.Default = lo.ToPtr(hash_ring.DefaultVirtualNodes)
+	cfg.AuditLog.Default = lo.ToPtr("")
+	cfg.AuditLogMaxSizeMb.Default = lo.ToPtr(100)
+	cfg.AuditLogMaxFiles.Default = lo.ToPtr(5)
+	cfg.Discovery.Default = lo.ToPtr("")
+	cfg.DiscoveryName.Default = lo.ToPtr("")
+	cfg.DiscoveryIntervalMillis.Default = lo.ToPtr(10_000)
+	cfg.PeerHealthCheckMillis.Default = lo.ToPtr(1000)
+	cfg.PeerDownPolicy.Default = lo.ToPtr(config.PeerDownFailClosed)
+	cfg.PeerDownLocalPercent.Default = lo.ToPtr(50)
+	cfg.PeerApiKey.Default = lo.ToPtr("test-peer-key")
+	cfg.PeerTransport.Default = lo.ToPtr(config.PeerTransportHttp)
+	cfg.PeerBinaryPort.Default = lo.ToPtr(0)
+	cfg.ReplicationFactor.Default = lo.ToPtr(0)
+	cfg.ReplicationMillis.Default = lo.ToPtr(500)
+	cfg.SplitRebalanceMillis.Default = lo.ToPtr(1000)
 	return cfg
 }
 
+// serverTypes are the server types that all tests in this file run against
+var serverTypes = []string{"echo", "echo-http2", "fast"}
+
+func forEachServerType(t *testing.T, test func(t *testing.T, serverType string)) {
+	for _, serverType := range serverTypes {
+		t.Run(serverType, func(t *testing.T) {
+			test(t, serverType)
+		})
+		// The server is gone, and some tests reuse fixed ports
+		http1Client.CloseIdleConnections()
+	}
+}
+
 func TestRun_server_starts(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
+		cfg := newDefaultTestCfg(serverType)
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	slog.Info(fmt.Sprintf("Server started on port %d", app.Port))
+		slog.Info(fmt.Sprintf("Server started on port %d", app.Port))
+	})
 }
 
 func TestRun_can_make_requests(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
+		cfg := newDefaultTestCfg(serverType)
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	if !makeTestRequest(app.Port, "my-id", false) {
-		t.Fatalf("Failed to make request")
-	}
+		if !makeTestRequest(app.Port, "my-id", false) {
+			t.Fatalf("Failed to make request")
+		}
+	})
 }
 
 func TestRun_can_make_requests_and_get_debug_output(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
-	cfg.WindowMillis.Default = lo.ToPtr(10_000)
+		cfg := newDefaultTestCfg(serverType)
+		cfg.WindowMillis.Default = lo.ToPtr(10_000)
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	makeTestRequest(app.Port, "id1", false)
-	makeTestRequest(app.Port, "id2", false)
-	makeTestRequest(app.Port, "id3", false)
-	makeTestRequest(app.Port, "id4", false)
+		makeTestRequest(app.Port, "id1", false)
+		makeTestRequest(app.Port, "id2", false)
+		makeTestRequest(app.Port, "id3", false)
+		makeTestRequest(app.Port, "id4", false)
 
-	allData := makeDebugRequest(app.Port, "")
+		allData := makeDebugRequest(app.Port, "")
 
-	snapshot := limiter_api.DebugSnapshotAll{}
-	err := json.Unmarshal([]byte(allData), &snapshot)
-	if err != nil {
-		t.Fatalf("Failed to unmarshal debug data: %v", err)
-	}
+		snapshot := limiter_api.DebugSnapshotAll{}
+		err := json.Unmarshal([]byte(allData), &snapshot)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal debug data: %v", err)
+		}
 
-	if len(snapshot.Instances) != 4 {
-		t.Fatalf("Expected 4 instances, got %d", len(snapshot.Instances))
-	}
+		if len(snapshot.Instances) != 4 {
+			t.Fatalf("Expected 4 instances, got %d", len(snapshot.Instances))
+		}
 
-	if makeDebugRequest(app.Port, "id1") == "" {
-		t.Fatalf("Expected debug data for id1")
-	}
+		if makeDebugRequest(app.Port, "id1") == "" {
+			t.Fatalf("Expected debug data for id1")
+		}
 
-	if makeDebugRequest(app.Port, "id2") == "" {
-		t.Fatalf("Expected debug data for id2")
-	}
+		if makeDebugRequest(app.Port, "id2") == "" {
+			t.Fatalf("Expected debug data for id2")
+		}
 
-	if makeDebugRequest(app.Port, "id3") == "" {
-		t.Fatalf("Expected debug data for id3")
-	}
+		if makeDebugRequest(app.Port, "id3") == "" {
+			t.Fatalf("Expected debug data for id3")
+		}
 
-	if makeDebugRequest(app.Port, "id4") == "" {
-		t.Fatalf("Expected debug data for id4")
-	}
+		if makeDebugRequest(app.Port, "id4") == "" {
+			t.Fatalf("Expected debug data for id4")
+		}
 
-	if makeDebugRequest(app.Port, "id5") != "" {
-		t.Fatalf("Expected no debug data for id5")
-	}
+		if makeDebugRequest(app.Port, "id5") != "" {
+			t.Fatalf("Expected no debug data for id5")
+		}
+	})
 }
 
 func TestRun_can_make_many_requests_on_diff_keys(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
-	cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	t0 := time.Now()
+		t0 := time.Now()
 
-	for i := 0; i < 100; i++ {
+		for i := 0; i < 100; i++ {
 
-		key := fmt.Sprintf("my-id-%d", i)
+			key := fmt.Sprintf("my-id-%d", i)
 
-		if !makeTestRequest(app.Port, key, false) {
-			t.Fatalf("Failed to make request")
+			if !makeTestRequest(app.Port, key, false) {
+				t.Fatalf("Failed to make request")
+			}
 		}
-	}
 
-	t1 := time.Now()
-	if t1.Sub(t0) > 1*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 1s, took %v", t1.Sub(t0))
-	}
+		t1 := time.Now()
+		if t1.Sub(t0) > 1*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 1s, took %v", t1.Sub(t0))
+		}
+	})
 }
 
 func TestRun_can_make_many_requests_on_same_key(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
+		cfg := newDefaultTestCfg(serverType)
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	t0 := time.Now()
+		t0 := time.Now()
 
-	for i := 0; i < 100; i++ {
+		for i := 0; i < 100; i++ {
 
-		key := "my-id"
+			key := "my-id"
 
-		if !makeTestRequest(app.Port, key, false) {
-			t.Fatalf("Failed to make request")
+			if !makeTestRequest(app.Port, key, false) {
+				t.Fatalf("Failed to make request")
+			}
 		}
-	}
 
-	t1 := time.Now()
-	if t1.Sub(t0) > 1*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 1s, took %v", t1.Sub(t0))
-	}
+		t1 := time.Now()
+		if t1.Sub(t0) > 1*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 1s, took %v", t1.Sub(t0))
+		}
+	})
 }
 
 func TestRun_cant_make_to_many_requests(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
+		cfg := newDefaultTestCfg(serverType)
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	t0 := time.Now()
-	key := "my-id"
+		t0 := time.Now()
+		key := "my-id"
 
-	for i := 0; i < 100; i++ {
-		if !makeTestRequest(app.Port, key, false) {
-			t.Fatalf("Failed to make request")
+		for i := 0; i < 100; i++ {
+			if !makeTestRequest(app.Port, key, false) {
+				t.Fatalf("Failed to make request")
+			}
 		}
-	}
 
-	// Make one more requests, that should fail
-	if makeTestRequest(app.Port, key, false) {
-		t.Fatalf("Expected request to fail")
-	}
+		// Make one more requests, that should fail
+		if makeTestRequest(app.Port, key, false) {
+			t.Fatalf("Expected request to fail")
+		}
 
-	t1 := time.Now()
-	if t1.Sub(t0) > 1*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 1s, took %v", t1.Sub(t0))
-	}
+		t1 := time.Now()
+		if t1.Sub(t0) > 1*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 1s, took %v", t1.Sub(t0))
+		}
+	})
 }
 
-func TestStartServer_10000_simultaneous_requests_same_key(t *testing.T) {
+func TestRun_responses_are_the_same_for_all_server_types(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
 
-	cfg := newDefaultTestCfg()
-	cfg.WindowMillis.Default = lo.ToPtr(100)
-	cfg.MaxRequests.Default = lo.ToPtr(5000)
-	cfg.MaxRequestsInQueue.Default = lo.ToPtr(10000)
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		request := func(method string, path string) (*http.Response, string) {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", app.Port, path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			resp, err := http1Client.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			return resp, string(body)
+		}
 
-	t0 := time.Now()
+		resp, body := request("POST", "/rate/parity")
+		if resp.StatusCode != 200 || body == "" || resp.Header.Get("RateLimit-Remaining") != "0" {
+			t.Fatalf("Unexpected approval: %d %q %v", resp.StatusCode, body, resp.Header)
+		}
 
-	key := "my-id"
+		resp, _ = request("GET", "/rate/parity")
+		if resp.StatusCode != 429 || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("Unexpected denial: %d %v", resp.StatusCode, resp.Header)
+		}
 
-	errs := make(chan error, 10000)
+		resp, body = request("POST", "/rate/parity?canWait=maybe")
+		if resp.StatusCode != 400 || body != "failed to parse canWait query parameter" {
+			t.Fatalf("Unexpected bad request response: %d %q", resp.StatusCode, body)
+		}
 
-	successes := atomic.Int32{}
+		resp, body = request("GET", "/debug/parity")
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/json" || !json.Valid([]byte(body)) {
+			t.Fatalf("Unexpected debug response: %d %v %q", resp.StatusCode, resp.Header, body)
+		}
 
-	numRequests := 10000
-	nThreads := 10
+		resp, body = request("GET", "/no-such-path")
+		if resp.StatusCode != 404 || body != "{\"message\":\"Not Found\"}\n" {
+			t.Fatalf("Unexpected not found response: %d %q", resp.StatusCode, body)
+		}
 
-	lop.ForEach(lo.Range(nThreads), func(i int, _ int) {
-		for j := 0; j < numRequests/nThreads; j++ {
-			if makeTestRequest(app.Port, key, true) {
-				successes.Add(1)
-			}
+		resp, body = request("PUT", "/healthz")
+		if resp.StatusCode != 405 || body != "{\"message\":\"Method Not Allowed\"}\n" {
+			t.Fatalf("Unexpected method not allowed response: %d %q", resp.StatusCode, body)
 		}
 	})
+}
 
-	close(errs)
+func TestStartServer_10000_simultaneous_requests_same_key(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	if successes.Load() != 10000 {
-		t.Errorf("expected 10000 successes, got %d", successes.Load())
-		for err := range errs {
-			t.Fatalf("one or more requests failed: %v", err)
-		}
-	}
+		cfg := newDefaultTestCfg(serverType)
+		cfg.WindowMillis.Default = lo.ToPtr(100)
+		cfg.MaxRequests.Default = lo.ToPtr(5000)
+		cfg.MaxRequestsInQueue.Default = lo.ToPtr(10000)
 
-	// takes 250 ms on my machine, but 10s on gh actions CI :S
-	t1 := time.Now()
-	if t1.Sub(t0) > 30*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 30s, took %v", t1.Sub(t0))
-	}
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
+		t0 := time.Now()
+
+		key := "my-id"
+
+		errs := make(chan error, 10000)
+
+		successes := atomic.Int32{}
+
+		numRequests := 10000
+		nThreads := 10
+
+		lop.ForEach(lo.Range(nThreads), func(i int, _ int) {
+			for j := 0; j < numRequests/nThreads; j++ {
+				if makeTestRequest(app.Port, key, true) {
+					successes.Add(1)
+				}
+			}
+		})
+
+		close(errs)
+
+		if successes.Load() != 10000 {
+			t.Errorf("expected 10000 successes, got %d", successes.Load())
+			for err := range errs {
+				t.Fatalf("one or more requests failed: %v", err)
+			}
+		}
+
+		// takes 250 ms on my machine, but 10s on gh actions CI :S
+		t1 := time.Now()
+		if t1.Sub(t0) > 30*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 30s, took %v", t1.Sub(t0))
+		}
+	})
 }
 
 func TestStartServer_config_change(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	tempDir := os.TempDir() + "/gocc-test"
-	if !config.DirExists(tempDir) {
-		err := os.Mkdir(tempDir, 0755)
-		if err != nil {
-			t.Fatalf("Failed to create temp dir: %v", err)
+		tempDir := os.TempDir() + "/gocc-test"
+		if !config.DirExists(tempDir) {
+			err := os.Mkdir(tempDir, 0755)
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
 		}
-	}
 
-	configFileName := "app-config.json"
-	configFilePath := tempDir + "/" + configFileName
-
-	globalConfig := newDefaultTestCfg()
-	globalConfig.WindowMillis.Default = lo.ToPtr(1000)
-	globalConfig.MaxRequests.Default = lo.ToPtr(1)
-	globalConfig.MaxRequestsInQueue.Default = lo.ToPtr(0)
-	globalConfig.LogLevel.Default = lo.ToPtr("INFO")
-	globalConfig.LogFormat.Default = lo.ToPtr("text")
-	globalConfig.ConfigFile.Default = lo.ToPtr(configFilePath)
-
-	configFromFile := &config.CfgFromFile{
-		Keys: []config.CfgFromFileKey{
-			{
-				KeyPattern:           "key1",
-				KeyPatternIsRegex:    false,
-				MaxRequestsPerWindow: 1,
-				MaxRequestsInQueue:   0,
-				WindowMillis:         1_000_000,
-			},
-			{
-				KeyPattern:           "key2",
-				KeyPatternIsRegex:    false,
-				MaxRequestsPerWindow: 1,
-				MaxRequestsInQueue:   0,
-				WindowMillis:         1_000_000,
+		configFileName := "app-config.json"
+		configFilePath := tempDir + "/" + configFileName
+
+		globalConfig := newDefaultTestCfg(serverType)
+		globalConfig.WindowMillis.Default = lo.ToPtr(1000)
+		globalConfig.MaxRequests.Default = lo.ToPtr(1)
+		globalConfig.MaxRequestsInQueue.Default = lo.ToPtr(0)
+		globalConfig.LogLevel.Default = lo.ToPtr("INFO")
+		globalConfig.LogFormat.Default = lo.ToPtr("text")
+		globalConfig.ConfigFile.Default = lo.ToPtr(configFilePath)
+
+		configFromFile := &config.CfgFromFile{
+			Keys: []config.CfgFromFileKey{
+				{
+					KeyPattern:           "key1",
+					KeyPatternIsRegex:    false,
+					MaxRequestsPerWindow: 1,
+					MaxRequestsInQueue:   0,
+					WindowMillis:         1_000_000,
+				},
+				{
+					KeyPattern:           "key2",
+					KeyPatternIsRegex:    false,
+					MaxRequestsPerWindow: 1,
+					MaxRequestsInQueue:   0,
+					WindowMillis:         1_000_000,
+				},
 			},
-		},
-	}
+		}
 
-	err := config.WriteAppConfigFile(configFilePath, configFromFile)
-	if err != nil {
-		t.Fatalf("Failed to write app config file: %v", err)
-	}
+		err := config.WriteAppConfigFile(configFilePath, configFromFile)
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
 
-	app := StartApplication(globalConfig, true)
-	defer app.Close()
+		app := StartApplication(globalConfig, true)
+		defer app.Close()
 
-	// Initial should go through
-	if !makeTestRequest(app.Port, "key1", false) {
-		t.Fatalf("Failed to make request")
-	}
-	if !makeTestRequest(app.Port, "key2", false) {
-		t.Fatalf("Failed to make request")
-	}
+		// Initial should go through
+		if !makeTestRequest(app.Port, "key1", false) {
+			t.Fatalf("Failed to make request")
+		}
+		if !makeTestRequest(app.Port, "key2", false) {
+			t.Fatalf("Failed to make request")
+		}
 
-	// But then should get 429
-	if makeTestRequest(app.Port, "key1", false) {
-		t.Fatalf("Unexpectedly succeeded in making request")
-	}
-	if makeTestRequest(app.Port, "key2", false) {
-		t.Fatalf("Unexpectedly succeeded in making request")
-	}
+		// But then should get 429
+		if makeTestRequest(app.Port, "key1", false) {
+			t.Fatalf("Unexpectedly succeeded in making request")
+		}
+		if makeTestRequest(app.Port, "key2", false) {
+			t.Fatalf("Unexpectedly succeeded in making request")
+		}
 
-	// Now we edit the config and overwrite the file, which
-	// should trigger a reload of the config
-	configFromFile.Keys[0].MaxRequestsPerWindow = 2
-	configFromFile.Keys[1].MaxRequestsPerWindow = 2
+		// Now we edit the config and overwrite the file, which
+		// should trigger a reload of the config
+		configFromFile.Keys[0].MaxRequestsPerWindow = 2
+		configFromFile.Keys[1].MaxRequestsPerWindow = 2
 
-	err = config.WriteAppConfigFile(configFilePath, configFromFile)
-	if err != nil {
-		t.Fatalf("Failed to write app config file: %v", err)
-	}
+		err = config.WriteAppConfigFile(configFilePath, configFromFile)
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
 
-	t0 := time.Now()
+		t0 := time.Now()
 
-	key1Success := false
-	key2Success := false
+		key1Success := false
+		key2Success := false
 
-	for time.Since(t0) < 5*time.Second && (!key1Success || !key2Success) {
+		for time.Since(t0) < 5*time.Second && (!key1Success || !key2Success) {
 
-		time.Sleep(100 * time.Millisecond)
+			time.Sleep(100 * time.Millisecond)
+
+			// Initial should go through
+			if !makeTestRequest(app.Port, "key1", false) && !key1Success {
+				slog.Warn("Config has not been reloaded yet")
+				continue
+			}
+			key1Success = true
+
+			if !makeTestRequest(app.Port, "key2", false) && !key2Success {
+				slog.Warn("Config has not been reloaded yet")
+				continue
+			}
+			key2Success = true
 
-		// Initial should go through
-		if !makeTestRequest(app.Port, "key1", false) && !key1Success {
-			slog.Warn("Config has not been reloaded yet")
-			continue
 		}
-		key1Success = true
 
-		if !makeTestRequest(app.Port, "key2", false) && !key2Success {
-			slog.Warn("Config has not been reloaded yet")
-			continue
+		if !key1Success || !key2Success {
+			t.Fatalf("Failed to make more requests after config reload")
 		}
-		key2Success = true
+	})
+}
 
-	}
+func TestStartServer_10000_simultaneous_requests_diff_keys(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	if !key1Success || !key2Success {
-		t.Fatalf("Failed to make more requests after config reload")
-	}
+		cfg := newDefaultTestCfg(serverType)
+		cfg.WindowMillis.Default = lo.ToPtr(100)
+		cfg.MaxRequests.Default = lo.ToPtr(5000)
+		cfg.MaxRequestsInQueue.Default = lo.ToPtr(5000)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		t0 := time.Now()
+
+		errs := make(chan error, 10000)
+
+		nSuccesses := atomic.Int32{}
+
+		numRequests := 10000
+		nThreads := 10
+
+		lop.ForEach(lo.Range(nThreads), func(i int, _ int) {
+			for j := 0; j < numRequests/nThreads; j++ {
+
+				key := "my-id-" + fmt.Sprintf("%d", rand.Intn(100))
+
+				if !makeTestRequest(app.Port, key, true) {
+					errs <- fmt.Errorf("failed to make request")
+					continue
+				}
+
+				nSuccesses.Add(1)
+			}
+		})
+
+		close(errs)
 
+		if nSuccesses.Load() != 10000 {
+			t.Errorf("expected 10000 successes, got %d", nSuccesses.Load())
+			for err := range errs {
+				t.Fatalf("%v", err)
+			}
+		}
+
+		// takes 250 ms on my machine, but 10s on gh actions CI :S
+		t1 := time.Now()
+		if t1.Sub(t0) > 30*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 30s, took %v", t1.Sub(t0))
+		}
+	})
 }
 
-func TestStartServer_10000_simultaneous_requests_diff_keys(t *testing.T) {
+// Too many parallel connections on windows and macos. need to keep to about 50 goroutines max
+func TestStartServer_10000_truly_simultaneous_requests(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
-	cfg.WindowMillis.Default = lo.ToPtr(100)
-	cfg.MaxRequests.Default = lo.ToPtr(5000)
-	cfg.MaxRequestsInQueue.Default = lo.ToPtr(5000)
+		if serverType != "echo-http2" {
+			t.Skip("needs h2c, http1 would open a connection per request")
+		}
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		cfg := newDefaultTestCfg(serverType)
+		cfg.WindowMillis.Default = lo.ToPtr(100)
+		cfg.MaxRequests.Default = lo.ToPtr(5000)
+		cfg.MaxRequestsInQueue.Default = lo.ToPtr(10000)
 
-	t0 := time.Now()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	errs := make(chan error, 10000)
+		t0 := time.Now()
 
-	nSuccesses := atomic.Int32{}
+		errs := make(chan error, 10000)
 
-	numRequests := 10000
-	nThreads := 10
+		nSuccesses := atomic.Int32{}
 
-	lop.ForEach(lo.Range(nThreads), func(i int, _ int) {
-		for j := 0; j < numRequests/nThreads; j++ {
+		lop.ForEach(lo.Range(10000), func(i int, _ int) {
 
 			key := "my-id-" + fmt.Sprintf("%d", rand.Intn(100))
+			if makeTestRequestClient(app.Port, key, true, testClient(serverType)) {
+				nSuccesses.Add(1)
+			}
+		})
 
-			if !makeTestRequest(app.Port, key, true) {
-				errs <- fmt.Errorf("failed to make request")
-				continue
+		close(errs)
+
+		if nSuccesses.Load() != 10000 {
+			t.Errorf("expected 10000 successes, got %d", nSuccesses.Load())
+			for err := range errs {
+				t.Fatalf("%v", err)
 			}
+		}
 
-			nSuccesses.Add(1)
+		// takes 100 ms on my machine, but 10s on gh actions CI :S
+		elapsed := time.Since(t0)
+		if elapsed > 10*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 30s, took %v", elapsed)
 		}
 	})
+}
+
+func TestStartServer_100k_requests(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.WindowMillis.Default = lo.ToPtr(100)
+		cfg.MaxRequestsInQueue.Default = lo.ToPtr(10000)
+		cfg.MaxRequests.Default = lo.ToPtr(1_000_000)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		t0 := time.Now()
+
+		nRequests := 100_000
+		nThreads := 10
+
+		nSuccesses := atomic.Int32{}
+
+		errs := make(chan error, nRequests)
+
+		lop.ForEach(lo.Range(nThreads), func(_ int, _ int) {
+			for j := 0; j < nRequests/nThreads; j++ {
 
-	close(errs)
+				key := "my-id-" + fmt.Sprintf("%d", rand.Intn(100))
 
-	if nSuccesses.Load() != 10000 {
-		t.Errorf("expected 10000 successes, got %d", nSuccesses.Load())
-		for err := range errs {
-			t.Fatalf("%v", err)
+				if makeTestRequestClient(app.Port, key, true, testClient(serverType)) {
+					nSuccesses.Add(1)
+				}
+			}
+		})
+
+		close(errs)
+
+		if nSuccesses.Load() != int32(nRequests) {
+			t.Errorf("expected %d successes, got %d", nRequests, nSuccesses.Load())
+			for err := range errs {
+				t.Fatalf("%v", err)
+			}
 		}
-	}
 
-	// takes 250 ms on my machine, but 10s on gh actions CI :S
-	t1 := time.Now()
-	if t1.Sub(t0) > 30*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 30s, took %v", t1.Sub(t0))
-	}
+		// This takes 2s on my machine, but 25 seconds on gh actions :D :D
+		t1 := time.Now()
+		if t1.Sub(t0) > 60*time.Second {
+			t.Fatalf("Expected all requests to be served in less than 60s, took %v", t1.Sub(t0))
+		}
+	})
+}
+
+func TestStartApplication_forwardToRightInstance(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		port := 8999
+		portStr := fmt.Sprintf("%d", port)
 
+		cfg := newDefaultTestCfg(serverType)
+		cfg.Port.Default = lo.ToPtr(port)
+		cfg.LogLevel.Default = lo.ToPtr("INFO")
+		//goland:noinspection HttpUrlsUsage
+		cfg.InstanceUrls.Default = lo.ToPtr([]string{"http://localhost:" + portStr, "http://" + svc_discovery.GetOwnHostName() + ":" + portStr})
+		cfg.SelfUrl.Default = lo.ToPtr("http://localhost:" + portStr)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		// this instance is localhost, so keys of the other url (real hostname of the machine) are forwarded there
+		makeTestRequest(app.Port, "my-id", true)
+		makeTestRequestClient(app.Port, "my-id", true, testClient(serverType))
+	})
 }
 
-// Too many parallel connections on windows and macos. need to keep to about 50 goroutines max
-func TestStartServer_10000_truly_simultaneous_requests(t *testing.T) {
+func TestStartApplication_envoyRateLimitService(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	cfg := newDefaultTestCfg()
-	cfg.WindowMillis.Default = lo.ToPtr(100)
-	cfg.MaxRequests.Default = lo.ToPtr(5000)
-	cfg.MaxRequestsInQueue.Default = lo.ToPtr(10000)
-	cfg.ServerType.Default = lo.ToPtr("echo-http2")
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.EnvoyRls.Default = lo.ToPtr(true)
+		cfg.EnvoyRlsPort.Default = lo.ToPtr(0)
+		cfg.EnvoyRlsKeyTemplate.Default = lo.ToPtr("{entry:user}")
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	t0 := time.Now()
+		rlsPort := app.FrontendPorts["envoy-rls"]
+		if rlsPort == 0 {
+			t.Fatalf("expected envoy-rls frontend to be bound, got ports %v", app.FrontendPorts)
+		}
 
-	errs := make(chan error, 10000)
+		conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", rlsPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatalf("Failed to create grpc client: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+		client := rlsv3.NewRateLimitServiceClient(conn)
+
+		req := &rlsv3.RateLimitRequest{
+			Domain: "envoy",
+			Descriptors: []*rlcommonv3.RateLimitDescriptor{{
+				Entries: []*rlcommonv3.RateLimitDescriptor_Entry{{Key: "user", Value: "alice"}},
+			}},
+		}
 
-	nSuccesses := atomic.Int32{}
+		resp, err := client.ShouldRateLimit(context.Background(), req)
+		if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Fatalf("Expected first request to be OK, got %v, %v", resp, err)
+		}
 
-	lop.ForEach(lo.Range(10000), func(i int, _ int) {
+		// The key is shared with the http api
+		if makeTestRequest(app.Port, "alice", false) {
+			t.Fatalf("Expected http request on the same key to be denied")
+		}
 
-		key := "my-id-" + fmt.Sprintf("%d", rand.Intn(100))
-		if makeHttp2TestRequest(app.Port, key, true) {
-			nSuccesses.Add(1)
+		resp, err = client.ShouldRateLimit(context.Background(), req)
+		if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Fatalf("Expected second request to be OVER_LIMIT, got %v, %v", resp, err)
 		}
 	})
+}
 
-	close(errs)
+func TestStartApplication_resp(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	if nSuccesses.Load() != 10000 {
-		t.Errorf("expected 10000 successes, got %d", nSuccesses.Load())
-		for err := range errs {
-			t.Fatalf("%v", err)
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.Resp.Default = lo.ToPtr(true)
+		cfg.RespPort.Default = lo.ToPtr(0)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		respPort := app.FrontendPorts["resp"]
+		if respPort == 0 {
+			t.Fatalf("expected resp frontend to be bound, got ports %v", app.FrontendPorts)
 		}
-	}
 
-	// takes 100 ms on my machine, but 10s on gh actions CI :S
-	elapsed := time.Since(t0)
-	if elapsed > 10*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 30s, took %v", elapsed)
-	}
+		client := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", respPort)})
+		defer func() { _ = client.Close() }()
+
+		result, err := client.Do(context.Background(), "CL.THROTTLE", "bob", 0, 1, 60).Int64Slice()
+		if err != nil || result[0] != 0 {
+			t.Fatalf("Expected first request to be allowed, got %v, %v", result, err)
+		}
+
+		// The key is shared with the http api
+		if makeTestRequest(app.Port, "bob", false) {
+			t.Fatalf("Expected http request on the same key to be denied")
+		}
 
+		result, err = client.Do(context.Background(), "CL.THROTTLE", "bob", 0, 1, 60).Int64Slice()
+		if err != nil || result[0] != 1 {
+			t.Fatalf("Expected second request to be limited, got %v, %v", result, err)
+		}
+	})
 }
 
-func TestStartServer_100k_requests(t *testing.T) {
+func TestStartApplication_binaryProtocol(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.Binary.Default = lo.ToPtr(true)
+		cfg.BinaryPort.Default = lo.ToPtr(0)
 
-	cfg := newDefaultTestCfg()
-	cfg.WindowMillis.Default = lo.ToPtr(100)
-	cfg.MaxRequestsInQueue.Default = lo.ToPtr(10000)
-	cfg.MaxRequests.Default = lo.ToPtr(1_000_000)
-	cfg.ServerType.Default = lo.ToPtr("echo-http2")
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		binaryPort := app.FrontendPorts["binary"]
+		if binaryPort == 0 {
+			t.Fatalf("expected binary frontend to be bound, got ports %v", app.FrontendPorts)
+		}
+
+		client, err := binary_proto.Dial("tcp", fmt.Sprintf("localhost:%d", binaryPort))
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer func() { _ = client.Close() }()
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		decision, err := client.Ask(context.Background(), "carol", binary_proto.AskOptions{})
+		if err != nil || !decision.Approved {
+			t.Fatalf("Expected first request to be approved, got %+v, %v", decision, err)
+		}
 
-	t0 := time.Now()
+		// The key is shared with the http api
+		if makeTestRequest(app.Port, "carol", false) {
+			t.Fatalf("Expected http request on the same key to be denied")
+		}
 
-	nRequests := 100_000
-	nThreads := 10
+		decision, err = client.Ask(context.Background(), "carol", binary_proto.AskOptions{})
+		if err != nil || decision.Approved {
+			t.Fatalf("Expected second request to be denied, got %+v, %v", decision, err)
+		}
+	})
+}
 
-	nSuccesses := atomic.Int32{}
+func TestStartApplication_unixSockets(t *testing.T) {
 
-	errs := make(chan error, nRequests)
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	lop.ForEach(lo.Range(nThreads), func(_ int, _ int) {
-		for j := 0; j < nRequests/nThreads; j++ {
+		socketDir := t.TempDir()
 
-			key := "my-id-" + fmt.Sprintf("%d", rand.Intn(100))
+		cfg := newDefaultTestCfg(serverType)
+		cfg.ServerType.Default = lo.ToPtr(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(2)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.UnixSocketDir.Default = lo.ToPtr(socketDir)
+		cfg.UnixSocketMode.Default = lo.ToPtr("0600")
+		cfg.Binary.Default = lo.ToPtr(true)
+		cfg.BinaryPort.Default = lo.ToPtr(0)
 
-			if makeHttp2TestRequest(app.Port, key, true) {
-				nSuccesses.Add(1)
+		app := StartApplication(cfg, true)
+		closed := false
+		defer func() {
+			if !closed {
+				app.Close()
 			}
+		}()
+
+		httpSocket := app.SocketPaths["http"]
+		binarySocket := app.SocketPaths["binary"]
+		if httpSocket == "" || binarySocket == "" {
+			t.Fatalf("expected http and binary unix sockets, got %v", app.SocketPaths)
+		}
+		if app.Port == 0 || app.FrontendPorts["binary"] == 0 {
+			t.Fatalf("expected tcp ports to be bound next to the unix sockets")
 		}
-	})
 
-	close(errs)
+		info, err := os.Stat(httpSocket)
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Fatalf("expected socket with mode 0600, got %v, %v", info, err)
+		}
 
-	if nSuccesses.Load() != int32(nRequests) {
-		t.Errorf("expected %d successes, got %d", nRequests, nSuccesses.Load())
-		for err := range errs {
-			t.Fatalf("%v", err)
+		// Same key through the unix socket and the tcp port
+		if !makeTestRequestClient(0, "unix", false, newUnixSocketHttp1Client(httpSocket)) {
+			t.Fatalf("Expected request over unix socket to be approved")
+		}
+		if serverType == "echo-http2" && !makeTestRequestClient(0, "unix", false, newUnixSocketHttp2Client(httpSocket)) {
+			t.Fatalf("Expected http2 request over unix socket to be approved")
+		}
+		if serverType != "echo-http2" && !makeTestRequest(app.Port, "unix", false) {
+			t.Fatalf("Expected request over tcp to be approved")
 		}
-	}
 
-	// This takes 2s on my machine, but 25 seconds on gh actions :D :D
-	t1 := time.Now()
-	if t1.Sub(t0) > 60*time.Second {
-		t.Fatalf("Expected all requests to be served in less than 60s, took %v", t1.Sub(t0))
-	}
+		client, err := binary_proto.Dial("unix", binarySocket)
+		if err != nil {
+			t.Fatalf("Failed to connect to binary unix socket: %v", err)
+		}
+		defer func() { _ = client.Close() }()
+		decision, err := client.Ask(context.Background(), "unix", binary_proto.AskOptions{})
+		if err != nil || decision.Approved {
+			t.Fatalf("Expected binary request on the same key to be denied, got %+v, %v", decision, err)
+		}
 
+		app.Close()
+		closed = true
+		for _, path := range []string{httpSocket, binarySocket} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be removed on shutdown, got %v", path, err)
+			}
+		}
+	})
 }
 
-func TestStartApplication_forwardToRightInstance(t *testing.T) {
+func TestStartApplication_unixSocketOnly(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		socketDir := t.TempDir()
 
-	port := 8999
-	portStr := fmt.Sprintf("%d", port)
+		cfg := newDefaultTestCfg(serverType)
+		cfg.UnixSocketDir.Default = lo.ToPtr(socketDir)
+		cfg.UnixSocketOnly.Default = lo.ToPtr(true)
+		cfg.Resp.Default = lo.ToPtr(true)
 
-	cfg := newDefaultTestCfg()
-	cfg.Port.Default = lo.ToPtr(port)
-	cfg.LogLevel.Default = lo.ToPtr("INFO")
-	//goland:noinspection HttpUrlsUsage
-	cfg.InstanceUrls.Default = lo.ToPtr([]string{"http://localhost:" + portStr, "http://" + svc_discovery.GetOwnHostName() + ":" + portStr})
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	app := StartApplication(cfg, true)
-	defer app.Close()
+		if app.Port != 0 || len(app.FrontendPorts) != 0 {
+			t.Fatalf("expected no tcp ports, got %d, %v", app.Port, app.FrontendPorts)
+		}
 
-	// sends request to localhost, forwards to right address (real hostname of the machine)
-	makeTestRequest(app.Port, "my-id", true)
-	makeHttp2TestRequest(app.Port, "my-id", true)
+		if !makeTestRequestClient(0, "unix-only", false, newUnixSocketHttp1Client(app.SocketPaths["http"])) {
+			t.Fatalf("Expected request over unix socket to be approved")
+		}
 
+		client := redis.NewClient(&redis.Options{Network: "unix", Addr: app.SocketPaths["resp"]})
+		defer func() { _ = client.Close() }()
+		if pong, err := client.Ping(context.Background()).Result(); err != nil || pong != "PONG" {
+			t.Fatalf("Expected PONG over resp unix socket, got %s, %v", pong, err)
+		}
+	})
 }
 
-func makeDebugRequest(port int, key string) string {
+func TestStartApplication_forwardAuth(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
 
-	var resp *http.Response
-	var err error
-	if key != "" {
-		resp, err = http1Client.Get(fmt.Sprintf("http://localhost:%d/debug/%s", port, key))
-	} else {
-		resp, err = http1Client.Get(fmt.Sprintf("http://localhost:%d/debug", port))
-	}
-	if err != nil {
-		panic(fmt.Sprintf("Error making GET request: %v", err))
-	}
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(2)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.ForwardAuthKeyTemplates.Default = lo.ToPtr([]string{"{client-ip}:{path}"})
 
-	if resp.StatusCode == 404 {
-		return ""
-	}
+		app := StartApplication(cfg, true)
+		defer app.Close()
 
-	if resp.StatusCode != 200 {
-		panic(fmt.Sprintf("Expected status code 200, got %d", resp.StatusCode))
-	}
+		spoofed := 0
+		makeAuthRequest := func(clientIp string) *http.Response {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/auth", app.Port), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			// The proxy appends the client's address, after whatever the client sent
+			spoofed++
+			req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.0.0.%d, %s", spoofed, clientIp))
+			req.Header.Set("X-Original-URI", "/api/things?x=y")
+			resp, err := http1Client.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+			return resp
+		}
 
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		panic(fmt.Sprintf("Error reading response body: %v", err))
-	}
+		resp := makeAuthRequest("1.2.3.4")
+		if resp.StatusCode != 200 || resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != "1" {
+			t.Fatalf("Unexpected first response: %d %v", resp.StatusCode, resp.Header)
+		}
 
-	return string(bytes)
-}
+		resp = makeAuthRequest("1.2.3.4")
+		if resp.StatusCode != 200 || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+			t.Fatalf("Unexpected second response: %d %v", resp.StatusCode, resp.Header)
+		}
 
-func makeTestRequestClient(port int, key string, canWait bool, client *http.Client) bool {
-	query := ""
-	if canWait {
-		query = "?canWait=true"
-	}
-	return makePerfTestRequest(port, "POST", "/rate/"+key, query, client)
-}
+		// A different spoofed first address doesn't make it a different client
+		resp = makeAuthRequest("1.2.3.4")
+		if resp.StatusCode != 429 || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("Expected 429 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		// Other clients are not affected
+		resp = makeAuthRequest("5.6.7.8")
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected other client to be approved, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestStartApplication_forwardAuth_denyStatus(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.ForwardAuthKeyTemplates.Default = lo.ToPtr([]string{"{authorization}", "{header:X-Tenant}"})
+		cfg.ForwardAuthDenyStatus.Default = lo.ToPtr(403)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		makeAuthRequest := func(tenant string) int {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/auth", app.Port), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("X-Tenant", tenant)
+			resp, err := http1Client.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+			return resp.StatusCode
+		}
+
+		// No Authorization header, so only the tenant template applies
+		if status := makeAuthRequest("tenant-a"); status != 200 {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if status := makeAuthRequest("tenant-a"); status != 403 {
+			t.Fatalf("Expected 403, got %d", status)
+		}
+	})
+}
+
+func TestStartApplication_mutualTls(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		dir := t.TempDir()
+		ca := newTestCert(t, nil)
+		serverCert := newTestCert(t, ca)
+		clientCert := newTestCert(t, ca)
+		serverCert.write(t, dir+"/server.crt", dir+"/server.key")
+		ca.write(t, dir+"/ca.crt", "")
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.TlsCertFile.Default = lo.ToPtr(dir + "/server.crt")
+		cfg.TlsKeyFile.Default = lo.ToPtr(dir + "/server.key")
+		cfg.TlsClientCaFile.Default = lo.ToPtr(dir + "/ca.crt")
+		cfg.Binary.Default = lo.ToPtr(true)
+		cfg.BinaryPort.Default = lo.ToPtr(0)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		rootCAs := x509.NewCertPool()
+		rootCAs.AddCert(ca.cert)
+		newClient := func(certs ...tls.Certificate) *http.Client {
+			return &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig:   &tls.Config{RootCAs: rootCAs, Certificates: certs},
+					ForceAttemptHTTP2: true,
+					DisableKeepAlives: true,
+				},
+				Timeout: 10 * time.Second,
+			}
+		}
+		client := newClient(clientCert.tlsCertificate(t))
+		url := fmt.Sprintf("https://localhost:%d/rate/tls", app.Port)
+
+		resp, err := client.Post(url, "", nil)
+		if err != nil {
+			t.Fatalf("Expected request with client certificate to succeed, got %v", err)
+		}
+		drainBody(resp)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected 200, got %d", resp.StatusCode)
+		}
+		expectedProto := 1
+		if serverType == "echo-http2" {
+			expectedProto = 2
+		}
+		if resp.ProtoMajor != expectedProto {
+			t.Fatalf("Expected http%d over tls, got %s", expectedProto, resp.Proto)
+		}
+
+		if _, err := newClient().Post(url, "", nil); err == nil {
+			t.Fatalf("Expected request without client certificate to fail")
+		}
+
+		binaryClient, err := binary_proto.DialTLS("tcp", fmt.Sprintf("localhost:%d", app.FrontendPorts["binary"]), &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{clientCert.tlsCertificate(t)},
+		})
+		if err != nil {
+			t.Fatalf("Failed to connect to binary protocol over tls: %v", err)
+		}
+		defer func() { _ = binaryClient.Close() }()
+		if decision, err := binaryClient.Ask(context.Background(), "tls", binary_proto.AskOptions{}); err != nil || !decision.Approved {
+			t.Fatalf("Expected binary request over tls to be approved, got %+v, %v", decision, err)
+		}
+
+		// Rotate the server certificate, new connections should pick it up
+		rotated := newTestCert(t, ca)
+		rotated.write(t, dir+"/server.crt", dir+"/server.key")
+		t0 := time.Now()
+		for {
+			resp, err := client.Post(url, "", nil)
+			if err == nil {
+				drainBody(resp)
+				if resp.TLS.PeerCertificates[0].SerialNumber.Cmp(rotated.cert.SerialNumber) == 0 {
+					break
+				}
+			}
+			if time.Since(t0) > 5*time.Second {
+				t.Fatalf("Server certificate was not reloaded, last error %v", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
+
+func TestStartApplication_tenantAuth(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		configFilePath := filepath.Join(t.TempDir(), "app-config.json")
+		err := config.WriteAppConfigFile(configFilePath, &config.CfgFromFile{
+			Tenants: []config.CfgFromFileTenant{
+				{Name: "billing", ApiKeySha256: []string{tenant_auth.HashApiKey("billing-secret")}, KeyPattern: "billing:"},
+				{Name: "search", ApiKeySha256: []string{tenant_auth.HashApiKey("search-secret")}, KeyPattern: "search:", CanSetRate: true},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.ConfigFile.Default = lo.ToPtr(configFilePath)
+		cfg.Resp.Default = lo.ToPtr(true)
+		cfg.RespPort.Default = lo.ToPtr(0)
+		cfg.Binary.Default = lo.ToPtr(true)
+		cfg.BinaryPort.Default = lo.ToPtr(0)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		rate := func(path string, apiKey string) int {
+			req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d%s", app.Port, path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+apiKey)
+			}
+			resp, err := testClient(serverType).Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+			return resp.StatusCode
+		}
+
+		for _, path := range []string{"/rate/billing:a", "/rate/search:a?maxRequests=5"} {
+			if status := rate(path, ""); status != 401 {
+				t.Fatalf("Expected 401 for %s without credentials, got %d", path, status)
+			}
+		}
+		if status := rate("/rate/billing:a", "wrong-key"); status != 401 {
+			t.Fatalf("Expected 401 for an unknown api key, got %d", status)
+		}
+		if status := rate("/rate/billing:a", "billing-secret"); status != 200 {
+			t.Fatalf("Expected 200 within the tenant's namespace, got %d", status)
+		}
+		if status := rate("/rate/search:a", "billing-secret"); status != 403 {
+			t.Fatalf("Expected 403 outside the tenant's namespace, got %d", status)
+		}
+		if status := rate("/rate/billing:a?maxRequests=5", "billing-secret"); status != 403 {
+			t.Fatalf("Expected 403 for an override the tenant has no right to, got %d", status)
+		}
+		if status := rate("/rate/search:a?maxRequests=5", "search-secret"); status != 200 {
+			t.Fatalf("Expected 200 for an override the tenant has the right to, got %d", status)
+		}
+
+		// Other tenants' keys are hidden from the debug output
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/debug", app.Port), nil)
+		req.Header.Set("Authorization", "Bearer billing-secret")
+		resp, err := http1Client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		debugOutput := &limiter_api.DebugSnapshotAll{}
+		if err := json.NewDecoder(resp.Body).Decode(debugOutput); err != nil {
+			t.Fatalf("Failed to decode debug output: %v", err)
+		}
+		_ = resp.Body.Close()
+		if len(debugOutput.Instances) != 1 || debugOutput.Instances["billing:a"] == nil {
+			t.Fatalf("Expected only the tenant's own key in the debug output, got %v", debugOutput.Instances)
+		}
+
+		// The redis protocol authenticates with AUTH, as with a redis password
+		respClient := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", app.FrontendPorts["resp"])})
+		defer func() { _ = respClient.Close() }()
+		if err := respClient.Do(context.Background(), "GOCC.ASK", "billing:b").Err(); err == nil || err.Error() != "NOAUTH Authentication required." {
+			t.Fatalf("Expected NOAUTH without credentials, got %v", err)
+		}
+		authedRespClient := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("localhost:%d", app.FrontendPorts["resp"]), Password: "billing-secret"})
+		defer func() { _ = authedRespClient.Close() }()
+		if err := authedRespClient.Do(context.Background(), "GOCC.ASK", "billing:b").Err(); err != nil {
+			t.Fatalf("Expected GOCC.ASK to succeed with credentials, got %v", err)
+		}
+		if err := authedRespClient.Do(context.Background(), "GOCC.ASK", "search:b").Err(); err == nil {
+			t.Fatalf("Expected GOCC.ASK outside the tenant's namespace to fail")
+		}
+
+		// The binary protocol authenticates with an Auth frame
+		binaryClient, err := binary_proto.Dial("tcp", fmt.Sprintf("localhost:%d", app.FrontendPorts["binary"]))
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer func() { _ = binaryClient.Close() }()
+		if _, err := binaryClient.Ask(context.Background(), "billing:c", binary_proto.AskOptions{}); err == nil {
+			t.Fatalf("Expected ask without credentials to fail")
+		}
+		if err := binaryClient.Authenticate(context.Background(), "wrong-key"); err == nil {
+			t.Fatalf("Expected authentication with an unknown api key to fail")
+		}
+		if err := binaryClient.Authenticate(context.Background(), "billing-secret"); err != nil {
+			t.Fatalf("Failed to authenticate: %v", err)
+		}
+		if decision, err := binaryClient.Ask(context.Background(), "billing:c", binary_proto.AskOptions{}); err != nil || !decision.Approved {
+			t.Fatalf("Expected ask with credentials to be approved, got %+v, %v", decision, err)
+		}
+	})
+}
+
+func TestStartApplication_perKeyOverridePolicy(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		configFilePath := filepath.Join(t.TempDir(), "app-config.json")
+		err := config.WriteAppConfigFile(configFilePath, &config.CfgFromFile{
+			Keys: []config.CfgFromFileKey{
+				{KeyPattern: "^premium-", KeyPatternIsRegex: true, Overrides: &config.CfgFromFileOverrides{
+					AllowSetRate: lo.ToPtr(true),
+					MaxRequests:  &config.CfgFromFileBounds{Min: lo.ToPtr(10), Max: lo.ToPtr(500)},
+				}},
+				{KeyPattern: "locked", Overrides: &config.CfgFromFileOverrides{AllowModQueue: lo.ToPtr(false)}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.ConfigFile.Default = lo.ToPtr(configFilePath)
+		cfg.RequestsCanSetRate.Default = lo.ToPtr(false)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		for query, expected := range map[string]int{
+			"/rate/premium-1?maxRequests=200":       200,
+			"/rate/premium-1?maxRequests=501":       400,
+			"/rate/premium-1?maxRequests=9":         400,
+			"/rate/basic-1?maxRequests=200":         403, // the global flag applies
+			"/rate/locked?maxRequestsInQueue=5":     403,
+			"/rate/not-locked?maxRequestsInQueue=5": 200,
+		} {
+			resp, err := testClient(serverType).Post(fmt.Sprintf("http://localhost:%d%s", app.Port, query), "", nil)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+			if resp.StatusCode != expected {
+				t.Fatalf("Expected %d for %s, got %d", expected, query, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestStartApplication_adminApi(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		configFilePath := filepath.Join(t.TempDir(), "app-config.json")
+		err := config.WriteAppConfigFile(configFilePath, &config.CfgFromFile{
+			Tenants: []config.CfgFromFileTenant{
+				{Name: "ops", ApiKeySha256: []string{tenant_auth.HashApiKey("ops-secret")}, KeyPattern: "billing:", Admin: true},
+				{Name: "billing", ApiKeySha256: []string{tenant_auth.HashApiKey("billing-secret")}, KeyPattern: "billing:"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.ConfigFile.Default = lo.ToPtr(configFilePath)
+		cfg.AdminApi.Default = lo.ToPtr(true)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		do := func(method string, path string, apiKey string, result any) int {
+			req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", app.Port, path), nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			resp, err := testClient(serverType).Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer drainBody(resp)
+			if result != nil && resp.StatusCode == 200 {
+				if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+					t.Fatalf("Failed to decode response of %s %s: %v", method, path, err)
+				}
+			}
+			return resp.StatusCode
+		}
+
+		if status := do("POST", "/admin/keys/billing:a/reset", "billing-secret", nil); status != 403 {
+			t.Fatalf("Expected 403 for a tenant that isn't an admin, got %d", status)
+		}
+		if status := do("POST", "/admin/keys/search:a/reset", "ops-secret", nil); status != 403 {
+			t.Fatalf("Expected 403 outside the admin's namespace, got %d", status)
+		}
+		if status := do("POST", "/admin/keys/billing:a/reset", "ops-secret", nil); status != 404 {
+			t.Fatalf("Expected 404 for a key without an instance, got %d", status)
+		}
+
+		if status := do("POST", "/rate/billing:a", "billing-secret", nil); status != 200 {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if status := do("POST", "/rate/billing:a", "billing-secret", nil); status != 429 {
+			t.Fatalf("Expected 429, got %d", status)
+		}
+
+		// Overrides apply right away, without using up a slot
+		view := &endpoints2.AdminKeyView{}
+		if status := do("PUT", "/admin/keys/billing:a/override?maxRequests=2", "ops-secret", view); status != 200 {
+			t.Fatalf("Expected 200 setting the override, got %d", status)
+		}
+		if view.Override.MaxRequestsPerWindow != 2 || view.Config.MaxRequestsPerWindow != 2 || view.Instance.NumApprovedThisWindow != 1 {
+			t.Fatalf("Unexpected view after setting the override: %+v", view)
+		}
+		if status := do("PUT", "/admin/keys/billing:a/override?maxRequests=0", "ops-secret", nil); status != 400 {
+			t.Fatalf("Expected 400 for an empty override, got %d", status)
+		}
+		if status := do("POST", "/rate/billing:a", "billing-secret", nil); status != 200 {
+			t.Fatalf("Expected 200 with the override, got %d", status)
+		}
+
+		if status := do("POST", "/admin/keys/billing:a/reset", "ops-secret", nil); status != 200 {
+			t.Fatalf("Expected 200 resetting the key, got %d", status)
+		}
+		view = &endpoints2.AdminKeyView{}
+		if status := do("GET", "/admin/keys/billing:a", "ops-secret", view); status != 200 || view.Instance.NumApprovedThisWindow != 0 {
+			t.Fatalf("Expected the counters to be reset, got %d, %+v", status, view)
+		}
+
+		view = &endpoints2.AdminKeyView{}
+		if status := do("DELETE", "/admin/keys/billing:a/override", "ops-secret", view); status != 200 || view.Override != nil || view.Config.MaxRequestsPerWindow != 1 {
+			t.Fatalf("Expected the override to be cleared, got %d, %+v", status, view)
+		}
+
+		if status := do("POST", "/admin/keys/billing:a/expire", "ops-secret", nil); status != 200 {
+			t.Fatalf("Expected 200 expiring the key, got %d", status)
+		}
+		view = &endpoints2.AdminKeyView{}
+		if status := do("GET", "/admin/keys/billing:a", "ops-secret", view); status != 200 || view.Instance != nil {
+			t.Fatalf("Expected the instance to be gone, got %d, %+v", status, view)
+		}
+	})
+}
+
+func TestStartApplication_keyListing(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		for i := 0; i < 3; i++ {
+			for j := 0; j <= i; j++ {
+				makeTestRequestClient(app.Port, fmt.Sprintf("list-%d", i), false, testClient(serverType))
+			}
+		}
+		makeTestRequestClient(app.Port, "other", false, testClient(serverType))
+
+		list := func(query string) (int, *endpoints2.KeyListResponse) {
+			resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/keys%s", app.Port, query))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer drainBody(resp)
+			result := &endpoints2.KeyListResponse{}
+			if resp.StatusCode == 200 {
+				if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+			}
+			return resp.StatusCode, result
+		}
+
+		// Stats are published right after the instances answer
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, page := list("?sort=denied&limit=1&fields=Key,NumDeniedThisWindow")
+			if len(page.Keys) == 1 && page.Keys[0].(map[string]any)["NumDeniedThisWindow"] == 2.0 {
+				if page.Keys[0].(map[string]any)["Key"] != "list-2" || len(page.Keys[0].(map[string]any)) != 2 || page.NextCursor == "" {
+					t.Fatalf("Unexpected first page: %+v", page)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected list-2 to be the most denied key, got %+v", page)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var keys []any
+		for cursor := ""; ; {
+			status, page := list("?prefix=list-&sort=denied&limit=2&fields=Key&cursor=" + cursor)
+			if status != 200 {
+				t.Fatalf("Expected 200, got %d", status)
+			}
+			for _, key := range page.Keys {
+				keys = append(keys, key.(map[string]any)["Key"])
+			}
+			if cursor = page.NextCursor; cursor == "" {
+				break
+			}
+		}
+		if fmt.Sprint(keys) != "[list-2 list-1 list-0]" {
+			t.Fatalf("Unexpected keys over all pages: %v", keys)
+		}
+
+		for _, query := range []string{"?regex=(", "?limit=0", "?limit=1001", "?sort=random", "?cursor=garbage!", "?fields=Secret"} {
+			if status, _ := list(query); status != 400 {
+				t.Fatalf("Expected 400 for %s, got %d", query, status)
+			}
+		}
+	})
+}
+
+func TestStartApplication_eventStream(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/events?key=watched", app.Port))
+		if err != nil {
+			t.Fatalf("Failed to subscribe: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }() // the stream never ends by itself
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		lines := make(chan string, 100)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		nextLine := func() string {
+			select {
+			case line := <-lines:
+				return line
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected more events")
+				return ""
+			}
+		}
+
+		if line := nextLine(); line != ": subscribed" {
+			t.Fatalf("Expected the subscribed comment, got '%s'", line)
+		}
+
+		makeTestRequestClient(app.Port, "unwatched", false, testClient(serverType))
+		makeTestRequestClient(app.Port, "watched", false, testClient(serverType))
+		makeTestRequestClient(app.Port, "watched", false, testClient(serverType))
+
+		for _, expected := range []string{"approved", "denied"} {
+			_ = nextLine() // blank line between events
+			if line := nextLine(); line != "event: "+expected {
+				t.Fatalf("Expected a %s event, got '%s'", expected, line)
+			}
+			event := &limiter_events.Event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(nextLine(), "data: ")), event); err != nil {
+				t.Fatalf("Failed to decode event: %v", err)
+			}
+			if event.Key != "watched" || string(event.Type) != expected {
+				t.Fatalf("Unexpected event: %+v", event)
+			}
+		}
+	})
+}
+
+func makeDebugRequest(port int, key string) string {
+
+	var resp *http.Response
+	var err error
+	if key != "" {
+		resp, err = http1Client.Get(fmt.Sprintf("http://localhost:%d/debug/%s", port, key))
+	} else {
+		resp, err = http1Client.Get(fmt.Sprintf("http://localhost:%d/debug", port))
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Error making GET request: %v", err))
+	}
+
+	if resp.StatusCode == 404 {
+		return ""
+	}
+
+	if resp.StatusCode != 200 {
+		panic(fmt.Sprintf("Expected status code 200, got %d", resp.StatusCode))
+	}
+
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(fmt.Sprintf("Error reading response body: %v", err))
+	}
+
+	return string(bytes)
+}
+
+func makeTestRequestClient(port int, key string, canWait bool, client *http.Client) bool {
+	query := ""
+	if canWait {
+		query = "?canWait=true"
+	}
+	return makePerfTestRequest(port, "POST", "/rate/"+key, query, client)
+}
 
 func makeTestRequest(port int, key string, canWait bool) bool {
 	return makeTestRequestClient(port, key, canWait, http1Client)
 }
 
-func makeHttp2TestRequest(port int, key string, canWait bool) bool {
-	return makeTestRequestClient(port, key, canWait, http2Client)
+// testClient returns the client to use with a server type. Only echo-http2 speaks h2c.
+func testClient(serverType string) *http.Client {
+	if serverType == "echo-http2" {
+		return http2Client
+	}
+	return http1Client
+}
+
+// newUnixSocketHttp1Client returns a client that sends all requests to a unix socket, regardless of url host/port
+func newUnixSocketHttp1Client(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+// newUnixSocketHttp2Client is like newUnixSocketHttp1Client, but speaks h2c
+func newUnixSocketHttp2Client(path string) *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a CA if parent is nil, otherwise a localhost certificate signed by parent
+func newTestCert(t *testing.T, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, err := cryptorand.Int(cryptorand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("Failed to generate serial: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// write writes the key before the certificate, like most rotation tooling does
+func (c *testCert) write(t *testing.T, certPath string, keyPath string) {
+	if keyPath != "" {
+		if err := os.WriteFile(keyPath, c.keyPEM, 0600); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+	}
+	if err := os.WriteFile(certPath, c.certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load key pair: %v", err)
+	}
+	return cert
+}
+
+func TestStartApplication_metrics(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		// Metrics are process wide, so each server type gets its own pattern
+		prefix := "metrics-" + serverType + ":"
+		pattern := "^" + prefix
+		configFilePath := filepath.Join(t.TempDir(), "app-config.json")
+		err := config.WriteAppConfigFile(configFilePath, &config.CfgFromFile{
+			Keys: []config.CfgFromFileKey{{KeyPattern: pattern, KeyPatternIsRegex: true, MaxRequestsPerWindow: 1}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.ConfigFile.Default = lo.ToPtr(configFilePath)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		for i := 0; i < 3; i++ {
+			makeTestRequestClient(app.Port, prefix+"user-1", false, testClient(serverType))
+		}
+		makeTestRequestClient(app.Port, prefix+"user-2", false, testClient(serverType))
+
+		scrape := func() string {
+			resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/metrics", app.Port))
+			if err != nil {
+				t.Fatalf("Failed to scrape metrics: %v", err)
+			}
+			defer drainBody(resp)
+			if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+				t.Fatalf("Expected prometheus text metrics, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			body, _ := io.ReadAll(resp.Body)
+			return string(body)
+		}
+
+		// Decisions are counted right after the instances answer
+		expected := []string{
+			fmt.Sprintf(`gocc_decisions_total{decision="approved",pattern="%s"} 2`, pattern),
+			fmt.Sprintf(`gocc_decisions_total{decision="denied",pattern="%s"} 2`, pattern),
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			body := scrape()
+			if lo.EveryBy(expected, func(line string) bool { return strings.Contains(body, line) }) {
+				if strings.Contains(body, "user-1") || !strings.Contains(body, "gocc_instances{shard=") {
+					t.Fatalf("Expected per shard instance counts and no keys in metrics, got:\n%s", body)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v in metrics, got:\n%s", expected, body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestStartApplication_tracing(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		exporter := tracetest.NewInMemoryExporter()
+		shutdown := tracing.Use(sdktrace.NewSimpleSpanProcessor(exporter), AppName)
+		defer func() { _ = shutdown(context.Background()) }()
+
+		port := 8998
+		portStr := fmt.Sprintf("%d", port)
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.Port.Default = lo.ToPtr(port)
+		cfg.MaxRequests.Default = lo.ToPtr(1)
+		cfg.WindowMillis.Default = lo.ToPtr(500)
+		//goland:noinspection HttpUrlsUsage
+		cfg.InstanceUrls.Default = lo.ToPtr([]string{"http://localhost:" + portStr, "http://" + svc_discovery.GetOwnHostName() + ":" + portStr})
+		cfg.SelfUrl.Default = lo.ToPtr("http://localhost:" + portStr)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		// A key owned by the second instance url, so that requests to localhost are forwarded
+		validCfg, err := cfg.ValidateInstanceUrls()
+		if err != nil {
+			t.Fatalf("Failed to validate instance urls: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if validCfg.Cluster.View().Ring.Owner(fmt.Sprintf("traced-%d", i)) == 1 {
+				key = fmt.Sprintf("traced-%d", i)
+			}
+		}
+
+		traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+		for i := 0; i < 2; i++ { // the second one waits in the queue for the next window
+			req, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/rate/%s?canWait=true", app.Port, key), nil)
+			req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			resp, err := testClient(serverType).Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+			if resp.StatusCode != 200 {
+				t.Fatalf("Expected 200, got %d", resp.StatusCode)
+			}
+		}
+
+		// Spans end right after the responses are written
+		expected := map[string]int{"HandleRateRequest": 4, "maybeForwardToCorrectInstance": 2, "AskPermission": 2, "queued": 1}
+		var spans tracetest.SpanStubs
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			spans = exporter.GetSpans()
+			counts := lo.CountValues(lo.Map(spans, func(s tracetest.SpanStub, _ int) string { return s.Name }))
+			if fmt.Sprint(counts) == fmt.Sprint(expected) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected spans %v, got %v", expected, counts)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		forwardSpans := map[string]bool{}
+		for _, span := range spans {
+			if span.SpanContext.TraceID().String() != traceID {
+				t.Fatalf("Expected all spans to be part of the incoming trace, got %s in %s", span.Name, span.SpanContext.TraceID())
+			}
+			if span.Name == "maybeForwardToCorrectInstance" {
+				forwardSpans[span.SpanContext.SpanID().String()] = true
+			}
+		}
+		// The owning instance continues the trace from the forwarding span
+		continued := lo.CountBy(spans, func(s tracetest.SpanStub) bool {
+			return s.Name == "HandleRateRequest" && forwardSpans[s.Parent.SpanID().String()]
+		})
+		if continued != 2 {
+			t.Fatalf("Expected both forwarded requests to continue the trace on the owner, got %d", continued)
+		}
+		queued, _ := lo.Find(spans, func(s tracetest.SpanStub) bool { return s.Name == "queued" })
+		if queued.EndTime.Sub(queued.StartTime) < 100*time.Millisecond {
+			t.Fatalf("Expected the queued span to cover the wait for the next window, got %v", queued.EndTime.Sub(queued.StartTime))
+		}
+	})
+}
+
+func TestStartApplication_auditLog(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		dir := t.TempDir()
+		configFilePath := filepath.Join(dir, "app-config.json")
+		err := config.WriteAppConfigFile(configFilePath, &config.CfgFromFile{
+			Keys: []config.CfgFromFileKey{
+				{KeyPattern: "^audited-", KeyPatternIsRegex: true, MaxRequestsPerWindow: 1},
+				{KeyPattern: "^unaudited-", KeyPatternIsRegex: true, AuditSampleRate: lo.ToPtr(0.0)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
+
+		auditLogPath := filepath.Join(dir, "audit.log")
+		cfg := newDefaultTestCfg(serverType)
+		cfg.ConfigFile.Default = lo.ToPtr(configFilePath)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.AuditLog.Default = lo.ToPtr(auditLogPath)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/rate/audited-1", app.Port), nil)
+			req.Header.Set("X-Correlation-ID", fmt.Sprintf("corr-%d", i))
+			resp, err := testClient(serverType).Do(req)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+		}
+		makeTestRequestClient(app.Port, "unaudited-1", false, testClient(serverType))
+
+		// Decisions are written in the background
+		var decisions []*audit.Decision
+		deadline := time.Now().Add(5 * time.Second)
+		for len(decisions) < 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected 2 decisions in the audit log, got %d", len(decisions))
+			}
+			time.Sleep(10 * time.Millisecond)
+			data, _ := os.ReadFile(auditLogPath)
+			decisions = nil
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				decision := &audit.Decision{}
+				if json.Unmarshal([]byte(line), decision) == nil {
+					decisions = append(decisions, decision)
+				}
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond) // and nothing more, for the unaudited key
+		data, _ := os.ReadFile(auditLogPath)
+		if strings.Contains(string(data), "unaudited-1") {
+			t.Fatalf("Expected decisions on keys with sample rate 0 not to be written, got:\n%s", data)
+		}
+
+		for i, expected := range []string{"approved", "denied"} {
+			d := decisions[i]
+			if d.Key != "audited-1" || d.Decision != expected || d.CorrelationID != fmt.Sprintf("corr-%d", i) ||
+				d.Pattern != "^audited-" || d.MaxRequestsPerWindow != 1 || d.WindowMillis != 60_000 || d.RequestID == "" {
+				t.Fatalf("Unexpected decision %d: %+v", i, d)
+			}
+		}
+	})
+}
+
+func TestStartApplication_fileDiscovery(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		instancesPath := filepath.Join(t.TempDir(), "instances")
+		cfg := newDefaultTestCfg(serverType)
+		cfg.Discovery.Default = lo.ToPtr("file")
+		cfg.DiscoveryName.Default = lo.ToPtr(instancesPath)
+		cfg.DiscoveryIntervalMillis.Default = lo.ToPtr(100)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		getMembers := func() *endpoints2.ClusterMembersResponse {
+			resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/cluster/members", app.Port))
+			if err != nil {
+				t.Fatalf("Failed to get cluster members: %v", err)
+			}
+			defer drainBody(resp)
+			result := &endpoints2.ClusterMembersResponse{}
+			if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+				t.Fatalf("Failed to decode cluster members: %v", err)
+			}
+			return result
+		}
+		awaitMembers := func(n int) *endpoints2.ClusterMembersResponse {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				members := getMembers()
+				if len(members.Members) == n {
+					return members
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected %d cluster members, got %+v", n, members)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+
+		// Until instances are found, keys are served here
+		if members := getMembers(); !members.Distributed || len(members.Members) != 0 {
+			t.Fatalf("Expected no cluster members yet, got %+v", members)
+		}
+		if !makeTestRequestClient(app.Port, "key", false, testClient(serverType)) {
+			t.Fatalf("Expected the request to be approved")
+		}
+
+		// Both urls are this instance, so forwarded requests end up here too
+		//goland:noinspection HttpUrlsUsage
+		self := []string{fmt.Sprintf("http://localhost:%d", app.Port), fmt.Sprintf("http://127.0.0.1:%d?weight=2", app.Port)}
+		if err := os.WriteFile(instancesPath, []byte("# gocc instances\n"+strings.Join(self, "\n")+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write instances file: %v", err)
+		}
+		members := awaitMembers(2)
+		if members.Members[0].Url != fmt.Sprintf("http://127.0.0.1:%d", app.Port) || members.Members[0].Weight != 2 {
+			t.Fatalf("Expected the weighted member first, got %+v", members)
+		}
+		for i := 0; i < 10; i++ {
+			if !makeTestRequestClient(app.Port, fmt.Sprintf("key-%d", i), false, testClient(serverType)) {
+				t.Fatalf("Expected the request on key-%d to be approved", i)
+			}
+		}
+
+		// Scaling down needs no restart either
+		if err := os.WriteFile(instancesPath, []byte(self[0]+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write instances file: %v", err)
+		}
+		awaitMembers(1)
+	})
+}
+
+func TestStartApplication_forwardingIsFaithful(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		port := 8996
+		portStr := fmt.Sprintf("%d", port)
+		auditLogPath := filepath.Join(t.TempDir(), "audit.log")
+
+		cfg := newDefaultTestCfg(serverType)
+		cfg.Port.Default = lo.ToPtr(port)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		cfg.AuditLog.Default = lo.ToPtr(auditLogPath)
+		//goland:noinspection HttpUrlsUsage
+		cfg.InstanceUrls.Default = lo.ToPtr([]string{"http://localhost:" + portStr, "http://" + svc_discovery.GetOwnHostName() + ":" + portStr})
+		cfg.SelfUrl.Default = lo.ToPtr("http://localhost:" + portStr)
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		// A key owned by the other instance url, that needs escaping
+		validCfg, err := cfg.ValidateInstanceUrls()
+		if err != nil {
+			t.Fatalf("Failed to validate instance urls: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if _, local := validCfg.Cluster.View().Route(fmt.Sprintf("forwarded key %d", i)); !local {
+				key = fmt.Sprintf("forwarded key %d", i)
+			}
+		}
+		rateUrl := fmt.Sprintf("http://localhost:%d/rate/%s?maxRequests=1", app.Port, url.PathEscape(key))
+
+		req, _ := http.NewRequest("POST", rateUrl, nil)
+		req.Header.Set("X-Correlation-ID", "forwarded-1")
+		resp, err := testClient(serverType).Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		requestID := string(body)
+		if resp.StatusCode != http.StatusOK || requestID == "" {
+			t.Fatalf("Expected 200 with the request id, got %d '%s'", resp.StatusCode, requestID)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "1" || resp.Header.Get("RateLimit-Remaining") != "0" {
+			t.Fatalf("Expected the rate limit headers of the owner, got %v", resp.Header)
+		}
+
+		// The query is passed on, so the second request is over the limit of 1
+		resp, err = testClient(serverType).Post(rateUrl, "", nil)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		drainBody(resp)
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("Expected 429 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+		}
+
+		// The request id works for releasing through any instance
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("http://localhost:%d/rate/%s/%s", app.Port, url.PathEscape(key), requestID), nil)
+		resp, err = testClient(serverType).Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		drainBody(resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 releasing the request, got %d", resp.StatusCode)
+		}
+
+		// The owner decided with the client's correlation id
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			data, _ := os.ReadFile(auditLogPath)
+			if strings.Contains(string(data), `"CorrelationID":"forwarded-1"`) && strings.Contains(string(data), key) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the owner's decision with the client's correlation id, got:\n%s", data)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestStartApplication_peerDown(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		// The other instance is down to begin with
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to find a free port: %v", err)
+		}
+		peerAddr := listener.Addr().String()
+		_ = listener.Close()
+
+		port := 8995
+		portStr := fmt.Sprintf("%d", port)
+		cfg := newDefaultTestCfg(serverType)
+		cfg.Port.Default = lo.ToPtr(port)
+		cfg.MaxRequests.Default = lo.ToPtr(4)
+		cfg.WindowMillis.Default = lo.ToPtr(60_000)
+		//goland:noinspection HttpUrlsUsage
+		cfg.InstanceUrls.Default = lo.ToPtr([]string{"http://localhost:" + portStr, "http://" + peerAddr})
+		cfg.SelfUrl.Default = lo.ToPtr("http://localhost:" + portStr)
+		cfg.PeerHealthCheckMillis.Default = lo.ToPtr(100)
+		cfg.PeerDownPolicy.Default = lo.ToPtr(config.PeerDownLocal)
+		cfg.ForwardAuthKeyTemplates.Default = lo.ToPtr([]string{"{header:X-Key}"})
+
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		awaitStatus := func(degraded bool) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/cluster", app.Port))
+				if err != nil {
+					t.Fatalf("Failed to get cluster status: %v", err)
+				}
+				status := &endpoints2.ClusterStatusResponse{}
+				_ = json.NewDecoder(resp.Body).Decode(status)
+				drainBody(resp)
+				if status.Degraded == degraded && status.PeerDownPolicy == config.PeerDownLocal && len(status.Members) == 2 {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected cluster status with degraded=%v, got %+v", degraded, status)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		awaitStatus(true)
+
+		validCfg, err := cfg.ValidateInstanceUrls()
+		if err != nil {
+			t.Fatalf("Failed to validate instance urls: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if _, local := validCfg.Cluster.View().Route(fmt.Sprintf("peer-down-%d", i)); !local {
+				key = fmt.Sprintf("peer-down-%d", i)
+			}
+		}
+
+		// Enforced here with half of the limit
+		for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+			resp, err := testClient(serverType).Post(fmt.Sprintf("http://localhost:%d/rate/%s", app.Port, key), "", nil)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			drainBody(resp)
+			if resp.StatusCode != expected || resp.Header.Get(endpoints2.HeaderDegraded) != config.PeerDownLocal || resp.Header.Get("RateLimit-Limit") != "2" {
+				t.Fatalf("Expected request %d to be answered with %d by the local policy, got %d %v", i, expected, resp.StatusCode, resp.Header)
+			}
+		}
+		// without changing the key's limit, which is all of it again if this instance takes the key over
+		snapshot := limiter_api.InstanceDebugSnapshot{}
+		if err := json.Unmarshal([]byte(makeDebugRequest(app.Port, key)), &snapshot); err != nil || snapshot.Config.MaxRequestsPerWindow != 4 {
+			t.Fatalf("Expected the key to keep its limit of 4, got %+v, %v", snapshot, err)
+		}
+
+		// The other instance comes back, and gets the requests again
+		// (h2c too, since echo-http2 instances talk http2 to each other)
+		peer := &http.Server{Addr: peerAddr, Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("canWait") == "true" {
+				<-r.Context().Done() // queued until the client gives up
+				return
+			}
+			if r.URL.Path != "/healthz" {
+				_, _ = w.Write([]byte("from-peer"))
+			}
+		}), &http2.Server{})}
+		go func() { _ = peer.ListenAndServe() }()
+		defer func() { _ = peer.Close() }()
+		awaitStatus(false)
+
+		resp, err := testClient(serverType).Post(fmt.Sprintf("http://localhost:%d/rate/%s", app.Port, key), "", nil)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "from-peer" || resp.Header.Get(endpoints2.HeaderDegraded) != "" {
+			t.Fatalf("Expected the request to be forwarded to the recovered instance, got %d '%s'", resp.StatusCode, body)
+		}
+
+		// A client giving up while waiting at the owner isn't the owner failing, for /rate and /auth
+		// (fasthttp doesn't notice clients going away)
+		if serverType != "fast" {
+			getMetrics := func() string {
+				resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/metrics", app.Port))
+				if err != nil {
+					t.Fatalf("Failed to get metrics: %v", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				return string(body)
+			}
+			degradedDecisions := regexp.MustCompile(`gocc_degraded_decisions_total\{policy="local"} \d+`)
+			before := degradedDecisions.FindString(getMetrics())
+
+			for _, path := range []string{"/rate/" + key + "?canWait=true", "/auth?canWait=true"} {
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				req, _ := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://localhost:%d%s", app.Port, path), nil)
+				req.Header.Set("X-Key", key)
+				if resp, err := testClient(serverType).Do(req); err == nil {
+					drainBody(resp)
+					t.Fatalf("Expected the client to give up on %s, got %d", path, resp.StatusCode)
+				}
+				cancel()
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			metricsText := getMetrics()
+			if strings.Contains(metricsText, `gocc_forwarding_errors_total{instance="`+peerAddr+`"}`) {
+				t.Fatalf("Expected no forwarding errors for clients that gave up, got:\n%s", metricsText)
+			}
+			if after := degradedDecisions.FindString(metricsText); after != before {
+				t.Fatalf("Expected no degraded decisions for clients that gave up, got '%s' after '%s'", after, before)
+			}
+		}
+	})
+}
+
+func TestStartApplication_keyHandoff(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		instancesPath := filepath.Join(t.TempDir(), "instances")
+		writeInstances := func(instanceUrls ...string) {
+			if err := os.WriteFile(instancesPath, []byte(strings.Join(instanceUrls, "\n")+"\n"), 0644); err != nil {
+				t.Fatalf("Failed to write instances file: %v", err)
+			}
+		}
+		start := func(port int) AppHandle {
+			cfg := newDefaultTestCfg(serverType)
+			cfg.Port.Default = lo.ToPtr(port)
+			cfg.MaxRequests.Default = lo.ToPtr(5)
+			cfg.WindowMillis.Default = lo.ToPtr(60_000)
+			cfg.Discovery.Default = lo.ToPtr("file")
+			cfg.DiscoveryName.Default = lo.ToPtr(instancesPath)
+			cfg.DiscoveryIntervalMillis.Default = lo.ToPtr(100)
+			cfg.SelfUrl.Default = lo.ToPtr(fmt.Sprintf("http://localhost:%d", port))
+			return StartApplication(cfg, true)
+		}
+		//goland:noinspection HttpUrlsUsage
+		urlA, urlB := "http://localhost:8993", "http://localhost:8994"
+
+		writeInstances(urlA)
+		a := start(8993)
+		defer a.Close()
+		b := start(8994)
+		defer b.Close()
+
+		// A key that moves from a to b when b joins
+		view, err := cluster.NewView([]string{urlA, urlB}, hash_ring.DefaultVirtualNodes)
+		if err != nil {
+			t.Fatalf("Failed to create view: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if owner, _ := view.Route(fmt.Sprintf("moving-%d", i)); owner.String() == urlB {
+				key = fmt.Sprintf("moving-%d", i)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			if !makeTestRequestClient(a.Port, key, false, testClient(serverType)) {
+				t.Fatalf("Expected request %d to be approved", i)
+			}
+		}
+
+		// b continues the window of a, instead of starting over
+		writeInstances(urlA, urlB)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			snapshot := limiter_api.InstanceDebugSnapshot{}
+			if data := makeDebugRequest(b.Port, key); data != "" {
+				if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+					t.Fatalf("Failed to unmarshal debug data: %v", err)
+				}
+			}
+			if snapshot.NumApprovedThisWindow == 3 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected b to take over 3 approved requests, got %+v", snapshot)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if makeDebugRequest(a.Port, key) != "" {
+			t.Fatalf("Expected a to have expired the key after handing it off")
+		}
+
+		for i := 0; i < 2; i++ {
+			if !makeTestRequestClient(a.Port, key, false, testClient(serverType)) {
+				t.Fatalf("Expected request %d after the handoff to be approved", i)
+			}
+		}
+		if makeTestRequestClient(a.Port, key, false, testClient(serverType)) {
+			t.Fatalf("Expected the limit of 5 to be reached across the handoff")
+		}
+
+		// Only other instances may hand off keys
+		forged := fmt.Sprintf(`{"From":"x","Keys":[{"Key":"%s","WindowMillis":60000,"NumApprovedThisWindow":1000}]}`, key)
+		for _, apiKey := range []string{"", "not-the-peer-key"} {
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/cluster/handoff", b.Port), strings.NewReader(forged))
+			if apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+apiKey)
+			}
+			resp, err := testClient(serverType).Do(req)
+			if err != nil {
+				t.Fatalf("Failed to post handoff: %v", err)
+			}
+			drainBody(resp)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Expected a handoff with api key '%s' to be unauthorized, got %d", apiKey, resp.StatusCode)
+			}
+		}
+
+		// and only with windows within the bounds of --window-millis
+		outOfBounds := fmt.Sprintf(`{"From":"x","Keys":[{"Key":"%s","WindowMillis":86400000,"ResetAfterMillis":86400000}]}`, key)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/cluster/handoff", b.Port), strings.NewReader(outOfBounds))
+		req.Header.Set("Authorization", "Bearer test-peer-key")
+		resp, err := testClient(serverType).Do(req)
+		if err != nil {
+			t.Fatalf("Failed to post handoff: %v", err)
+		}
+		drainBody(resp)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected a handoff with a window out of bounds to be rejected, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestStartApplication_peerRoutesOnlyInDistributedMode(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		cfg := newDefaultTestCfg(serverType)
+		app := StartApplication(cfg, true)
+		defer app.Close()
+
+		for _, path := range []string{"/cluster/handoff", "/cluster/replicate", "/cluster/replicas", "/cluster/lend", "/cluster/repay"} {
+			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d%s", app.Port, path), strings.NewReader("{}"))
+			req.Header.Set("Authorization", "Bearer test-peer-key")
+			resp, err := testClient(serverType).Do(req)
+			if err != nil {
+				t.Fatalf("Failed to post to %s: %v", path, err)
+			}
+			drainBody(resp)
+			if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+				t.Fatalf("Expected %s not to be served in single instance mode, got %d", path, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestStartApplication_replicatedKeys(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+		if serverType == "echo-http2" {
+			t.Skip("instances talk h2c to each other, over connections that outlive closing an in-process server")
+		}
+
+		//goland:noinspection HttpUrlsUsage
+		urlA, urlB := "http://localhost:8991", "http://localhost:8992"
+		start := func(port int) AppHandle {
+			cfg := newDefaultTestCfg(serverType)
+			cfg.Port.Default = lo.ToPtr(port)
+			cfg.MaxRequests.Default = lo.ToPtr(5)
+			cfg.WindowMillis.Default = lo.ToPtr(60_000)
+			cfg.InstanceUrls.Default = lo.ToPtr([]string{urlA, urlB})
+			cfg.SelfUrl.Default = lo.ToPtr(fmt.Sprintf("http://localhost:%d", port))
+			cfg.PeerHealthCheckMillis.Default = lo.ToPtr(100)
+			cfg.ReplicationFactor.Default = lo.ToPtr(1)
+			cfg.ReplicationMillis.Default = lo.ToPtr(50)
+			return StartApplication(cfg, true)
+		}
+		awaitApproved := func(port int, key string, expected int) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				snapshot := limiter_api.InstanceDebugSnapshot{}
+				if data := makeDebugRequest(port, key); data != "" {
+					if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+						t.Fatalf("Failed to unmarshal debug data: %v", err)
+					}
+				}
+				if snapshot.NumApprovedThisWindow == expected {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected %d approved requests on port %d, got %+v", expected, port, snapshot)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		awaitHealthy := func(port int, healthy bool) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				status := &endpoints2.ClusterStatusResponse{}
+				if resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d/cluster", port)); err == nil {
+					_ = json.NewDecoder(resp.Body).Decode(status)
+					drainBody(resp)
+				}
+				if status.Degraded != healthy && len(status.Members) == 2 {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the cluster on port %d to be healthy=%v, got %+v", port, healthy, status)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+
+		a := start(8991)
+		b := start(8992)
+		defer b.Close()
+
+		// A key owned by a, replicated to b
+		view, err := cluster.NewView([]string{urlA, urlB}, hash_ring.DefaultVirtualNodes)
+		if err != nil {
+			t.Fatalf("Failed to create view: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if owner, _ := view.Route(fmt.Sprintf("replicated-%d", i)); owner.String() == urlA {
+				key = fmt.Sprintf("replicated-%d", i)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			if !makeTestRequestClient(b.Port, key, false, testClient(serverType)) {
+				t.Fatalf("Expected request %d to be approved", i)
+			}
+		}
+		awaitApproved(a.Port, key, 3)
+		time.Sleep(200 * time.Millisecond) // a few replication intervals
+
+		// Only other instances may replicate keys
+		forged := fmt.Sprintf(`{"From":"%s","Keys":[{"Key":"%s","WindowMillis":60000,"NumApprovedThisWindow":1000}]}`, urlA, key)
+		resp, err := testClient(serverType).Post(fmt.Sprintf("http://localhost:%d/cluster/replicate", b.Port), "application/json", strings.NewReader(forged))
+		if err != nil {
+			t.Fatalf("Failed to post replication: %v", err)
+		}
+		drainBody(resp)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected a replication without the peer api key to be unauthorized, got %d", resp.StatusCode)
+		}
+
+		// b stands in for a while it is down, continuing the window from the replica
+		a.Close()
+		awaitHealthy(b.Port, false)
+		for i := 0; i < 2; i++ {
+			if !makeTestRequestClient(b.Port, key, false, testClient(serverType)) {
+				t.Fatalf("Expected request %d on the replica to be approved", i)
+			}
+		}
+		if makeTestRequestClient(b.Port, key, false, testClient(serverType)) {
+			t.Fatalf("Expected the limit of 5 to be reached across the failover")
+		}
+
+		// a gets the key back when it is up again
+		a = start(8991)
+		defer a.Close()
+		awaitHealthy(b.Port, true)
+		awaitApproved(a.Port, key, 5)
+		if makeTestRequestClient(b.Port, key, false, testClient(serverType)) {
+			t.Fatalf("Expected the limit of 5 to still be reached after a is back")
+		}
+	})
+}
+
+func TestStartApplication_splitKeys(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		configFilePath := filepath.Join(t.TempDir(), "app-config.json")
+		err := config.WriteAppConfigFile(configFilePath, &config.CfgFromFile{
+			Keys: []config.CfgFromFileKey{
+				{KeyPattern: "^hot-", KeyPatternIsRegex: true, MaxRequestsPerWindow: 40, WindowMillis: 60_000, Split: lo.ToPtr(true)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to write app config file: %v", err)
+		}
+
+		//goland:noinspection HttpUrlsUsage
+		urlA, urlB := "http://localhost:8989", "http://localhost:8990"
+		start := func(port int) AppHandle {
+			cfg := newDefaultTestCfg(serverType)
+			cfg.Port.Default = lo.ToPtr(port)
+			cfg.ConfigFile.Default = lo.ToPtr(configFilePath)
+			cfg.InstanceUrls.Default = lo.ToPtr([]string{urlA, urlB})
+			cfg.SelfUrl.Default = lo.ToPtr(fmt.Sprintf("http://localhost:%d", port))
+			cfg.SplitRebalanceMillis.Default = lo.ToPtr(100)
+			return StartApplication(cfg, true)
+		}
+		a := start(8989)
+		defer a.Close()
+		b := start(8990)
+		defer b.Close()
+
+		// A split key owned by a
+		view, err := cluster.NewView([]string{urlA, urlB}, hash_ring.DefaultVirtualNodes)
+		if err != nil {
+			t.Fatalf("Failed to create view: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if owner, _ := view.Route(fmt.Sprintf("hot-%d", i)); owner.String() == urlA {
+				key = fmt.Sprintf("hot-%d", i)
+			}
+		}
+		awaitApprovedOnOwner := func(expected int) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				snapshot := limiter_api.InstanceDebugSnapshot{}
+				if data := makeDebugRequest(a.Port, key); data != "" {
+					if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+						t.Fatalf("Failed to unmarshal debug data: %v", err)
+					}
+				}
+				if snapshot.NumApprovedThisWindow == expected {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected %d approved on the owner, got %+v", expected, snapshot)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+
+		// b borrows a quarter of its share, and decides on its own until it has used it
+		if !makeTestRequestClient(b.Port, key, false, testClient(serverType)) {
+			t.Fatalf("Expected the first request on b to be approved")
+		}
+		awaitApprovedOnOwner(5)
+		if makeDebugRequest(b.Port, key) != "" {
+			t.Fatalf("Expected b not to have an instance of the key")
+		}
+
+		// What b doesn't use is given back
+		awaitApprovedOnOwner(1)
+
+		// The global limit holds across both instances
+		numApproved := 1
+		for i := 0; i < 50; i++ {
+			if makeTestRequestClient(b.Port, key, false, testClient(serverType)) {
+				numApproved++
+			}
+			if makeTestRequestClient(a.Port, key, false, testClient(serverType)) {
+				numApproved++
+			}
+		}
+		if numApproved != 40 {
+			t.Fatalf("Expected 40 requests approved across the instances, got %d", numApproved)
+		}
+	})
+}
+
+func TestStartApplication_binaryPeerTransport(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		//goland:noinspection HttpUrlsUsage
+		urlA, urlB := "http://localhost:8987", "http://localhost:8988"
+		// Both instances run on localhost, so each is told the binary protocol port of the other
+		start := func(port int, binaryPort int, peerBinaryPort int) AppHandle {
+			cfg := newDefaultTestCfg(serverType)
+			cfg.Port.Default = lo.ToPtr(port)
+			cfg.InstanceUrls.Default = lo.ToPtr([]string{urlA, urlB})
+			cfg.SelfUrl.Default = lo.ToPtr(fmt.Sprintf("http://localhost:%d", port))
+			cfg.Binary.Default = lo.ToPtr(true)
+			cfg.BinaryPort.Default = lo.ToPtr(binaryPort)
+			cfg.PeerTransport.Default = lo.ToPtr(config.PeerTransportBinary)
+			cfg.PeerBinaryPort.Default = lo.ToPtr(peerBinaryPort)
+			return StartApplication(cfg, true)
+		}
+		a := start(8987, 8985, 8986)
+		defer a.Close()
+		b := start(8988, 8986, 8985)
+		defer b.Close()
+
+		// A key owned by a
+		view, err := cluster.NewView([]string{urlA, urlB}, hash_ring.DefaultVirtualNodes)
+		if err != nil {
+			t.Fatalf("Failed to create view: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if owner, _ := view.Route(fmt.Sprintf("peer-key-%d", i)); owner.String() == urlA {
+				key = fmt.Sprintf("peer-key-%d", i)
+			}
+		}
+		ask := func() (int, string, http.Header) {
+			resp, err := testClient(serverType).Post(fmt.Sprintf("http://localhost:%d/rate/%s?maxRequests=2", b.Port, key), "", nil)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			return resp.StatusCode, string(body), resp.Header
+		}
+
+		// b asks a, with the client's overrides
+		status, requestID, header := ask()
+		if status != http.StatusOK || requestID == "" {
+			t.Fatalf("Expected 200 with the request id, got %d '%s'", status, requestID)
+		}
+		if header.Get("RateLimit-Limit") != "2" || header.Get("RateLimit-Remaining") != "1" {
+			t.Fatalf("Expected the rate limit status of the owner, got %v", header)
+		}
+		if status, _, _ := ask(); status != http.StatusOK {
+			t.Fatalf("Expected the second request to be approved, got %d", status)
+		}
+		if status, _, header := ask(); status != http.StatusTooManyRequests || header.Get("Retry-After") == "" {
+			t.Fatalf("Expected 429 with Retry-After, got %d %v", status, header)
+		}
+		if makeDebugRequest(b.Port, key) != "" {
+			t.Fatalf("Expected b not to have an instance of the key")
+		}
+		snapshot := limiter_api.InstanceDebugSnapshot{}
+		if err := json.Unmarshal([]byte(makeDebugRequest(a.Port, key)), &snapshot); err != nil || snapshot.NumApprovedThisWindow != 2 {
+			t.Fatalf("Expected 2 approved on the owner, got %+v, %v", snapshot, err)
+		}
+
+		// Releasing through b makes room on a
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("http://localhost:%d/rate/%s/%s", b.Port, key, requestID), nil)
+		resp, err := testClient(serverType).Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		drainBody(resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 releasing the request, got %d", resp.StatusCode)
+		}
+		if status, _, _ := ask(); status != http.StatusOK {
+			t.Fatalf("Expected a request to be approved after the release, got %d", status)
+		}
+	})
+}
+
+func TestStartApplication_clusterTopology(t *testing.T) {
+	forEachServerType(t, func(t *testing.T, serverType string) {
+
+		//goland:noinspection HttpUrlsUsage
+		urlA, urlB, urlC := "http://localhost:8983", "http://localhost:8984", "http://localhost:8982"
+		start := func(port int, instanceUrls []string) AppHandle {
+			cfg := newDefaultTestCfg(serverType)
+			cfg.Port.Default = lo.ToPtr(port)
+			cfg.InstanceUrls.Default = lo.ToPtr(instanceUrls)
+			cfg.SelfUrl.Default = lo.ToPtr(fmt.Sprintf("http://localhost:%d", port))
+			cfg.PeerHealthCheckMillis.Default = lo.ToPtr(100)
+			return StartApplication(cfg, true)
+		}
+		// b is given an instance that a doesn't know of, so the two disagree on the owners of some keys
+		a := start(8983, []string{urlA, urlB})
+		defer a.Close()
+		b := start(8984, []string{urlA, urlB, urlC})
+		defer b.Close()
+
+		view, err := cluster.NewView([]string{urlA, urlB}, hash_ring.DefaultVirtualNodes)
+		if err != nil {
+			t.Fatalf("Failed to create view: %v", err)
+		}
+		key := ""
+		for i := 0; key == ""; i++ {
+			if owner, _ := view.Route(fmt.Sprintf("topology-%d", i)); owner.String() == urlA {
+				key = fmt.Sprintf("topology-%d", i)
+			}
+		}
+		if !makeTestRequestClient(a.Port, key, false, testClient(serverType)) {
+			t.Fatalf("Expected the request to be approved")
+		}
+
+		getJson := func(port int, path string, result any) int {
+			resp, err := testClient(serverType).Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			if err != nil {
+				t.Fatalf("Failed to get %s: %v", path, err)
+			}
+			defer drainBody(resp)
+			_ = json.NewDecoder(resp.Body).Decode(result)
+			return resp.StatusCode
+		}
+
+		// a sees b's ring and number of keys, after the health checks
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status := &endpoints2.ClusterStatusResponse{}
+			getJson(a.Port, "/cluster", status)
+			members := lo.SliceToMap(status.Members, func(m endpoints2.ClusterMemberStatus) (string, endpoints2.ClusterMemberStatus) { return m.Url, m })
+			if !status.RingsAgree && status.RingVersion == 1 && status.RingHash == view.Ring.Fingerprint() &&
+				status.NumKeys == 1 && members[urlA].Self && members[urlA].NumKeys == 1 &&
+				members[urlB].RingHash != "" && members[urlB].RingHash != status.RingHash && members[urlB].NumKeys == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected a to see that b has another ring, got %+v", status)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		owner := &endpoints2.ClusterOwnerResponse{}
+		if status := getJson(b.Port, "/cluster/owner/"+key, owner); status != http.StatusOK {
+			t.Fatalf("Expected 200 for the owner of the key, got %d", status)
+		}
+		bView, _ := cluster.NewView([]string{urlA, urlB, urlC}, hash_ring.DefaultVirtualNodes)
+		expectedOwner, _ := bView.Route(key)
+		if owner.Key != key || owner.Owner != expectedOwner.String() || owner.DecidedBy != owner.Owner || owner.Self != (owner.Owner == urlB) {
+			t.Fatalf("Expected b to name the owner on its own ring, %s, got %+v", expectedOwner, owner)
+		}
+
+		owner = &endpoints2.ClusterOwnerResponse{}
+		getJson(a.Port, "/cluster/owner/"+key, owner)
+		if owner.Owner != urlA || !owner.Self || !owner.Healthy || len(owner.Replicas) != 0 || owner.Split {
+			t.Fatalf("Expected a to own the key, got %+v", owner)
+		}
+	})
 }
@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const buffer = 10_000 // decisions waiting to be written before dropping
+
+// Decision is a rate limiting decision, as written to the audit log (one json object per line)
+type Decision struct {
+	Time                 time.Time
+	Key                  string
+	Decision             string // approved, denied or client-gave-up
+	RequestID            string
+	CorrelationID        string
+	Pattern              string // the config file pattern matching the key, see metrics.NoPattern
+	QueueWaitMillis      int64  // 0 if never queued
+	MaxRequestsPerWindow int
+	MaxRequestsInQueue   int
+	WindowMillis         int
+}
+
+// Log writes decisions to its sink in the background. Recording never blocks:
+// decisions are dropped, and counted, if the sink doesn't keep up.
+type Log struct {
+	mutex     sync.RWMutex
+	closed    bool // guarded by mutex
+	decisions chan *Decision
+	dropped   atomic.Int64
+	done      chan struct{}
+}
+
+// Open opens the audit log sink: "stdout", or a file rotated when it reaches maxSizeMb,
+// keeping maxFiles rotated files. An empty sink returns nil, for no audit log.
+func Open(sink string, maxSizeMb int, maxFiles int) (*Log, error) {
+	switch sink {
+	case "":
+		return nil, nil
+	case "stdout":
+		return New(nopCloser{os.Stdout}), nil
+	default:
+		file, err := OpenRotatingFile(sink, int64(maxSizeMb)*1024*1024, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		return New(file), nil
+	}
+}
+
+// New writes decisions to out, and closes it when the log is closed
+func New(out io.WriteCloser) *Log {
+	l := &Log{
+		decisions: make(chan *Decision, buffer),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		defer func() { _ = out.Close() }()
+		encoder := json.NewEncoder(out)
+		for decision := range l.decisions {
+			if err := encoder.Encode(decision); err != nil {
+				slog.Error(fmt.Sprintf("Failed to write audit log: %v", err))
+			}
+		}
+	}()
+	return l
+}
+
+// Record passes a decision to the sink, without waiting for it to be written
+func (l *Log) Record(decision *Decision) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.closed {
+		return // limiter instances may still be stopping
+	}
+	select {
+	case l.decisions <- decision:
+	default:
+		if l.dropped.Add(1)%1000 == 1 {
+			slog.Warn(fmt.Sprintf("Audit log sink doesn't keep up, %d decisions dropped so far", l.dropped.Load()))
+		}
+	}
+}
+
+// Dropped returns the number of decisions dropped so far, because the sink didn't keep up
+func (l *Log) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// Close writes the remaining decisions and closes the sink. Decisions recorded after are discarded.
+func (l *Log) Close() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.decisions)
+	}
+	l.mutex.Unlock()
+	<-l.done
+}
+
+// ForPattern returns what limiter instances of keys matching a config file pattern record to the log.
+// Nil if there is no log.
+func (l *Log) ForPattern(pattern string, sampleRate float64) *KeyAudit {
+	if l == nil {
+		return nil
+	}
+	return &KeyAudit{log: l, Pattern: pattern, SampleRate: sampleRate}
+}
+
+// KeyAudit records the decisions of keys matching a pattern, a sample of them
+type KeyAudit struct {
+	log        *Log
+	Pattern    string
+	SampleRate float64 // 0 to 1
+}
+
+// Sampled returns true if a decision should be recorded. Always false for nil.
+func (k *KeyAudit) Sampled() bool {
+	return k != nil && (k.SampleRate >= 1 || rand.Float64() < k.SampleRate)
+}
+
+// Record records a decision, with the pattern filled in. Use Sampled first.
+func (k *KeyAudit) Record(decision *Decision) {
+	decision.Pattern = k.Pattern
+	k.log.Record(decision)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
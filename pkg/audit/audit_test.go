@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLog_writesDecisionsAsJsonLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path, 1, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyAudit := log.ForPattern("^user-", 1)
+	for _, decision := range []string{"approved", "denied"} {
+		if !keyAudit.Sampled() {
+			t.Fatalf("expected a sample rate of 1 to sample all decisions")
+		}
+		keyAudit.Record(&Decision{Key: "user-1", Decision: decision, RequestID: "1", MaxRequestsPerWindow: 10})
+	}
+	log.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+	var decisions []*Decision
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		decision := &Decision{}
+		if err := json.Unmarshal(scanner.Bytes(), decision); err != nil {
+			t.Fatalf("expected json lines, got '%s': %v", scanner.Text(), err)
+		}
+		decisions = append(decisions, decision)
+	}
+	if len(decisions) != 2 || decisions[1].Decision != "denied" || decisions[1].Pattern != "^user-" || decisions[1].MaxRequestsPerWindow != 10 {
+		t.Fatalf("unexpected decisions: %+v", decisions)
+	}
+}
+
+func TestKeyAudit_Sampled(t *testing.T) {
+	var none *KeyAudit
+	if none.Sampled() {
+		t.Fatalf("expected nothing to be sampled without a log")
+	}
+	if (&KeyAudit{SampleRate: 0}).Sampled() {
+		t.Fatalf("expected nothing to be sampled with a sample rate of 0")
+	}
+	sampled := 0
+	half := &KeyAudit{SampleRate: 0.5}
+	for i := 0; i < 10_000; i++ {
+		if half.Sampled() {
+			sampled++
+		}
+	}
+	if sampled < 4_000 || sampled > 6_000 {
+		t.Fatalf("expected about half to be sampled, got %d of 10000", sampled)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_ = file.Close()
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, content := range expected {
+		data, err := os.ReadFile(p)
+		if err != nil || string(data) != content {
+			t.Fatalf("expected '%s' in %s, got '%s' (%v)", strings.TrimSpace(content), p, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 rotated files")
+	}
+
+	// Reopening appends, and counts the existing size
+	file, err = OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _ = file.Write([]byte("fifth\n"))
+	_ = file.Close()
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "fourth\n" {
+		t.Fatalf("expected the reopened file to be rotated, got '%s'", data)
+	}
+}
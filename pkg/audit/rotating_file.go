@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+)
+
+// RotatingFile is a file that is rotated when it reaches a max size: path is renamed to path.1,
+// path.1 to path.2 and so on, up to path.<maxFiles>, which is removed. Not safe for concurrent use.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("max size of %s must be > 0, got %d", path, maxSize)
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("max files of %s must be >= 0, got %d", path, maxFiles)
+	}
+	f := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat %s: %w", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p doesn't fit. Writes larger than the
+// max size get a file of their own.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", f.path, err)
+	}
+	if f.maxFiles == 0 {
+		_ = os.Remove(f.path)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)) // may not exist yet
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate %s: %w", f.path, err)
+		}
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	return f.file.Close()
+}
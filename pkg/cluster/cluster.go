@@ -0,0 +1,224 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/kivra/gocc/pkg/hash_ring"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// View is the membership of the cluster at some point in time. Views are never modified once they are
+// current, a new one replaces the current one when the members change.
+type View struct {
+	Instances []*url.URL // without ?weight=
+	Ring      *hash_ring.Ring
+	Self      int    // index of this instance in Instances, -1 if it isn't one of them
+	Version   uint64 // counts the views of a membership, starting at 1. Only comparable on the same instance
+	Since     time.Time
+}
+
+// NewView parses instance urls, which may carry a ?weight=, into a view
+func NewView(instanceUrls []string, virtualNodes int) (*View, error) {
+	instances := make([]*url.URL, 0, len(instanceUrls))
+	members := make([]hash_ring.Member, 0, len(instanceUrls))
+	for _, instanceUrl := range instanceUrls {
+		instanceUrl = strings.TrimSpace(instanceUrl)
+		if len(instanceUrl) == 0 {
+			return nil, fmt.Errorf("instance url '%s' is empty", instanceUrl)
+		}
+		parsedUrl, err := url.Parse(instanceUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance url: '%v'", instanceUrl)
+		}
+		if !parsedUrl.IsAbs() {
+			return nil, fmt.Errorf("instance url '%s' is not absolute. Only absolute urls are supported", instanceUrl)
+		}
+		// ?weight=2 gives an instance twice the share of keys
+		parsedUrl, member, err := hash_ring.UrlMember(parsedUrl)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, parsedUrl)
+		members = append(members, member)
+	}
+	ring, err := hash_ring.New(members, virtualNodes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance urls: %w", err)
+	}
+	return &View{Instances: instances, Ring: ring, Self: -1, Since: time.Now()}, nil
+}
+
+// Route returns the instance owning a key, and whether that is this instance. Keys are local when
+// there are no instances, so that they are served here until discovery has found the instances.
+func (v *View) Route(key string) (owner *url.URL, local bool) {
+	index := v.Ring.Owner(key)
+	if index < 0 {
+		return nil, true
+	}
+	return v.Instances[index], index == v.Self
+}
+
+// Successors returns up to n instances that a key moves to, in order, if its owner is removed. These are
+// the instances that keep replicas of the key's state.
+func (v *View) Successors(key string, n int) []*url.URL {
+	var result []*url.URL
+	for _, index := range v.Ring.Owners(key, n+1)[1:] {
+		result = append(result, v.Instances[index])
+	}
+	return result
+}
+
+// RouteWithFailover is like Route, but if the owner isn't healthy, the key goes to the first of its
+// replicas successors that is, as when the owner is removed. Returns the owner if none of them is healthy.
+func (v *View) RouteWithFailover(key string, replicas int, healthy func(instance *url.URL) bool) (owner *url.URL, local bool) {
+	owner, local = v.Route(key)
+	if local || replicas == 0 || healthy(owner) {
+		return owner, local
+	}
+	for _, successor := range v.Successors(key, replicas) {
+		if successor == v.SelfUrl() {
+			return successor, true
+		}
+		if healthy(successor) {
+			return successor, false
+		}
+	}
+	return owner, false
+}
+
+// SelfUrl returns the url of this instance, nil if it isn't one of the instances
+func (v *View) SelfUrl() *url.URL {
+	if v.Self < 0 {
+		return nil
+	}
+	return v.Instances[v.Self]
+}
+
+// Members returns the ring members, i.e. the instance urls and weights, sorted by url
+func (v *View) Members() []hash_ring.Member {
+	members := v.Ring.Members()
+	slices.SortFunc(members, func(a, b hash_ring.Member) int { return strings.Compare(a.Name, b.Name) })
+	return members
+}
+
+// Membership is the current view of the cluster, which discovery replaces as instances come and go
+type Membership struct {
+	view         atomic.Pointer[View]
+	virtualNodes int
+	isSelf       func(instance *url.URL) bool
+
+	mutex        sync.Mutex                  // serializes updates
+	requireHttps bool                        // guarded by mutex
+	onChange     []func(before, after *View) // guarded by mutex
+}
+
+// NewMembership starts from the initial view. isSelf tells which of the instances is this one.
+func NewMembership(initial *View, virtualNodes int, isSelf func(instance *url.URL) bool) *Membership {
+	m := &Membership{virtualNodes: virtualNodes, isSelf: isSelf}
+	m.findSelf(initial)
+	initial.Version = 1
+	m.view.Store(initial)
+	return m
+}
+
+func (m *Membership) findSelf(view *View) {
+	view.Self = slices.IndexFunc(view.Instances, m.isSelf)
+}
+
+// View returns the current view. Use the same view for all decisions about a request.
+func (m *Membership) View() *View {
+	return m.view.Load()
+}
+
+// RequireHttps rejects instance urls that aren't https, now and in later updates. Used when tls is configured.
+func (m *Membership) RequireHttps() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := checkHttps(m.View().Instances); err != nil {
+		return err
+	}
+	m.requireHttps = true
+	return nil
+}
+
+// OnChange calls f with the previous and the new view every time the view is replaced. Updates wait
+// for f, so it should hand slow work off to a goroutine.
+func (m *Membership) OnChange(f func(before, after *View)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.onChange = append(m.onChange, f)
+}
+
+func checkHttps(instances []*url.URL) error {
+	for _, instance := range instances {
+		if instance.Scheme != "https" {
+			return fmt.Errorf("instance url '%s' must be https when tls is configured", instance.String())
+		}
+	}
+	return nil
+}
+
+// Update replaces the view if the instance urls differ from the current ones, and logs the changes.
+// Returns true if the view was replaced.
+func (m *Membership) Update(instanceUrls []string) (bool, error) {
+	view, err := NewView(instanceUrls, m.virtualNodes)
+	if err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.requireHttps {
+		if err := checkHttps(view.Instances); err != nil {
+			return false, err
+		}
+	}
+
+	current := m.View()
+	added, removed := diff(current.Members(), view.Members())
+	if len(added) == 0 && len(removed) == 0 {
+		return false, nil
+	}
+	m.findSelf(view)
+	view.Version = current.Version + 1
+	m.view.Store(view)
+	slog.Info(fmt.Sprintf("Cluster membership changed, %d instances", len(view.Instances)),
+		slog.Any("added", added),
+		slog.Any("removed", removed),
+	)
+	if view.Self < 0 {
+		slog.Warn("This instance is not one of the cluster members, all keys are forwarded to the others")
+	}
+	for _, f := range m.onChange {
+		f(current, view)
+	}
+	return true, nil
+}
+
+// diff returns the members added and removed between two sorted member lists, as "url" or "url (weight n)".
+// A member whose weight changed is both removed and added.
+func diff(before []hash_ring.Member, after []hash_ring.Member) (added []string, removed []string) {
+	describe := func(member hash_ring.Member) string {
+		if member.Weight > 1 {
+			return fmt.Sprintf("%s (weight %d)", member.Name, member.Weight)
+		}
+		return member.Name
+	}
+	for _, member := range after {
+		if !slices.Contains(before, member) {
+			added = append(added, describe(member))
+		}
+	}
+	for _, member := range before {
+		if !slices.Contains(after, member) {
+			removed = append(removed, describe(member))
+		}
+	}
+	return added, removed
+}
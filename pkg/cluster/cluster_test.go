@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kivra/gocc/pkg/hash_ring"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func mustMembership(t *testing.T, instanceUrls []string) *Membership {
+	t.Helper()
+	view, err := NewView(instanceUrls, hash_ring.DefaultVirtualNodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return NewMembership(view, hash_ring.DefaultVirtualNodes, func(instance *url.URL) bool { return instance.Host == "a:8080" })
+}
+
+func names(view *View) []string {
+	var result []string
+	for _, member := range view.Members() {
+		result = append(result, member.Name)
+	}
+	return result
+}
+
+func TestMembership_Update(t *testing.T) {
+	m := mustMembership(t, []string{"http://a:8080", "http://b:8080"})
+	initial := m.View()
+	var changes [][2]*View
+	m.OnChange(func(before, after *View) { changes = append(changes, [2]*View{before, after}) })
+
+	if changed, err := m.Update([]string{"http://b:8080", "http://a:8080"}); changed || err != nil {
+		t.Fatalf("expected the same members in another order not to change the view, got %v, %v", changed, err)
+	}
+	if m.View() != initial {
+		t.Fatalf("expected the view to be kept")
+	}
+
+	if changed, err := m.Update([]string{"http://a:8080", "http://b:8080", "http://c:8080"}); !changed || err != nil {
+		t.Fatalf("expected a new member to change the view, got %v, %v", changed, err)
+	}
+	if got := names(m.View()); !slices.Equal(got, []string{"http://a:8080", "http://b:8080", "http://c:8080"}) {
+		t.Fatalf("unexpected members %v", got)
+	}
+	if len(changes) != 1 || changes[0][0] != initial || changes[0][1] != m.View() {
+		t.Fatalf("expected one change from the initial view to the current one, got %v", changes)
+	}
+
+	if changed, _ := m.Update([]string{"http://a:8080", "http://b:8080", "http://c:8080?weight=2"}); !changed {
+		t.Fatalf("expected a new weight to change the view")
+	}
+
+	if _, err := m.Update([]string{"http://a:8080", "not a url"}); err == nil {
+		t.Fatalf("expected invalid urls to be rejected")
+	}
+	if len(m.View().Instances) != 3 || len(changes) != 2 {
+		t.Fatalf("expected invalid urls to keep the view")
+	}
+	if initial.Version != 1 || m.View().Version != 3 {
+		t.Fatalf("expected the views to be versions 1 to 3, got %d and %d", initial.Version, m.View().Version)
+	}
+}
+
+func TestMembership_RequireHttps(t *testing.T) {
+	if err := mustMembership(t, []string{"http://a:8080"}).RequireHttps(); err == nil {
+		t.Fatalf("expected http instances to be rejected")
+	}
+	m := mustMembership(t, []string{"https://a:8080"})
+	if err := m.RequireHttps(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.Update([]string{"https://a:8080", "http://b:8080"}); err == nil {
+		t.Fatalf("expected http instances to be rejected after RequireHttps")
+	}
+}
+
+func TestMembership_Refresh_keepsViewOnFailure(t *testing.T) {
+	m := mustMembership(t, []string{"http://a:8080", "http://b:8080"})
+	initial := m.View()
+
+	m.Refresh(context.Background(), func(ctx context.Context) ([]string, error) { return nil, errors.New("no dns") })
+	m.Refresh(context.Background(), func(ctx context.Context) ([]string, error) { return nil, nil })
+	if m.View() != initial {
+		t.Fatalf("expected failed and empty lookups to keep the view")
+	}
+
+	m.Refresh(context.Background(), func(ctx context.Context) ([]string, error) { return []string{"http://a:8080"}, nil })
+	if got := names(m.View()); !slices.Equal(got, []string{"http://a:8080"}) {
+		t.Fatalf("unexpected members %v", got)
+	}
+}
+
+func TestView_Route(t *testing.T) {
+	empty := mustMembership(t, nil).View()
+	if owner, local := empty.Route("key"); owner != nil || !local {
+		t.Fatalf("expected keys to be local without instances, got %v, %v", owner, local)
+	}
+
+	view := mustMembership(t, []string{"http://b:8080", "http://a:8080?weight=2"}).View()
+	if view.SelfUrl().String() != "http://a:8080" {
+		t.Fatalf("expected this instance to be http://a:8080, got %v", view.SelfUrl())
+	}
+	for i := 0; i < 100; i++ {
+		owner, local := view.Route(fmt.Sprintf("key-%d", i))
+		if owner == nil || owner.RawQuery != "" {
+			t.Fatalf("expected an owner without the weight, got %v", owner)
+		}
+		if local != (owner.Host == "a:8080") {
+			t.Fatalf("expected keys of http://a:8080 only to be local, got %v for %v", local, owner)
+		}
+	}
+
+	// The view of a membership update knows this instance too
+	m := mustMembership(t, []string{"http://b:8080"})
+	if m.View().SelfUrl() != nil {
+		t.Fatalf("expected this instance not to be a member")
+	}
+	_, _ = m.Update([]string{"http://b:8080", "http://a:8080"})
+	if m.View().SelfUrl() == nil {
+		t.Fatalf("expected this instance to be a member after the update")
+	}
+}
+
+func TestView_RouteWithFailover(t *testing.T) {
+	view := mustMembership(t, []string{"http://a:8080", "http://b:8080", "http://c:8080"}).View()
+	down := map[string]bool{}
+	healthy := func(instance *url.URL) bool { return !down[instance.Host] }
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner, local := view.Route(key)
+		successors := view.Successors(key, 2)
+		if len(successors) != 2 || successors[0] == owner || successors[1] == owner {
+			t.Fatalf("expected the 2 other instances as successors of %s, got %v", key, successors)
+		}
+		if failover, _ := view.RouteWithFailover(key, 2, healthy); failover != owner {
+			t.Fatalf("expected %s to stay with its owner while it is healthy, got %v", key, failover)
+		}
+
+		if local {
+			continue // this instance is never down
+		}
+
+		down[owner.Host] = true
+		failover, local := view.RouteWithFailover(key, 2, healthy)
+		if failover != successors[0] || local != (successors[0].Host == "a:8080") {
+			t.Fatalf("expected %s to fail over to %v, got %v, %v", key, successors[0], failover, local)
+		}
+		if failover, _ := view.RouteWithFailover(key, 0, healthy); failover != owner {
+			t.Fatalf("expected no failover without replicas, got %v", failover)
+		}
+		down[successors[0].Host] = true
+		if failover, _ := view.RouteWithFailover(key, 1, healthy); failover != owner && successors[0].Host != "a:8080" {
+			t.Fatalf("expected the owner when no replica is healthy, got %v", failover)
+		}
+		clear(down)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances")
+	if _, err := FileSource(path)(context.Background()); err == nil {
+		t.Fatalf("expected a missing file to be an error")
+	}
+	if err := os.WriteFile(path, []byte("# instances\nhttp://a:8080\n\n  http://b:8080  \n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	urls, err := FileSource(path)(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(urls, []string{"http://a:8080", "http://b:8080"}) {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+}
@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DiscoveryDns  = "dns"
+	DiscoveryFile = "file"
+)
+
+// Source returns the instance urls of the cluster as they are now
+type Source func(ctx context.Context) ([]string, error)
+
+// DnsSource resolves the instances from dns. SRV records of name are used if there are any, as
+// scheme://target:port. Otherwise its A/AAAA records are, as scheme://ip:port. For a kubernetes
+// headless service, name is the service name, or _<port name>._tcp.<service name> for SRV records.
+func DnsSource(name string, scheme string, port int) Source {
+	return func(ctx context.Context) ([]string, error) {
+		var urls []string
+		if _, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name); err == nil && len(records) > 0 {
+			for _, record := range records {
+				target := strings.TrimSuffix(record.Target, ".")
+				urls = append(urls, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(target, strconv.Itoa(int(record.Port)))))
+			}
+		} else {
+			ips, err := net.DefaultResolver.LookupHost(ctx, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+			}
+			for _, ip := range ips {
+				urls = append(urls, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip, strconv.Itoa(port))))
+			}
+		}
+		slices.Sort(urls)
+		return slices.Compact(urls), nil
+	}
+}
+
+// FileSource reads the instances from a file, one instance url per line. Empty lines and lines
+// starting with # are skipped. Works well with a mounted kubernetes config map.
+func FileSource(path string) Source {
+	return func(ctx context.Context) ([]string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var urls []string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				urls = append(urls, line)
+			}
+		}
+		return urls, nil
+	}
+}
+
+// Follow updates the membership from source every interval, until stop is called. Failed lookups and
+// empty results keep the current view, so that a dns hiccup doesn't move all keys.
+func (m *Membership) Follow(source Source, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			m.Refresh(ctx, source)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Refresh updates the membership from source once
+func (m *Membership) Refresh(ctx context.Context, source Source) {
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	urls, err := source(lookupCtx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Warn(fmt.Sprintf("Cluster discovery failed, keeping the current members: %v", err))
+		}
+		return
+	}
+	if len(urls) == 0 {
+		slog.Warn("Cluster discovery found no instances, keeping the current members")
+		return
+	}
+	if _, err := m.Update(urls); err != nil {
+		slog.Warn(fmt.Sprintf("Cluster discovery found invalid instances, keeping the current members: %v", err))
+	}
+}
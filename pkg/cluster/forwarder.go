@@ -0,0 +1,25 @@
+package cluster
+
+import (
+	"context"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"net/url"
+)
+
+// Forwarder asks the owners of keys for decisions, over connections kept open to them, on behalf of
+// clients that this instance has already authorized. Errors mean that the owner couldn't be reached,
+// or didn't decide, e.g. because it rejected the overrides.
+type Forwarder interface {
+	// Ask asks the owner for permission to make a request on a key. The request id is only set if approved.
+	Ask(
+		ctx context.Context,
+		owner *url.URL,
+		key string,
+		canWait bool,
+		maxRequests int,
+		maxRequestsInQueue int,
+	) (*limiter_api.PermissionResponse, string, error)
+
+	// Release releases a request approved by the owner
+	Release(ctx context.Context, owner *url.URL, key string, requestID string) error
+}
@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/kivra/gocc/pkg/metrics"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnhealthyAfter is the number of failed health checks in a row after which an instance is considered down.
+// A single successful check brings it back up.
+const UnhealthyAfter = 2
+
+// PeerHealth is the health of another instance, as this instance sees it, and what it last reported about itself
+type PeerHealth struct {
+	Url                 string
+	Healthy             bool
+	Since               time.Time // when Healthy last changed
+	ConsecutiveFailures int
+	LastError           string `json:",omitempty"`
+	RingHash            string `json:",omitempty"` // the fingerprint of the instance's ring, see hash_ring.Ring
+	NumKeys             int    // the keys that the instance has limiters for
+}
+
+// PeerReport is what an instance reports about itself when it is checked. Empty if it doesn't.
+type PeerReport struct {
+	RingHash string
+	NumKeys  int
+}
+
+// Probe checks the health of an instance, e.g. with GET /healthz
+type Probe func(ctx context.Context, instance *url.URL) (PeerReport, error)
+
+// HealthChecker checks the other members of the cluster periodically, so that requests on keys owned
+// by an instance that is down can be decided without waiting for it to time out
+type HealthChecker struct {
+	membership *Membership
+	probe      Probe
+
+	mutex sync.RWMutex
+	peers map[string]*PeerHealth // by instance url
+	onUp  []func(instance *url.URL)
+}
+
+func NewHealthChecker(membership *Membership, probe Probe) *HealthChecker {
+	return &HealthChecker{membership: membership, probe: probe, peers: map[string]*PeerHealth{}}
+}
+
+// Healthy returns false if the instance is known to be down. Instances that haven't been checked yet
+// are assumed to be up. A nil checker considers all instances healthy.
+func (h *HealthChecker) Healthy(instance *url.URL) bool {
+	if h == nil {
+		return true
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	peer, ok := h.peers[instance.String()]
+	return !ok || peer.Healthy
+}
+
+// Peers returns the health of the other members, sorted by url
+func (h *HealthChecker) Peers() []PeerHealth {
+	if h == nil {
+		return nil
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	result := make([]PeerHealth, 0, len(h.peers))
+	for _, peer := range h.peers {
+		result = append(result, *peer)
+	}
+	slices.SortFunc(result, func(a, b PeerHealth) int { return strings.Compare(a.Url, b.Url) })
+	return result
+}
+
+// OnUp calls f when an instance that was down is up again
+func (h *HealthChecker) OnUp(f func(instance *url.URL)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onUp = append(h.onUp, f)
+}
+
+// Follow checks the other members every interval, until stop is called. Each check times out after the interval.
+func (h *HealthChecker) Follow(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			h.CheckAll(ctx, interval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// CheckAll checks all other members of the current view once, in parallel
+func (h *HealthChecker) CheckAll(ctx context.Context, timeout time.Duration) {
+	view := h.membership.View()
+
+	var peers []*url.URL
+	for i, instance := range view.Instances {
+		if i != view.Self {
+			peers = append(peers, instance)
+		}
+	}
+	h.forgetAllBut(peers)
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			report, err := h.probe(checkCtx, peer)
+			if ctx.Err() == nil {
+				for _, f := range h.record(peer, view, report, err) {
+					f(peer)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// record records the outcome of a check, and returns the callbacks to call if the instance is up again
+func (h *HealthChecker) record(instance *url.URL, view *View, report PeerReport, err error) (onUp []func(instance *url.URL)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	name := instance.String()
+	peer, ok := h.peers[name]
+	if !ok {
+		peer = &PeerHealth{Url: name, Healthy: true, Since: time.Now()}
+		h.peers[name] = peer
+	}
+
+	if err == nil {
+		if !peer.Healthy {
+			slog.Info(fmt.Sprintf("Instance %s is up again", name))
+			peer.Healthy = true
+			peer.Since = time.Now()
+			onUp = slices.Clone(h.onUp)
+		}
+		peer.ConsecutiveFailures = 0
+		peer.LastError = ""
+		checkRing(peer, view, report.RingHash)
+		peer.RingHash = report.RingHash
+		peer.NumKeys = report.NumKeys
+	} else {
+		peer.ConsecutiveFailures++
+		peer.LastError = err.Error()
+		if peer.Healthy && peer.ConsecutiveFailures >= UnhealthyAfter {
+			slog.Warn(fmt.Sprintf("Instance %s is down: %v", name, err))
+			peer.Healthy = false
+			peer.Since = time.Now()
+		}
+	}
+	metrics.PeerUp(name, peer.Healthy)
+	return onUp
+}
+
+// checkRing warns when an instance starts reporting another ring than this instance's, which means that the two
+// disagree on which instance owns some keys, e.g. because they were given different --instance-urls
+func checkRing(peer *PeerHealth, view *View, ringHash string) {
+	own := view.Ring.Fingerprint()
+	switch {
+	case ringHash == "" || ringHash == peer.RingHash:
+	case ringHash != own:
+		slog.Warn(fmt.Sprintf("Instance %s has another ring (%s) than this instance (%s), so the two forward some keys "+
+			"to different owners. Check that all instances have the same --instance-urls and --virtual-nodes",
+			peer.Url, ringHash, own))
+	case peer.RingHash != "":
+		slog.Info(fmt.Sprintf("Instance %s has the same ring as this instance again (%s)", peer.Url, own))
+	}
+}
+
+// forgetAllBut forgets instances that are no longer members, so that they start out healthy if they come back
+func (h *HealthChecker) forgetAllBut(peers []*url.URL) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for name := range h.peers {
+		if !slices.ContainsFunc(peers, func(peer *url.URL) bool { return peer.String() == name }) {
+			delete(h.peers, name)
+			metrics.PeerRemoved(name)
+		}
+	}
+}
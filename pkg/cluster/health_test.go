@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	m := mustMembership(t, []string{"http://a:8080", "http://b:8080"})
+	b, _ := url.Parse("http://b:8080")
+
+	var down atomic.Bool
+	var probed atomic.Int32
+	checker := NewHealthChecker(m, func(ctx context.Context, instance *url.URL) (PeerReport, error) {
+		if instance.Host == "a:8080" {
+			t.Errorf("expected this instance not to be checked")
+		}
+		probed.Add(1)
+		if down.Load() {
+			return PeerReport{}, errors.New("connection refused")
+		}
+		return PeerReport{RingHash: m.View().Ring.Fingerprint(), NumKeys: int(probed.Load())}, nil
+	})
+
+	var upAgain []string
+	checker.OnUp(func(instance *url.URL) { upAgain = append(upAgain, instance.String()) })
+
+	if !checker.Healthy(b) {
+		t.Fatalf("expected unchecked instances to be healthy")
+	}
+	checker.CheckAll(context.Background(), time.Second)
+	if probed.Load() != 1 || !checker.Healthy(b) {
+		t.Fatalf("expected b to be checked and healthy")
+	}
+	if peers := checker.Peers(); peers[0].RingHash != m.View().Ring.Fingerprint() || peers[0].NumKeys != 1 {
+		t.Fatalf("expected what b reported to be kept, got %+v", peers)
+	}
+
+	down.Store(true)
+	checker.CheckAll(context.Background(), time.Second)
+	if !checker.Healthy(b) {
+		t.Fatalf("expected a single failed check not to mark b as down")
+	}
+	checker.CheckAll(context.Background(), time.Second)
+	if checker.Healthy(b) {
+		t.Fatalf("expected b to be down after %d failed checks", UnhealthyAfter)
+	}
+	if peers := checker.Peers(); len(peers) != 1 || peers[0].Healthy || peers[0].ConsecutiveFailures != 2 || peers[0].LastError == "" {
+		t.Fatalf("unexpected peers %+v", peers)
+	}
+
+	down.Store(false)
+	checker.CheckAll(context.Background(), time.Second)
+	if !checker.Healthy(b) || len(upAgain) != 1 || upAgain[0] != "http://b:8080" {
+		t.Fatalf("expected b to be up again after a successful check, and to be told once, got %v", upAgain)
+	}
+
+	// Instances that leave are forgotten
+	_, _ = m.Update([]string{"http://a:8080", "http://c:8080"})
+	checker.CheckAll(context.Background(), time.Second)
+	if peers := checker.Peers(); len(peers) != 1 || peers[0].Url != "http://c:8080" {
+		t.Fatalf("unexpected peers %+v", peers)
+	}
+
+	var nilChecker *HealthChecker
+	if !nilChecker.Healthy(b) {
+		t.Fatalf("expected a nil checker to consider all instances healthy")
+	}
+}
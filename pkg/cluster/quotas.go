@@ -0,0 +1,167 @@
+package cluster
+
+import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"sync"
+	"time"
+)
+
+// Quotas are the requests of split keys that this instance has borrowed from the keys' owners, and approves
+// on its own. A nil Quotas keeps nothing.
+type Quotas struct {
+	mutex sync.Mutex
+	keys  map[string]*quota
+}
+
+type quota struct {
+	borrowing *borrowCall // the loan being borrowed for the key, if any
+	tokens    int         // borrowed requests left
+	loan      limiter_api.Loan
+	expiresAt time.Time // when the window of the loans ends, by the clock of this instance
+	used      bool      // since the last Reclaim
+}
+
+// borrowCall is a loan being borrowed, whose outcome the requests waiting for it share
+type borrowCall struct {
+	done    chan struct{} // closed when the loan has been borrowed, or failed
+	granted int
+	err     error
+}
+
+func NewQuotas() *Quotas {
+	return &Quotas{keys: map[string]*quota{}}
+}
+
+// Take approves a request on a key with a borrowed request, if there is one left. The status is the key's,
+// as far as this instance knows it.
+func (q *Quotas) Take(key string) (limiter_api.LimitStatus, bool) {
+	if q == nil {
+		return limiter_api.LimitStatus{}, false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.take(q.keys[key])
+}
+
+// Borrow approves a request like Take, after borrowing more requests with borrow if none are left. One request
+// per key borrows at a time, the others wait for its loan, or share its error. Not approved if the owner has
+// nothing left to lend.
+func (q *Quotas) Borrow(key string, borrow func() (*limiter_api.Loan, error)) (limiter_api.LimitStatus, bool, error) {
+	if q == nil {
+		return limiter_api.LimitStatus{}, false, nil
+	}
+	for {
+		q.mutex.Lock()
+		entry, ok := q.keys[key]
+		if !ok {
+			entry = &quota{}
+			q.keys[key] = entry
+		}
+		if status, ok := q.take(entry); ok {
+			q.mutex.Unlock()
+			return status, true, nil
+		}
+		call := entry.borrowing
+		if call == nil {
+			call = &borrowCall{done: make(chan struct{})}
+			entry.borrowing = call
+			q.mutex.Unlock()
+			return q.borrow(key, entry, call, borrow)
+		}
+		q.mutex.Unlock()
+
+		<-call.done
+		if call.err != nil {
+			return limiter_api.LimitStatus{}, false, call.err
+		}
+		if call.granted == 0 {
+			q.mutex.Lock()
+			status := entry.status()
+			q.mutex.Unlock()
+			return status, false, nil
+		}
+		// The loan was used up by the others waiting for it, borrow again
+	}
+}
+
+// borrow makes the call that borrows more requests for a key, and approves a request with them
+func (q *Quotas) borrow(key string, entry *quota, call *borrowCall, borrow func() (*limiter_api.Loan, error)) (limiter_api.LimitStatus, bool, error) {
+	defer close(call.done)
+
+	loan, err := borrow()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	entry.borrowing = nil
+	if err != nil {
+		call.err = err
+		return limiter_api.LimitStatus{}, false, err
+	}
+	call.granted = loan.Granted
+	expiresAt := time.Now().Add(time.Duration(loan.ResetAfterMillis) * time.Millisecond)
+	if time.Now().After(entry.expiresAt) || expiresAt.Sub(entry.expiresAt) > time.Duration(loan.WindowMillis)*time.Millisecond/2 {
+		entry.tokens = 0 // of an earlier window of the owner
+	}
+	entry.tokens += loan.Granted
+	entry.loan = *loan
+	entry.expiresAt = expiresAt
+	q.keys[key] = entry // in case Reclaim forgot it meanwhile
+	status, approved := q.take(entry)
+	if !approved {
+		status = entry.status()
+	}
+	return status, approved, nil
+}
+
+// Reclaim takes back the borrowed requests of keys that haven't been used since the last Reclaim, to be repaid
+// to their owners, so that other instances can borrow them. Keys whose loans have expired are forgotten.
+func (q *Quotas) Reclaim() map[string]int {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+	unused := map[string]int{}
+	for key, entry := range q.keys {
+		switch {
+		case now.After(entry.expiresAt):
+			delete(q.keys, key)
+		case !entry.used && entry.tokens > 0:
+			unused[key] = entry.tokens
+			entry.tokens = 0
+		}
+		entry.used = false
+	}
+	return unused
+}
+
+// Len returns the number of keys with loans, including ones that have expired but haven't been forgotten yet
+func (q *Quotas) Len() int {
+	if q == nil {
+		return 0
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.keys)
+}
+
+// take approves a request with a borrowed request, if there is one. Must be called with the mutex held.
+func (q *Quotas) take(entry *quota) (limiter_api.LimitStatus, bool) {
+	if entry == nil || entry.tokens <= 0 || time.Now().After(entry.expiresAt) {
+		return limiter_api.LimitStatus{}, false
+	}
+	entry.tokens--
+	entry.used = true
+	return entry.status(), true
+}
+
+// status is the limit status of the key, counting what is left at the owner and here as not approved
+func (entry *quota) status() limiter_api.LimitStatus {
+	return limiter_api.LimitStatus{
+		MaxRequestsPerWindow:  entry.loan.MaxRequestsPerWindow,
+		NumApprovedThisWindow: max(0, entry.loan.MaxRequestsPerWindow-entry.loan.Remaining-entry.tokens),
+		WindowMillis:          entry.loan.WindowMillis,
+		WindowResetsAt:        entry.expiresAt,
+	}
+}
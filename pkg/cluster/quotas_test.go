@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	quotas := NewQuotas()
+	if _, ok := quotas.Take("hot"); ok {
+		t.Fatalf("expected nothing to take before borrowing")
+	}
+
+	// Concurrent requests share one loan
+	var numLoans atomic.Int32
+	lend := func() (*limiter_api.Loan, error) {
+		numLoans.Add(1)
+		return &limiter_api.Loan{Key: "hot", Granted: 5, MaxRequestsPerWindow: 40, WindowMillis: 60_000, Remaining: 30, ResetAfterMillis: 50_000}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, approved, err := quotas.Borrow("hot", lend); !approved || err != nil {
+				t.Errorf("expected the request to be approved, got %v %v", approved, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if numLoans.Load() != 1 {
+		t.Fatalf("expected one loan for 5 requests, got %d", numLoans.Load())
+	}
+	status, approved, _ := quotas.Borrow("hot", lend)
+	if !approved || numLoans.Load() != 2 || status.MaxRequestsPerWindow != 40 || status.Remaining() != 34 {
+		t.Fatalf("expected a second loan, got %+v %v", status, approved)
+	}
+
+	// Nothing left to lend
+	status, approved, _ = quotas.Borrow("cold", func() (*limiter_api.Loan, error) {
+		return &limiter_api.Loan{Key: "cold", MaxRequestsPerWindow: 10, WindowMillis: 60_000, ResetAfterMillis: 50_000}, nil
+	})
+	if approved || status.Remaining() != 0 || status.MaxRequestsPerWindow != 10 {
+		t.Fatalf("expected the request to be denied, got %+v %v", status, approved)
+	}
+	if _, approved, err := quotas.Borrow("failing", func() (*limiter_api.Loan, error) { return nil, fmt.Errorf("down") }); approved || err == nil {
+		t.Fatalf("expected the failed loan to be passed on")
+	}
+
+	// Requests waiting for a loan that fails share its error, rather than borrowing again one after another
+	var numFailing atomic.Int32
+	started := make(chan struct{})
+	fail := make(chan struct{})
+	failing := func() (*limiter_api.Loan, error) {
+		if numFailing.Add(1) == 1 {
+			close(started)
+		}
+		<-fail
+		return nil, fmt.Errorf("down")
+	}
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, _, err := quotas.Borrow("failing", failing)
+			errs <- err
+		}()
+	}
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(fail)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err == nil {
+			t.Fatalf("expected the failed loan to be passed on to all requests")
+		}
+	}
+	if numFailing.Load() != 1 {
+		t.Fatalf("expected one failed loan for 5 requests, got %d", numFailing.Load())
+	}
+
+	// Unused requests are reclaimed, used ones only once they haven't been used since the last time
+	if unused := quotas.Reclaim(); len(unused) != 0 {
+		t.Fatalf("expected nothing unused yet, got %v", unused)
+	}
+	if unused := quotas.Reclaim(); len(unused) != 1 || unused["hot"] != 4 {
+		t.Fatalf("expected the 4 requests left of hot to be reclaimed, got %v", unused)
+	}
+	if _, ok := quotas.Take("hot"); ok {
+		t.Fatalf("expected nothing left of hot after reclaiming it")
+	}
+
+	// Expired loans are forgotten
+	quotas.Borrow("ending", func() (*limiter_api.Loan, error) {
+		return &limiter_api.Loan{Key: "ending", Granted: 2, MaxRequestsPerWindow: 10, WindowMillis: 60_000, ResetAfterMillis: 0}, nil
+	})
+	if _, ok := quotas.Take("ending"); ok {
+		t.Fatalf("expected an expired loan not to approve anything")
+	}
+	quotas.Reclaim()
+	if quotas.Len() != 2 {
+		t.Fatalf("expected hot and cold to be kept, got %d", quotas.Len())
+	}
+
+	var none *Quotas
+	if _, ok := none.Take("hot"); ok || none.Reclaim() != nil || none.Len() != 0 {
+		t.Fatalf("expected a nil Quotas to keep nothing")
+	}
+}
@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"sync"
+	"time"
+)
+
+// Replicas are copies of the state of keys owned by other instances, kept in case their owner fails.
+// A nil Replicas keeps nothing.
+type Replicas struct {
+	mutex     sync.Mutex
+	keys      map[string]*replica
+	lastSweep time.Time
+}
+
+type replica struct {
+	owner    string
+	state    limiter_api.KeyState
+	resetsAt time.Time // when the window of the state ends, by the clock of this instance
+}
+
+func NewReplicas() *Replicas {
+	return &Replicas{keys: map[string]*replica{}, lastSweep: time.Now()}
+}
+
+// Put stores the states of keys sent by their owner, replacing earlier ones. Replicas whose windows
+// have ended are dropped along the way.
+func (r *Replicas) Put(owner string, states []*limiter_api.KeyState) {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, state := range states {
+		r.keys[state.Key] = &replica{
+			owner:    owner,
+			state:    *state,
+			resetsAt: now.Add(time.Duration(state.ResetAfterMillis) * time.Millisecond),
+		}
+	}
+	if now.Sub(r.lastSweep) > time.Second {
+		for key, replica := range r.keys {
+			if !replica.resetsAt.After(now) {
+				delete(r.keys, key)
+			}
+		}
+		r.lastSweep = now
+	}
+}
+
+// Take removes the replica of a key, and returns its state with the time left of its window as of now.
+// Returns nil if there is none, or if its window has ended.
+func (r *Replicas) Take(key string) *limiter_api.KeyState {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	replica, ok := r.keys[key]
+	delete(r.keys, key)
+	r.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return replica.current()
+}
+
+// TakeAll removes the replicas of the keys of an owner that match, and returns their states, e.g. for the owner
+// to continue their windows after a restart
+func (r *Replicas) TakeAll(owner string, matches func(key string) bool) []*limiter_api.KeyState {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var result []*limiter_api.KeyState
+	for key, replica := range r.keys {
+		if replica.owner == owner && matches(key) {
+			delete(r.keys, key)
+			if state := replica.current(); state != nil {
+				result = append(result, state)
+			}
+		}
+	}
+	return result
+}
+
+// Len returns the number of replicas kept, including ones whose windows have ended but haven't been dropped yet
+func (r *Replicas) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.keys)
+}
+
+// current returns the state with the time left of its window as of now, nil if the window has ended
+func (r *replica) current() *limiter_api.KeyState {
+	resetAfter := time.Until(r.resetsAt)
+	if resetAfter <= 0 {
+		return nil
+	}
+	state := r.state
+	state.ResetAfterMillis = int(resetAfter.Milliseconds())
+	return &state
+}
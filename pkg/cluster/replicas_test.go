@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"testing"
+	"time"
+)
+
+func TestReplicas(t *testing.T) {
+	replicas := NewReplicas()
+	replicas.Put("http://a:8080", []*limiter_api.KeyState{
+		{Key: "x", WindowMillis: 60_000, NumApprovedThisWindow: 1, ResetAfterMillis: 60_000},
+		{Key: "y", WindowMillis: 60_000, NumApprovedThisWindow: 2, ResetAfterMillis: 60_000},
+		{Key: "ending", WindowMillis: 60_000, NumApprovedThisWindow: 3, ResetAfterMillis: 10},
+	})
+	replicas.Put("http://b:8080", []*limiter_api.KeyState{
+		{Key: "z", WindowMillis: 60_000, NumApprovedThisWindow: 4, ResetAfterMillis: 60_000},
+	})
+	// Later states replace earlier ones
+	replicas.Put("http://a:8080", []*limiter_api.KeyState{
+		{Key: "x", WindowMillis: 60_000, NumApprovedThisWindow: 5, ResetAfterMillis: 50_000},
+	})
+	if replicas.Len() != 4 {
+		t.Fatalf("expected 4 replicas, got %d", replicas.Len())
+	}
+
+	state := replicas.Take("x")
+	if state == nil || state.NumApprovedThisWindow != 5 || state.ResetAfterMillis > 50_000 || state.ResetAfterMillis < 49_000 {
+		t.Fatalf("expected the latest state of x, got %+v", state)
+	}
+	if replicas.Take("x") != nil {
+		t.Fatalf("expected the replica of x to be taken")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if replicas.Take("ending") != nil {
+		t.Fatalf("expected no state for a window that has ended")
+	}
+
+	all := func(key string) bool { return true }
+	if states := replicas.TakeAll("http://a:8080", func(key string) bool { return key != "y" }); len(states) != 0 {
+		t.Fatalf("expected no replicas of a that match, got %+v", states)
+	}
+	if states := replicas.TakeAll("http://b:8080", all); len(states) != 1 || states[0].Key != "z" {
+		t.Fatalf("expected the replicas of b, got %+v", states)
+	}
+	if replicas.Len() != 1 {
+		t.Fatalf("expected only the replica of y to be left, got %d", replicas.Len())
+	}
+
+	var none *Replicas
+	if none.Take("y") != nil || none.TakeAll("http://a:8080", all) != nil || none.Len() != 0 {
+		t.Fatalf("expected a nil Replicas to keep nothing")
+	}
+}
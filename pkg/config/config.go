@@ -5,13 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/GiGurra/boa/pkg/boa"
+	"github.com/kivra/gocc/pkg/cluster"
+	"github.com/kivra/gocc/pkg/config/experimental/svc_discovery"
+	"github.com/kivra/gocc/pkg/hash_ring"
+	"github.com/kivra/gocc/pkg/keytemplate"
+	"github.com/kivra/gocc/pkg/metrics"
 	"github.com/samber/lo"
 	"log/slog"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type ServerType string
@@ -22,27 +30,82 @@ const (
 	ServerTypeFast      ServerType = "fast"
 )
 
+// Policies for requests on keys whose owner is down, see --peer-down-policy
+const (
+	PeerDownFailClosed = "fail-closed"
+	PeerDownFailOpen   = "fail-open"
+	PeerDownLocal      = "local"
+)
+
+// Transports for requests forwarded to the owners of keys, see --peer-transport
+const (
+	PeerTransportHttp   = "http"
+	PeerTransportBinary = "binary"
+)
+
 type GlobalCfg struct {
-	MaxRequests         boa.Required[int]      `default:"100"        env:"MAX_REQUESTS"           descr:"Default max requests per window per key"`
-	MaxRequestsInQueue  boa.Required[int]      `default:"400"        env:"MAX_REQUESTS_IN_QUEUE"  descr:"Default max requests in queue per key"`
-	WindowMillis        boa.Required[int]      `default:"1000"       env:"WINDOW_MILLIS"          descr:"Default size in milliseconds per window"`
-	RequestsCanSetRate  boa.Required[bool]     `default:"true"       env:"REQUESTS_CAN_SET_RATE"  descr:"Allow clients to set their own rate"`
-	RequestsCanModQueue boa.Required[bool]     `default:"true"       env:"REQUESTS_CAN_MOD_QUEUE" descr:"Allow clients to set their own queue size"`
-	ConfigFile          boa.Required[string]   `default:""           env:"CONFIG_FILE"            descr:"Path to a JSON file with key-specific rate limits"`
-	Port                boa.Required[int]      `default:"8080"       env:"PORT"                   descr:"Port to listen on"`
-	LogFormat           boa.Required[string]   `default:"json"       env:"LOG_FORMAT"             descr:"json,text,system-default"`
-	LogLevel            boa.Required[string]   `default:"INFO"       env:"LOG_LEVEL"              descr:"DEBUG,INFO,WARN,ERROR"`
-	LogIncludesSource   boa.Required[bool]     `default:"true"       env:"LOG_INCLUDES_SOURCE"    descr:"if true, log messages include the source code location"`
-	Log2xx              boa.Required[bool]     `default:"false"      env:"LOG_2XX"                descr:"if true, log 2xx responses"`
-	Log4xx              boa.Required[bool]     `default:"false"      env:"LOG_4XX"                descr:"if true, log 4xx responses. Includes rate limit exceeded responses"`
-	Log5xx              boa.Required[bool]     `default:"true"       env:"LOG_5XX"                descr:"if true, log 5xx responses"`
-	ServerType          boa.Required[string]   `default:"echo-http2" env:"SERVER_TYPE"            descr:"echo,echo-http2,fast. 'fast' is a fasthttp server, not fully implemented yet"`
-	InstanceUrls        boa.Required[[]string] `default:"[]"         env:"INSTANCE_URLS"          descr:"For distributed mode, a list of instance urls to use (incl this instance)"`
+	MaxRequests             boa.Required[int]      `default:"100"        env:"MAX_REQUESTS"           descr:"Default max requests per window per key"`
+	MaxRequestsInQueue      boa.Required[int]      `default:"400"        env:"MAX_REQUESTS_IN_QUEUE"  descr:"Default max requests in queue per key"`
+	WindowMillis            boa.Required[int]      `default:"1000"       env:"WINDOW_MILLIS"          descr:"Default size in milliseconds per window"`
+	RequestsCanSetRate      boa.Required[bool]     `default:"true"       env:"REQUESTS_CAN_SET_RATE"  descr:"Allow clients to set their own rate"`
+	RequestsCanModQueue     boa.Required[bool]     `default:"true"       env:"REQUESTS_CAN_MOD_QUEUE" descr:"Allow clients to set their own queue size"`
+	ConfigFile              boa.Required[string]   `default:""           env:"CONFIG_FILE"            descr:"Path to a JSON file with key-specific rate limits"`
+	Port                    boa.Required[int]      `default:"8080"       env:"PORT"                   descr:"Port to listen on"`
+	LogFormat               boa.Required[string]   `default:"json"       env:"LOG_FORMAT"             descr:"json,text,system-default"`
+	LogLevel                boa.Required[string]   `default:"INFO"       env:"LOG_LEVEL"              descr:"DEBUG,INFO,WARN,ERROR"`
+	LogIncludesSource       boa.Required[bool]     `default:"true"       env:"LOG_INCLUDES_SOURCE"    descr:"if true, log messages include the source code location"`
+	Log2xx                  boa.Required[bool]     `default:"false"      env:"LOG_2XX"                descr:"if true, log 2xx responses"`
+	Log4xx                  boa.Required[bool]     `default:"false"      env:"LOG_4XX"                descr:"if true, log 4xx responses. Includes rate limit exceeded responses"`
+	Log5xx                  boa.Required[bool]     `default:"true"       env:"LOG_5XX"                descr:"if true, log 5xx responses"`
+	ServerType              boa.Required[string]   `default:"echo-http2" env:"SERVER_TYPE"            descr:"echo,echo-http2,fast. 'fast' is a fasthttp server (http1 only)"`
+	InstanceUrls            boa.Required[[]string] `default:"[]"         env:"INSTANCE_URLS"          descr:"For distributed mode, a list of instance urls to use (incl this instance)"`
+	SelfUrl                 boa.Required[string]   `default:""           env:"SELF_URL"               descr:"For distributed mode, the url of this instance among the instance urls. Defaults to the one whose host is this pod's hostname or ip"`
+	EnvoyRls                boa.Required[bool]     `default:"false"      env:"ENVOY_RLS"              descr:"if true, serve the envoy.service.ratelimit.v3 gRPC API (envoy external rate limit service)"`
+	EnvoyRlsPort            boa.Required[int]      `default:"8081"       env:"ENVOY_RLS_PORT"         descr:"Port for the envoy rate limit service gRPC API"`
+	EnvoyRlsKeyTemplate     boa.Required[string]   `default:"{domain}:{entries}" env:"ENVOY_RLS_KEY_TEMPLATE" descr:"Template mapping envoy descriptors to keys. Placeholders: {domain}, {entries} (all entries as k=v,k=v), {entry:<descriptor key>}"`
+	ForwardAuthKeyTemplates boa.Required[[]string] `default:"[{client-ip}]" env:"FORWARD_AUTH_KEY_TEMPLATES" descr:"Templates building keys for /auth from forwarded headers. All resulting keys must be within limits. Placeholders: {client-ip}, {uri}, {path}, {method}, {host}, {authorization} (sha256 of the Authorization header), {header:<name>}"`
+	ForwardAuthDenyStatus   boa.Required[int]      `default:"429"           env:"FORWARD_AUTH_DENY_STATUS"   descr:"Status code returned by /auth when rate limited. nginx auth_request only accepts 401 and 403 as denials"`
+	Resp                    boa.Required[bool]     `default:"false"      env:"RESP"                   descr:"if true, serve the redis protocol (RESP) with CL.THROTTLE and GOCC.* commands"`
+	RespPort                boa.Required[int]      `default:"6379"       env:"RESP_PORT"              descr:"Port for the redis protocol (RESP) frontend"`
+	Binary                  boa.Required[bool]     `default:"false"      env:"BINARY"                 descr:"if true, serve gocc's compact binary protocol, for high throughput clients"`
+	BinaryPort              boa.Required[int]      `default:"8082"       env:"BINARY_PORT"            descr:"Port for the binary protocol"`
+	UnixSocketDir           boa.Required[string]   `default:""           env:"UNIX_SOCKET_DIR"        descr:"If set, also listen on unix domain sockets in this dir: http.sock, and <frontend>.sock for each enabled frontend (e.g. resp.sock)"`
+	UnixSocketMode          boa.Required[string]   `default:"0660"       env:"UNIX_SOCKET_MODE"       descr:"File mode (octal) of the unix domain sockets"`
+	UnixSocketOnly          boa.Required[bool]     `default:"false"      env:"UNIX_SOCKET_ONLY"       descr:"if true, only listen on unix domain sockets, not on tcp ports. Requires --unix-socket-dir"`
+	TlsCertFile             boa.Required[string]   `default:""           env:"TLS_CERT_FILE"          descr:"If set, serve tls on all tcp ports with this PEM certificate (chain). Also used as client certificate towards other instances. Reloaded on change"`
+	TlsKeyFile              boa.Required[string]   `default:""           env:"TLS_KEY_FILE"           descr:"PEM private key of --tls-cert-file. Reloaded on change"`
+	TlsClientCaFile         boa.Required[string]   `default:""           env:"TLS_CLIENT_CA_FILE"     descr:"If set, require clients to present a certificate signed by one of these PEM CAs (mTLS). Reloaded on change"`
+	TlsCaFile               boa.Required[string]   `default:""           env:"TLS_CA_FILE"            descr:"PEM CAs used to verify other instances when forwarding to https instance urls. Defaults to the system roots. Reloaded on change"`
+	AdminApi                boa.Required[bool]     `default:"false"      env:"ADMIN_API"              descr:"if true, serve the /admin endpoints for changing and resetting keys at runtime. Requires tenant auth, only admin tenants may use them"`
+	Metrics                 boa.Required[bool]     `default:"true"       env:"METRICS"                descr:"if true, serve prometheus metrics on /metrics, without tenant auth. Labelled by config file key pattern, never by key"`
+	AuditLog                boa.Required[string]   `default:""           env:"AUDIT_LOG"              descr:"If set, write rate limiting decisions as json lines to 'stdout' or to this file. Sampled per key pattern with audit_sample_rate in the config file"`
+	AuditLogMaxSizeMb       boa.Required[int]      `default:"100"        env:"AUDIT_LOG_MAX_SIZE_MB"  descr:"Size in MB at which the --audit-log file is rotated"`
+	AuditLogMaxFiles        boa.Required[int]      `default:"5"          env:"AUDIT_LOG_MAX_FILES"    descr:"Number of rotated --audit-log files to keep"`
+	VirtualNodes            boa.Required[int]      `default:"128"        env:"VIRTUAL_NODES"          descr:"For distributed mode, points per instance on the consistent hash ring. All instances and clients must use the same value"`
+	Discovery               boa.Required[string]   `default:""           env:"DISCOVERY"              descr:"dns,file. If set, run in distributed mode and find the instances with dns or in a file, instead of --instance-urls. Re-resolved every --discovery-interval-millis"`
+	DiscoveryName           boa.Required[string]   `default:""           env:"DISCOVERY_NAME"         descr:"For --discovery=dns, the name to resolve (SRV or A records). Defaults to the headless service of this pod. For --discovery=file, the file with one instance url per line"`
+	DiscoveryIntervalMillis boa.Required[int]      `default:"10000"      env:"DISCOVERY_INTERVAL_MILLIS" descr:"How often --discovery looks for instances, in milliseconds"`
+	PeerHealthCheckMillis   boa.Required[int]      `default:"1000"       env:"PEER_HEALTH_CHECK_MILLIS" descr:"For distributed mode, how often other instances are health checked, in milliseconds"`
+	PeerDownPolicy          boa.Required[string]   `default:"fail-closed" env:"PEER_DOWN_POLICY"      descr:"fail-closed,fail-open,local. How requests on keys whose owner is down are decided: denied, approved, or limited here with --peer-down-local-percent of the key's limit"`
+	PeerDownLocalPercent    boa.Required[int]      `default:"50"         env:"PEER_DOWN_LOCAL_PERCENT" descr:"For --peer-down-policy=local, the percentage of a key's max requests per window that this instance allows while its owner is down"`
+	PeerApiKey              boa.Required[string]   `default:""           env:"PEER_API_KEY"           descr:"For distributed mode, the secret that instances authenticate to each other with. With tenant auth, the api key of an admin tenant. Required"`
+	PeerTransport           boa.Required[string]   `default:"http"       env:"PEER_TRANSPORT"         descr:"http,binary. How requests are forwarded to the owners of keys: as http requests, or pipelined over connections kept open to the binary protocol port of the other instances, which must all run with --binary"`
+	PeerBinaryPort          boa.Required[int]      `default:"0"          env:"PEER_BINARY_PORT"       descr:"For --peer-transport=binary, the binary protocol port of the other instances. 0 = the same as --binary-port"`
+	ReplicationFactor       boa.Required[int]      `default:"0"          env:"REPLICATION_FACTOR"     descr:"For distributed mode, the number of instances after a key's owner on the ring that keep a copy of its counters, and take over the key while its owner is down. 0 = no replication"`
+	ReplicationMillis       boa.Required[int]      `default:"500"        env:"REPLICATION_MILLIS"     descr:"For --replication-factor, how often owners send the counters that changed to the replicas, in milliseconds. What was counted since is lost if an owner fails"`
+	SplitRebalanceMillis    boa.Required[int]      `default:"1000"       env:"SPLIT_REBALANCE_MILLIS" descr:"For keys with split limits in the config file, how often instances give back the requests they borrowed for a key and didn't use, in milliseconds"`
+	OtlpEndpoint            boa.Required[string]   `default:""           env:"OTLP_ENDPOINT"          descr:"If set, export traces over OTLP gRPC to this endpoint, e.g. localhost:4317. Incoming W3C trace context is continued, and passed on when forwarding"`
 }
 
 type GlobalCfgValidated struct {
 	*GlobalCfg
-	Instances []*url.URL
+	Cluster  *cluster.Membership    // the instances and owners of keys, nil if not in distributed mode
+	Health   *cluster.HealthChecker // health of the other instances, nil if they aren't checked
+	Replicas *cluster.Replicas      // copies of the counters of keys of other instances, nil without --replication-factor
+	Quotas   *cluster.Quotas        // requests of split keys borrowed from their owners, nil if not in distributed mode
+	Peers    cluster.Forwarder      // forwards requests to the owners of keys with --peer-transport=binary, nil for http
+	Tls      *TlsCerts              // nil if tls is not configured
+	FromFile *CurrentCfgFromFile    // the config file as it is now, nil if it isn't followed
 }
 
 func (c *GlobalCfg) ValidateInstanceUrls() (*GlobalCfgValidated, error) {
@@ -55,33 +118,46 @@ func (c *GlobalCfg) ValidateInstanceUrls() (*GlobalCfgValidated, error) {
 		return nil, fmt.Errorf("duplicate instance urls provided")
 	}
 
+	if c.Discovery.Value() != "" {
+		if len(instanceUrlStrings) != 0 {
+			return nil, fmt.Errorf("--instance-urls and --discovery can't be combined, discovery finds the instance urls")
+		}
+		slog.Info(fmt.Sprintf("Discovering instances with %s, preparing for distributed mode", c.Discovery.Value()))
+		// Instances are added by the first discovery, see DiscoverySource
+		isSelf, err := c.selfMatcher()
+		if err != nil {
+			return nil, err
+		}
+		view, _ := cluster.NewView(nil, c.VirtualNodes.Value())
+		result.Cluster = cluster.NewMembership(view, c.VirtualNodes.Value(), isSelf)
+		return result, nil
+	}
+
 	if len(instanceUrlStrings) == 1 {
 		return nil, fmt.Errorf("only one instance url provided, distributed mode requires at least 2. Omit this setting to run in single instance mode")
 	}
 
 	if len(instanceUrlStrings) != 0 {
 		slog.Info(fmt.Sprintf("%d instance urls provided, preparing for distributed mode", len(instanceUrlStrings)))
-		// we must ensure these are valid, and that our own hostname corresponds to one of these.
-		// Otherwise, we know the configuration is wrong.
-		instances := make([]*url.URL, 0, len(c.InstanceUrls.Value()))
-		for _, instanceUrl := range c.InstanceUrls.Value() {
-			instanceUrl = strings.TrimSpace(instanceUrl)
-			slog.Info(fmt.Sprintf("Instance url: %v", instanceUrl))
-			if len(strings.TrimSpace(instanceUrl)) == 0 {
-				return nil, fmt.Errorf("instance url '%s' is empty", instanceUrl)
-			}
-			parsedUrl, err := url.Parse(instanceUrl)
-			if err != nil {
-				return nil, fmt.Errorf("invalid instance url: '%v'", instanceUrl)
-			}
-			if !parsedUrl.IsAbs() {
-				return nil, fmt.Errorf("instance url '%s' is not absolute. Only absolute urls are supported", instanceUrl)
+		for _, instanceUrl := range instanceUrlStrings {
+			slog.Info(fmt.Sprintf("Instance url: %v", strings.TrimSpace(instanceUrl)))
+		}
+		view, err := cluster.NewView(instanceUrlStrings, c.VirtualNodes.Value())
+		if err != nil {
+			return nil, err
+		}
+		isSelf, err := c.selfMatcher()
+		if err != nil {
+			return nil, err
+		}
+		if self := lo.Filter(view.Instances, func(instance *url.URL, _ int) bool { return isSelf(instance) }); len(self) != 1 {
+			if c.SelfUrl.Value() != "" {
+				return nil, fmt.Errorf("--self-url '%s' is not one of the instance urls", c.SelfUrl.Value())
 			}
-			instances = append(instances, parsedUrl)
+			return nil, fmt.Errorf("%d instance urls have the hostname or ip of this instance, set --self-url to the url of this instance", len(self))
 		}
-
-		result.Instances = instances
-
+		result.Cluster = cluster.NewMembership(view, c.VirtualNodes.Value(), isSelf)
+		slog.Info(fmt.Sprintf("This instance is %v", result.Cluster.View().SelfUrl()))
 		return result, nil
 
 	} else {
@@ -89,8 +165,69 @@ func (c *GlobalCfg) ValidateInstanceUrls() (*GlobalCfgValidated, error) {
 	}
 }
 
+// selfMatcher tells which instance url is this instance: --self-url if set, otherwise the ones whose host
+// is this pod's hostname (also as the first label of a dns name, e.g. gocc-0.gocc) or one of its ips.
+func (c *GlobalCfg) selfMatcher() (func(instance *url.URL) bool, error) {
+	if selfUrl := c.SelfUrl.Value(); selfUrl != "" {
+		parsedUrl, err := url.Parse(strings.TrimSpace(selfUrl))
+		if err != nil || !parsedUrl.IsAbs() {
+			return nil, fmt.Errorf("invalid --self-url: '%v'", selfUrl)
+		}
+		parsedUrl, _, err = hash_ring.UrlMember(parsedUrl)
+		if err != nil {
+			return nil, err
+		}
+		return func(instance *url.URL) bool { return instance.String() == parsedUrl.String() }, nil
+	}
+
+	hostname := strings.ToLower(svc_discovery.GetOwnHostName())
+	ips, err := svc_discovery.GetOwnIPs()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to look up the ips of this instance, matching instance urls by hostname only: %v", err))
+	}
+	return func(instance *url.URL) bool {
+		host := strings.ToLower(instance.Hostname())
+		if net.ParseIP(host) != nil {
+			return lo.Contains(ips, host)
+		}
+		return host == hostname || strings.Split(host, ".")[0] == strings.Split(hostname, ".")[0]
+	}, nil
+}
+
 func (c *GlobalCfgValidated) DistributedMode() bool {
-	return len(c.Instances) > 0
+	return c.Cluster != nil
+}
+
+// DiscoverySource returns the source of instance urls configured with --discovery, nil if the
+// instance urls are fixed
+func (c *GlobalCfgValidated) DiscoverySource() (cluster.Source, error) {
+	switch c.Discovery.Value() {
+	case "":
+		return nil, nil
+	case cluster.DiscoveryDns:
+		name := c.DiscoveryName.Value()
+		if name == "" {
+			var err error
+			name, err = svc_discovery.InferHeadlessSvcName(svc_discovery.GetOwnHostName())
+			if err != nil {
+				return nil, fmt.Errorf("failed to infer headless service name, set --discovery-name: %w", err)
+			}
+		}
+		scheme := "http"
+		if c.TlsCertFile.Value() != "" {
+			scheme = "https"
+		}
+		slog.Info("Discovering instances from dns", slog.String("name", name))
+		return cluster.DnsSource(name, scheme, c.Port.Value()), nil
+	case cluster.DiscoveryFile:
+		if c.DiscoveryName.Value() == "" {
+			return nil, fmt.Errorf("--discovery=file requires --discovery-name, the path of the file")
+		}
+		slog.Info("Discovering instances from file", slog.String("path", c.DiscoveryName.Value()))
+		return cluster.FileSource(c.DiscoveryName.Value()), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery '%s'", c.Discovery.Value())
+	}
 }
 
 func NewGlobalCfg() *GlobalCfg {
@@ -102,17 +239,36 @@ func NewGlobalCfg() *GlobalCfg {
 	cfg.LogFormat.CustomValidator = oneOf("json", "text", "system-default")
 	cfg.LogLevel.CustomValidator = oneOf("DEBUG", "INFO", "WARN", "ERROR")
 	cfg.ServerType.CustomValidator = oneOf("echo", "echo-http2", "fast")
+	cfg.EnvoyRlsPort.CustomValidator = minMax(0, 65_535) // 0 = ephemeral port
+	cfg.EnvoyRlsKeyTemplate.CustomValidator = validKeyTemplate
+	cfg.ForwardAuthKeyTemplates.CustomValidator = validKeyTemplates
+	cfg.ForwardAuthDenyStatus.CustomValidator = minMax(400, 499)
+	cfg.RespPort.CustomValidator = minMax(0, 65_535)   // 0 = ephemeral port
+	cfg.BinaryPort.CustomValidator = minMax(0, 65_535) // 0 = ephemeral port
+	cfg.UnixSocketMode.CustomValidator = validFileMode
+	cfg.Discovery.CustomValidator = oneOf("", "dns", "file")
+	cfg.PeerHealthCheckMillis.CustomValidator = minMax(100, 3600*1000)
+	cfg.PeerDownPolicy.CustomValidator = oneOf(PeerDownFailClosed, PeerDownFailOpen, PeerDownLocal)
+	cfg.PeerDownLocalPercent.CustomValidator = minMax(1, 100)
+	cfg.PeerTransport.CustomValidator = oneOf(PeerTransportHttp, PeerTransportBinary)
+	cfg.PeerBinaryPort.CustomValidator = minMax(0, 65_535)
+	cfg.ReplicationFactor.CustomValidator = minMax(0, 5)
+	cfg.ReplicationMillis.CustomValidator = minMax(10, 60*1000)
+	cfg.SplitRebalanceMillis.CustomValidator = minMax(10, 60*1000)
+	cfg.DiscoveryIntervalMillis.CustomValidator = minMax(100, 3600*1000)
 	return cfg
 }
 
 type CfgFromFile struct {
-	Keys []CfgFromFileKey `json:"keys"`
+	Keys    []CfgFromFileKey    `json:"keys"`
+	Tenants []CfgFromFileTenant `json:"tenants,omitempty"`
+	Jwt     *CfgFromFileJwt     `json:"jwt,omitempty"`
 }
 
 // MonitorConfigFromFile reads the config file and sets up a monitor for changes.
-func MonitorConfigFromFile(path string) (*CfgFromFile, *JsonFileChangeMonitor[*CfgFromFile]) {
+func MonitorConfigFromFile(path string) (*CfgFromFile, *FileChangeMonitor[*CfgFromFile]) {
 	initAppConfigFromFile := &CfgFromFile{}
-	var configFileChangeMonitor *JsonFileChangeMonitor[*CfgFromFile] = nil
+	var configFileChangeMonitor *FileChangeMonitor[*CfgFromFile] = nil
 	if path != "" {
 		configDir, configFile := filepath.Split(path)
 		if configDir == "" {
@@ -135,6 +291,9 @@ func MonitorConfigFromFile(path string) (*CfgFromFile, *JsonFileChangeMonitor[*C
 		for _, key := range initAppConfigFromFile.Keys {
 			slog.Info(fmt.Sprintf(" - %s", key.ToJson()))
 		}
+		for _, tenant := range initAppConfigFromFile.Tenants {
+			slog.Info(fmt.Sprintf(" - tenant %s: key pattern '%s'", tenant.Name, tenant.KeyPattern))
+		}
 		configFileChangeMonitor = MonitorJsonFileUpdates[*CfgFromFile](configDir, configFile, StringTransformer)
 	} else {
 		slog.Warn("No config file provided, no key specific rate limits will be used (unless clients set them)", slog.String("configFile", path))
@@ -142,12 +301,100 @@ func MonitorConfigFromFile(path string) (*CfgFromFile, *JsonFileChangeMonitor[*C
 	return initAppConfigFromFile, configFileChangeMonitor
 }
 
+// CurrentCfgFromFile follows changes of the config file, for code that reads it per request
+type CurrentCfgFromFile struct {
+	current atomic.Pointer[CfgFromFile]
+}
+
+// FollowCfgFromFile keeps track of the latest config file, until the channel is closed
+func FollowCfgFromFile(initCfg *CfgFromFile, changes <-chan *CfgFromFile) *CurrentCfgFromFile {
+	c := &CurrentCfgFromFile{}
+	c.current.Store(initCfg)
+	go func() {
+		for newCfg := range changes {
+			c.current.Store(newCfg)
+		}
+	}()
+	return c
+}
+
+// Get returns the latest config file. Never nil, an empty config is returned if there is none.
+func (c *CurrentCfgFromFile) Get() *CfgFromFile {
+	if c == nil || c.current.Load() == nil {
+		return &CfgFromFile{}
+	}
+	return c.current.Load()
+}
+
 type CfgFromFileKey struct {
-	KeyPattern           string `json:"key_pattern"`
-	KeyPatternIsRegex    bool   `json:"key_pattern_is_regex"`
-	MaxRequestsPerWindow int    `json:"max_requests_per_window"`
-	MaxRequestsInQueue   int    `json:"max_requests_in_queue"`
-	WindowMillis         int    `json:"window_millis"`
+	KeyPattern           string                `json:"key_pattern"`
+	KeyPatternIsRegex    bool                  `json:"key_pattern_is_regex"`
+	MaxRequestsPerWindow int                   `json:"max_requests_per_window"`
+	MaxRequestsInQueue   int                   `json:"max_requests_in_queue"`
+	WindowMillis         int                   `json:"window_millis"`
+	Overrides            *CfgFromFileOverrides `json:"overrides,omitempty"`
+	AuditSampleRate      *float64              `json:"audit_sample_rate,omitempty"` // 0 to 1 of the decisions written to the audit log
+	Split                *bool                 `json:"split,omitempty"`             // decided by all instances, with requests borrowed from the owner
+}
+
+// CfgFromFileOverrides is what clients may override for matching keys, e.g. with ?maxRequests=.
+// Unset fields are inherited from earlier matching key patterns, and then from the global flags.
+type CfgFromFileOverrides struct {
+	AllowSetRate       *bool              `json:"allow_set_rate,omitempty"`  // instead of --requests-can-set-rate
+	AllowModQueue      *bool              `json:"allow_mod_queue,omitempty"` // instead of --requests-can-mod-queue
+	MaxRequests        *CfgFromFileBounds `json:"max_requests,omitempty"`
+	MaxRequestsInQueue *CfgFromFileBounds `json:"max_requests_in_queue,omitempty"`
+	WindowMillis       *CfgFromFileBounds `json:"window_millis,omitempty"`
+}
+
+// CfgFromFileBounds are inclusive bounds of an overridden value, within the global bounds
+type CfgFromFileBounds struct {
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+}
+
+// Check returns an error if the value is out of bounds. nil bounds allow any value.
+func (b *CfgFromFileBounds) Check(value int) error {
+	if b == nil {
+		return nil
+	}
+	if b.Min != nil && value < *b.Min {
+		return fmt.Errorf("value must be at least %d", *b.Min)
+	}
+	if b.Max != nil && value > *b.Max {
+		return fmt.Errorf("value must be at most %d", *b.Max)
+	}
+	return nil
+}
+
+// OverridesFor returns the override policy of a key. Like limits, the policies of all
+// matching key patterns are applied in the order they are defined.
+func (c *CfgFromFile) OverridesFor(key string) *CfgFromFileOverrides {
+	result := &CfgFromFileOverrides{}
+	for _, configKey := range c.Keys {
+		if configKey.Overrides == nil || !configKey.MatchesKey(key) {
+			continue
+		}
+		o := configKey.Overrides
+		result.AllowSetRate = cmp.Or(o.AllowSetRate, result.AllowSetRate)
+		result.AllowModQueue = cmp.Or(o.AllowModQueue, result.AllowModQueue)
+		result.MaxRequests = cmp.Or(o.MaxRequests, result.MaxRequests)
+		result.MaxRequestsInQueue = cmp.Or(o.MaxRequestsInQueue, result.MaxRequestsInQueue)
+		result.WindowMillis = cmp.Or(o.WindowMillis, result.WindowMillis)
+	}
+	return result
+}
+
+// SplitsKey returns true if the limit of a key is split between the instances, instead of decided by its owner.
+// The last matching key pattern that sets it decides.
+func (c *CfgFromFile) SplitsKey(key string) bool {
+	split := false
+	for _, configKey := range c.Keys {
+		if configKey.Split != nil && configKey.MatchesKey(key) {
+			split = *configKey.Split
+		}
+	}
+	return split
 }
 
 func (c *CfgFromFileKey) ToJson() string {
@@ -171,6 +418,26 @@ func (c *CfgFromFileKey) MatchesKey(str string) bool {
 	}
 }
 
+// CfgFromFileTenant is a client of gocc, and the credentials it authenticates with.
+// When any tenants are configured, all requests must carry the credentials of one of them.
+type CfgFromFileTenant struct {
+	Name              string   `json:"name"`
+	ApiKeySha256      []string `json:"api_key_sha256,omitempty"` // hex encoded sha256 of each api key
+	JwtSubjects       []string `json:"jwt_subjects,omitempty"`   // sub claims of jwts verified against the jwks file
+	KeyPattern        string   `json:"key_pattern"`              // a prefix of the keys the tenant may use, unless a regex
+	KeyPatternIsRegex bool     `json:"key_pattern_is_regex"`
+	CanSetRate        bool     `json:"can_set_rate"`  // may override maxRequests and windows, if --requests-can-set-rate
+	CanModQueue       bool     `json:"can_mod_queue"` // may override maxRequestsInQueue, if --requests-can-mod-queue
+	Admin             bool     `json:"admin"`         // may use the /admin endpoints, for keys matching the key pattern
+}
+
+// CfgFromFileJwt is how tenants' jwts are verified
+type CfgFromFileJwt struct {
+	JwksFile string `json:"jwks_file"`
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+}
+
 func ParseAppConfigBytes(data []byte) (*CfgFromFile, error) {
 	var cfg CfgFromFile
 	if err := json.Unmarshal(data, &cfg); err != nil {
@@ -199,6 +466,7 @@ func ReadAppConfigFile(filePath string) (*CfgFromFile, error) {
 
 func StringTransformer(in string) (*CfgFromFile, bool) {
 	config, err := ParseAppConfigString(in)
+	metrics.ConfigReloaded(err == nil)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Failed to parse config file: %v", err))
 		return nil, false
@@ -232,6 +500,31 @@ func minMax[T cmp.Ordered](min T, max T) func(t T) error {
 	}
 }
 
+func validKeyTemplate(t string) error {
+	_, err := keytemplate.Parse(t)
+	return err
+}
+
+func validKeyTemplates(ts []string) error {
+	if len(ts) == 0 {
+		return fmt.Errorf("at least one key template is required")
+	}
+	for _, t := range ts {
+		if err := validKeyTemplate(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validFileMode(t string) error {
+	mode, err := strconv.ParseUint(t, 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("value must be an octal file mode, e.g. 0660")
+	}
+	return nil
+}
+
 func oneOf(validValues ...string) func(t string) error {
 	return func(t string) error {
 		for _, v := range validValues {
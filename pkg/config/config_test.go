@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/kivra/gocc/pkg/config/experimental/svc_discovery"
+	"github.com/kivra/gocc/pkg/hash_ring"
 	"github.com/samber/lo"
 	"log/slog"
 	"os"
@@ -66,6 +67,8 @@ func TestValidateInstanceUrls(t *testing.T) {
 	testCases := []struct {
 		name         string
 		instanceUrls []string
+		discovery    string
+		selfUrl      string
 		expectError  bool
 	}{
 		{
@@ -84,6 +87,30 @@ func TestValidateInstanceUrls(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "Weighted instance URLs",
+			instanceUrls: []string{
+				"https://" + svc_discovery.GetOwnHostName() + ":8080?weight=2",
+				"https://" + "other" + ":8081",
+			},
+			expectError: false,
+		},
+		{
+			name: "Invalid weight",
+			instanceUrls: []string{
+				"https://" + svc_discovery.GetOwnHostName() + ":8080?weight=0",
+				"https://" + "other" + ":8081",
+			},
+			expectError: true,
+		},
+		{
+			name: "Same instance with different weights",
+			instanceUrls: []string{
+				"https://other:8081?weight=2",
+				"https://other:8081",
+			},
+			expectError: true,
+		},
 		{
 			name: "Single valid instance URL",
 			instanceUrls: []string{
@@ -91,12 +118,64 @@ func TestValidateInstanceUrls(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "Self url",
+			instanceUrls: []string{
+				"https://gocc-0.gocc:8080",
+				"https://gocc-1.gocc:8080?weight=2",
+			},
+			selfUrl:     "https://gocc-1.gocc:8080",
+			expectError: false,
+		},
+		{
+			name: "Self url not among the instance URLs",
+			instanceUrls: []string{
+				"https://gocc-0.gocc:8080",
+				"https://gocc-1.gocc:8080",
+			},
+			selfUrl:     "https://gocc.default.svc:8080",
+			expectError: true,
+		},
+		{
+			name: "No instance URL of this instance",
+			instanceUrls: []string{
+				"https://gocc-0.gocc:8080",
+				"https://gocc-1.gocc:8080",
+			},
+			expectError: true,
+		},
+		{
+			name: "Several instance URLs of this instance",
+			instanceUrls: []string{
+				"https://" + svc_discovery.GetOwnHostName() + ":8080",
+				"https://" + svc_discovery.GetOwnHostName() + ":8081",
+			},
+			expectError: true,
+		},
+		{
+			name:         "Discovery",
+			instanceUrls: []string{},
+			discovery:    "dns",
+			expectError:  false,
+		},
+		{
+			name: "Discovery and instance URLs",
+			instanceUrls: []string{
+				"https://" + svc_discovery.GetOwnHostName() + ":8080",
+				"https://" + "other" + ":8081",
+			},
+			discovery:   "file",
+			expectError: true,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			cfg := &GlobalCfg{}
 			cfg.InstanceUrls.Default = lo.ToPtr(tc.instanceUrls)
+			cfg.VirtualNodes.Default = lo.ToPtr(hash_ring.DefaultVirtualNodes)
+			cfg.Discovery.Default = lo.ToPtr(tc.discovery)
+			cfg.SelfUrl.Default = lo.ToPtr(tc.selfUrl)
 
 			vCfg, err := cfg.ValidateInstanceUrls()
 			if tc.expectError && err == nil {
@@ -119,3 +198,86 @@ func TestValidateInstanceUrls(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadTls_requires_cert_and_key(t *testing.T) {
+
+	testCases := []struct {
+		name        string
+		certFile    string
+		keyFile     string
+		caFile      string
+		expectError bool
+	}{
+		{name: "not configured"},
+		{name: "key without cert", keyFile: "server.key", expectError: true},
+		{name: "ca without cert", caFile: "ca.crt", expectError: true},
+		{name: "cert without key", certFile: "server.crt", expectError: true},
+		{name: "missing files", certFile: "/does/not/exist.crt", keyFile: "/does/not/exist.key", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &GlobalCfg{}
+			cfg.TlsCertFile.Default = lo.ToPtr(tc.certFile)
+			cfg.TlsKeyFile.Default = lo.ToPtr(tc.keyFile)
+			cfg.TlsClientCaFile.Default = lo.ToPtr("")
+			cfg.TlsCaFile.Default = lo.ToPtr(tc.caFile)
+
+			vCfg := &GlobalCfgValidated{GlobalCfg: cfg}
+			err := vCfg.LoadTls()
+			if tc.expectError != (err != nil) {
+				t.Fatalf("Expected error: %v, got %v", tc.expectError, err)
+			}
+			if vCfg.Tls != nil {
+				t.Fatalf("Expected no tls certs to be loaded")
+			}
+		})
+	}
+}
+
+func TestOverridesFor_merges_matching_patterns_in_order(t *testing.T) {
+
+	cfg, err := ParseAppConfigString(`{
+		"keys": [
+			{"key_pattern": "^user-", "key_pattern_is_regex": true, "overrides": {"allow_set_rate": true, "max_requests": {"min": 1, "max": 100}}},
+			{"key_pattern": "^user-vip-", "key_pattern_is_regex": true, "overrides": {"max_requests": {"max": 1000}, "allow_mod_queue": false}},
+			{"key_pattern": "^user-", "key_pattern_is_regex": true, "max_requests_per_window": 5}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	user := cfg.OverridesFor("user-1")
+	if !lo.FromPtr(user.AllowSetRate) || user.AllowModQueue != nil || user.MaxRequests.Check(100) != nil || user.MaxRequests.Check(101) == nil {
+		t.Fatalf("Unexpected policy for user-1: %+v", user)
+	}
+
+	vip := cfg.OverridesFor("user-vip-1")
+	if !lo.FromPtr(vip.AllowSetRate) || vip.AllowModQueue == nil || *vip.AllowModQueue || vip.MaxRequests.Check(1000) != nil || vip.MaxRequests.Check(0) != nil {
+		t.Fatalf("Unexpected policy for user-vip-1: %+v", vip)
+	}
+
+	other := cfg.OverridesFor("other")
+	if other.AllowSetRate != nil || other.MaxRequests.Check(1_000_000) != nil {
+		t.Fatalf("Expected no policy for other keys, got %+v", other)
+	}
+}
+
+func TestSplitsKey_last_matching_pattern_decides(t *testing.T) {
+
+	cfg, err := ParseAppConfigString(`{
+		"keys": [
+			{"key_pattern": "^hot-", "key_pattern_is_regex": true, "split": true},
+			{"key_pattern": "hot-but-not", "split": false},
+			{"key_pattern": "^hot-", "key_pattern_is_regex": true, "max_requests_per_window": 5}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	if !cfg.SplitsKey("hot-1") || cfg.SplitsKey("hot-but-not") || cfg.SplitsKey("cold") {
+		t.Fatalf("Unexpected split keys: hot-1=%v hot-but-not=%v cold=%v", cfg.SplitsKey("hot-1"), cfg.SplitsKey("hot-but-not"), cfg.SplitsKey("cold"))
+	}
+}
@@ -9,19 +9,19 @@ import (
 	"path/filepath"
 )
 
-type JsonFileChangeMonitor[T any] struct {
+type FileChangeMonitor[T any] struct {
 	changeCh <-chan T
 	closer   chan any
 }
 
-func (f *JsonFileChangeMonitor[T]) Close() {
+func (f *FileChangeMonitor[T]) Close() {
 	if f == nil {
 		return
 	}
 	close(f.closer)
 }
 
-func (f *JsonFileChangeMonitor[T]) Changes() <-chan T {
+func (f *FileChangeMonitor[T]) Changes() <-chan T {
 	if f == nil {
 		return nil
 	}
@@ -37,11 +37,88 @@ func MonitorJsonFileUpdates[T any](
 	configFileDir string,
 	fileName string,
 	transformer func(string) (T, bool),
-) *JsonFileChangeMonitor[T] {
+) *FileChangeMonitor[T] {
+
+	changeCh, closer := monitorDir(configFileDir, func(event fsnotify.Event) (string, bool) {
+
+		if event.Op&fsnotify.Write != fsnotify.Write {
+			return "", false
+		}
+
+		_, fileNameInEvent := filepath.Split(event.Name)
+		if fileName != fileNameInEvent {
+			slog.Warn(fmt.Sprintf("File %v is not the config file we are looking for, skipping", event.Name))
+			return "", false
+		}
+
+		// read the entire file, if it is more than 10 bytes and valid json, emit a change
+		bytes, err := os.ReadFile(event.Name)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to read file %v: %v", event.Name, err))
+			return "", false
+		}
+
+		if len(bytes) < 10 {
+			slog.Warn(fmt.Sprintf("File %v is too small to be a valid config file", event.Name))
+			return "", false
+		}
+
+		// check if the file is a json file
+		testObj := make(map[string]any)
+		err = json.Unmarshal(bytes, &testObj)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("File %v is not a valid json file, skipping", event.Name))
+			return "", false
+		}
+
+		slog.Info(fmt.Sprintf("Detected change in file %v, emitting change event", event.Name))
+		return string(bytes), true
+	})
+
+	changeChT := transformChan(changeCh, transformer)
+
+	return &FileChangeMonitor[T]{
+		changeCh: changeChT,
+		closer:   closer,
+	}
+}
+
+// MonitorFileUpdates monitors a file of any format, and emits its path when it has been written or replaced.
+// This includes kubernetes updating mounted secrets, which is done by swapping a ..data symlink in the dir.
+func MonitorFileUpdates(path string) *FileChangeMonitor[string] {
+
+	dir, fileName := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	changeCh, closer := monitorDir(dir, func(event fsnotify.Event) (string, bool) {
+
+		if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+			return "", false
+		}
+
+		_, fileNameInEvent := filepath.Split(event.Name)
+		if fileNameInEvent != fileName && fileNameInEvent != "..data" {
+			return "", false
+		}
+
+		slog.Info(fmt.Sprintf("Detected change in file %v, emitting change event", path))
+		return path, true
+	})
+
+	return &FileChangeMonitor[string]{
+		changeCh: changeCh,
+		closer:   closer,
+	}
+}
+
+// monitorDir watches a dir until closed, emitting what onEvent returns for events it accepts
+func monitorDir(dir string, onEvent func(event fsnotify.Event) (string, bool)) (<-chan string, chan any) {
 
 	// check if the path is a directory
-	if !DirExists(configFileDir) {
-		panic(fmt.Sprintf("Path does not exist or is not an accessible directory: %v", configFileDir))
+	if !DirExists(dir) {
+		panic(fmt.Sprintf("Path does not exist or is not an accessible directory: %v", dir))
 	}
 
 	// set up file system watcher
@@ -50,9 +127,9 @@ func MonitorJsonFileUpdates[T any](
 		panic(fmt.Sprintf("Failed to create watcher: %v", err))
 	}
 
-	err = watcher.Add(configFileDir)
+	err = watcher.Add(dir)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to add path %v to watcher: %v", configFileDir, err))
+		panic(fmt.Sprintf("Failed to add path %v to watcher: %v", dir, err))
 	}
 
 	changeCh := make(chan string, 10)
@@ -61,11 +138,12 @@ func MonitorJsonFileUpdates[T any](
 	// start watching for changes
 	go func() {
 		defer close(changeCh)
+		defer func() { _ = watcher.Close() }()
 		for {
 			select {
 			case _, ok := <-closer:
 				if !ok {
-					slog.Warn(fmt.Sprintf("File change monitor closed for %v", configFileDir))
+					slog.Warn(fmt.Sprintf("File change monitor closed for %v", dir))
 					return
 				}
 			case event, ok := <-watcher.Events:
@@ -73,47 +151,14 @@ func MonitorJsonFileUpdates[T any](
 					panic("BUG: Watcher events channel closed. This should not happen.")
 				}
 
-				if event.Op&fsnotify.Write == fsnotify.Write {
-
-					_, fileNameInEvent := filepath.Split(event.Name)
-					if fileName != fileNameInEvent {
-						slog.Warn(fmt.Sprintf("File %v is not the config file we are looking for, skipping", event.Name))
-						continue
-					}
-
-					// read the entire file, if it is more than 10 bytes and valid json, emit a change
-					bytes, err := os.ReadFile(event.Name)
-					if err != nil {
-						slog.Warn(fmt.Sprintf("Failed to read file %v: %v", event.Name, err))
-						continue
-					}
-
-					if len(bytes) < 10 {
-						slog.Warn(fmt.Sprintf("File %v is too small to be a valid config file", event.Name))
-						continue
-					}
-
-					// check if the file is a json file
-					testObj := make(map[string]any)
-					err = json.Unmarshal(bytes, &testObj)
-					if err != nil {
-						slog.Warn(fmt.Sprintf("File %v is not a valid json file, skipping", event.Name))
-						continue
-					}
-
-					slog.Info(fmt.Sprintf("Detected change in file %v, emitting change event", event.Name))
-					changeCh <- string(bytes)
+				if change, emit := onEvent(event); emit {
+					changeCh <- change
 				}
 			}
 		}
 	}()
 
-	changeChT := transformChan(changeCh, transformer)
-
-	return &JsonFileChangeMonitor[T]{
-		changeCh: changeChT,
-		closer:   closer,
-	}
+	return changeCh, closer
 }
 
 func DirExists(path string) bool {
@@ -141,3 +186,30 @@ func transformChan[From any, To any](
 	}()
 	return output
 }
+
+// FanOut copies every value from input to n outputs, so that several consumers can follow the same changes.
+// Each output is buffered like the input, and a slow consumer holds up the others once its buffer is full.
+func FanOut[T any](input <-chan T, n int) []<-chan T {
+	outputs := make([]chan T, n)
+	result := make([]<-chan T, n)
+	if input == nil {
+		return result // nothing will ever be sent
+	}
+	for i := range outputs {
+		outputs[i] = make(chan T, cap(input))
+		result[i] = outputs[i]
+	}
+	go func() {
+		defer func() {
+			for _, output := range outputs {
+				close(output)
+			}
+		}()
+		for in := range input {
+			for _, output := range outputs {
+				output <- in
+			}
+		}
+	}()
+	return result
+}
@@ -82,3 +82,23 @@ func TestFileChangeMonitor_Close(t *testing.T) {
 	//	t.Fatalf("Received more changes than expected")
 	//}
 }
+
+func TestFanOut(t *testing.T) {
+
+	input := make(chan string, 2)
+	outputs := FanOut(input, 2)
+
+	input <- "a"
+	input <- "b"
+	close(input)
+
+	for i, output := range outputs {
+		var received []string
+		for change := range output {
+			received = append(received, change)
+		}
+		if len(received) != 2 || received[0] != "a" || received[1] != "b" {
+			t.Fatalf("Expected output %d to receive all changes in order, got %v", i, received)
+		}
+	}
+}
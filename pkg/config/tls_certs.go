@@ -0,0 +1,178 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// TlsCerts holds the certificate and CAs used by tls listeners and by requests to other instances.
+// They are reloaded when their files change, so that certificates can be rotated without restarts.
+// Connections already established keep using the certificates they were set up with.
+type TlsCerts struct {
+	certFile     string
+	keyFile      string
+	clientCaFile string
+	caFile       string
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool // nil = client certificates not required
+	rootCAs   *x509.CertPool // nil = system roots
+
+	monitors []*FileChangeMonitor[string]
+}
+
+// LoadTls loads the configured tls files into c.Tls, and starts monitoring them for changes.
+// Instances talk tls to each other, so instance urls must be https when tls is configured.
+func (c *GlobalCfgValidated) LoadTls() error {
+	tlsCerts, err := loadTlsCerts(c.GlobalCfg)
+	if err != nil {
+		return err
+	}
+	if tlsCerts != nil && c.Cluster != nil {
+		if err := c.Cluster.RequireHttps(); err != nil {
+			tlsCerts.Close()
+			return err
+		}
+	}
+	c.Tls = tlsCerts
+	return nil
+}
+
+func loadTlsCerts(c *GlobalCfg) (*TlsCerts, error) {
+
+	t := &TlsCerts{
+		certFile:     c.TlsCertFile.Value(),
+		keyFile:      c.TlsKeyFile.Value(),
+		clientCaFile: c.TlsClientCaFile.Value(),
+		caFile:       c.TlsCaFile.Value(),
+	}
+
+	if t.certFile == "" {
+		if t.keyFile != "" || t.clientCaFile != "" || t.caFile != "" {
+			return nil, fmt.Errorf("tls options require --tls-cert-file")
+		}
+		return nil, nil
+	}
+	if t.keyFile == "" {
+		return nil, fmt.Errorf("--tls-cert-file requires --tls-key-file")
+	}
+
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+
+	for _, path := range []string{t.certFile, t.keyFile, t.clientCaFile, t.caFile} {
+		if path == "" {
+			continue
+		}
+		monitor := MonitorFileUpdates(path)
+		t.monitors = append(t.monitors, monitor)
+		go func() {
+			for range monitor.Changes() {
+				if err := t.reload(); err != nil {
+					// Typically the cert and key files are mid-update. Next change will fix it.
+					slog.Warn(fmt.Sprintf("Failed to reload tls files, keeping the previous ones: %v", err))
+				} else {
+					slog.Info("Reloaded tls files", slog.String("certFile", t.certFile))
+				}
+			}
+		}()
+	}
+
+	return t, nil
+}
+
+// Close stops monitoring the tls files for changes
+func (t *TlsCerts) Close() {
+	if t == nil {
+		return
+	}
+	for _, monitor := range t.monitors {
+		monitor.Close()
+	}
+}
+
+// ServerConfig returns a tls config for listeners, always using the latest certificates.
+// Client certificates are required if a client CA is configured.
+func (t *TlsCerts) ServerConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mutex.RLock()
+			defer t.mutex.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*t.cert},
+				NextProtos:   nextProtos,
+			}
+			if t.clientCAs != nil {
+				cfg.ClientCAs = t.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns a tls config for connecting to another instance, with the latest certificates.
+// Our own certificate is presented if the other instance asks for one.
+func (t *TlsCerts) ClientConfig(serverName string, nextProtos ...string) *tls.Config {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	cert := t.cert
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    t.rootCAs,
+		NextProtos: nextProtos,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		},
+	}
+}
+
+func (t *TlsCerts) reload() error {
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate %s: %w", t.certFile, err)
+	}
+
+	clientCAs, err := loadCertPool(t.clientCaFile)
+	if err != nil {
+		return err
+	}
+
+	rootCAs, err := loadCertPool(t.caFile)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	t.rootCAs = rootCAs
+	return nil
+}
+
+// loadCertPool reads a PEM bundle of CAs. Returns nil for an empty path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file %s: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
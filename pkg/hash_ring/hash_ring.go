@@ -0,0 +1,159 @@
+package hash_ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points on the ring per member of weight 1. More points spread keys
+// more evenly between members, at the cost of a larger ring. With 128, members get within ~10% of their share.
+const DefaultVirtualNodes = 128
+
+// Member is a member of the ring, e.g. a gocc instance url. Keys are spread over members in proportion
+// to their weights. Members are identified by name only, so all parties must use the same names.
+type Member struct {
+	Name   string
+	Weight int // 0 = 1
+}
+
+// Ring assigns keys to members by consistent hashing: each member has virtualNodes*weight points on a ring
+// of hashes, and a key belongs to the member of the first point at or after the key's hash. When a member is
+// added or removed, only the keys between its points and the preceding ones move, i.e. about 1/n of them.
+//
+// The gocc servers forward requests to the owners of keys with it, and clients can use it to send requests
+// to the owners directly. Both must use the same members and virtual nodes, in any order.
+type Ring struct {
+	members     []Member
+	points      []point // sorted by hash
+	fingerprint string
+}
+
+type point struct {
+	hash   uint64
+	member int // index in members
+}
+
+// New creates a ring of members. Member names must be unique.
+func New(members []Member, virtualNodes int) (*Ring, error) {
+	if virtualNodes <= 0 {
+		return nil, fmt.Errorf("virtual nodes must be > 0, got %d", virtualNodes)
+	}
+	r := &Ring{members: slices.Clone(members)}
+	seen := map[string]bool{}
+	for i, member := range members {
+		if seen[member.Name] {
+			return nil, fmt.Errorf("duplicate ring member '%s'", member.Name)
+		}
+		seen[member.Name] = true
+		if member.Weight < 0 {
+			return nil, fmt.Errorf("weight of ring member '%s' must be >= 0, got %d", member.Name, member.Weight)
+		}
+		for v := 0; v < virtualNodes*max(member.Weight, 1); v++ {
+			r.points = append(r.points, point{hash: Hash(member.Name + "#" + strconv.Itoa(v)), member: i})
+		}
+	}
+	// Ties are broken by name, so that the ring doesn't depend on the order of the members
+	sort.Slice(r.points, func(a, b int) bool {
+		if r.points[a].hash != r.points[b].hash {
+			return r.points[a].hash < r.points[b].hash
+		}
+		return r.members[r.points[a].member].Name < r.members[r.points[b].member].Name
+	})
+	r.fingerprint = fingerprint(r)
+	return r, nil
+}
+
+// fingerprint hashes the points of a ring and their members, which only depend on the members, their weights
+// and the virtual nodes, not on the order of the members
+func fingerprint(r *Ring) string {
+	h := fnv.New64a()
+	for _, p := range r.points {
+		_, _ = h.Write(binary.BigEndian.AppendUint64(nil, p.hash))
+		_, _ = h.Write([]byte(r.members[p.member].Name))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Fingerprint identifies the ring. Rings with the same fingerprint assign all keys to the same members, so
+// parties can compare fingerprints to check that they agree on the members, weights and virtual nodes.
+func (r *Ring) Fingerprint() string {
+	return r.fingerprint
+}
+
+// Owner returns the index, in the members given to New, of the member owning a key. -1 if the ring is empty.
+func (r *Ring) Owner(key string) int {
+	if len(r.points) == 0 {
+		return -1
+	}
+	return r.points[r.first(key)].member
+}
+
+// Owners returns the indexes of up to n members for a key: its owner, followed by the members that would
+// own it if the ones before them were removed from the ring. Empty if the ring is empty.
+func (r *Ring) Owners(key string, n int) []int {
+	result := make([]int, 0, min(n, len(r.members)))
+	if len(r.points) == 0 {
+		return result
+	}
+	start := r.first(key)
+	for i := 0; i < len(r.points) && len(result) < n; i++ {
+		member := r.points[(start+i)%len(r.points)].member
+		if !slices.Contains(result, member) {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// first returns the index of the first point at or after the hash of a key
+func (r *Ring) first(key string) int {
+	hash := Hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0 // wrap around
+	}
+	return i
+}
+
+// Members returns the members of the ring, in the order given to New
+func (r *Ring) Members() []Member {
+	return slices.Clone(r.members)
+}
+
+// UrlMember returns the ring member of an instance url, e.g. one of --instance-urls. Its ?weight= query
+// parameter is the member's weight, and is not part of the member's name, which is the returned url.
+func UrlMember(instanceUrl *url.URL) (*url.URL, Member, error) {
+	result := *instanceUrl
+	weight := 1
+	if rawWeight := result.Query().Get("weight"); rawWeight != "" {
+		var err error
+		weight, err = strconv.Atoi(rawWeight)
+		if err != nil || weight < 1 {
+			return nil, Member{}, fmt.Errorf("weight of instance url '%s' must be a positive integer", instanceUrl)
+		}
+		query := result.Query()
+		query.Del("weight")
+		result.RawQuery = query.Encode()
+	}
+	return &result, Member{Name: result.String(), Weight: weight}, nil
+}
+
+// Hash is the hash of keys and points on the ring: 64-bit fnv-1a, mixed so that similar keys
+// (e.g. user-1, user-2) end up far apart.
+func Hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,169 @@
+package hash_ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func members(n int) []Member {
+	result := make([]Member, n)
+	for i := range result {
+		result[i] = Member{Name: fmt.Sprintf("http://gocc-%d.gocc:8080", i)}
+	}
+	return result
+}
+
+func ownersOf(t *testing.T, ring *Ring, numKeys int) map[string]string {
+	t.Helper()
+	result := make(map[string]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		result[key] = ring.members[ring.Owner(key)].Name
+	}
+	return result
+}
+
+func moved(before map[string]string, after map[string]string) int {
+	n := 0
+	for key, owner := range before {
+		if after[key] != owner {
+			n++
+		}
+	}
+	return n
+}
+
+func mustNew(t *testing.T, members []Member) *Ring {
+	t.Helper()
+	ring, err := New(members, DefaultVirtualNodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return ring
+}
+
+const numKeys = 100_000
+
+func TestRing_spreadsKeysEvenly(t *testing.T) {
+	owners := ownersOf(t, mustNew(t, members(10)), numKeys)
+	counts := map[string]int{}
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	for owner, count := range counts {
+		if count < numKeys/10*8/10 || count > numKeys/10*12/10 {
+			t.Fatalf("expected %s to own about %d keys, got %d", owner, numKeys/10, count)
+		}
+	}
+}
+
+func TestRing_addingAMemberMovesFewKeys(t *testing.T) {
+	before := ownersOf(t, mustNew(t, members(10)), numKeys)
+	after := ownersOf(t, mustNew(t, members(11)), numKeys)
+
+	// Ideally 1/11 of the keys move, all to the new member. With hash % n, ~10/11 would.
+	n := moved(before, after)
+	t.Logf("adding an 11th member moved %d of %d keys (%.1f%%)", n, numKeys, 100*float64(n)/numKeys)
+	if n > numKeys/11*13/10 {
+		t.Fatalf("expected about %d keys to move, got %d", numKeys/11, n)
+	}
+	for key, owner := range after {
+		if before[key] != owner && owner != "http://gocc-10.gocc:8080" {
+			t.Fatalf("expected keys to move to the new member only, %s moved to %s", key, owner)
+		}
+	}
+}
+
+func TestRing_removingAMemberMovesOnlyItsKeys(t *testing.T) {
+	all := members(10)
+	before := ownersOf(t, mustNew(t, all), numKeys)
+	after := ownersOf(t, mustNew(t, append(all[:4:4], all[5:]...)), numKeys)
+
+	n := moved(before, after)
+	t.Logf("removing 1 of 10 members moved %d of %d keys (%.1f%%)", n, numKeys, 100*float64(n)/numKeys)
+	for key, owner := range before {
+		if after[key] != owner && owner != all[4].Name {
+			t.Fatalf("expected only the keys of the removed member to move, %s moved from %s", key, owner)
+		}
+	}
+}
+
+func TestRing_Owners_areTheOwnersAfterRemovals(t *testing.T) {
+	all := members(5)
+	ring := mustNew(t, all)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owners := ring.Owners(key, 3)
+		if len(owners) != 3 || owners[0] != ring.Owner(key) || owners[0] == owners[1] || owners[1] == owners[2] || owners[0] == owners[2] {
+			t.Fatalf("expected 3 distinct owners of %s starting with its owner, got %v", key, owners)
+		}
+		// The second owner is the owner once the first is gone
+		remaining := append(all[:owners[0]:owners[0]], all[owners[0]+1:]...)
+		if after := mustNew(t, remaining); after.members[after.Owner(key)].Name != all[owners[1]].Name {
+			t.Fatalf("expected %s to move to %s, got %s", key, all[owners[1]].Name, after.members[after.Owner(key)].Name)
+		}
+	}
+	if owners := ring.Owners("user-1", 10); len(owners) != 5 {
+		t.Fatalf("expected all 5 members at most, got %v", owners)
+	}
+	if owners := mustNew(t, nil).Owners("user-1", 2); len(owners) != 0 {
+		t.Fatalf("expected no owners on an empty ring, got %v", owners)
+	}
+}
+
+func TestRing_weights(t *testing.T) {
+	ring := mustNew(t, []Member{{Name: "small"}, {Name: "big", Weight: 3}})
+	counts := map[string]int{}
+	for _, owner := range ownersOf(t, ring, numKeys) {
+		counts[owner]++
+	}
+	if counts["big"] < numKeys*70/100 || counts["big"] > numKeys*80/100 {
+		t.Fatalf("expected the member of weight 3 to own about 75%% of the keys, got %v", counts)
+	}
+}
+
+func TestRing_doesNotDependOnMemberOrder(t *testing.T) {
+	forward := members(5)
+	backward := make([]Member, len(forward))
+	for i, member := range forward {
+		backward[len(forward)-1-i] = member
+	}
+	if n := moved(ownersOf(t, mustNew(t, forward), numKeys), ownersOf(t, mustNew(t, backward), numKeys)); n != 0 {
+		t.Fatalf("expected the same owners regardless of member order, %d keys differ", n)
+	}
+	if mustNew(t, forward).Fingerprint() != mustNew(t, backward).Fingerprint() {
+		t.Fatalf("expected the same fingerprint regardless of member order")
+	}
+}
+
+func TestRing_Fingerprint_differsForOtherRings(t *testing.T) {
+	ring := mustNew(t, members(3))
+	heavier := members(3)
+	heavier[0].Weight = 2
+	fewerNodes, _ := New(members(3), DefaultVirtualNodes/2)
+	for name, other := range map[string]*Ring{
+		"another member": mustNew(t, members(4)),
+		"another weight": mustNew(t, heavier),
+		"fewer nodes":    fewerNodes,
+	} {
+		if other.Fingerprint() == ring.Fingerprint() {
+			t.Fatalf("expected a ring with %s to have another fingerprint", name)
+		}
+	}
+}
+
+func TestNew_rejectsInvalidRings(t *testing.T) {
+	if _, err := New([]Member{{Name: "a"}, {Name: "a"}}, DefaultVirtualNodes); err == nil {
+		t.Fatalf("expected duplicate members to be rejected")
+	}
+	if _, err := New([]Member{{Name: "a", Weight: -1}}, DefaultVirtualNodes); err == nil {
+		t.Fatalf("expected negative weights to be rejected")
+	}
+	if _, err := New(members(2), 0); err == nil {
+		t.Fatalf("expected 0 virtual nodes to be rejected")
+	}
+	empty, _ := New(nil, DefaultVirtualNodes)
+	if empty.Owner("key") != -1 {
+		t.Fatalf("expected no owner in an empty ring")
+	}
+}
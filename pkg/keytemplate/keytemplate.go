@@ -0,0 +1,100 @@
+package keytemplate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template builds rate limiting keys from request data, for frontends where the
+// key isn't given explicitly by the client (e.g. envoy descriptors or proxy headers).
+// Placeholders are written as {name}. Everything else is copied literally.
+// Example: "{domain}:{entry:remote_address}"
+type Template struct {
+	raw      string
+	segments []segment
+}
+
+type segment struct {
+	literal string
+	varName string // if non-empty, this segment is a placeholder
+}
+
+// Parse parses a template string. It fails on unbalanced or empty placeholders.
+func Parse(raw string) (*Template, error) {
+	t := &Template{raw: raw}
+	rest := raw
+	for len(rest) > 0 {
+		open := strings.IndexByte(rest, '{')
+		closing := strings.IndexByte(rest, '}')
+		if open == -1 {
+			if closing != -1 {
+				return nil, fmt.Errorf("unbalanced '}' in key template '%s'", raw)
+			}
+			t.segments = append(t.segments, segment{literal: rest})
+			break
+		}
+		if closing != -1 && closing < open {
+			return nil, fmt.Errorf("unbalanced '}' in key template '%s'", raw)
+		}
+		if open > 0 {
+			t.segments = append(t.segments, segment{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated placeholder in key template '%s'", raw)
+		}
+		name := strings.TrimSpace(rest[open+1 : open+end])
+		if len(name) == 0 || strings.ContainsRune(name, '{') {
+			return nil, fmt.Errorf("invalid placeholder in key template '%s'", raw)
+		}
+		t.segments = append(t.segments, segment{varName: name})
+		rest = rest[open+end+1:]
+	}
+	if len(t.segments) == 0 {
+		return nil, fmt.Errorf("key template is empty")
+	}
+	return t, nil
+}
+
+// MustParse is like Parse, but panics on error. Intended for defaults and tests.
+func MustParse(raw string) *Template {
+	t, err := Parse(raw)
+	if err != nil {
+		panic(fmt.Sprintf("BUG: invalid key template: %v", err))
+	}
+	return t
+}
+
+// Vars returns the names of all placeholders in the template, in order of appearance
+func (t *Template) Vars() []string {
+	var result []string
+	for _, seg := range t.segments {
+		if seg.varName != "" {
+			result = append(result, seg.varName)
+		}
+	}
+	return result
+}
+
+// Execute renders the template. The lookup function resolves placeholders. If any placeholder
+// can't be resolved, an error naming it is returned, so that callers can decide what to do
+// (usually: not rate limit, or reject the request)
+func (t *Template) Execute(lookup func(name string) (string, bool)) (string, error) {
+	var sb strings.Builder
+	for _, seg := range t.segments {
+		if seg.varName == "" {
+			sb.WriteString(seg.literal)
+			continue
+		}
+		value, ok := lookup(seg.varName)
+		if !ok {
+			return "", fmt.Errorf("unresolved placeholder '{%s}' in key template '%s'", seg.varName, t.raw)
+		}
+		sb.WriteString(value)
+	}
+	return sb.String(), nil
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
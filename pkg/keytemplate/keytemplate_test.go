@@ -0,0 +1,65 @@
+package keytemplate
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestParse_and_execute(t *testing.T) {
+
+	tmpl, err := Parse("{domain}:{entry:remote_address}/x")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"domain", "entry:remote_address"}, tmpl.Vars()); diff != "" {
+		t.Fatalf("unexpected vars (-want +got):\n%s", diff)
+	}
+
+	vars := map[string]string{"domain": "envoy", "entry:remote_address": "10.0.0.1"}
+	result, err := tmpl.Execute(func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result != "envoy:10.0.0.1/x" {
+		t.Fatalf("expected 'envoy:10.0.0.1/x', got '%s'", result)
+	}
+}
+
+func TestExecute_unresolved_placeholder(t *testing.T) {
+
+	tmpl := MustParse("{a}-{b}")
+
+	_, err := tmpl.Execute(func(name string) (string, bool) {
+		return "x", name == "a"
+	})
+	if err == nil {
+		t.Fatalf("expected error for unresolved placeholder")
+	}
+}
+
+func TestParse_invalid(t *testing.T) {
+	for _, raw := range []string{"", "{", "}", "a}{b", "{}", "{a{b}}"} {
+		if _, err := Parse(raw); err == nil {
+			t.Errorf("expected error for template '%s'", raw)
+		}
+	}
+}
+
+func TestParse_literal_only(t *testing.T) {
+
+	tmpl := MustParse("static-key")
+
+	result, err := tmpl.Execute(func(name string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result != "static-key" {
+		t.Fatalf("expected 'static-key', got '%s'", result)
+	}
+}
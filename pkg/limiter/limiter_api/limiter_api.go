@@ -2,6 +2,9 @@ package limiter_api
 
 import (
 	"context"
+	"regexp"
+	"sync/atomic"
+	"time"
 )
 
 type ExtRespCode string
@@ -26,6 +29,10 @@ type PermissionRequest struct {
 	CanWait            bool
 	MaxRequests        int
 	MaxRequestsInQueue int
+	WindowMillis       int
+	Hits               int       // the number of slots the request takes, all or none, see LimiterManagerSet.AskPermissionForHits. 0 means 1
+	LimitPercent       int       // decides the request against this percentage of the key's limit, without changing the limit. 0 means 100
+	QueuedAt           time.Time // set by the limiter instance when placed in its queue
 }
 
 func (r *PermissionRequest) IsLimiterManagerRequest()  {}
@@ -40,8 +47,37 @@ type ReleaseRequest struct {
 func (r *ReleaseRequest) IsLimiterManagerRequest()  {}
 func (r *ReleaseRequest) IsLimiterInstanceRequest() {}
 
+// PeekRequest asks for the current limit status of a key, without consuming any of its slots
+type PeekRequest struct {
+	Key      string
+	RespChan chan *LimitStatus
+}
+
+func (r *PeekRequest) IsLimiterManagerRequest()  {}
+func (r *PeekRequest) IsLimiterInstanceRequest() {}
+
 type PermissionResponse struct {
 	RespCode ExtRespCode
+	Status   LimitStatus
+}
+
+// LimitStatus describes the state of a key's limiter at the time a decision was made.
+// Protocol frontends use it to report limits/remaining/reset information back to clients.
+type LimitStatus struct {
+	MaxRequestsPerWindow  int
+	NumApprovedThisWindow int
+	WindowMillis          int
+	WindowResetsAt        time.Time
+}
+
+// Remaining returns the number of requests that can still be approved in the current window
+func (s *LimitStatus) Remaining() int {
+	return max(0, s.MaxRequestsPerWindow-s.NumApprovedThisWindow)
+}
+
+// ResetAfter returns the time left until the current window is reset
+func (s *LimitStatus) ResetAfter() time.Duration {
+	return max(0, time.Until(s.WindowResetsAt))
 }
 
 type ClientGaveUpNotification struct {
@@ -81,3 +117,104 @@ type InstanceDebugSnapshot struct {
 	NumWaiting            int
 	Found                 bool // The instance was found
 }
+
+// KeyState is the window of a key, as handed off to the key's new owner when the cluster changes.
+// The time left of the window is relative, so that it doesn't depend on the clocks of the instances agreeing.
+type KeyState struct {
+	Key                   string
+	WindowMillis          int
+	NumApprovedThisWindow int
+	NumDeniedThisWindow   int
+	ResetAfterMillis      int // time left of the window
+}
+
+// LoansPerShare is how many loans an equal share of a split key's limit is lent in. Smaller loans leave more
+// of the limit to instances that need it, larger ones take fewer round trips to the owner.
+const LoansPerShare = 4
+
+// Loan is part of the limit of a split key for the current window, lent by the key's owner to another instance,
+// which approves that many requests on its own
+type Loan struct {
+	Key                  string
+	Granted              int // 0 if the limit has been used up, or lent out, this window
+	MaxRequestsPerWindow int
+	WindowMillis         int
+	Remaining            int // left at the owner after the loan
+	ResetAfterMillis     int // time left of the window, after which the loan expires
+}
+
+// InstanceStats are published by a limiter instance as its state changes, so that they can be read
+// without sending messages to the instance. Fields are updated one by one, so a read
+// can see a mix of two consecutive states.
+type InstanceStats struct {
+	windowMillis          atomic.Int64
+	maxRequestsPerWindow  atomic.Int64
+	maxRequestsInQueue    atomic.Int64
+	numApprovedThisWindow atomic.Int64
+	numDeniedThisWindow   atomic.Int64
+	numWaiting            atomic.Int64
+	windowResetsAt        atomic.Int64 // unix millis
+}
+
+// Publish updates the stats. Only called by the instance itself
+func (s *InstanceStats) Publish(config *Config, numApprovedThisWindow int, numDeniedThisWindow int, numWaiting int, windowResetsAt time.Time) {
+	s.windowMillis.Store(int64(config.WindowMillis))
+	s.maxRequestsPerWindow.Store(int64(config.MaxRequestsPerWindow))
+	s.maxRequestsInQueue.Store(int64(config.MaxRequestsInQueue))
+	s.numApprovedThisWindow.Store(int64(numApprovedThisWindow))
+	s.numDeniedThisWindow.Store(int64(numDeniedThisWindow))
+	s.numWaiting.Store(int64(numWaiting))
+	s.windowResetsAt.Store(windowResetsAt.UnixMilli())
+}
+
+// Snapshot returns the stats in the same form as a debug snapshot
+func (s *InstanceStats) Snapshot(key string) *InstanceDebugSnapshot {
+	return &InstanceDebugSnapshot{
+		Key: key,
+		Config: Config{
+			WindowMillis:         int(s.windowMillis.Load()),
+			MaxRequestsPerWindow: int(s.maxRequestsPerWindow.Load()),
+			MaxRequestsInQueue:   int(s.maxRequestsInQueue.Load()),
+		},
+		NumApprovedThisWindow: int(s.numApprovedThisWindow.Load()),
+		NumDeniedThisWindow:   int(s.numDeniedThisWindow.Load()),
+		NumWaiting:            int(s.numWaiting.Load()),
+		Found:                 true,
+	}
+}
+
+// KeyState returns the stats as the state of the key's window
+func (s *InstanceStats) KeyState(key string) *KeyState {
+	return &KeyState{
+		Key:                   key,
+		WindowMillis:          int(s.windowMillis.Load()),
+		NumApprovedThisWindow: int(s.numApprovedThisWindow.Load()),
+		NumDeniedThisWindow:   int(s.numDeniedThisWindow.Load()),
+		ResetAfterMillis:      int(max(0, s.windowResetsAt.Load()-time.Now().UnixMilli())),
+	}
+}
+
+type KeySort string
+
+const (
+	SortByKey      KeySort = "key"      // ascending
+	SortByDenied   KeySort = "denied"   // most denied this window first
+	SortByWaiting  KeySort = "waiting"  // deepest queue first
+	SortByApproved KeySort = "approved" // most approved this window first
+)
+
+// KeyListQuery selects a page of keys with instances
+type KeyListQuery struct {
+	Prefix string
+	Regex  *regexp.Regexp        // nil = any key
+	Allow  func(key string) bool // nil = any key. For restricting tenants to their keys
+	SortBy KeySort               // "" = SortByKey
+	Cursor string                // NextCursor of the previous page, "" for the first page
+	Limit  int
+}
+
+// KeyListPage is a page of keys, sorted as requested
+type KeyListPage struct {
+	Keys       []*InstanceDebugSnapshot
+	NextCursor string // "" if this is the last page
+}
@@ -0,0 +1,150 @@
+package limiter_events
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventType string
+
+const (
+	Approved      EventType = "approved"       // a request was approved, directly or from the queue
+	Denied        EventType = "denied"         // a request was denied, or denied from the queue
+	Queued        EventType = "queued"         // a request was placed in the queue
+	GaveUp        EventType = "gave-up"        // a queued request was removed, because its client gave up
+	Released      EventType = "released"       // a slot was released
+	WindowReset   EventType = "window-reset"   // a new window started
+	ConfigChanged EventType = "config-changed" // the key's config changed
+	Expired       EventType = "expired"        // the key's instance stopped
+	TakenOver     EventType = "taken-over"     // the key's window was handed off here by its previous owner
+	Lent          EventType = "lent"           // part of the limit of a split key was lent to another instance
+	Repaid        EventType = "repaid"         // unused requests of a loan were given back by another instance
+)
+
+const (
+	maxSubscriptions         = 100 // on a hub, so that matching keys doesn't hold up the limiter instances too much
+	maxSubscriptionsPerOwner = 10  // of one owner, e.g. a tenant, so that one owner can't take them all
+)
+
+// ErrTooManySubscriptions is returned when subscribing to a hub, or as an owner, that has all the subscriptions it
+// may have
+var ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+// Event is something that happened to a key, and the key's state right after
+type Event struct {
+	Time                  time.Time
+	Key                   string
+	Type                  EventType
+	MaxRequestsPerWindow  int
+	NumApprovedThisWindow int
+	NumDeniedThisWindow   int
+	NumWaiting            int
+}
+
+// Hub passes events from limiter instances to subscribers. Publishing never blocks:
+// events are dropped for subscribers that don't keep up. Keys are matched against the subscriptions
+// by the instances publishing, so the number of subscriptions is limited.
+type Hub struct {
+	mutex                    sync.RWMutex
+	subscriptions            map[*Subscription]bool
+	byOwner                  map[string]int // number of subscriptions of owners
+	active                   atomic.Bool    // there are subscriptions
+	maxSubscriptions         int
+	maxSubscriptionsPerOwner int
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscriptions:            map[*Subscription]bool{},
+		byOwner:                  map[string]int{},
+		maxSubscriptions:         maxSubscriptions,
+		maxSubscriptionsPerOwner: maxSubscriptionsPerOwner,
+	}
+}
+
+// Active returns true if anyone is subscribed. Lets instances skip building events no one listens to.
+func (h *Hub) Active() bool {
+	return h != nil && h.active.Load()
+}
+
+// Publish passes an event to the subscriptions matching its key, without waiting for them
+func (h *Hub) Publish(event *Event) {
+	if !h.Active() {
+		return
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for subscription := range h.subscriptions {
+		if !subscription.matches(event.Key) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			subscription.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe subscribes to the events of keys for which matches returns true. Up to buffer events are
+// kept for the subscriber, and later events are dropped until it catches up. An owner, e.g. a tenant, can only
+// have a few of the hub's subscriptions, "" is no owner. ErrTooManySubscriptions is returned past the limits.
+func (h *Hub) Subscribe(owner string, matches func(key string) bool, buffer int) (*Subscription, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.subscriptions) >= h.maxSubscriptions || (owner != "" && h.byOwner[owner] >= h.maxSubscriptionsPerOwner) {
+		return nil, ErrTooManySubscriptions
+	}
+	subscription := &Subscription{
+		hub:     h,
+		owner:   owner,
+		matches: matches,
+		events:  make(chan *Event, buffer),
+	}
+	h.subscriptions[subscription] = true
+	if owner != "" {
+		h.byOwner[owner]++
+	}
+	h.active.Store(true)
+	return subscription, nil
+}
+
+// Subscription is a subscriber's stream of events
+type Subscription struct {
+	hub     *Hub
+	owner   string
+	matches func(key string) bool
+	events  chan *Event
+	dropped atomic.Int64
+	closed  bool // guarded by the hub's mutex
+}
+
+// Events returns the subscribed events. The channel is closed when the subscription is closed.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Dropped returns the number of events dropped so far, because the subscriber didn't keep up
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.hub.subscriptions, s)
+	if s.owner != "" {
+		if s.hub.byOwner[s.owner]--; s.hub.byOwner[s.owner] == 0 {
+			delete(s.hub.byOwner, s.owner)
+		}
+	}
+	s.hub.active.Store(len(s.hub.subscriptions) > 0)
+	close(s.events)
+}
@@ -0,0 +1,95 @@
+package limiter_events
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHub_publishes_to_matching_subscriptions(t *testing.T) {
+
+	hub := NewHub()
+	if hub.Active() {
+		t.Fatalf("expected a hub without subscriptions to be inactive")
+	}
+
+	fooKeys, _ := hub.Subscribe("", func(key string) bool { return strings.HasPrefix(key, "foo") }, 10)
+	allKeys, _ := hub.Subscribe("", func(key string) bool { return true }, 10)
+	if !hub.Active() {
+		t.Fatalf("expected the hub to be active")
+	}
+
+	hub.Publish(&Event{Key: "foo-1", Type: Approved})
+	hub.Publish(&Event{Key: "bar-1", Type: Denied})
+
+	if event := <-fooKeys.Events(); event.Key != "foo-1" {
+		t.Fatalf("expected foo-1, got %+v", event)
+	}
+	if len(fooKeys.Events()) != 0 {
+		t.Fatalf("expected only the matching event")
+	}
+	if len(allKeys.Events()) != 2 {
+		t.Fatalf("expected both events, got %d", len(allKeys.Events()))
+	}
+
+	fooKeys.Close()
+	fooKeys.Close() // closing twice is fine
+	if _, open := <-fooKeys.Events(); open {
+		t.Fatalf("expected the events channel to be closed")
+	}
+	allKeys.Close()
+	if hub.Active() {
+		t.Fatalf("expected the hub to be inactive after all subscriptions closed")
+	}
+	hub.Publish(&Event{Key: "foo-2", Type: Approved}) // no one listening
+}
+
+func TestHub_drops_events_for_slow_subscribers(t *testing.T) {
+
+	hub := NewHub()
+	slow, _ := hub.Subscribe("", func(key string) bool { return true }, 2)
+	defer slow.Close()
+
+	for i := 0; i < 5; i++ {
+		hub.Publish(&Event{Key: "key", Type: Approved}) // must not block
+	}
+
+	if len(slow.Events()) != 2 || slow.Dropped() != 3 {
+		t.Fatalf("expected 2 buffered and 3 dropped events, got %d and %d", len(slow.Events()), slow.Dropped())
+	}
+}
+
+func TestHub_limits_subscriptions(t *testing.T) {
+
+	hub := NewHub()
+	hub.maxSubscriptions = 3
+	hub.maxSubscriptionsPerOwner = 2
+	all := func(key string) bool { return true }
+
+	first, _ := hub.Subscribe("a", all, 1)
+	if _, err := hub.Subscribe("a", all, 1); err != nil {
+		t.Fatalf("expected a second subscription of a, got %v", err)
+	}
+	if _, err := hub.Subscribe("a", all, 1); !errors.Is(err, ErrTooManySubscriptions) {
+		t.Fatalf("expected a third subscription of a to be refused, got %v", err)
+	}
+	if _, err := hub.Subscribe("b", all, 1); err != nil {
+		t.Fatalf("expected a subscription of b, got %v", err)
+	}
+	if _, err := hub.Subscribe("", all, 1); !errors.Is(err, ErrTooManySubscriptions) {
+		t.Fatalf("expected a fourth subscription on the hub to be refused, got %v", err)
+	}
+
+	first.Close()
+	if _, err := hub.Subscribe("a", all, 1); err != nil {
+		t.Fatalf("expected a to subscribe again after closing a subscription, got %v", err)
+	}
+}
+
+func TestHub_nil_is_inactive(t *testing.T) {
+	var hub *Hub
+	if hub.Active() {
+		t.Fatalf("expected a nil hub to be inactive")
+	}
+	hub.Publish(&Event{Key: "key", Type: Approved})
+}
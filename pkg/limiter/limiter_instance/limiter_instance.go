@@ -1,32 +1,54 @@
 package limiter_instance
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"github.com/kivra/gocc/pkg/audit"
 	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_events"
 	"github.com/kivra/gocc/pkg/limiter/limiter_instance_api"
 	"github.com/kivra/gocc/pkg/limiter/limiter_manager_api"
 	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/metrics"
+	"github.com/kivra/gocc/pkg/tracing"
 	"github.com/samber/lo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
 	"time"
 )
 
+// Observers are told what an instance does. All of them are optional.
+type Observers struct {
+	Stats   *limiter_api.InstanceStats // kept up to date with the instance's state
+	Events  *limiter_events.Hub
+	Metrics *metrics.KeyMetrics
+	Audit   *audit.KeyAudit
+}
+
 func New(
 	key string,
 	config *limiter_api.Config,
 	parent chan<- limiter_manager_api.Request,
+	observers Observers,
 ) chan<- limiter_instance_api.Request {
 	l := &internalState{
 		key:                 key,
 		config:              *config, // copy it, because we might change it internally
 		nApprovedThisWindow: 0,
 		timeLastUsed:        time.Now(),
+		windowStart:         time.Now(),
 		throttled:           make([]*limiter_api.PermissionRequest, 0, config.MaxRequestsPerWindow),
 
 		mailbox: make(chan limiter_instance_api.Request, min(1_000, config.MaxRequestsPerWindow)), // some reasonable number
 		parent:  parent,
+		stats:   observers.Stats,
+		events:  observers.Events,
+		metrics: cmp.Or(observers.Metrics, metrics.Discard),
+		audit:   observers.Audit,
 	}
+	l.publishStats()
 
 	go l.loop()
 
@@ -39,12 +61,66 @@ type internalState struct {
 	nApprovedThisWindow int
 	nDeniedThisWindow   int
 	timeLastUsed        time.Time
+	windowStart         time.Time
 	throttled           []*limiter_api.PermissionRequest // requests that have been received, but are being throttled/waiting
+	takenOverApproved   int                              // of the states taken over this window, see limiter_manager_api.TakeOverRequest
+	takenOverDenied     int
+	lentThisWindow      int // requests of nApprovedThisWindow lent to other instances, see limiter_manager_api.LendRequest
 
 	mailbox chan limiter_instance_api.Request
 	parent  chan<- limiter_manager_api.Request
+	stats   *limiter_api.InstanceStats
+	events  *limiter_events.Hub
+	metrics *metrics.KeyMetrics
+	audit   *audit.KeyAudit
+}
+
+// record counts a decision in the metrics, and publishes it as an event
+func (state *internalState) record(eventType limiter_events.EventType) {
+	switch eventType {
+	case limiter_events.Approved:
+		state.metrics.Approved.Inc()
+	case limiter_events.Denied:
+		state.metrics.Denied.Inc()
+	case limiter_events.Queued:
+		state.metrics.Queued.Inc()
+	case limiter_events.GaveUp:
+		state.metrics.GaveUp.Inc()
+	}
+	state.emit(eventType)
+}
+
+// emit publishes an event with the current state, if anyone is listening
+func (state *internalState) emit(eventType limiter_events.EventType) {
+	if state.events.Active() {
+		state.events.Publish(&limiter_events.Event{
+			Time:                  time.Now(),
+			Key:                   state.key,
+			Type:                  eventType,
+			MaxRequestsPerWindow:  state.config.MaxRequestsPerWindow,
+			NumApprovedThisWindow: state.nApprovedThisWindow,
+			NumDeniedThisWindow:   state.nDeniedThisWindow,
+			NumWaiting:            len(state.throttled),
+		})
+	}
 }
 
+func (state *internalState) publishStats() {
+	if state.stats != nil {
+		state.stats.Publish(&state.config, state.nApprovedThisWindow, state.nDeniedThisWindow, len(state.throttled), state.limitStatus().WindowResetsAt)
+	}
+}
+
+// approveQueued approves the queued requests that fit in the window, in order
+func (state *internalState) approveQueued(ctx context.Context) {
+	n := 0
+	for n < len(state.throttled) && state.nApprovedThisWindow+n < state.limitFor(state.throttled[n]) {
+		n++
+	}
+	state.flushQueued(ctx, n)
+}
+
+// flushQueued approves the first nMax queued requests, regardless of the slots left in the window
 func (state *internalState) flushQueued(ctx context.Context, nMax int) {
 	n := min(nMax, len(state.throttled))
 	if n > 0 {
@@ -52,11 +128,92 @@ func (state *internalState) flushQueued(ctx context.Context, nMax int) {
 		state.timeLastUsed = time.Now()
 		numToFlush := min(len(state.throttled), n)
 		for i := 0; i < numToFlush; i++ {
-			state.throttled[i].RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Approved}
+			state.nApprovedThisWindow++
+			state.throttled[i].RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Approved, Status: state.limitStatusFor(state.throttled[i])}
+			state.metrics.QueueWait.Observe(time.Since(state.throttled[i].QueuedAt).Seconds())
+			traceQueueWait(state.throttled[i], limiter_api.Approved)
+			state.auditDecision(state.throttled[i], limiter_api.Approved)
 		}
-		state.nApprovedThisWindow += numToFlush
 		state.throttled = discardFirstItems(state.throttled, numToFlush)
+		// Events carry the state after the whole flush, with the queue already shrunk
+		for i := 0; i < numToFlush; i++ {
+			state.record(limiter_events.Approved)
+		}
+	}
+}
+
+// denyQueued denies all queued requests
+func (state *internalState) denyQueued() {
+	n := len(state.throttled)
+	for _, queued := range state.throttled {
+		state.nDeniedThisWindow++
+		queued.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Denied, Status: state.limitStatusFor(queued)}
+		traceQueueWait(queued, limiter_api.Denied)
+		state.auditDecision(queued, limiter_api.Denied)
+	}
+	state.throttled = discardFirstItems(state.throttled, n)
+	for i := 0; i < n; i++ {
+		state.record(limiter_events.Denied)
+	}
+}
+
+// auditDecision writes a decision on a request to the audit log, if it is sampled
+func (state *internalState) auditDecision(r *limiter_api.PermissionRequest, decision limiter_api.ExtRespCode) {
+	if !state.audit.Sampled() {
+		return
+	}
+	queueWaitMillis := int64(0)
+	if !r.QueuedAt.IsZero() {
+		queueWaitMillis = time.Since(r.QueuedAt).Milliseconds()
+	}
+	state.audit.Record(&audit.Decision{
+		Time:                 time.Now(),
+		Key:                  state.key,
+		Decision:             string(decision),
+		RequestID:            r.ReqID,
+		CorrelationID:        logctx.Get(r.Ctx, "correlation-id"),
+		QueueWaitMillis:      queueWaitMillis,
+		MaxRequestsPerWindow: state.config.MaxRequestsPerWindow,
+		MaxRequestsInQueue:   state.config.MaxRequestsInQueue,
+		WindowMillis:         state.config.WindowMillis,
+	})
+}
+
+// traceQueueWait adds the time a request spent in the queue to its trace, if it has one
+func traceQueueWait(r *limiter_api.PermissionRequest, outcome limiter_api.ExtRespCode) {
+	if !tracing.Traced(r.Ctx) {
+		return
+	}
+	_, span := tracing.Tracer().Start(r.Ctx, "queued",
+		trace.WithTimestamp(r.QueuedAt),
+		trace.WithAttributes(attribute.String("gocc.outcome", string(outcome))),
+	)
+	span.End()
+}
+
+// limitStatus returns the current limit status, to be included in responses
+func (state *internalState) limitStatus() limiter_api.LimitStatus {
+	return limiter_api.LimitStatus{
+		MaxRequestsPerWindow:  state.config.MaxRequestsPerWindow,
+		NumApprovedThisWindow: state.nApprovedThisWindow,
+		WindowMillis:          state.config.WindowMillis,
+		WindowResetsAt:        state.windowStart.Add(time.Duration(state.config.WindowMillis) * time.Millisecond),
+	}
+}
+
+// limitFor returns the limit a request is decided against, see limiter_api.PermissionRequest.LimitPercent
+func (state *internalState) limitFor(r *limiter_api.PermissionRequest) int {
+	if r.LimitPercent <= 0 {
+		return state.config.MaxRequestsPerWindow
 	}
+	return max(1, state.config.MaxRequestsPerWindow*r.LimitPercent/100)
+}
+
+// limitStatusFor is the limit status, with the limit the request was decided against
+func (state *internalState) limitStatusFor(r *limiter_api.PermissionRequest) limiter_api.LimitStatus {
+	status := state.limitStatus()
+	status.MaxRequestsPerWindow = state.limitFor(r)
+	return status
 }
 
 func (state *internalState) loop() {
@@ -72,6 +229,7 @@ func (state *internalState) loop() {
 
 	slog.Debug("Started limiter instance", logctx.GetAll(ctx)...)
 	expiryNotificationSent := false
+	continuesHandedOffWindow := false // the ticker is set to end a window handed off by the key's previous owner
 
 	for {
 		select {
@@ -79,9 +237,18 @@ func (state *internalState) loop() {
 		case <-ticker.C:
 
 			// slog.Debug("Resetting approval count", logctx.GetAll(ctx)...)
+			if continuesHandedOffWindow {
+				ticker.Reset(time.Duration(state.config.WindowMillis) * time.Millisecond)
+				continuesHandedOffWindow = false
+			}
 			state.nApprovedThisWindow = 0
 			state.nDeniedThisWindow = 0
-			state.flushQueued(ctx, state.config.MaxRequestsPerWindow) // also updates timeLastUsed if any were flushed
+			state.takenOverApproved = 0
+			state.takenOverDenied = 0
+			state.lentThisWindow = 0
+			state.windowStart = time.Now()
+			state.emit(limiter_events.WindowReset)
+			state.approveQueued(ctx) // also updates timeLastUsed if any were approved
 			if time.Since(state.timeLastUsed) > time.Duration(3*state.config.WindowMillis)*time.Millisecond && !expiryNotificationSent {
 				// slog.Debug("instance expired: telling parent", logctx.GetAll(ctx)...)
 				state.parent <- &limiter_manager_api.InstanceExpiredNotification{Key: state.key, InstanceMailbox: state.mailbox}
@@ -103,6 +270,7 @@ func (state *internalState) loop() {
 					// slog.Debug(fmt.Sprintf("Changing windowMillis to %d", r.WindowMillis), logctx.GetAll(ctx)...)
 					ticker.Stop()
 					ticker = time.NewTicker(time.Duration(r.WindowMillis) * time.Millisecond)
+					state.windowStart = time.Now()
 					state.config.WindowMillis = r.WindowMillis
 				}
 
@@ -122,9 +290,18 @@ func (state *internalState) loop() {
 					state.config.MaxRequestsPerWindow = r.MaxRequestsPerWindow
 				}
 
+				if r.Metrics != nil { // the key may match other patterns now
+					state.metrics = r.Metrics
+				}
+				if r.Audit != nil {
+					state.audit = r.Audit
+				}
+				state.emit(limiter_events.ConfigChanged)
+
 			case *limiter_instance_api.Kill:
 				// slog.Debug("Received kill notification, no more requests will be received by this instance", logctx.GetAll(ctx)...)
 				state.flushQueued(ctx, len(state.throttled)) // flush any remaining requests. This can happen if we get messages EXACTLY when we're deregistered. It's ok. It's just a rate limiter :)
+				state.emit(limiter_events.Expired)
 				state.parent <- &limiter_manager_api.InstanceDiedNotification{Key: state.key}
 				return // we're done
 
@@ -139,6 +316,9 @@ func (state *internalState) loop() {
 				})
 				if found {
 					state.throttled = discardItemAt(state.throttled, idx)
+					state.record(limiter_events.GaveUp)
+					traceQueueWait(r.OriginalRequest, limiter_api.ClientGaveUp)
+					state.auditDecision(r.OriginalRequest, limiter_api.ClientGaveUp)
 					// slog.Debug("Client gave up, removed from queue", logctx.GetAll(ctx)...)
 				} else {
 					slog.Warn("Client gave up, but original request was not found in queue for cleanup!", logctx.GetAll(ctx)...)
@@ -158,26 +338,45 @@ func (state *internalState) loop() {
 					state.config.MaxRequestsInQueue = r.MaxRequestsInQueue
 				}
 
-				// check if we have any slots left
-				if state.nApprovedThisWindow >= state.config.MaxRequestsPerWindow {
-					if r.CanWait {
+				if r.WindowMillis != 0 &&
+					r.WindowMillis != limiter_api.NoChange &&
+					state.config.WindowMillis != r.WindowMillis {
+
+					ticker.Stop()
+					ticker = time.NewTicker(time.Duration(r.WindowMillis) * time.Millisecond)
+					state.windowStart = time.Now()
+					state.config.WindowMillis = r.WindowMillis
+				}
+
+				// check if we have any slots left, for all hits of the request
+				hits := max(1, r.Hits)
+				if state.nApprovedThisWindow+hits > state.limitFor(r) {
+					if r.CanWait && hits == 1 {
 						if len(state.throttled) < state.config.MaxRequestsInQueue {
 							// slog.Debug("No slots left in window, placing in wait queue", logctx.GetAll(ctx)...)
+							r.QueuedAt = time.Now()
 							state.throttled = append(state.throttled, r)
+							state.record(limiter_events.Queued)
 						} else {
 							// slog.Debug("No slots left in window, and no slots left in wait queue, denying Request", logctx.GetAll(ctx)...)
 							state.nDeniedThisWindow++
-							r.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Denied}
+							r.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Denied, Status: state.limitStatusFor(r)}
+							state.record(limiter_events.Denied)
+							state.auditDecision(r, limiter_api.Denied)
 						}
 					} else {
 						// slog.Debug("No slots left in window, denying Request", logctx.GetAll(ctx)...)
 						state.nDeniedThisWindow++
-						r.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Denied}
+						r.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Denied, Status: state.limitStatusFor(r)}
+						state.record(limiter_events.Denied)
+						state.auditDecision(r, limiter_api.Denied)
 					}
 				} else {
 					// slog.Debug("Slot approved", logctx.GetAll(ctx)...)
-					state.nApprovedThisWindow++
-					r.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Approved}
+					state.nApprovedThisWindow += hits
+					r.RespChan <- &limiter_api.PermissionResponse{RespCode: limiter_api.Approved, Status: state.limitStatusFor(r)}
+					state.record(limiter_events.Approved)
+					state.auditDecision(r, limiter_api.Approved)
 				}
 
 			case *limiter_api.ReleaseRequest:
@@ -191,6 +390,35 @@ func (state *internalState) loop() {
 
 				state.timeLastUsed = time.Now()
 				state.nApprovedThisWindow = max(0, state.nApprovedThisWindow-1)
+				state.emit(limiter_events.Released)
+
+			case *limiter_api.PeekRequest:
+				// Doesn't count as usage, so peeking alone doesn't keep the instance alive
+				status := state.limitStatus()
+				r.RespChan <- &status
+
+			case *limiter_manager_api.ResetRequest:
+				slog.Info("Resetting counters on admin request", logctx.GetAll(ctx)...)
+				ticker.Reset(time.Duration(state.config.WindowMillis) * time.Millisecond)
+				state.nApprovedThisWindow = 0
+				state.nDeniedThisWindow = 0
+				state.takenOverApproved = 0
+				state.takenOverDenied = 0
+				state.lentThisWindow = 0
+				state.windowStart = time.Now()
+				state.emit(limiter_events.WindowReset)
+				state.approveQueued(ctx)
+				r.RespChan <- &limiter_manager_api.KeyActionResult{Found: true}
+
+			case *limiter_manager_api.DrainQueueRequest:
+				slog.Info(fmt.Sprintf("Draining queue of %d on admin request, deny=%v", len(state.throttled), r.Deny), logctx.GetAll(ctx)...)
+				n := len(state.throttled)
+				if r.Deny {
+					state.denyQueued()
+				} else {
+					state.flushQueued(ctx, n) // regardless of the slots left in the window
+				}
+				r.RespChan <- &limiter_manager_api.KeyActionResult{Found: true, NumDrained: n}
 
 			case *limiter_api.DebugSnapshotRequest:
 				// slog.Debug("Received debug snapshot request", logctx.GetAll(ctx)...)
@@ -203,11 +431,72 @@ func (state *internalState) loop() {
 					Found:                 true,
 				}
 
+			case *limiter_instance_api.HandOff:
+				// The instance is killed next, see limiter_manager_api.HandOffRequest. Approving the queued requests
+				// would go over the limit, denied they can be retried at the new owner
+				state.denyQueued()
+				status := state.limitStatus()
+				r.RespChan <- &limiter_api.KeyState{
+					Key:                   state.key,
+					WindowMillis:          state.config.WindowMillis,
+					NumApprovedThisWindow: state.nApprovedThisWindow,
+					NumDeniedThisWindow:   state.nDeniedThisWindow,
+					ResetAfterMillis:      int(status.ResetAfter().Milliseconds()),
+				}
+
+			case *limiter_manager_api.TakeOverRequest:
+				// Never longer than the key's own window, which the windows after this one are
+				resetAfter := time.Duration(min(r.State.ResetAfterMillis, r.State.WindowMillis, state.config.WindowMillis)) * time.Millisecond
+				if resetAfter > 0 {
+					slog.Debug(fmt.Sprintf("Taking over window with %d approved, ending in %v", r.State.NumApprovedThisWindow, resetAfter), logctx.GetAll(ctx)...)
+					// Continue the window of the previous owner for the time it has left, so that the key's window
+					// doesn't restart when it moves
+					state.windowStart = time.Now().Add(resetAfter - time.Duration(state.config.WindowMillis)*time.Millisecond)
+					ticker.Reset(resetAfter)
+					continuesHandedOffWindow = true
+					state.nApprovedThisWindow += max(0, r.State.NumApprovedThisWindow-state.takenOverApproved)
+					state.nDeniedThisWindow += max(0, r.State.NumDeniedThisWindow-state.takenOverDenied)
+					state.takenOverApproved = max(state.takenOverApproved, r.State.NumApprovedThisWindow)
+					state.takenOverDenied = max(state.takenOverDenied, r.State.NumDeniedThisWindow)
+					state.emit(limiter_events.TakenOver)
+				}
+				r.RespChan <- &limiter_manager_api.KeyActionResult{Found: true}
+
+			case *limiter_manager_api.LendRequest:
+				state.timeLastUsed = time.Now()
+				share := state.config.MaxRequestsPerWindow / max(1, r.Shares)
+				granted := min(max(1, share/limiter_api.LoansPerShare), max(0, state.config.MaxRequestsPerWindow-state.nApprovedThisWindow))
+				state.nApprovedThisWindow += granted
+				state.lentThisWindow += granted
+				status := state.limitStatus()
+				r.RespChan <- &limiter_api.Loan{
+					Key:                  state.key,
+					Granted:              granted,
+					MaxRequestsPerWindow: status.MaxRequestsPerWindow,
+					WindowMillis:         status.WindowMillis,
+					Remaining:            status.Remaining(),
+					ResetAfterMillis:     int(status.ResetAfter().Milliseconds()),
+				}
+				if granted > 0 {
+					state.emit(limiter_events.Lent)
+				}
+
+			case *limiter_manager_api.RepayRequest:
+				repaid := min(r.N, state.lentThisWindow, state.nApprovedThisWindow)
+				if repaid > 0 {
+					state.nApprovedThisWindow -= repaid
+					state.lentThisWindow -= repaid
+					state.emit(limiter_events.Repaid)
+					state.approveQueued(ctx)
+				}
+
 			default:
 				slog.Error(fmt.Sprintf("Unexpected message of type %T", req), logctx.GetAll(ctx)...)
 			}
 		}
 
+		state.publishStats()
+
 	}
 
 }
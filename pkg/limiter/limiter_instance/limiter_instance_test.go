@@ -23,6 +23,7 @@ func TestNew_instance_can_be_closed(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 
 	instance <- &limiter_instance_api.Kill{}
@@ -57,6 +58,7 @@ func TestNew_instance_can_be_queried_for_debug_snapshot(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
@@ -89,6 +91,7 @@ func TestNew_instance_can_display_send_status(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
@@ -126,6 +129,7 @@ func TestNew_can_display_updated_config(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
@@ -166,6 +170,7 @@ func TestNew_can_config_values_only_update_on_nonzero(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
@@ -207,6 +212,7 @@ func TestNew_approves_max_request_but_not_more(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
@@ -235,6 +241,7 @@ func TestNew_approves_can_queue_a_lot(t *testing.T) {
 			MaxRequestsInQueue:   1000,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
@@ -282,6 +289,7 @@ func TestNew_approves_max_request_plus_queue_but_not_more(t *testing.T) {
 			MaxRequestsInQueue:   10,
 		},
 		parentChan,
+		Observers{},
 	)
 	defer func() { instance <- &limiter_instance_api.Kill{} }()
 
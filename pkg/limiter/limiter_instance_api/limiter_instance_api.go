@@ -1,6 +1,10 @@
 package limiter_instance_api
 
-import "github.com/kivra/gocc/pkg/limiter/limiter_api"
+import (
+	"github.com/kivra/gocc/pkg/audit"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/metrics"
+)
 
 type Request interface {
 	IsLimiterInstanceRequest()
@@ -13,6 +17,16 @@ func (r *Kill) IsLimiterInstanceRequest() {}
 
 type ConfigUpdateNotification struct {
 	*limiter_api.Config
+	Metrics *metrics.KeyMetrics // of the pattern that the key matches now, nil = unchanged
+	Audit   *audit.KeyAudit     // of the pattern that the key matches now, nil = unchanged
 }
 
 func (r *ConfigUpdateNotification) IsLimiterInstanceRequest() {}
+
+// HandOff asks an instance for the state of its window, for the key's new owner. Its queue is denied first,
+// and counted in the state, since the instance is killed right after.
+type HandOff struct {
+	RespChan chan *limiter_api.KeyState
+}
+
+func (r *HandOff) IsLimiterInstanceRequest() {}
@@ -0,0 +1,141 @@
+package limiter_manager
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"slices"
+	"strings"
+)
+
+// keyCursor is the position of the last key of a page, in the page's sort order
+type keyCursor struct {
+	Value int    `json:"v"`
+	Key   string `json:"k"`
+}
+
+// KeyStates returns the state of the windows of the keys for which matches returns true. Like ListKeys,
+// it reads the stats that instances publish, without holding them up.
+func (mgr *LimiterManagerSet) KeyStates(matches func(key string) bool) []*limiter_api.KeyState {
+	var result []*limiter_api.KeyState
+	mgr.stats.Range(func(k, v any) bool {
+		if key := k.(string); matches(key) {
+			result = append(result, v.(*limiter_api.InstanceStats).KeyState(key))
+		}
+		return true
+	})
+	return result
+}
+
+// ListKeys returns a page of the keys that have instances, filtered and sorted as requested.
+// It reads the stats that instances publish, so it doesn't send any messages to the shards or
+// instances, and doesn't hold them up. As counters change between pages, keys sorted by
+// counters may show up on more than one page, or on none. Only the keys of the page, and the one after it, are
+// kept while scanning, so pages cost a scan of the keys but no more memory than their size.
+func (mgr *LimiterManagerSet) ListKeys(query *limiter_api.KeyListQuery) (*limiter_api.KeyListPage, error) {
+
+	if query.Limit <= 0 {
+		return nil, fmt.Errorf("limit must be > 0, got %d", query.Limit)
+	}
+	sortBy := cmp.Or(query.SortBy, limiter_api.SortByKey)
+	if !slices.Contains([]limiter_api.KeySort{limiter_api.SortByKey, limiter_api.SortByDenied, limiter_api.SortByWaiting, limiter_api.SortByApproved}, sortBy) {
+		return nil, fmt.Errorf("unknown sort '%s'", sortBy)
+	}
+	after, err := decodeKeyCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	compare := func(a, b *limiter_api.InstanceDebugSnapshot) int {
+		return compareKeys(sortValue(a, sortBy), a.Key, sortValue(b, sortBy), b.Key)
+	}
+	// The first limit+1 keys in sort order, the one after the page telling that there is a next page
+	matching := &keyHeap{compare: compare}
+	mgr.stats.Range(func(k, v any) bool {
+		key := k.(string)
+		if !strings.HasPrefix(key, query.Prefix) ||
+			(query.Regex != nil && !query.Regex.MatchString(key)) ||
+			(query.Allow != nil && !query.Allow(key)) {
+			return true
+		}
+		snapshot := v.(*limiter_api.InstanceStats).Snapshot(key)
+		if after != nil && compareKeys(after.Value, after.Key, sortValue(snapshot, sortBy), key) >= 0 {
+			return true // on a previous page
+		}
+		if matching.Len() <= query.Limit {
+			heap.Push(matching, snapshot)
+		} else if compare(snapshot, matching.keys[0]) < 0 {
+			matching.keys[0] = snapshot
+			heap.Fix(matching, 0)
+		}
+		return true
+	})
+
+	keys := matching.keys
+	slices.SortFunc(keys, compare)
+
+	page := &limiter_api.KeyListPage{Keys: keys}
+	if len(keys) > query.Limit {
+		page.Keys = keys[:query.Limit]
+		last := page.Keys[query.Limit-1]
+		page.NextCursor = encodeKeyCursor(&keyCursor{Value: sortValue(last, sortBy), Key: last.Key})
+	}
+	return page, nil
+}
+
+// keyHeap is a heap of keys with the last one in sort order on top, to be replaced by keys before it
+type keyHeap struct {
+	keys    []*limiter_api.InstanceDebugSnapshot
+	compare func(a, b *limiter_api.InstanceDebugSnapshot) int
+}
+
+func (h *keyHeap) Len() int           { return len(h.keys) }
+func (h *keyHeap) Less(i, j int) bool { return h.compare(h.keys[i], h.keys[j]) > 0 }
+func (h *keyHeap) Swap(i, j int)      { h.keys[i], h.keys[j] = h.keys[j], h.keys[i] }
+func (h *keyHeap) Push(x any)         { h.keys = append(h.keys, x.(*limiter_api.InstanceDebugSnapshot)) }
+func (h *keyHeap) Pop() any {
+	last := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	return last
+}
+
+// sortValue is what keys are sorted by, highest first. Keys with the same value are sorted by key.
+func sortValue(snapshot *limiter_api.InstanceDebugSnapshot, sortBy limiter_api.KeySort) int {
+	switch sortBy {
+	case limiter_api.SortByDenied:
+		return snapshot.NumDeniedThisWindow
+	case limiter_api.SortByWaiting:
+		return snapshot.NumWaiting
+	case limiter_api.SortByApproved:
+		return snapshot.NumApprovedThisWindow
+	default:
+		return 0
+	}
+}
+
+func compareKeys(valueA int, keyA string, valueB int, keyB string) int {
+	return cmp.Or(cmp.Compare(valueB, valueA), strings.Compare(keyA, keyB))
+}
+
+func encodeKeyCursor(cursor *keyCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeKeyCursor(cursor string) (*keyCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var result keyCursor
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &result, nil
+}
@@ -0,0 +1,85 @@
+package limiter_manager
+
+import (
+	"context"
+	"fmt"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/samber/lo"
+	"regexp"
+	"testing"
+)
+
+func TestLimiterManager_ListKeys(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 2,
+		MaxRequestsInQueue:   0,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer mgr.Close()
+
+	ctx := context.Background()
+
+	// key-i gets i denied requests
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 2+i; j++ {
+			mgr.AskPermission(ctx, fmt.Sprintf("key-%d", i), false, limiter_api.NoChange, limiter_api.NoChange)
+		}
+	}
+	mgr.AskPermission(ctx, "other", false, limiter_api.NoChange, limiter_api.NoChange)
+
+	// Stats are published right after the instances answer
+	waitFor(t, func() bool {
+		page, _ := mgr.ListKeys(&limiter_api.KeyListQuery{SortBy: limiter_api.SortByDenied, Limit: 1})
+		return len(page.Keys) == 1 && page.Keys[0].NumDeniedThisWindow == 4
+	})
+
+	keysOf := func(page *limiter_api.KeyListPage) []string {
+		return lo.Map(page.Keys, func(s *limiter_api.InstanceDebugSnapshot, _ int) string { return s.Key })
+	}
+
+	tests := []struct {
+		name     string
+		query    limiter_api.KeyListQuery
+		expected [][]string // pages
+	}{
+		{name: "by key", query: limiter_api.KeyListQuery{Limit: 4}, expected: [][]string{{"key-0", "key-1", "key-2", "key-3"}, {"key-4", "other"}}},
+		{name: "by denied", query: limiter_api.KeyListQuery{Prefix: "key-", SortBy: limiter_api.SortByDenied, Limit: 2}, expected: [][]string{{"key-4", "key-3"}, {"key-2", "key-1"}, {"key-0"}}},
+		{name: "regex", query: limiter_api.KeyListQuery{Regex: regexp.MustCompile("[13]$"), Limit: 10}, expected: [][]string{{"key-1", "key-3"}}},
+		{name: "allow", query: limiter_api.KeyListQuery{Allow: func(key string) bool { return key == "other" }, Limit: 10}, expected: [][]string{{"other"}}},
+		{name: "no matches", query: limiter_api.KeyListQuery{Prefix: "nope", Limit: 10}, expected: [][]string{nil}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query
+			for i, expected := range test.expected {
+				page, err := mgr.ListKeys(&query)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if keys := keysOf(page); fmt.Sprint(keys) != fmt.Sprint(expected) {
+					t.Fatalf("page %d: expected %v, got %v", i, expected, keys)
+				}
+				if (page.NextCursor == "") != (i == len(test.expected)-1) {
+					t.Fatalf("page %d: unexpected cursor '%s'", i, page.NextCursor)
+				}
+				query.Cursor = page.NextCursor
+			}
+		})
+	}
+
+	if _, err := mgr.ListKeys(&limiter_api.KeyListQuery{Cursor: "garbage!", Limit: 10}); err == nil {
+		t.Fatalf("expected an invalid cursor to be rejected")
+	}
+	if _, err := mgr.ListKeys(&limiter_api.KeyListQuery{SortBy: "random", Limit: 10}); err == nil {
+		t.Fatalf("expected an unknown sort to be rejected")
+	}
+
+	// Expired instances are no longer listed
+	mgr.Expire(ctx, "other")
+	page, _ := mgr.ListKeys(&limiter_api.KeyListQuery{Prefix: "other", Limit: 10})
+	if len(page.Keys) != 0 {
+		t.Fatalf("expected the expired key to be gone, got %v", keysOf(page))
+	}
+}
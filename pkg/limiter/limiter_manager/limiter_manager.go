@@ -2,23 +2,34 @@ package limiter_manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/kivra/gocc/pkg/audit"
 	"github.com/kivra/gocc/pkg/config"
 	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_events"
 	"github.com/kivra/gocc/pkg/limiter/limiter_instance"
 	"github.com/kivra/gocc/pkg/limiter/limiter_instance_api"
 	"github.com/kivra/gocc/pkg/limiter/limiter_manager_api"
 	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/metrics"
+	"github.com/kivra/gocc/pkg/tracing"
 	"github.com/samber/lo"
 	lop "github.com/samber/lo/parallel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"hash/fnv"
 	"log/slog"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var DefaultSharding = 25
 
+// ErrNotSplit is returned by Lend for keys that aren't split, unless they already have an instance to lend from
+var ErrNotSplit = errors.New("the key is not split")
+
 // LimiterManagerSet is the main entry point for the limiter system.
 // It internally runs multiple shards of the manager, and uses hashing on keys
 // to distribute requests to the correct shard. Below each shard is then
@@ -27,6 +38,9 @@ var DefaultSharding = 25
 type LimiterManagerSet struct {
 	reqIdGen  atomic.Int64
 	mailboxes []chan<- limiter_manager_api.Request
+	stats     *sync.Map      // key -> *limiter_api.InstanceStats, for the instances of all shards
+	numKeys   []atomic.Int64 // the number of instances of each shard
+	events    *limiter_events.Hub
 }
 
 func NewManagerSet(
@@ -35,6 +49,18 @@ func NewManagerSet(
 	configFromFileCh <-chan *config.CfgFromFile,
 	sharding int,
 ) *LimiterManagerSet {
+	return NewManagerSetWithAudit(globalConfig, initConfigFromFile, configFromFileCh, sharding, nil)
+}
+
+// NewManagerSetWithAudit is like NewManagerSet, but also writes the decisions of the limiter
+// instances to an audit log, sampled per config file pattern. No decisions are written if auditLog is nil.
+func NewManagerSetWithAudit(
+	globalConfig *limiter_api.Config,
+	initConfigFromFile *config.CfgFromFile,
+	configFromFileCh <-chan *config.CfgFromFile,
+	sharding int,
+	auditLog *audit.Log,
+) *LimiterManagerSet {
 
 	if sharding <= 0 {
 		panic(fmt.Sprintf("BUG: sharding must be > 0, got %d", sharding))
@@ -44,13 +70,16 @@ func NewManagerSet(
 	}
 
 	// Prepare the shards
+	stats := &sync.Map{}
+	events := limiter_events.NewHub()
 	mailBoxes := make([]chan<- limiter_manager_api.Request, sharding)
 	configChs := make([]chan *config.CfgFromFile, sharding)
+	numKeys := make([]atomic.Int64, sharding)
 	for i := 0; i < sharding; i++ {
 		mailbox := make(chan limiter_manager_api.Request, 10_000) // some reasonable number of requests buffered in each manager
 		configChs[i] = make(chan *config.CfgFromFile, 10)         // some reasonable number of config updates buffered in each manager
 		mailBoxes[i] = mailbox
-		go loop(globalConfig, mailbox, initConfigFromFile, configChs[i])
+		go loop(globalConfig, mailbox, initConfigFromFile, configChs[i], stats, &numKeys[i], events, metrics.ForShard(i), auditLog)
 	}
 
 	// Forward the changes in config from file to all shards
@@ -64,7 +93,7 @@ func NewManagerSet(
 		}
 	}()
 
-	l := &LimiterManagerSet{mailboxes: mailBoxes}
+	l := &LimiterManagerSet{mailboxes: mailBoxes, stats: stats, numKeys: numKeys, events: events}
 
 	return l
 }
@@ -78,6 +107,15 @@ func hash(s string) uint32 {
 	return h.Sum32()
 }
 
+// NumKeys returns the number of keys that have instances, across all shards
+func (mgr *LimiterManagerSet) NumKeys() int {
+	result := int64(0)
+	for i := range mgr.numKeys {
+		result += mgr.numKeys[i].Load()
+	}
+	return int(result)
+}
+
 // GetShardIndex returns the index of the shard that should handle the given key. Public for testing purposes.
 func (mgr *LimiterManagerSet) GetShardIndex(key string) int {
 	return int(hash(key)) % len(mgr.mailboxes)
@@ -152,6 +190,72 @@ func (mgr *LimiterManagerSet) AskPermission(
 	maxRequests int,
 	maxRequestsInQueue int,
 ) (limiter_api.ExtRespCode, string) {
+	resp, reqId := mgr.AskPermissionWithStatus(ctx, key, canWait, maxRequests, maxRequestsInQueue, limiter_api.NoChange)
+	return resp.RespCode, reqId
+}
+
+// AskPermissionWithStatus is like AskPermission, but also returns the limit status of the key
+// at the time the decision was made. Used by frontends that report remaining quota/reset times to clients.
+// It also allows overriding the window size, which protocols like CL.THROTTLE specify per request.
+func (mgr *LimiterManagerSet) AskPermissionWithStatus(
+	ctx context.Context,
+	key string,
+	canWait bool,
+	maxRequests int,
+	maxRequestsInQueue int,
+	windowMillis int,
+) (*limiter_api.PermissionResponse, string) {
+	return mgr.askPermission(ctx, key, canWait, 1, 0, maxRequests, maxRequestsInQueue, windowMillis)
+}
+
+// AskPermissionForHits is like AskPermissionWithStatus, but asks for several slots at once, e.g. for the
+// hits_addend of envoy or the quantity of CL.THROTTLE. Either all of them are approved, or none, so more hits
+// than the key's limit are always denied. The request doesn't wait in the queue.
+func (mgr *LimiterManagerSet) AskPermissionForHits(
+	ctx context.Context,
+	key string,
+	hits int,
+	maxRequests int,
+	maxRequestsInQueue int,
+	windowMillis int,
+) (*limiter_api.PermissionResponse, string) {
+	return mgr.askPermission(ctx, key, false, max(1, hits), 0, maxRequests, maxRequestsInQueue, windowMillis)
+}
+
+// AskPermissionWithinPercent is like AskPermissionWithStatus, but decides the request against a percentage of the
+// key's limit, e.g. while the key's owner is down. The key's limit itself doesn't change, so later requests, and
+// the key's window if this instance takes it over, get all of it again.
+func (mgr *LimiterManagerSet) AskPermissionWithinPercent(
+	ctx context.Context,
+	key string,
+	canWait bool,
+	percent int,
+	maxRequests int,
+	maxRequestsInQueue int,
+) (*limiter_api.PermissionResponse, string) {
+	return mgr.askPermission(ctx, key, canWait, 1, percent, maxRequests, maxRequestsInQueue, limiter_api.NoChange)
+}
+
+func (mgr *LimiterManagerSet) askPermission(
+	ctx context.Context,
+	key string,
+	canWait bool,
+	hits int,
+	limitPercent int,
+	maxRequests int,
+	maxRequestsInQueue int,
+	windowMillis int,
+) (resp *limiter_api.PermissionResponse, reqId string) {
+
+	// The round trip through the manager's mailbox and the instance, including any wait in its queue
+	if tracing.Traced(ctx) {
+		var span trace.Span
+		ctx, span = tracing.Tracer().Start(ctx, "AskPermission", trace.WithAttributes(attribute.Bool("gocc.can_wait", canWait)))
+		defer func() {
+			span.SetAttributes(attribute.String("gocc.decision", string(resp.RespCode)))
+			span.End()
+		}()
+	}
 
 	// Need a buffered channel (,1), so that the limiter can answer if the
 	// client gives up before the limiter has had time to answer.
@@ -159,7 +263,7 @@ func (mgr *LimiterManagerSet) AskPermission(
 
 	// we used to use uuids here, but it's not necessary, an int64 atomic counter is enough
 	// and 100x faster (YES we were actually peformance limited by UUID generation)
-	reqId := fmt.Sprintf("%d", mgr.reqIdGen.Add(1))
+	reqId = fmt.Sprintf("%d", mgr.reqIdGen.Add(1))
 	req := &limiter_api.PermissionRequest{
 		ReqID:              reqId,
 		Key:                key,
@@ -168,6 +272,9 @@ func (mgr *LimiterManagerSet) AskPermission(
 		CanWait:            canWait,
 		MaxRequests:        maxRequests,
 		MaxRequestsInQueue: maxRequestsInQueue,
+		WindowMillis:       windowMillis,
+		Hits:               hits,
+		LimitPercent:       limitPercent,
 	}
 
 	mailbox := mgr.getShardMailbox(key)
@@ -176,11 +283,37 @@ func (mgr *LimiterManagerSet) AskPermission(
 
 	select {
 	case resp := <-respChan:
-		return resp.RespCode, reqId
+		return resp, reqId
 	case <-ctx.Done():
 		slog.Warn("client gave up on request. context cancelled before receiving response", logctx.GetAll(ctx)...)
 		mailbox <- &limiter_api.ClientGaveUpNotification{OriginalRequest: req}
-		return limiter_api.ClientGaveUp, reqId
+		return &limiter_api.PermissionResponse{RespCode: limiter_api.ClientGaveUp}, reqId
+	}
+}
+
+// Peek returns the current limit status of a key, without consuming a slot. Keys without
+// a limiter instance report their configured limits and a fresh window.
+func (mgr *LimiterManagerSet) Peek(
+	ctx context.Context,
+	key string,
+) (*limiter_api.LimitStatus, error) {
+
+	respChan := make(chan *limiter_api.LimitStatus, 1)
+
+	req := &limiter_api.PeekRequest{
+		Key:      key,
+		RespChan: respChan,
+	}
+
+	mailbox := mgr.getShardMailbox(key)
+
+	mailbox <- req
+
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -205,6 +338,127 @@ func (mgr *LimiterManagerSet) Release(
 	mailbox <- req
 }
 
+// KeyConfig returns a key's runtime override, if any, and the config that the key gets with it
+func (mgr *LimiterManagerSet) KeyConfig(
+	ctx context.Context,
+	key string,
+) (*limiter_manager_api.KeyConfig, error) {
+	respChan := make(chan *limiter_manager_api.KeyConfig, 1)
+	mgr.getShardMailbox(key) <- &limiter_manager_api.KeyConfigRequest{Key: key, RespChan: respChan}
+	return awaitResponse(ctx, respChan)
+}
+
+// SetOverride overrides a key's config at runtime, on top of the global config and the config file.
+// Zero values in the override are not overridden. A nil override clears any previous override.
+func (mgr *LimiterManagerSet) SetOverride(
+	ctx context.Context,
+	key string,
+	override *limiter_api.Config,
+) (*limiter_manager_api.KeyConfig, error) {
+	respChan := make(chan *limiter_manager_api.KeyConfig, 1)
+	mgr.getShardMailbox(key) <- &limiter_manager_api.SetOverrideRequest{Key: key, Override: copyOf(override), RespChan: respChan}
+	return awaitResponse(ctx, respChan)
+}
+
+// Reset resets the counters of a key, and starts a new window for it
+func (mgr *LimiterManagerSet) Reset(
+	ctx context.Context,
+	key string,
+) (*limiter_manager_api.KeyActionResult, error) {
+	respChan := make(chan *limiter_manager_api.KeyActionResult, 1)
+	mgr.getShardMailbox(key) <- &limiter_manager_api.ResetRequest{Key: key, RespChan: respChan}
+	return awaitResponse(ctx, respChan)
+}
+
+// DrainQueue empties the queue of a key. Queued requests are approved, or denied if deny is set.
+func (mgr *LimiterManagerSet) DrainQueue(
+	ctx context.Context,
+	key string,
+	deny bool,
+) (*limiter_manager_api.KeyActionResult, error) {
+	respChan := make(chan *limiter_manager_api.KeyActionResult, 1)
+	mgr.getShardMailbox(key) <- &limiter_manager_api.DrainQueueRequest{Key: key, Deny: deny, RespChan: respChan}
+	return awaitResponse(ctx, respChan)
+}
+
+// Expire removes the instance of a key right away, instead of waiting for it to be idle
+func (mgr *LimiterManagerSet) Expire(
+	ctx context.Context,
+	key string,
+) (*limiter_manager_api.KeyActionResult, error) {
+	respChan := make(chan *limiter_manager_api.KeyActionResult, 1)
+	mgr.getShardMailbox(key) <- &limiter_manager_api.ExpireRequest{Key: key, RespChan: respChan}
+	return awaitResponse(ctx, respChan)
+}
+
+// HandOff takes the state of the keys that have moved to other instances, for their new owners. The instances
+// of the keys are expired, after their queues have been denied, which the state includes.
+func (mgr *LimiterManagerSet) HandOff(moved func(key string) bool) []*limiter_api.KeyState {
+	many := lop.Map(mgr.mailboxes, func(mailbox chan<- limiter_manager_api.Request, _ int) []*limiter_api.KeyState {
+		respChan := make(chan []*limiter_api.KeyState, 1)
+		mailbox <- &limiter_manager_api.HandOffRequest{Moved: moved, RespChan: respChan}
+		select {
+		case resp := <-respChan:
+			return resp
+		case <-time.After(10 * time.Second):
+			slog.Error("Gave up waiting for the state of keys to hand off")
+			return nil
+		}
+	})
+	return lo.Flatten(many)
+}
+
+// TakeOver continues the window of a key, as handed off by its previous owner
+func (mgr *LimiterManagerSet) TakeOver(
+	ctx context.Context,
+	state *limiter_api.KeyState,
+) (*limiter_manager_api.KeyActionResult, error) {
+	respChan := make(chan *limiter_manager_api.KeyActionResult, 1)
+	mgr.getShardMailbox(state.Key) <- &limiter_manager_api.TakeOverRequest{State: state, RespChan: respChan}
+	return awaitResponse(ctx, respChan)
+}
+
+// Lend lends part of the limit of a split key for the current window to another instance, see
+// limiter_manager_api.LendRequest. Keys that aren't split aren't created, but ErrNotSplit is returned.
+func (mgr *LimiterManagerSet) Lend(
+	ctx context.Context,
+	key string,
+	shares int,
+) (*limiter_api.Loan, error) {
+	respChan := make(chan *limiter_api.Loan, 1)
+	mgr.getShardMailbox(key) <- &limiter_manager_api.LendRequest{Key: key, Shares: shares, RespChan: respChan}
+	loan, err := awaitResponse(ctx, respChan)
+	if err == nil && loan == nil {
+		return nil, ErrNotSplit
+	}
+	return loan, err
+}
+
+// Repay gives back requests lent to another instance that it didn't use. Like Release, it doesn't wait.
+func (mgr *LimiterManagerSet) Repay(key string, n int) {
+	mgr.getShardMailbox(key) <- &limiter_manager_api.RepayRequest{Key: key, N: n}
+}
+
+func awaitResponse[T any](ctx context.Context, respChan chan T) (T, error) {
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Subscribe subscribes to the events of the keys for which matches returns true, as the limiter instances
+// produce them. Slow subscribers miss events rather than holding up the instances, see limiter_events.Hub.
+func (mgr *LimiterManagerSet) Subscribe(
+	owner string,
+	matches func(key string) bool,
+	buffer int,
+) (*limiter_events.Subscription, error) {
+	return mgr.events.Subscribe(owner, matches, buffer)
+}
+
 func (mgr *LimiterManagerSet) Close() {
 	slog.Info("Killing limiter manager, and all of its limiters")
 	for _, mailbox := range mgr.mailboxes {
@@ -212,6 +466,15 @@ func (mgr *LimiterManagerSet) Close() {
 	}
 }
 
+// copyOf copies a config, so that it isn't shared between goroutines
+func copyOf(cfg *limiter_api.Config) *limiter_api.Config {
+	if cfg == nil {
+		return nil
+	}
+	result := *cfg
+	return &result
+}
+
 func combineConfigs(
 	globalConfig *limiter_api.Config,
 	configFromFile *config.CfgFromFileKey,
@@ -251,13 +514,100 @@ func mergeConfigsForInstance(
 	return result
 }
 
+// patternOf returns the last pattern in the config file matching a key, which is the one
+// that decides its config, as metric label. Keys themselves would make too many series.
+func patternOf(
+	key string,
+	configFromFile *config.CfgFromFile,
+) string {
+	pattern := metrics.NoPattern
+	if configFromFile != nil {
+		for _, configKey := range configFromFile.Keys {
+			if configKey.MatchesKey(key) {
+				pattern = configKey.KeyPattern
+			}
+		}
+	}
+	return pattern
+}
+
+// auditSampleRateOf returns the audit sample rate of a key, from the last matching pattern in
+// the config file that sets one. All decisions are sampled by default.
+func auditSampleRateOf(
+	key string,
+	configFromFile *config.CfgFromFile,
+) float64 {
+	sampleRate := 1.0
+	if configFromFile != nil {
+		for _, configKey := range configFromFile.Keys {
+			if configKey.AuditSampleRate != nil && configKey.MatchesKey(key) {
+				sampleRate = *configKey.AuditSampleRate
+			}
+		}
+	}
+	return sampleRate
+}
+
+// applyOverride applies a key's runtime override, set through the admin endpoints, on top of its config
+func applyOverride(
+	cfg *limiter_api.Config,
+	override *limiter_api.Config,
+) *limiter_api.Config {
+	if override == nil {
+		return cfg
+	}
+	return combineConfigs(cfg, &config.CfgFromFileKey{
+		MaxRequestsPerWindow: override.MaxRequestsPerWindow,
+		MaxRequestsInQueue:   override.MaxRequestsInQueue,
+		WindowMillis:         override.WindowMillis,
+	})
+}
+
 func loop(
 	globalConfig *limiter_api.Config,
 	mailbox chan limiter_manager_api.Request,
 	configFromFile *config.CfgFromFile,
 	configFromFileCh <-chan *config.CfgFromFile,
+	stats *sync.Map,
+	numKeys *atomic.Int64,
+	events *limiter_events.Hub,
+	shardMetrics *metrics.Shard,
+	auditLog *audit.Log,
 ) {
+	// Keys are added to and removed from stats together with the registry
 	registry := map[string]chan<- limiter_instance_api.Request{}
+	overrides := map[string]*limiter_api.Config{} // runtime overrides, kept when instances expire
+
+	configFor := func(key string) *limiter_api.Config {
+		return applyOverride(mergeConfigsForInstance(key, globalConfig, configFromFile), overrides[key])
+	}
+
+	countInstances := func() {
+		shardMetrics.Instances.Set(float64(len(registry)))
+		numKeys.Store(int64(len(registry)))
+	}
+
+	auditFor := func(key string) *audit.KeyAudit {
+		return auditLog.ForPattern(patternOf(key, configFromFile), auditSampleRateOf(key, configFromFile))
+	}
+
+	// instanceFor finds the rate limiter instance of a key, or creates one
+	instanceFor := func(key string) chan<- limiter_instance_api.Request {
+		instance, exists := registry[key]
+		if !exists {
+			instanceStats := &limiter_api.InstanceStats{}
+			instance = limiter_instance.New(key, configFor(key), mailbox, limiter_instance.Observers{
+				Stats:   instanceStats,
+				Events:  events,
+				Metrics: metrics.ForPattern(patternOf(key, configFromFile)),
+				Audit:   auditFor(key),
+			})
+			registry[key] = instance
+			stats.Store(key, instanceStats)
+			countInstances()
+		}
+		return instance
+	}
 
 	slog.Debug("Limiter manager started")
 
@@ -267,11 +617,15 @@ func loop(
 			slog.Debug("Received new config from file, updating all instances...")
 			for key, instance := range registry {
 				// slog.Debug("Updating instance", "key", key)
-				instanceConfig := mergeConfigsForInstance(key, globalConfig, configFromFile)
-				instance <- &limiter_instance_api.ConfigUpdateNotification{Config: instanceConfig}
+				instance <- &limiter_instance_api.ConfigUpdateNotification{
+					Config:  configFor(key),
+					Metrics: metrics.ForPattern(patternOf(key, configFromFile)),
+					Audit:   auditFor(key),
+				}
 			}
 
 		case req := <-mailbox:
+			shardMetrics.MailboxDepth.Set(float64(len(mailbox)))
 			// slog.Debug("Received request", "req", fmt.Sprintf("%T", req))
 			switch r := req.(type) {
 			case *limiter_api.PermissionRequest:
@@ -280,14 +634,7 @@ func loop(
 				// and forward the request to it
 
 				// slog.Debug("Received permission request", logctx.GetAll(r.Ctx)...)
-				instance, exists := registry[r.Key]
-				if !exists {
-					instanceConfig := mergeConfigsForInstance(r.Key, globalConfig, configFromFile)
-					instance = limiter_instance.New(r.Key, instanceConfig, mailbox)
-					registry[r.Key] = instance
-				}
-
-				instance <- r
+				instanceFor(r.Key) <- r
 
 			case *limiter_api.ReleaseRequest:
 
@@ -301,6 +648,21 @@ func loop(
 					slog.Warn("Received release request for unknown instance", logctx.GetAll(r.Ctx)...)
 				}
 
+			case *limiter_api.PeekRequest:
+
+				// Peeking shouldn't create instances, so answer on behalf of keys that don't have one
+				instance, exists := registry[r.Key]
+				if exists {
+					instance <- r
+				} else {
+					instanceConfig := configFor(r.Key)
+					r.RespChan <- &limiter_api.LimitStatus{
+						MaxRequestsPerWindow: instanceConfig.MaxRequestsPerWindow,
+						WindowMillis:         instanceConfig.WindowMillis,
+						WindowResetsAt:       time.Now().Add(time.Duration(instanceConfig.WindowMillis) * time.Millisecond),
+					}
+				}
+
 			case *limiter_api.DebugSnapshotRequest:
 
 				// slog.Debug("Received debug snapshot request", "key", r.Key)
@@ -348,6 +710,100 @@ func loop(
 					}),
 				}
 
+			case *limiter_manager_api.KeyConfigRequest:
+
+				r.RespChan <- &limiter_manager_api.KeyConfig{Override: copyOf(overrides[r.Key]), Config: *configFor(r.Key)}
+
+			case *limiter_manager_api.SetOverrideRequest:
+
+				if r.Override == nil {
+					slog.Info("Clearing override on admin request", "key", r.Key)
+					delete(overrides, r.Key)
+				} else {
+					slog.Info("Setting override on admin request", "key", r.Key, "override", *r.Override)
+					overrides[r.Key] = copyOf(r.Override)
+				}
+				if instance, exists := registry[r.Key]; exists {
+					instance <- &limiter_instance_api.ConfigUpdateNotification{Config: configFor(r.Key)}
+				}
+				r.RespChan <- &limiter_manager_api.KeyConfig{Override: copyOf(overrides[r.Key]), Config: *configFor(r.Key)}
+
+			case *limiter_manager_api.ResetRequest:
+
+				if instance, exists := registry[r.Key]; exists {
+					instance <- r
+				} else {
+					r.RespChan <- &limiter_manager_api.KeyActionResult{Found: false}
+				}
+
+			case *limiter_manager_api.DrainQueueRequest:
+
+				if instance, exists := registry[r.Key]; exists {
+					instance <- r
+				} else {
+					r.RespChan <- &limiter_manager_api.KeyActionResult{Found: false}
+				}
+
+			case *limiter_manager_api.ExpireRequest:
+
+				// Same as when the instance expires by itself, see InstanceExpiredNotification below
+				instance, exists := registry[r.Key]
+				if exists {
+					slog.Info("Expiring instance on admin request", "key", r.Key)
+					delete(registry, r.Key)
+					stats.Delete(r.Key)
+					countInstances()
+					instance <- &limiter_instance_api.Kill{}
+				}
+				r.RespChan <- &limiter_manager_api.KeyActionResult{Found: exists}
+
+			case *limiter_manager_api.HandOffRequest:
+
+				// The instances are removed as on ExpireRequest, right after they have answered with their state
+				respChan := make(chan *limiter_api.KeyState, len(registry))
+				var moved []string
+				for key, instance := range registry {
+					if r.Moved(key) {
+						moved = append(moved, key)
+						instance <- &limiter_instance_api.HandOff{RespChan: respChan}
+						instance <- &limiter_instance_api.Kill{}
+						delete(registry, key)
+						stats.Delete(key)
+					}
+				}
+				countInstances()
+
+				states := make([]*limiter_api.KeyState, 0, len(moved))
+				for _, key := range moved {
+					select {
+					case state := <-respChan:
+						states = append(states, state)
+					case <-time.After(3 * time.Second):
+						slog.Error("Gave up waiting for the state of a key to hand off", "key", key)
+					}
+				}
+				r.RespChan <- states
+
+			case *limiter_manager_api.TakeOverRequest:
+
+				instanceFor(r.State.Key) <- r
+
+			case *limiter_manager_api.LendRequest:
+
+				// Only keys that are split lend, having an instance here doesn't make a key split
+				if configFromFile != nil && configFromFile.SplitsKey(r.Key) {
+					instanceFor(r.Key) <- r
+				} else {
+					r.RespChan <- nil
+				}
+
+			case *limiter_manager_api.RepayRequest:
+
+				// Nothing to give back to if the instance has expired, along with the window of the loans
+				if instance, exists := registry[r.Key]; exists {
+					instance <- r
+				}
+
 			case *limiter_api.ClientGaveUpNotification:
 
 				// The client has disconnected, probably due to a client side timeout.
@@ -380,15 +836,20 @@ func loop(
 						slog.Warn("Received instance expired notification => instance mismatch", "key", r.Key)
 					} else {
 						delete(registry, r.Key)
+						stats.Delete(r.Key)
+						countInstances()
 					}
 				}
 				r.InstanceMailbox <- &limiter_instance_api.Kill{}
 
 			case *limiter_manager_api.Kill:
 				slog.Info("Close received, stopping all instances and limiter manager. This should probably only be used for testing")
-				for _, instance := range registry {
+				for key, instance := range registry {
 					instance <- &limiter_instance_api.Kill{}
+					stats.Delete(key)
 				}
+				shardMetrics.Instances.Set(0)
+				numKeys.Store(0)
 				return
 
 			case *limiter_manager_api.InstanceDiedNotification:
@@ -2,10 +2,12 @@ package limiter_manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/kivra/gocc/pkg/config"
 	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_events"
 	"github.com/kivra/gocc/pkg/logging"
 	"github.com/samber/lo"
 	lop "github.com/samber/lo/parallel"
@@ -441,3 +443,404 @@ func TestLimiterManagerSet_GetShardIndex(t *testing.T) {
 		t.Fatalf("expected %d shard indexes, got %d", DefaultSharding, len(shardIndexCounts))
 	}
 }
+
+func TestLimiterManager_Peek_doesnt_consume_slots(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         10_000,
+		MaxRequestsPerWindow: 2,
+		MaxRequestsInQueue:   0,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, 1)
+	defer mgr.Close()
+
+	ctx := context.Background()
+
+	// Unknown keys report their configured limits
+	status, err := mgr.Peek(ctx, "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status.MaxRequestsPerWindow != 2 || status.Remaining() != 2 {
+		t.Fatalf("expected 2 of 2 remaining, got %+v", status)
+	}
+
+	if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+		t.Fatalf("expected Approved, got %v", result)
+	}
+
+	for i := 0; i < 3; i++ {
+		status, err = mgr.Peek(ctx, "key")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if status.Remaining() != 1 {
+			t.Fatalf("expected 1 remaining, got %+v", status)
+		}
+	}
+
+	if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+		t.Fatalf("expected Approved, got %v", result)
+	}
+}
+
+func TestLimiterManager_SetOverride_applies_to_existing_and_new_instances(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         10_000,
+		MaxRequestsPerWindow: 1,
+		MaxRequestsInQueue:   100,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, 1)
+	defer mgr.Close()
+
+	ctx := context.Background()
+
+	if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+		t.Fatalf("expected Approved, got %v", result)
+	}
+
+	keyConfig, err := mgr.SetOverride(ctx, "key", &limiter_api.Config{MaxRequestsPerWindow: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := limiter_api.Config{WindowMillis: 10_000, MaxRequestsPerWindow: 2, MaxRequestsInQueue: 100}
+	if diff := cmp.Diff(expected, keyConfig.Config); diff != "" {
+		t.Fatalf("unexpected config (-want +got):\n%s", diff)
+	}
+
+	if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+		t.Fatalf("expected the override to apply to the existing instance, got %v", result)
+	}
+
+	// The override outlives the instance
+	if result, _ := mgr.Expire(ctx, "key"); !result.Found {
+		t.Fatalf("expected the instance to be found")
+	}
+	if result, _ := mgr.Expire(ctx, "key"); result.Found {
+		t.Fatalf("expected the instance to be gone")
+	}
+	for i := 0; i < 2; i++ {
+		if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+			t.Fatalf("expected the override to apply to the new instance, got %v", result)
+		}
+	}
+
+	keyConfig, _ = mgr.SetOverride(ctx, "key", nil)
+	if keyConfig.Override != nil || keyConfig.Config != *globalCfg {
+		t.Fatalf("expected the override to be cleared, got %+v", keyConfig)
+	}
+	if snapshot := mgr.GetDebugSnapshot("key"); snapshot.Config.MaxRequestsPerWindow != 1 {
+		t.Fatalf("expected the instance to be back at the global config, got %+v", snapshot.Config)
+	}
+}
+
+func TestLimiterManager_Reset_and_DrainQueue(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 1,
+		MaxRequestsInQueue:   100,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, 1)
+	defer mgr.Close()
+
+	ctx := context.Background()
+
+	if result, _ := mgr.Reset(ctx, "key"); result.Found {
+		t.Fatalf("expected no instance to reset")
+	}
+
+	mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange)
+	if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Denied {
+		t.Fatalf("expected Denied, got %v", result)
+	}
+	if result, _ := mgr.Reset(ctx, "key"); !result.Found {
+		t.Fatalf("expected the instance to be reset")
+	}
+	if result, _ := mgr.AskPermission(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+		t.Fatalf("expected Approved after reset, got %v", result)
+	}
+
+	for _, deny := range []bool{false, true} {
+		results := make(chan limiter_api.ExtRespCode, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				result, _ := mgr.AskPermission(ctx, "key", true, limiter_api.NoChange, limiter_api.NoChange)
+				results <- result
+			}()
+		}
+		waitFor(t, func() bool { return mgr.GetDebugSnapshot("key").NumWaiting == 3 })
+
+		result, _ := mgr.DrainQueue(ctx, "key", deny)
+		if result.NumDrained != 3 {
+			t.Fatalf("expected 3 drained, got %d", result.NumDrained)
+		}
+		expected := lo.Ternary(deny, limiter_api.Denied, limiter_api.Approved)
+		for i := 0; i < 3; i++ {
+			if result := <-results; result != expected {
+				t.Fatalf("expected %v, got %v", expected, result)
+			}
+		}
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for t0 := time.Now(); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("condition not met within 5 seconds")
+		}
+	}
+}
+
+func TestLimiterManager_Subscribe_streams_decisions(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 1,
+		MaxRequestsInQueue:   0,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer mgr.Close()
+
+	subscription, _ := mgr.Subscribe("", func(key string) bool { return key == "watched" }, 10)
+	defer subscription.Close()
+
+	ctx := context.Background()
+	mgr.AskPermission(ctx, "unwatched", false, limiter_api.NoChange, limiter_api.NoChange)
+	mgr.AskPermission(ctx, "watched", false, limiter_api.NoChange, limiter_api.NoChange)
+	mgr.AskPermission(ctx, "watched", false, limiter_api.NoChange, limiter_api.NoChange)
+	mgr.Reset(ctx, "watched")
+
+	for _, expected := range []limiter_events.EventType{limiter_events.Approved, limiter_events.Denied, limiter_events.WindowReset} {
+		select {
+		case event := <-subscription.Events():
+			if event.Key != "watched" || event.Type != expected {
+				t.Fatalf("expected %s of watched, got %+v", expected, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a %s event", expected)
+		}
+	}
+}
+
+func TestLimiterManager_HandOff_and_TakeOver(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 2,
+		MaxRequestsInQueue:   100,
+	}
+	previousOwner := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer previousOwner.Close()
+	newOwner := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer newOwner.Close()
+
+	ctx := context.Background()
+	previousOwner.AskPermission(ctx, "moved", false, limiter_api.NoChange, limiter_api.NoChange)
+	previousOwner.AskPermission(ctx, "moved", false, limiter_api.NoChange, limiter_api.NoChange)
+	previousOwner.AskPermission(ctx, "stays", false, limiter_api.NoChange, limiter_api.NoChange)
+	queued := make(chan limiter_api.ExtRespCode, 1)
+	go func() {
+		result, _ := previousOwner.AskPermission(ctx, "moved", true, limiter_api.NoChange, limiter_api.NoChange)
+		queued <- result
+	}()
+	waitFor(t, func() bool { return previousOwner.GetDebugSnapshot("moved").NumWaiting == 1 })
+
+	// The queue is denied, rather than approved over the limit, and counted in the state
+	states := previousOwner.HandOff(func(key string) bool { return key == "moved" })
+	if len(states) != 1 || states[0].Key != "moved" || states[0].NumApprovedThisWindow != 2 || states[0].NumDeniedThisWindow != 1 || states[0].WindowMillis != 60_000 {
+		t.Fatalf("expected the state of moved with 2 approved and 1 denied, got %+v", states)
+	}
+	if result := <-queued; result != limiter_api.Denied {
+		t.Fatalf("expected the queued request to be denied, got %v", result)
+	}
+	if previousOwner.GetDebugSnapshot("moved").Found || !previousOwner.GetDebugSnapshot("stays").Found {
+		t.Fatalf("expected only the instance of the moved key to be expired")
+	}
+
+	// Requests that the new owner decided before the state arrived count too
+	newOwner.AskPermission(ctx, "moved", false, limiter_api.NoChange, limiter_api.NoChange)
+	if result, _ := newOwner.TakeOver(ctx, states[0]); !result.Found {
+		t.Fatalf("expected the state to be taken over")
+	}
+	if snapshot := newOwner.GetDebugSnapshot("moved"); snapshot.NumApprovedThisWindow != 3 {
+		t.Fatalf("expected 3 approved, got %+v", snapshot)
+	}
+	if result, _ := newOwner.AskPermission(ctx, "moved", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Denied {
+		t.Fatalf("expected Denied, got %v", result)
+	}
+
+	// A later snapshot of the same window only adds what is new in it
+	later := *states[0]
+	later.NumApprovedThisWindow = 4
+	newOwner.TakeOver(ctx, &later)
+	if snapshot := newOwner.GetDebugSnapshot("moved"); snapshot.NumApprovedThisWindow != 5 {
+		t.Fatalf("expected 5 approved, got %+v", snapshot)
+	}
+
+	// The window of the previous owner is continued, and windows are as configured after it
+	newOwner.TakeOver(ctx, &limiter_api.KeyState{Key: "ending", WindowMillis: 60_000, NumApprovedThisWindow: 2, ResetAfterMillis: 100})
+	if result, _ := newOwner.AskPermission(ctx, "ending", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Denied {
+		t.Fatalf("expected Denied before the window ends, got %v", result)
+	}
+	waitFor(t, func() bool { return newOwner.GetDebugSnapshot("ending").NumApprovedThisWindow == 0 })
+	for i := 0; i < 2; i++ {
+		if result, _ := newOwner.AskPermission(ctx, "ending", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+			t.Fatalf("expected Approved in the next window, got %v", result)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if snapshot := newOwner.GetDebugSnapshot("ending"); snapshot.NumApprovedThisWindow != 2 {
+		t.Fatalf("expected a full window after the one taken over, got %+v", snapshot)
+	}
+
+	// The key keeps its own window, and a longer one of the previous owner is only continued for as long as that
+	newOwner.TakeOver(ctx, &limiter_api.KeyState{Key: "longer", WindowMillis: 3_600_000, NumApprovedThisWindow: 1, ResetAfterMillis: 3_000_000})
+	if snapshot := newOwner.GetDebugSnapshot("longer"); snapshot.Config.WindowMillis != 60_000 || snapshot.NumApprovedThisWindow != 1 {
+		t.Fatalf("expected the configured window with 1 approved, got %+v", snapshot)
+	}
+	if status, err := newOwner.Peek(ctx, "longer"); err != nil || status.ResetAfter() > 60*time.Second {
+		t.Fatalf("expected the window to end within the configured window, got %+v, %v", status, err)
+	}
+
+	// Windows that have ended are not taken over
+	newOwner.TakeOver(ctx, &limiter_api.KeyState{Key: "ended", WindowMillis: 60_000, NumApprovedThisWindow: 2, ResetAfterMillis: 0})
+	if snapshot := newOwner.GetDebugSnapshot("ended"); snapshot.NumApprovedThisWindow != 0 {
+		t.Fatalf("expected nothing taken over, got %+v", snapshot)
+	}
+}
+
+func TestLimiterManager_Lend_and_Repay(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 40,
+		MaxRequestsInQueue:   100,
+	}
+	configFromFile := &config.CfgFromFile{Keys: []config.CfgFromFileKey{{KeyPattern: "split", Split: lo.ToPtr(true)}}}
+	manager := NewManagerSet(globalCfg, configFromFile, nil, DefaultSharding)
+	defer manager.Close()
+
+	// Keys that aren't split aren't created to lend from
+	ctx := context.Background()
+	if loan, err := manager.Lend(ctx, "not-split", 2); !errors.Is(err, ErrNotSplit) {
+		t.Fatalf("expected ErrNotSplit, got %+v %v", loan, err)
+	}
+	if n := manager.NumKeys(); n != 0 {
+		t.Fatalf("expected no keys to be created, got %d", n)
+	}
+	manager.AskPermission(ctx, "not-split", false, limiter_api.NoChange, limiter_api.NoChange)
+	if loan, err := manager.Lend(ctx, "not-split", 2); !errors.Is(err, ErrNotSplit) {
+		t.Fatalf("expected ErrNotSplit for a key that isn't split but has an instance, got %+v %v", loan, err)
+	}
+
+	// A quarter of an equal share of 2 is lent at a time, and counts as approved
+	loan, err := manager.Lend(ctx, "split", 2)
+	if err != nil || loan.Granted != 5 || loan.MaxRequestsPerWindow != 40 || loan.Remaining != 35 || loan.ResetAfterMillis <= 0 {
+		t.Fatalf("expected a loan of 5, got %+v %v", loan, err)
+	}
+	for i := 0; i < 7; i++ {
+		manager.Lend(ctx, "split", 2)
+	}
+	if loan, _ := manager.Lend(ctx, "split", 2); loan.Granted != 0 || loan.Remaining != 0 {
+		t.Fatalf("expected nothing left to lend, got %+v", loan)
+	}
+	if result, _ := manager.AskPermission(ctx, "split", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Denied {
+		t.Fatalf("expected Denied with everything lent, got %v", result)
+	}
+
+	// Unused requests are given back, but never more than were lent
+	manager.Repay("split", 3)
+	waitFor(t, func() bool { return manager.GetDebugSnapshot("split").NumApprovedThisWindow == 37 })
+	manager.Repay("split", 100)
+	waitFor(t, func() bool { return manager.GetDebugSnapshot("split").NumApprovedThisWindow == 0 })
+	if result, _ := manager.AskPermission(ctx, "split", false, limiter_api.NoChange, limiter_api.NoChange); result != limiter_api.Approved {
+		t.Fatalf("expected Approved after the loans were repaid, got %v", result)
+	}
+	manager.Repay("split", 1)
+	time.Sleep(50 * time.Millisecond)
+	if snapshot := manager.GetDebugSnapshot("split"); snapshot.NumApprovedThisWindow != 1 {
+		t.Fatalf("expected the approved request to stay counted, got %+v", snapshot)
+	}
+}
+
+func TestLimiterManager_NumKeys(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         10_000,
+		MaxRequestsPerWindow: 1,
+		MaxRequestsInQueue:   100,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer mgr.Close()
+
+	if n := mgr.NumKeys(); n != 0 {
+		t.Fatalf("expected no keys, got %d", n)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c", "a"} {
+		mgr.AskPermission(ctx, key, false, limiter_api.NoChange, limiter_api.NoChange)
+	}
+	if n := mgr.NumKeys(); n != 3 {
+		t.Fatalf("expected 3 keys, got %d", n)
+	}
+}
+
+func TestLimiterManager_AskPermissionForHits(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 5,
+		MaxRequestsInQueue:   100,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer mgr.Close()
+
+	ctx := context.Background()
+	ask := func(hits int) *limiter_api.PermissionResponse {
+		resp, _ := mgr.AskPermissionForHits(ctx, "key", hits, limiter_api.NoChange, limiter_api.NoChange, limiter_api.NoChange)
+		return resp
+	}
+	if resp := ask(3); resp.RespCode != limiter_api.Approved || resp.Status.Remaining() != 2 {
+		t.Fatalf("expected 3 hits to be approved, got %+v", resp)
+	}
+
+	// All or none: the hits that don't fit take no slots
+	if resp := ask(3); resp.RespCode != limiter_api.Denied || resp.Status.Remaining() != 2 {
+		t.Fatalf("expected 3 more hits to be denied without taking slots, got %+v", resp)
+	}
+	if resp := ask(1_000_000); resp.RespCode != limiter_api.Denied {
+		t.Fatalf("expected hits beyond the limit to be denied, got %+v", resp)
+	}
+	if resp := ask(2); resp.RespCode != limiter_api.Approved || resp.Status.Remaining() != 0 {
+		t.Fatalf("expected the last 2 slots to be approved, got %+v", resp)
+	}
+}
+
+func TestLimiterManager_AskPermissionWithinPercent(t *testing.T) {
+	globalCfg := &limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: 4,
+		MaxRequestsInQueue:   100,
+	}
+	mgr := NewManagerSet(globalCfg, nil, nil, DefaultSharding)
+	defer mgr.Close()
+
+	ctx := context.Background()
+	ask := func() *limiter_api.PermissionResponse {
+		resp, _ := mgr.AskPermissionWithinPercent(ctx, "key", false, 50, limiter_api.NoChange, limiter_api.NoChange)
+		return resp
+	}
+	for i, expected := range []limiter_api.ExtRespCode{limiter_api.Approved, limiter_api.Approved, limiter_api.Denied} {
+		if resp := ask(); resp.RespCode != expected || resp.Status.MaxRequestsPerWindow != 2 {
+			t.Fatalf("expected request %d to be %s against half of the limit, got %+v", i, expected, resp)
+		}
+	}
+
+	// The key's limit doesn't change
+	keyConfig, err := mgr.KeyConfig(ctx, "key")
+	if err != nil || keyConfig.Config.MaxRequestsPerWindow != 4 {
+		t.Fatalf("expected the key to keep its limit of 4, got %+v, %v", keyConfig, err)
+	}
+	resp, _ := mgr.AskPermissionWithStatus(ctx, "key", false, limiter_api.NoChange, limiter_api.NoChange, limiter_api.NoChange)
+	if resp.RespCode != limiter_api.Approved || resp.Status.Remaining() != 1 {
+		t.Fatalf("expected the rest of the limit for other requests, got %+v", resp)
+	}
+	if resp := ask(); resp.RespCode != limiter_api.Denied || resp.Status.MaxRequestsPerWindow != 2 {
+		t.Fatalf("expected the share not to shrink further, got %+v", resp)
+	}
+}
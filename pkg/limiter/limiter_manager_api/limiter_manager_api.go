@@ -1,6 +1,7 @@
 package limiter_manager_api
 
 import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
 	"github.com/kivra/gocc/pkg/limiter/limiter_instance_api"
 )
 
@@ -25,3 +26,104 @@ type InstanceDiedNotification struct {
 }
 
 func (r *InstanceDiedNotification) IsLimiterManagerRequest() {}
+
+// KeyConfig is what a key is configured with, for the admin endpoints
+type KeyConfig struct {
+	Override *limiter_api.Config // set at runtime, nil if none. 0 = not overridden
+	Config   limiter_api.Config  // global config, then the config file, then the override
+}
+
+// KeyConfigRequest asks for a key's runtime override and resulting config
+type KeyConfigRequest struct {
+	Key      string
+	RespChan chan *KeyConfig
+}
+
+func (r *KeyConfigRequest) IsLimiterManagerRequest() {}
+
+// SetOverrideRequest sets a key's runtime override, or clears it if Override is nil.
+// The override outlives the key's instance, and is applied on top of the config file, also after it changes.
+type SetOverrideRequest struct {
+	Key      string
+	Override *limiter_api.Config
+	RespChan chan *KeyConfig
+}
+
+func (r *SetOverrideRequest) IsLimiterManagerRequest() {}
+
+// KeyActionResult is the outcome of an admin action on a key's instance
+type KeyActionResult struct {
+	Found      bool // the key had an instance. If not, nothing was done
+	NumDrained int  // requests taken out of the queue, by a DrainQueueRequest
+}
+
+// ResetRequest resets a key's counters and starts a new window. Queued requests are let through as usual for a new window.
+type ResetRequest struct {
+	Key      string
+	RespChan chan *KeyActionResult
+}
+
+func (r *ResetRequest) IsLimiterManagerRequest()  {}
+func (r *ResetRequest) IsLimiterInstanceRequest() {}
+
+// DrainQueueRequest empties a key's queue, approving all queued requests, or denying them if Deny is set
+type DrainQueueRequest struct {
+	Key      string
+	Deny     bool
+	RespChan chan *KeyActionResult
+}
+
+func (r *DrainQueueRequest) IsLimiterManagerRequest()  {}
+func (r *DrainQueueRequest) IsLimiterInstanceRequest() {}
+
+// ExpireRequest expires a key's instance right away, as if it had been idle. Queued requests are approved,
+// and the next request for the key starts from scratch.
+type ExpireRequest struct {
+	Key      string
+	RespChan chan *KeyActionResult
+}
+
+func (r *ExpireRequest) IsLimiterManagerRequest() {}
+
+// HandOffRequest takes the state of the keys that have moved to other instances, and expires their instances,
+// so that the state isn't counted twice if the keys move back
+type HandOffRequest struct {
+	Moved    func(key string) bool
+	RespChan chan []*limiter_api.KeyState
+}
+
+func (r *HandOffRequest) IsLimiterManagerRequest() {}
+
+// TakeOverRequest continues the window of a key that was handed off by its previous owner. Counts that the key
+// already has here are kept, they are of requests that weren't decided by the previous owner. States taken over
+// in the same window are snapshots of the same window of the previous owner, e.g. a replica and then a handoff,
+// so only what a state adds to the ones before it is counted.
+type TakeOverRequest struct {
+	State    *limiter_api.KeyState
+	RespChan chan *KeyActionResult
+}
+
+func (r *TakeOverRequest) IsLimiterManagerRequest()  {}
+func (r *TakeOverRequest) IsLimiterInstanceRequest() {}
+
+// LendRequest lends part of a split key's limit for the current window to another instance. Shares is the number
+// of instances the limit is split between, and a loan is at most a limiter_api.LoansPerShare:th of an equal share.
+// Lent requests count as approved here.
+type LendRequest struct {
+	Key      string
+	Shares   int
+	RespChan chan *limiter_api.Loan
+}
+
+func (r *LendRequest) IsLimiterManagerRequest()  {}
+func (r *LendRequest) IsLimiterInstanceRequest() {}
+
+// RepayRequest gives back requests of loans that another instance didn't use. Only requests lent in the current
+// window are taken back, the ones of earlier windows have expired.
+type RepayRequest struct {
+	Key string
+	N   int
+}
+
+func (r *RepayRequest) IsLimiterManagerRequest()  {}
+func (r *RepayRequest) IsLimiterInstanceRequest() {}
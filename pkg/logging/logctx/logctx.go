@@ -19,6 +19,16 @@ func Add(c context.Context, key string, value string) context.Context {
 	return context.WithValue(c, logCtxKey, result)
 }
 
+// Get returns the value of a key added with Add, or "" if there is none
+func Get(c context.Context, key string) string {
+	for _, v := range GetAll(c) {
+		if slogAttr, ok := v.(slog.Attr); ok && slogAttr.Key == key {
+			return slogAttr.Value.String()
+		}
+	}
+	return ""
+}
+
 func GetAll(c context.Context) []any {
 	prev := c.Value(logCtxKey)
 	if prev != nil {
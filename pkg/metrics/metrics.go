@@ -0,0 +1,210 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/expfmt"
+	"strconv"
+	"sync"
+)
+
+// NoPattern is the pattern label of keys that no pattern in the config file matches
+const NoPattern = "(none)"
+
+// Registry holds all of gocc's metrics. Keys are never used as labels, only the config file
+// patterns they match, so that the number of series stays bounded regardless of the number of keys.
+var Registry = prometheus.NewRegistry()
+
+var (
+	decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_decisions_total",
+		Help: "Rate limiting decisions, by the config file pattern matching the key",
+	}, []string{"pattern", "decision"})
+
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gocc_queue_wait_seconds",
+		Help:    "Time spent in the wait queue by requests approved from it, by the config file pattern matching the key",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"pattern"})
+
+	instances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gocc_instances",
+		Help: "Live limiter instances, i.e. keys, per manager shard",
+	}, []string{"shard"})
+
+	mailboxDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gocc_manager_mailbox_depth",
+		Help: "Messages waiting in the mailbox of each manager shard",
+	}, []string{"shard"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_config_reloads_total",
+		Help: "Reloads of the config file, by result (success, failure)",
+	}, []string{"result"})
+
+	forwardingErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_forwarding_errors_total",
+		Help: "Failed requests to other instances, by instance",
+	}, []string{"instance"})
+
+	peerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gocc_peer_up",
+		Help: "Whether the health checks of other instances succeed (1) or not (0), by instance",
+	}, []string{"instance"})
+
+	degradedDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_degraded_decisions_total",
+		Help: "Decisions on keys whose owner was down, by the --peer-down-policy that made them",
+	}, []string{"policy"})
+
+	handedOffKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_handed_off_keys_total",
+		Help: "Keys whose window state was handed off between instances as the cluster changed, sent or received",
+	}, []string{"direction"})
+
+	replicatedKeys = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_replicated_keys_total",
+		Help: "Key states replicated between instances with --replication-factor, sent, received or taken over from a replica",
+	}, []string{"direction"})
+
+	splitRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gocc_split_requests_total",
+		Help: "Requests of split keys lent to other instances, borrowed from owners, or repaid to owners unused",
+	}, []string{"direction"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		decisions,
+		queueWait,
+		instances,
+		mailboxDepth,
+		configReloads,
+		forwardingErrors,
+		peerUp,
+		degradedDecisions,
+		handedOffKeys,
+		replicatedKeys,
+		splitRequests,
+	)
+}
+
+// KeyMetrics are the metrics of the keys matching a pattern, resolved once so that
+// limiter instances don't look up labels for every decision
+type KeyMetrics struct {
+	Approved  prometheus.Counter
+	Denied    prometheus.Counter
+	Queued    prometheus.Counter
+	GaveUp    prometheus.Counter
+	QueueWait prometheus.Observer
+}
+
+var keyMetrics sync.Map // pattern -> *KeyMetrics
+
+// Discard are metrics that aren't registered, for limiter instances created without metrics
+var Discard = &KeyMetrics{
+	Approved:  prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"}),
+	Denied:    prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"}),
+	Queued:    prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"}),
+	GaveUp:    prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"}),
+	QueueWait: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "discarded"}),
+}
+
+// ForPattern returns the metrics of the keys matching a config file pattern
+func ForPattern(pattern string) *KeyMetrics {
+	if m, ok := keyMetrics.Load(pattern); ok {
+		return m.(*KeyMetrics)
+	}
+	m, _ := keyMetrics.LoadOrStore(pattern, &KeyMetrics{
+		Approved:  decisions.WithLabelValues(pattern, "approved"),
+		Denied:    decisions.WithLabelValues(pattern, "denied"),
+		Queued:    decisions.WithLabelValues(pattern, "queued"),
+		GaveUp:    decisions.WithLabelValues(pattern, "gave-up"),
+		QueueWait: queueWait.WithLabelValues(pattern),
+	})
+	return m.(*KeyMetrics)
+}
+
+// Shard are the metrics of a manager shard
+type Shard struct {
+	Instances    prometheus.Gauge
+	MailboxDepth prometheus.Gauge
+}
+
+func ForShard(shard int) *Shard {
+	label := strconv.Itoa(shard)
+	return &Shard{
+		Instances:    instances.WithLabelValues(label),
+		MailboxDepth: mailboxDepth.WithLabelValues(label),
+	}
+}
+
+// ConfigReloaded counts a reload of the config file
+func ConfigReloaded(ok bool) {
+	if ok {
+		configReloads.WithLabelValues("success").Inc()
+	} else {
+		configReloads.WithLabelValues("failure").Inc()
+	}
+}
+
+// ForwardingFailed counts a failed request to another instance
+func ForwardingFailed(instance string) {
+	forwardingErrors.WithLabelValues(instance).Inc()
+}
+
+// PeerUp records the health of another instance
+func PeerUp(instance string, up bool) {
+	if up {
+		peerUp.WithLabelValues(instance).Set(1)
+	} else {
+		peerUp.WithLabelValues(instance).Set(0)
+	}
+}
+
+// PeerRemoved forgets the health of an instance that is no longer a member of the cluster
+func PeerRemoved(instance string) {
+	peerUp.DeleteLabelValues(instance)
+}
+
+// DegradedDecision counts a decision on a key whose owner was down
+func DegradedDecision(policy string) {
+	degradedDecisions.WithLabelValues(policy).Inc()
+}
+
+// HandedOffKeys counts keys handed off to other instances, direction "sent", or from them, direction "received"
+func HandedOffKeys(direction string, n int) {
+	handedOffKeys.WithLabelValues(direction).Add(float64(n))
+}
+
+// ReplicatedKeys counts key states sent to replicas, direction "sent", received from owners, direction "received",
+// or taken over from a replica when the owner was down or restarted, direction "taken-over"
+func ReplicatedKeys(direction string, n int) {
+	replicatedKeys.WithLabelValues(direction).Add(float64(n))
+}
+
+// SplitRequests counts requests of split keys lent by their owner, direction "lent", borrowed from the owner,
+// direction "borrowed", or given back to the owner unused, direction "repaid"
+func SplitRequests(direction string, n int) {
+	splitRequests.WithLabelValues(direction).Add(float64(n))
+}
+
+// Gather returns all metrics in the prometheus text format, and its content type
+func Gather() ([]byte, string, error) {
+	families, err := Registry.Gather()
+	if err != nil {
+		return nil, "", err
+	}
+	format := expfmt.NewFormat(expfmt.TypeTextPlain)
+	buf := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buf, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return nil, "", err
+		}
+	}
+	return buf.Bytes(), string(format), nil
+}
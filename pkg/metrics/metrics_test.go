@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForPattern(t *testing.T) {
+	m := ForPattern("test-pattern")
+	if ForPattern("test-pattern") != m {
+		t.Fatalf("expected the metrics of a pattern to be resolved once")
+	}
+
+	m.Approved.Inc()
+	m.Approved.Inc()
+	m.GaveUp.Inc()
+	m.QueueWait.Observe(0.02)
+	Discard.Approved.Inc() // not registered, so not gathered
+	ConfigReloaded(false)
+
+	body, contentType, err := Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(contentType, "text/plain") {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+	for _, expected := range []string{
+		`gocc_decisions_total{decision="approved",pattern="test-pattern"} 2`,
+		`gocc_decisions_total{decision="gave-up",pattern="test-pattern"} 1`,
+		`gocc_queue_wait_seconds_bucket{pattern="test-pattern",le="0.05"} 1`,
+		`gocc_queue_wait_seconds_count{pattern="test-pattern"} 1`,
+		`gocc_config_reloads_total{result="failure"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("expected '%s' in:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(string(body), "discarded") {
+		t.Fatalf("expected discarded metrics not to be gathered")
+	}
+}
@@ -0,0 +1,341 @@
+package binary_proto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/hash_ring"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/samber/lo"
+	lop "github.com/samber/lo/parallel"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestFrontend(t *testing.T, requestsCanSetRate bool, limiterCfg *limiter_api.Config) *Client {
+
+	client, err := Dial("tcp", serveTestFrontend(t, requestsCanSetRate, limiterCfg))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+// serveTestFrontend serves a frontend with a limiter manager of its own, and returns its address
+func serveTestFrontend(t *testing.T, requestsCanSetRate bool, limiterCfg *limiter_api.Config) string {
+
+	globalCfg := config.NewGlobalCfg()
+	globalCfg.BinaryPort.Default = lo.ToPtr(0)
+	globalCfg.RequestsCanSetRate.Default = lo.ToPtr(requestsCanSetRate)
+	globalCfg.RequestsCanModQueue.Default = lo.ToPtr(true)
+	cfg := &config.GlobalCfgValidated{GlobalCfg: globalCfg}
+
+	mgr := limiter_manager.NewManagerSet(limiterCfg, nil, nil, 1)
+	t.Cleanup(mgr.Close)
+
+	frontend := New(cfg, mgr, nil)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = frontend.Serve(listener) }()
+	t.Cleanup(frontend.Close)
+
+	return listener.Addr().String()
+}
+
+func TestAsk_approves_then_denies(t *testing.T) {
+
+	client := startTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 2})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		decision, err := client.Ask(ctx, "key", AskOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !decision.Approved || decision.RequestID == "" || decision.Limit != 2 || decision.Remaining != 1-i {
+			t.Fatalf("expected approval, got %+v", decision)
+		}
+		if decision.ResetAfter <= 0 || decision.ResetAfter > time.Minute {
+			t.Fatalf("expected reset within the window, got %v", decision.ResetAfter)
+		}
+	}
+
+	decision, err := client.Ask(ctx, "key", AskOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decision.Approved || decision.RequestID != "" || decision.Remaining != 0 {
+		t.Fatalf("expected denial, got %+v", decision)
+	}
+}
+
+func TestPeek_and_Release(t *testing.T) {
+
+	client := startTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1})
+	ctx := context.Background()
+
+	peeked, err := client.Peek(ctx, "key")
+	if err != nil || !peeked.Approved || peeked.Remaining != 1 {
+		t.Fatalf("expected a free slot, got %+v, %v", peeked, err)
+	}
+
+	decision, err := client.Ask(ctx, "key", AskOptions{})
+	if err != nil || !decision.Approved {
+		t.Fatalf("expected approval, got %+v, %v", decision, err)
+	}
+
+	peeked, err = client.Peek(ctx, "key")
+	if err != nil || peeked.Approved || peeked.Remaining != 0 {
+		t.Fatalf("expected no free slots, got %+v, %v", peeked, err)
+	}
+
+	if err := client.Release(ctx, "key", decision.RequestID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	decision, err = client.Ask(ctx, "key", AskOptions{})
+	if err != nil || !decision.Approved {
+		t.Fatalf("expected approval after release, got %+v, %v", decision, err)
+	}
+}
+
+func TestAsk_overrides(t *testing.T) {
+
+	ctx := context.Background()
+
+	client := startTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1})
+	decision, err := client.Ask(ctx, "key", AskOptions{MaxRequests: lo.ToPtr(5)})
+	if err != nil || !decision.Approved || decision.Limit != 5 {
+		t.Fatalf("expected override to apply, got %+v, %v", decision, err)
+	}
+
+	client = startTestFrontend(t, false, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1})
+	_, err = client.Ask(ctx, "key", AskOptions{MaxRequests: lo.ToPtr(5)})
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("expected server error, got %v", err)
+	}
+}
+
+func TestAsk_waiting_requests_dont_block_the_connection(t *testing.T) {
+
+	client := startTestFrontend(t, true, &limiter_api.Config{WindowMillis: 500, MaxRequestsPerWindow: 1, MaxRequestsInQueue: 10})
+	ctx := context.Background()
+
+	if decision, err := client.Ask(ctx, "slow", AskOptions{}); err != nil || !decision.Approved {
+		t.Fatalf("expected approval, got %+v, %v", decision, err)
+	}
+
+	waited := make(chan *Decision, 1)
+	go func() {
+		decision, _ := client.Ask(ctx, "slow", AskOptions{CanWait: true})
+		waited <- decision
+	}()
+
+	// Meanwhile, other keys are answered immediately
+	t0 := time.Now()
+	if decision, err := client.Ask(ctx, "fast", AskOptions{}); err != nil || !decision.Approved {
+		t.Fatalf("expected approval, got %+v, %v", decision, err)
+	}
+	if time.Since(t0) > 250*time.Millisecond {
+		t.Fatalf("expected an immediate answer, took %v", time.Since(t0))
+	}
+
+	select {
+	case decision := <-waited:
+		if decision == nil || !decision.Approved {
+			t.Fatalf("expected queued request to be approved, got %+v", decision)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued request was never answered")
+	}
+}
+
+func TestAsk_pipelined_requests(t *testing.T) {
+
+	client := startTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1000})
+	ctx := context.Background()
+
+	approved := atomic.Int32{}
+	lop.ForEach(lo.Range(20), func(i int, _ int) {
+		for j := 0; j < 100; j++ {
+			decision, err := client.Ask(ctx, "shared", AskOptions{})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if decision.Approved {
+				approved.Add(1)
+			}
+		}
+	})
+
+	if approved.Load() != 1000 {
+		t.Fatalf("expected 1000 approved, got %d", approved.Load())
+	}
+}
+
+func TestFrontend_answers_pipelined_requests_before_closing(t *testing.T) {
+
+	addr := serveTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 100_000})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// More than are decided at a time, sent before reading any answers, and then no more
+	n := 3 * maxInFlightFrames
+	go func() {
+		w := bufio.NewWriter(conn)
+		for i := 0; i < n; i++ {
+			body := encodeAsk(&askBody{maxRequests: notSet, maxRequestsInQueue: notSet, key: strconv.Itoa(i % 10)})
+			_ = writeFrame(w, &frame{frameType: FrameAsk, correlationID: uint64(i), body: body})
+		}
+		_ = w.Flush()
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	answered := map[uint64]bool{}
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			break
+		}
+		answered[f.correlationID] = true
+	}
+	if len(answered) != n {
+		t.Fatalf("expected all %d requests to be answered before the connection closed, got %d", n, len(answered))
+	}
+}
+
+func TestClient_closed(t *testing.T) {
+
+	client := startTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1})
+	_ = client.Close()
+
+	if _, err := client.Ask(context.Background(), "key", AskOptions{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestReadFrame_rejects_invalid_frames(t *testing.T) {
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeFrame(w, &frame{frameType: FrameAsk, correlationID: 7, body: []byte{0, 0}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = w.Flush()
+
+	f, err := readFrame(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	if err != nil || f.correlationID != 7 {
+		t.Fatalf("unexpected frame %+v, %v", f, err)
+	}
+	if _, err := decodeAsk(f.body); !errors.Is(err, errProtocol) {
+		t.Fatalf("expected truncated body to be rejected, got %v", err)
+	}
+
+	tooLong := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(tooLong))); !errors.Is(err, errProtocol) {
+		t.Fatalf("expected oversized frame to be rejected, got %v", err)
+	}
+}
+
+func TestClusterClient_sends_keys_to_their_owners(t *testing.T) {
+
+	limiterCfg := &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1}
+	addresses := map[string]string{
+		"gocc-0": serveTestFrontend(t, true, limiterCfg),
+		"gocc-1": serveTestFrontend(t, true, limiterCfg),
+	}
+	instanceUrls := []string{"http://gocc-0:8080", "http://gocc-1:8080?weight=2"}
+
+	cluster, err := DialCluster(instanceUrls, hash_ring.DefaultVirtualNodes, func(instanceUrl *url.URL) (*Client, error) {
+		return Dial("tcp", addresses[instanceUrl.Hostname()])
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = cluster.Close() }()
+
+	// The same ring as the instances, see cluster.NewView
+	members := []hash_ring.Member{{Name: "http://gocc-0:8080", Weight: 1}, {Name: "http://gocc-1:8080", Weight: 2}}
+	ring, _ := hash_ring.New(members, hash_ring.DefaultVirtualNodes)
+
+	ctx := context.Background()
+	owned := map[int]int{}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if first, err := cluster.Ask(ctx, key, AskOptions{}); err != nil || !first.Approved {
+			t.Fatalf("expected the first ask on %s to be approved, got %+v, %v", key, first, err)
+		}
+		if second, err := cluster.Ask(ctx, key, AskOptions{}); err != nil || second.Approved {
+			t.Fatalf("expected the second ask on %s to be denied by the same instance, got %+v, %v", key, second, err)
+		}
+		owner := ring.Owner(key)
+		owned[owner]++
+		if cluster.Client(key) != cluster.clients[owner] {
+			t.Fatalf("expected %s to be sent to instance %d", key, owner)
+		}
+	}
+	if owned[0] == 0 || owned[1] == 0 {
+		t.Fatalf("expected keys on both instances, got %v", owned)
+	}
+
+	if _, err := DialCluster([]string{"http://gocc-0:8080?weight=-1"}, hash_ring.DefaultVirtualNodes, nil); err == nil {
+		t.Fatalf("expected an invalid weight to be rejected")
+	}
+}
+
+func TestPeerForwarder_asks_owners_and_redials(t *testing.T) {
+
+	address := serveTestFrontend(t, true, &limiter_api.Config{WindowMillis: 60_000, MaxRequestsPerWindow: 1})
+	host, port, _ := net.SplitHostPort(address)
+	globalCfg := config.NewGlobalCfg()
+	globalCfg.BinaryPort.Default = lo.ToPtr(lo.Must(strconv.Atoi(port)))
+	globalCfg.PeerBinaryPort.Default = lo.ToPtr(0)
+	globalCfg.PeerApiKey.Default = lo.ToPtr("")
+	forwarder := NewPeerForwarder(&config.GlobalCfgValidated{GlobalCfg: globalCfg})
+	owner := &url.URL{Scheme: "http", Host: host + ":8080"}
+	ctx := context.Background()
+
+	first, requestID, err := forwarder.Ask(ctx, owner, "key", false, 2, limiter_api.NoChange)
+	if err != nil || first.RespCode != limiter_api.Approved || requestID == "" || first.Status.MaxRequestsPerWindow != 2 {
+		t.Fatalf("expected the first ask to be approved with the overridden limit, got %+v, '%s', %v", first, requestID, err)
+	}
+	if second, _, err := forwarder.Ask(ctx, owner, "key", false, 2, limiter_api.NoChange); err != nil || second.RespCode != limiter_api.Approved {
+		t.Fatalf("expected the second ask to be approved, got %+v, %v", second, err)
+	}
+	if third, _, err := forwarder.Ask(ctx, owner, "key", false, 2, limiter_api.NoChange); err != nil || third.RespCode != limiter_api.Denied || third.Status.Remaining() != 0 {
+		t.Fatalf("expected the third ask to be denied, got %+v, %v", third, err)
+	}
+	if err := forwarder.Release(ctx, owner, "key", requestID); err != nil {
+		t.Fatalf("unexpected error releasing: %v", err)
+	}
+
+	// A failed connection is dialed again by the next request
+	_ = forwarder.peers[owner.String()].current().Close()
+	if again, _, err := forwarder.Ask(ctx, owner, "key", false, 2, limiter_api.NoChange); err != nil || again.RespCode != limiter_api.Approved {
+		t.Fatalf("expected an ask after the release to be approved over a new connection, got %+v, %v", again, err)
+	}
+
+	forwarder.Close()
+	if _, _, err := forwarder.Ask(ctx, owner, "key", false, 2, limiter_api.NoChange); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after closing, got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package binary_proto
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned for requests on a client whose connection has been closed or has failed
+var ErrClosed = errors.New("binary protocol connection closed")
+
+// ServerError is returned when the server rejects a request, e.g. because of disallowed overrides
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return "gocc: " + e.Msg
+}
+
+// Decision is the server's answer to an Ask or a Peek. For a Peek, Approved means
+// that there are slots left in the current window.
+type Decision struct {
+	Approved   bool
+	RequestID  string // only set for approved asks, pass it to Release
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration
+}
+
+// AskOptions are optional per request overrides, same as the query parameters of the http api.
+// nil means that the key's configured value is used.
+type AskOptions struct {
+	CanWait            bool
+	MaxRequests        *int
+	MaxRequestsInQueue *int
+}
+
+// Client is a binary protocol client. It is safe for concurrent use, and concurrent requests
+// are pipelined over its single connection.
+type Client struct {
+	conn   net.Conn
+	writer *frameWriter
+	nextID atomic.Uint64
+
+	mutex   sync.Mutex
+	pending map[uint64]chan *responseBody
+	err     error // set once the connection has failed or been closed
+}
+
+// Dial connects to a gocc binary protocol listener. network is as for net.Dial, e.g. "tcp".
+func Dial(network string, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialTLS connects to a gocc binary protocol listener that is served with tls
+func DialTLS(network string, address string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient creates a client on top of an existing connection. The client takes ownership of the connection.
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		pending: map[uint64]chan *responseBody{},
+	}
+	c.writer = newFrameWriter(conn, c.fail)
+	go c.readLoop()
+	return c
+}
+
+// Ask asks for permission to make a request on a key
+func (c *Client) Ask(ctx context.Context, key string, opts AskOptions) (*Decision, error) {
+	body := encodeAsk(&askBody{
+		canWait:            opts.CanWait,
+		maxRequests:        toWire(opts.MaxRequests),
+		maxRequestsInQueue: toWire(opts.MaxRequestsInQueue),
+		key:                key,
+	})
+	resp, err := c.roundTrip(ctx, FrameAsk, body)
+	if err != nil {
+		return nil, err
+	}
+	return toDecision(resp), nil
+}
+
+// Release releases a previously approved request, making room for another one in the key's window
+func (c *Client) Release(ctx context.Context, key string, requestID string) error {
+	_, err := c.roundTrip(ctx, FrameRelease, encodeRelease(key, requestID))
+	return err
+}
+
+// Peek returns the key's current limit status, without consuming a slot
+func (c *Client) Peek(ctx context.Context, key string) (*Decision, error) {
+	resp, err := c.roundTrip(ctx, FramePeek, encodePeek(key))
+	if err != nil {
+		return nil, err
+	}
+	return toDecision(resp), nil
+}
+
+// Authenticate sends the tenant credentials (an api key or a jwt) that all following requests are made with
+func (c *Client) Authenticate(ctx context.Context, token string) error {
+	_, err := c.roundTrip(ctx, FrameAuth, encodeAuth(token))
+	return err
+}
+
+// Close closes the connection. Requests in flight fail with ErrClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+func (c *Client) roundTrip(ctx context.Context, frameType uint8, body []byte) (*responseBody, error) {
+	id := c.nextID.Add(1)
+	respCh := make(chan *responseBody, 1)
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.pending[id] = respCh
+	c.mutex.Unlock()
+
+	if !c.writer.send(&frame{frameType: frameType, correlationID: id, body: body}) {
+		c.removePending(id)
+		return nil, c.closedErr()
+	}
+
+	select {
+	case resp, ok := <-respCh:
+		if !ok {
+			return nil, c.closedErr()
+		}
+		if resp.result == ResultError {
+			return nil, &ServerError{Msg: resp.text}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		// The server will still answer, but nobody is listening
+		c.removePending(id)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) readLoop() {
+	reader := bufio.NewReaderSize(c.conn, 32*1024)
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		resp, err := decodeResponse(f.body)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mutex.Lock()
+		respCh, ok := c.pending[f.correlationID]
+		delete(c.pending, f.correlationID)
+		c.mutex.Unlock()
+		if ok {
+			respCh <- resp
+		}
+	}
+}
+
+// fail closes the connection and fails all pending requests. Only the first error is kept.
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	if !errors.Is(err, ErrClosed) {
+		err = fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+	c.err = err
+	c.writer.close()
+	_ = c.conn.Close()
+	for id, respCh := range c.pending {
+		close(respCh)
+		delete(c.pending, id)
+	}
+}
+
+func (c *Client) removePending(id uint64) {
+	c.mutex.Lock()
+	delete(c.pending, id)
+	c.mutex.Unlock()
+}
+
+// failed returns true once the connection has failed or been closed
+func (c *Client) failed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err != nil
+}
+
+func (c *Client) closedErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return ErrClosed
+}
+
+func toWire(override *int) int {
+	if override == nil {
+		return notSet
+	}
+	return *override
+}
+
+func toDecision(resp *responseBody) *Decision {
+	return &Decision{
+		Approved:   resp.result == ResultApproved,
+		RequestID:  resp.text,
+		Limit:      resp.limit,
+		Remaining:  resp.remaining,
+		ResetAfter: resp.resetAfter,
+	}
+}
@@ -0,0 +1,80 @@
+package binary_proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kivra/gocc/pkg/cluster"
+	"github.com/kivra/gocc/pkg/hash_ring"
+	"net/url"
+)
+
+// ClusterClient sends each request to the instance owning its key, for gocc in distributed mode. Unlike the
+// http api, the binary protocol frontend doesn't forward requests to the owners of keys, so clients must.
+// It uses the same consistent hash ring as the instances, so it must be given the same instance urls
+// (--instance-urls, including any ?weight=) and virtual nodes (--virtual-nodes).
+type ClusterClient struct {
+	ring    *hash_ring.Ring
+	clients []*Client // in the order of the ring's members
+}
+
+// DialCluster connects to all instances. dial connects to the binary protocol listener of an instance,
+// given its instance url, e.g. with Dial("tcp", instanceUrl.Hostname()+":8082").
+func DialCluster(
+	instanceUrls []string,
+	virtualNodes int,
+	dial func(instanceUrl *url.URL) (*Client, error),
+) (*ClusterClient, error) {
+	view, err := cluster.NewView(instanceUrls, virtualNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ClusterClient{ring: view.Ring}
+	for _, instance := range view.Instances {
+		client, err := dial(instance)
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("failed to connect to %s: %w", instance, err)
+		}
+		c.clients = append(c.clients, client)
+	}
+	return c, nil
+}
+
+// Client returns the client of the instance owning a key
+func (c *ClusterClient) Client(key string) *Client {
+	return c.clients[c.ring.Owner(key)]
+}
+
+// Ask asks the instance owning the key for permission to make a request on it
+func (c *ClusterClient) Ask(ctx context.Context, key string, opts AskOptions) (*Decision, error) {
+	return c.Client(key).Ask(ctx, key, opts)
+}
+
+// Release releases a previously approved request on the instance owning the key
+func (c *ClusterClient) Release(ctx context.Context, key string, requestID string) error {
+	return c.Client(key).Release(ctx, key, requestID)
+}
+
+// Peek returns the key's current limit status from the instance owning it
+func (c *ClusterClient) Peek(ctx context.Context, key string) (*Decision, error) {
+	return c.Client(key).Peek(ctx, key)
+}
+
+// Authenticate sends the tenant credentials to all instances
+func (c *ClusterClient) Authenticate(ctx context.Context, token string) error {
+	var errs []error
+	for _, client := range c.clients {
+		errs = append(errs, client.Authenticate(ctx, token))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the connections to all instances
+func (c *ClusterClient) Close() error {
+	for _, client := range c.clients {
+		_ = client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package binary_proto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/server/endpoints"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxInFlightFrames is the number of requests of a connection that are decided at a time. Pipelined requests
+// beyond it wait to be read until earlier ones have been answered.
+const maxInFlightFrames = 1024
+
+// flushTimeout is how long the answers to the last requests of a connection may take to be written
+const flushTimeout = 5 * time.Second
+
+// Frontend serves the binary protocol, for high throughput callers that want to go beyond http.
+// Each request frame is handled on its own goroutine, so pipelined requests on the same connection
+// are processed in parallel across limiter shards, and answered as soon as they are decided.
+// With tenant auth, connections send an Auth frame before their other requests.
+type Frontend struct {
+	cfg            *config.GlobalCfgValidated
+	limiterManager *limiter_manager.LimiterManagerSet
+	auth           *tenant_auth.Authenticator
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func New(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) *Frontend {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Frontend{
+		cfg:            cfg,
+		limiterManager: limiterManager,
+		auth:           auth,
+		conns:          map[net.Conn]struct{}{},
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+func (f *Frontend) Name() string {
+	return "binary"
+}
+
+func (f *Frontend) Port() int {
+	return f.cfg.BinaryPort.Value()
+}
+
+func (f *Frontend) Serve(listener net.Listener) error {
+	f.mutex.Lock()
+	f.listeners = append(f.listeners, listener)
+	f.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if f.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		f.mutex.Lock()
+		f.conns[conn] = struct{}{}
+		f.mutex.Unlock()
+		go f.serveConn(conn)
+	}
+}
+
+func (f *Frontend) Close() {
+	f.cancel()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, listener := range f.listeners {
+		_ = listener.Close()
+	}
+	for conn := range f.conns {
+		_ = conn.Close()
+	}
+}
+
+func (f *Frontend) serveConn(conn net.Conn) {
+
+	// Cancelled when the connection goes away, so that queued asks give up their place
+	connCtx, cancel := context.WithCancel(f.ctx)
+	writer := newFrameWriter(conn, func(err error) {
+		slog.Debug(fmt.Sprintf("binary protocol connection write failed: %v", err))
+		cancel()
+		_ = conn.Close()
+	})
+	inFlight := make(chan struct{}, maxInFlightFrames)
+	var handlers sync.WaitGroup
+
+	defer func() {
+		handlers.Wait()
+		cancel()
+		_ = conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+		writer.flushAndClose()
+		f.mutex.Lock()
+		delete(f.conns, conn)
+		f.mutex.Unlock()
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReaderSize(conn, 32*1024)
+	token := "" // credentials from the latest Auth frame
+
+	for {
+		req, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				// Gone rather than done sending, e.g. reset, so nobody is waiting for the answers
+				cancel()
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Debug(fmt.Sprintf("binary protocol connection closed: %v", err))
+				}
+			}
+			return
+		}
+		if req.frameType == FrameAuth {
+			// Handled in order, so that the requests pipelined after it use the new credentials
+			var resp *responseBody
+			token, resp = f.handleAuth(token, req.body)
+			writer.send(&frame{frameType: req.frameType | frameResponseBit, correlationID: req.correlationID, body: encodeResponse(resp)})
+			continue
+		}
+
+		// Stop reading while too many requests are in flight, until some of them are answered
+		select {
+		case inFlight <- struct{}{}:
+		case <-connCtx.Done():
+			return
+		}
+		handlers.Add(1)
+		go func(token string) {
+			defer func() {
+				<-inFlight
+				handlers.Done()
+			}()
+			resp := f.handleFrame(connCtx, token, req)
+			if resp != nil {
+				writer.send(&frame{
+					frameType:     req.frameType | frameResponseBit,
+					correlationID: req.correlationID,
+					body:          encodeResponse(resp),
+				})
+			}
+		}(token)
+	}
+}
+
+// handleAuth checks the credentials of an Auth frame. Returns the token to use for following requests.
+func (f *Frontend) handleAuth(previous string, body []byte) (string, *responseBody) {
+	token, err := decodeAuth(body)
+	if err != nil {
+		return previous, errorResponse(err.Error())
+	}
+	if _, authErr := f.auth.Authenticate(token); authErr != nil {
+		return previous, errorResponse(authErr.Msg)
+	}
+	return token, &responseBody{result: ResultApproved}
+}
+
+// handleFrame decides a request. Returns nil if no response should be sent.
+func (f *Frontend) handleFrame(connCtx context.Context, token string, req *frame) *responseBody {
+	switch req.frameType {
+	case FrameAsk:
+		ask, err := decodeAsk(req.body)
+		if err != nil {
+			return errorResponse(err.Error())
+		}
+		return f.handleAsk(connCtx, token, req.correlationID, ask)
+	case FrameRelease:
+		key, requestID, err := decodeRelease(req.body)
+		if err != nil {
+			return errorResponse(err.Error())
+		}
+		return f.handleRelease(connCtx, token, req.correlationID, key, requestID)
+	case FramePeek:
+		key, err := decodePeek(req.body)
+		if err != nil {
+			return errorResponse(err.Error())
+		}
+		return f.handlePeek(connCtx, token, key)
+	default:
+		return errorResponse(fmt.Sprintf("unknown frame type %d", req.frameType))
+	}
+}
+
+func (f *Frontend) handleAsk(connCtx context.Context, token string, correlationID uint64, ask *askBody) *responseBody {
+	key := strings.TrimSpace(ask.key)
+	if len(key) == 0 {
+		return errorResponse("empty key provided")
+	}
+	tenant, authErr := f.auth.Authorize(token, key)
+	if authErr != nil {
+		return errorResponse(authErr.Msg)
+	}
+	ctx := newRequestContext(connCtx, correlationID, key)
+
+	maxRequests, maxRequestsInQueue := fromWire(ask.maxRequests), fromWire(ask.maxRequestsInQueue)
+	if err := endpoints.ValidateOverrides(f.cfg, tenant, key, maxRequests, maxRequestsInQueue, limiter_api.NoChange); err != nil {
+		slog.Warn(err.Msg, logctx.GetAll(ctx)...)
+		return errorResponse(err.Msg)
+	}
+
+	resp, requestID := f.limiterManager.AskPermissionWithStatus(ctx, key, ask.canWait, maxRequests, maxRequestsInQueue, limiter_api.NoChange)
+
+	switch resp.RespCode {
+	case limiter_api.Approved:
+		return statusResponse(ResultApproved, &resp.Status, requestID)
+	case limiter_api.Denied:
+		return statusResponse(ResultDenied, &resp.Status, "")
+	case limiter_api.ClientGaveUp:
+		return nil // the connection is gone
+	default:
+		slog.Error("unexpected response from limiter", append(logctx.GetAll(ctx), slog.String("response", string(resp.RespCode)))...)
+		return errorResponse("unexpected response from limiter")
+	}
+}
+
+func (f *Frontend) handleRelease(connCtx context.Context, token string, correlationID uint64, key string, requestID string) *responseBody {
+	key, requestID = strings.TrimSpace(key), strings.TrimSpace(requestID)
+	if len(key) == 0 || len(requestID) == 0 {
+		return errorResponse("empty key or id provided")
+	}
+	if _, authErr := f.auth.Authorize(token, key); authErr != nil {
+		return errorResponse(authErr.Msg)
+	}
+	f.limiterManager.Release(newRequestContext(connCtx, correlationID, key), key, requestID)
+	return &responseBody{result: ResultApproved}
+}
+
+func (f *Frontend) handlePeek(connCtx context.Context, token string, key string) *responseBody {
+	key = strings.TrimSpace(key)
+	if len(key) == 0 {
+		return errorResponse("empty key provided")
+	}
+	if _, authErr := f.auth.Authorize(token, key); authErr != nil {
+		return errorResponse(authErr.Msg)
+	}
+	status, err := f.limiterManager.Peek(connCtx, key)
+	if err != nil {
+		return nil // the connection is gone
+	}
+	result := ResultApproved
+	if status.Remaining() == 0 {
+		result = ResultDenied
+	}
+	return statusResponse(result, status, "")
+}
+
+// newRequestContext uses the client's correlation id for logging, since generating uuids
+// would be a measurable part of the cost of a request at the rates this protocol is for
+func newRequestContext(connCtx context.Context, correlationID uint64, key string) context.Context {
+	ctx := logctx.Add(connCtx, "correlation-id", "bin-"+strconv.FormatUint(correlationID, 10))
+	return logctx.Add(ctx, "key", key)
+}
+
+func fromWire(override int) int {
+	if override == notSet {
+		return limiter_api.NoChange
+	}
+	return override
+}
+
+func statusResponse(result uint8, status *limiter_api.LimitStatus, text string) *responseBody {
+	return &responseBody{
+		result:     result,
+		limit:      status.MaxRequestsPerWindow,
+		remaining:  status.Remaining(),
+		resetAfter: status.ResetAfter(),
+		text:       text,
+	}
+}
+
+func errorResponse(msg string) *responseBody {
+	return &responseBody{result: ResultError, text: msg}
+}
@@ -0,0 +1,188 @@
+package binary_proto
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/metrics"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PeerForwarder forwards requests on keys to their owners over the binary protocol, for --peer-transport=binary.
+// It keeps one connection per instance, dialed when it is first needed and again after it has failed, so that
+// the requests forwarded to an instance are pipelined over it and batched into as few writes as possible.
+// The connections authenticate with --peer-api-key, since clients have already been authorized by this instance.
+type PeerForwarder struct {
+	cfg *config.GlobalCfgValidated
+
+	mutex  sync.Mutex
+	peers  map[string]*peerConn // by instance url
+	closed bool
+}
+
+type peerConn struct {
+	dialing sync.Mutex // held while dialing, so that one request at a time dials the instance
+	client  atomic.Pointer[Client]
+}
+
+var peerDialer = &net.Dialer{Timeout: 5 * time.Second}
+
+func NewPeerForwarder(cfg *config.GlobalCfgValidated) *PeerForwarder {
+	return &PeerForwarder{cfg: cfg, peers: map[string]*peerConn{}}
+}
+
+// Ask asks the owner of a key for permission to make a request on it
+func (f *PeerForwarder) Ask(
+	ctx context.Context,
+	owner *url.URL,
+	key string,
+	canWait bool,
+	maxRequests int,
+	maxRequestsInQueue int,
+) (*limiter_api.PermissionResponse, string, error) {
+
+	opts := AskOptions{CanWait: canWait}
+	if maxRequests != limiter_api.NoChange {
+		opts.MaxRequests = &maxRequests
+	}
+	if maxRequestsInQueue != limiter_api.NoChange {
+		opts.MaxRequestsInQueue = &maxRequestsInQueue
+	}
+
+	var decision *Decision
+	err := f.do(ctx, owner, func(client *Client) (err error) {
+		decision, err = client.Ask(ctx, key, opts)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	result := &limiter_api.PermissionResponse{
+		RespCode: limiter_api.Denied,
+		Status: limiter_api.LimitStatus{
+			MaxRequestsPerWindow:  decision.Limit,
+			NumApprovedThisWindow: decision.Limit - decision.Remaining,
+			WindowMillis:          max(1, int(decision.ResetAfter.Milliseconds())), // the real window size is not known
+			WindowResetsAt:        time.Now().Add(decision.ResetAfter),
+		},
+	}
+	if decision.Approved {
+		result.RespCode = limiter_api.Approved
+	}
+	return result, decision.RequestID, nil
+}
+
+// Release releases a request approved by the owner of the key
+func (f *PeerForwarder) Release(ctx context.Context, owner *url.URL, key string, requestID string) error {
+	return f.do(ctx, owner, func(client *Client) error {
+		return client.Release(ctx, key, requestID)
+	})
+}
+
+// Close closes the connections to all instances. Requests in flight fail.
+func (f *PeerForwarder) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	for _, peer := range f.peers {
+		if client := peer.current(); client != nil {
+			_ = client.Close()
+		}
+	}
+}
+
+// do makes a request on the connection to an instance. Connections that have failed are dialed again by the
+// next request, rather than retrying this one, which the instance may already have decided.
+func (f *PeerForwarder) do(ctx context.Context, instance *url.URL, request func(client *Client) error) error {
+	client, err := f.client(ctx, instance)
+	if err == nil {
+		err = request(client)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		metrics.ForwardingFailed(instance.Host)
+	}
+	return err
+}
+
+func (f *PeerForwarder) client(ctx context.Context, instance *url.URL) (*Client, error) {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil, ErrClosed
+	}
+	peer, ok := f.peers[instance.String()]
+	if !ok {
+		peer = &peerConn{}
+		f.peers[instance.String()] = peer
+	}
+	f.mutex.Unlock()
+
+	if client := peer.current(); client != nil {
+		return client, nil
+	}
+	peer.dialing.Lock()
+	defer peer.dialing.Unlock()
+	if client := peer.current(); client != nil {
+		return client, nil // dialed by another request meanwhile
+	}
+
+	client, err := f.dial(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		_ = client.Close()
+		return nil, ErrClosed
+	}
+	peer.client.Store(client)
+	return client, nil
+}
+
+// dial connects to the binary protocol port of an instance, with tls if configured, and authenticates
+func (f *PeerForwarder) dial(ctx context.Context, instance *url.URL) (*Client, error) {
+	port := f.cfg.PeerBinaryPort.Value()
+	if port == 0 {
+		port = f.cfg.BinaryPort.Value()
+	}
+	address := net.JoinHostPort(instance.Hostname(), strconv.Itoa(port))
+
+	var conn net.Conn
+	var err error
+	if f.cfg.Tls != nil {
+		dialer := &tls.Dialer{NetDialer: peerDialer, Config: f.cfg.Tls.ClientConfig(instance.Hostname())}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = peerDialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(conn)
+	if apiKey := f.cfg.PeerApiKey.Value(); apiKey != "" {
+		if err := client.Authenticate(ctx, apiKey); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// current returns the client of the connection, unless there is none or it has failed
+func (p *peerConn) current() *Client {
+	client := p.client.Load()
+	if client == nil || client.failed() {
+		return nil
+	}
+	return client
+}
@@ -0,0 +1,321 @@
+package binary_proto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// A compact length-prefixed protocol on top of TCP. All integers are big endian.
+//
+// Every frame, in both directions:
+//
+//	uint32 length of the rest of the frame
+//	uint8  frame type
+//	uint64 correlation id, chosen by the client and echoed back in the response
+//	...    frame type specific body
+//
+// Request bodies:
+//
+//	Ask:     uint8 flags (bit 0 = can wait), int32 max requests, int32 max requests in queue, string key
+//	Release: string key, string request id
+//	Peek:    string key
+//	Auth:    string credentials (an api key or a jwt), for all following requests on the connection
+//
+// where overrides of -1 mean "not set", and strings are an uint16 length followed by that many bytes.
+//
+// Responses have the request's frame type with the high bit set, and all share the same body:
+//
+//	uint8 result code, int32 limit, int32 remaining, uint32 millis until the window resets,
+//	string request id (approved asks) or error message (errors)
+//
+// Clients may send any number of requests without waiting for responses. Responses can arrive
+// out of order, since asks that wait in queue don't hold up other requests on the same connection.
+
+const (
+	FrameAsk     uint8 = 0x01
+	FrameRelease uint8 = 0x02
+	FramePeek    uint8 = 0x03
+	FrameAuth    uint8 = 0x04
+
+	frameResponseBit uint8 = 0x80
+)
+
+const (
+	ResultApproved uint8 = 0
+	ResultDenied   uint8 = 1
+	ResultError    uint8 = 2
+)
+
+const (
+	flagCanWait uint8 = 0x01
+
+	notSet = -1
+
+	maxFrameLen  = 64 * 1024 // keys and ids are short, anything bigger is garbage
+	headerLen    = 1 + 8     // frame type + correlation id
+	maxStringLen = math.MaxUint16
+)
+
+var errProtocol = errors.New("protocol error")
+
+type frame struct {
+	frameType     uint8
+	correlationID uint64
+	body          []byte
+}
+
+type askBody struct {
+	canWait            bool
+	maxRequests        int
+	maxRequestsInQueue int
+	key                string
+}
+
+type responseBody struct {
+	result     uint8
+	limit      int
+	remaining  int
+	resetAfter time.Duration
+	text       string // request id or error message
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n < headerLen || n > maxFrameLen {
+		return nil, fmt.Errorf("%w: invalid frame length %d", errProtocol, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &frame{
+		frameType:     buf[0],
+		correlationID: binary.BigEndian.Uint64(buf[1:9]),
+		body:          buf[9:],
+	}, nil
+}
+
+func writeFrame(w *bufio.Writer, f *frame) error {
+	var header [4 + headerLen]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(headerLen+len(f.body)))
+	header[4] = f.frameType
+	binary.BigEndian.PutUint64(header[5:13], f.correlationID)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.body)
+	return err
+}
+
+// bodyReader reads fields from a frame body, remembering the first error
+type bodyReader struct {
+	buf []byte
+	err error
+}
+
+func (b *bodyReader) take(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if len(b.buf) < n {
+		b.err = fmt.Errorf("%w: truncated frame body", errProtocol)
+		return nil
+	}
+	result := b.buf[:n]
+	b.buf = b.buf[n:]
+	return result
+}
+
+func (b *bodyReader) uint8() uint8 {
+	if v := b.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (b *bodyReader) int32() int {
+	if v := b.take(4); v != nil {
+		return int(int32(binary.BigEndian.Uint32(v)))
+	}
+	return 0
+}
+
+func (b *bodyReader) uint32() uint32 {
+	if v := b.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (b *bodyReader) string() string {
+	v := b.take(2)
+	if v == nil {
+		return ""
+	}
+	return string(b.take(int(binary.BigEndian.Uint16(v))))
+}
+
+func appendString(buf []byte, s string) []byte {
+	if len(s) > maxStringLen {
+		s = s[:maxStringLen]
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendInt32(buf []byte, i int) []byte {
+	return binary.BigEndian.AppendUint32(buf, uint32(int32(i)))
+}
+
+func encodeAsk(a *askBody) []byte {
+	buf := make([]byte, 0, 1+4+4+2+len(a.key))
+	flags := uint8(0)
+	if a.canWait {
+		flags |= flagCanWait
+	}
+	buf = append(buf, flags)
+	buf = appendInt32(buf, a.maxRequests)
+	buf = appendInt32(buf, a.maxRequestsInQueue)
+	return appendString(buf, a.key)
+}
+
+func decodeAsk(body []byte) (*askBody, error) {
+	r := &bodyReader{buf: body}
+	flags := r.uint8()
+	result := &askBody{
+		canWait:            flags&flagCanWait != 0,
+		maxRequests:        r.int32(),
+		maxRequestsInQueue: r.int32(),
+		key:                r.string(),
+	}
+	return result, r.err
+}
+
+func encodeRelease(key string, requestID string) []byte {
+	buf := make([]byte, 0, 2+len(key)+2+len(requestID))
+	buf = appendString(buf, key)
+	return appendString(buf, requestID)
+}
+
+func decodeRelease(body []byte) (string, string, error) {
+	r := &bodyReader{buf: body}
+	key := r.string()
+	requestID := r.string()
+	return key, requestID, r.err
+}
+
+func encodePeek(key string) []byte {
+	return appendString(make([]byte, 0, 2+len(key)), key)
+}
+
+func decodePeek(body []byte) (string, error) {
+	r := &bodyReader{buf: body}
+	key := r.string()
+	return key, r.err
+}
+
+func encodeAuth(token string) []byte {
+	return appendString(make([]byte, 0, 2+len(token)), token)
+}
+
+func decodeAuth(body []byte) (string, error) {
+	r := &bodyReader{buf: body}
+	token := r.string()
+	return token, r.err
+}
+
+func encodeResponse(resp *responseBody) []byte {
+	buf := make([]byte, 0, 1+4+4+4+2+len(resp.text))
+	buf = append(buf, resp.result)
+	buf = appendInt32(buf, resp.limit)
+	buf = appendInt32(buf, resp.remaining)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(min(resp.resetAfter.Milliseconds(), math.MaxUint32)))
+	return appendString(buf, resp.text)
+}
+
+func decodeResponse(body []byte) (*responseBody, error) {
+	r := &bodyReader{buf: body}
+	result := &responseBody{
+		result:     r.uint8(),
+		limit:      r.int32(),
+		remaining:  r.int32(),
+		resetAfter: time.Duration(r.uint32()) * time.Millisecond,
+		text:       r.string(),
+	}
+	return result, r.err
+}
+
+// frameWriter serializes frames from many goroutines onto one connection. Frames are
+// buffered and only flushed when no more frames are waiting, so pipelined traffic is batched.
+type frameWriter struct {
+	frames    chan *frame
+	done      chan struct{}
+	stopped   chan struct{} // closed when the writing goroutine has returned
+	closeOnce sync.Once
+}
+
+func newFrameWriter(w io.Writer, onError func(error)) *frameWriter {
+	fw := &frameWriter{
+		frames:  make(chan *frame, 1024),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(fw.stopped)
+		bw := bufio.NewWriterSize(w, 32*1024)
+		for {
+			select {
+			case f := <-fw.frames:
+				err := writeFrame(bw, f)
+				if err == nil && len(fw.frames) == 0 {
+					err = bw.Flush()
+				}
+				if err != nil {
+					fw.close()
+					onError(err)
+					return
+				}
+			case <-fw.done:
+				// Write what was sent before closing, see flushAndClose
+				for len(fw.frames) > 0 {
+					if writeFrame(bw, <-fw.frames) != nil {
+						return
+					}
+				}
+				_ = bw.Flush()
+				return
+			}
+		}
+	}()
+	return fw
+}
+
+// send queues a frame. Returns false if the writer has been closed.
+func (fw *frameWriter) send(f *frame) bool {
+	select {
+	case fw.frames <- f:
+		return true
+	case <-fw.done:
+		return false
+	}
+}
+
+func (fw *frameWriter) close() {
+	fw.closeOnce.Do(func() { close(fw.done) })
+}
+
+// flushAndClose closes the writer, and waits for the frames sent so far to be written
+func (fw *frameWriter) flushAndClose() {
+	fw.close()
+	<-fw.stopped
+}
@@ -0,0 +1,199 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager_api"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminKeyView is what the admin endpoints return for a key
+type AdminKeyView struct {
+	Key      string
+	Override *limiter_api.Config                // set through the admin endpoints, nil if none. 0 = not overridden
+	Config   limiter_api.Config                 // what new instances of the key are configured with
+	Instance *limiter_api.InstanceDebugSnapshot // nil if the key has no instance right now
+}
+
+// HandleAdminGetKeyRequest returns a key's override, config and instance state
+func HandleAdminGetKeyRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return adminHandler(cfg, auth, func(c Request, ctx context.Context, key string) error {
+		keyConfig, err := limiterManager.KeyConfig(ctx, key)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("failed to get key config: %v", err), logctx.GetAll(ctx)...)
+			return c.String(http.StatusInternalServerError, "Unable to get key config, check server logs")
+		}
+		return c.JSON(http.StatusOK, adminKeyView(limiterManager, key, keyConfig))
+	})
+}
+
+// HandleAdminSetOverrideRequest overrides a key's config with the maxRequests, maxRequestsInQueue
+// and windowMillis query parameters. Parameters left out are not overridden.
+// Tenants' rights and the key's override policy don't apply, but the global bounds do.
+func HandleAdminSetOverrideRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return adminHandler(cfg, auth, func(c Request, ctx context.Context, key string) error {
+
+		override := &limiter_api.Config{}
+		params := []struct {
+			name      string
+			value     *int
+			validator func(int) error
+		}{
+			{name: "maxRequests", value: &override.MaxRequestsPerWindow, validator: cfg.MaxRequests.CustomValidator},
+			{name: "maxRequestsInQueue", value: &override.MaxRequestsInQueue, validator: cfg.MaxRequestsInQueue.CustomValidator},
+			{name: "windowMillis", value: &override.WindowMillis, validator: cfg.WindowMillis.CustomValidator},
+		}
+		for _, param := range params {
+			value, err := parseOptionalInt32Param(c.QueryParam(param.name), 0)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "failed to parse "+param.name+" query parameter")
+			}
+			if value != 0 {
+				if err := param.validator(value); err != nil {
+					return c.String(http.StatusBadRequest, param.name+" out of bounds")
+				}
+			}
+			*param.value = value
+		}
+		if *override == (limiter_api.Config{}) {
+			return c.String(http.StatusBadRequest, "no maxRequests, maxRequestsInQueue or windowMillis query parameter provided")
+		}
+
+		keyConfig, err := limiterManager.SetOverride(ctx, key, override)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("failed to set override: %v", err), logctx.GetAll(ctx)...)
+			return c.String(http.StatusInternalServerError, "Unable to set override, check server logs")
+		}
+		return c.JSON(http.StatusOK, adminKeyView(limiterManager, key, keyConfig))
+	})
+}
+
+// HandleAdminClearOverrideRequest clears a key's override, so that the key is configured by the
+// global config and the config file again
+func HandleAdminClearOverrideRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return adminHandler(cfg, auth, func(c Request, ctx context.Context, key string) error {
+		keyConfig, err := limiterManager.SetOverride(ctx, key, nil)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("failed to clear override: %v", err), logctx.GetAll(ctx)...)
+			return c.String(http.StatusInternalServerError, "Unable to clear override, check server logs")
+		}
+		return c.JSON(http.StatusOK, adminKeyView(limiterManager, key, keyConfig))
+	})
+}
+
+// HandleAdminResetRequest resets a key's counters and starts a new window
+func HandleAdminResetRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return adminHandler(cfg, auth, func(c Request, ctx context.Context, key string) error {
+		result, err := limiterManager.Reset(ctx, key)
+		return writeKeyActionResult(c, ctx, result, err)
+	})
+}
+
+// HandleAdminDrainQueueRequest empties a key's queue. Queued requests are approved, or denied with ?deny=true
+func HandleAdminDrainQueueRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return adminHandler(cfg, auth, func(c Request, ctx context.Context, key string) error {
+		deny, err := parseOptionalBoolParam(c.QueryParam("deny"), false)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to parse deny query parameter")
+		}
+		result, err := limiterManager.DrainQueue(ctx, key, deny)
+		return writeKeyActionResult(c, ctx, result, err)
+	})
+}
+
+// HandleAdminExpireRequest expires a key's instance right away. Its queue is approved.
+func HandleAdminExpireRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return adminHandler(cfg, auth, func(c Request, ctx context.Context, key string) error {
+		result, err := limiterManager.Expire(ctx, key)
+		return writeKeyActionResult(c, ctx, result, err)
+	})
+}
+
+// adminHandler does what all admin endpoints do first: checks the key and the admin's credentials,
+// and forwards the request to the instance owning the key
+func adminHandler(
+	cfg *config.GlobalCfgValidated,
+	auth *tenant_auth.Authenticator,
+	handle func(c Request, ctx context.Context, key string) error,
+) Handler {
+	return func(c Request) error {
+
+		key := strings.TrimSpace(c.Param("key"))
+
+		// Set up log context
+		ctx := c.Context()
+		ctx = logctx.Add(ctx, "correlation-id", getCorrelationID(c))
+		ctx = logctx.Add(ctx, "key", key)
+
+		if len(key) == 0 {
+			slog.Warn("empty key provided", logctx.GetAll(ctx)...)
+			return c.String(http.StatusBadRequest, "empty key provided")
+		}
+
+		if _, authErr := auth.AuthorizeAdmin(bearerToken(c), key); authErr != nil {
+			slog.Warn(authErr.Msg, logctx.GetAll(ctx)...)
+			return writeAuthError(c, authErr)
+		}
+
+		// Keys only live on the instance owning them
+		if correctInstance, remote := getRemoteOwner(c, cfg, key); remote {
+			return proxyToInstance(c, cfg, correctInstance, ctx)
+		}
+
+		return handle(c, ctx, key)
+	}
+}
+
+func adminKeyView(
+	limiterManager *limiter_manager.LimiterManagerSet,
+	key string,
+	keyConfig *limiter_manager_api.KeyConfig,
+) *AdminKeyView {
+	view := &AdminKeyView{Key: key, Override: keyConfig.Override, Config: keyConfig.Config}
+	if snapshot := limiterManager.GetDebugSnapshot(key); snapshot != nil && snapshot.Found {
+		view.Instance = snapshot
+	}
+	return view
+}
+
+func writeKeyActionResult(c Request, ctx context.Context, result *limiter_manager_api.KeyActionResult, err error) error {
+	if err != nil {
+		slog.Warn(fmt.Sprintf("admin request failed: %v", err), logctx.GetAll(ctx)...)
+		return c.String(http.StatusInternalServerError, "Unable to complete admin request, check server logs")
+	}
+	if !result.Found {
+		return c.String(http.StatusNotFound, "Key not found")
+	}
+	return c.JSON(http.StatusOK, result)
+}
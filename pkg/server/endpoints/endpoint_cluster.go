@@ -0,0 +1,180 @@
+package endpoints
+
+import (
+	"github.com/kivra/gocc/pkg/cluster"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ClusterMember struct {
+	Url    string
+	Weight int
+}
+
+// ClusterMembersResponse is the current membership of the cluster, as this instance sees it
+type ClusterMembersResponse struct {
+	Distributed bool
+	Members     []ClusterMember
+	Self        string    // the url of this instance, empty if it isn't one of the members
+	Since       time.Time // when the members last changed
+}
+
+// HandleClusterMembersRequest returns the instances that keys are currently spread over. With
+// --discovery, they change as instances come and go.
+func HandleClusterMembersRequest(
+	cfg *config.GlobalCfgValidated,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		if _, authErr := auth.Authenticate(bearerToken(c)); authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
+		result := ClusterMembersResponse{Members: []ClusterMember{}}
+		if cfg.DistributedMode() {
+			view := cfg.Cluster.View()
+			result.Distributed = true
+			result.Since = view.Since
+			if self := view.SelfUrl(); self != nil {
+				result.Self = self.String()
+			}
+			for _, member := range view.Members() {
+				result.Members = append(result.Members, ClusterMember{Url: member.Name, Weight: member.Weight})
+			}
+		}
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// ClusterMemberStatus is a member of the cluster and its health, as this instance sees it
+type ClusterMemberStatus struct {
+	Url      string
+	Weight   int
+	Self     bool
+	Healthy  bool                // always true for this instance, and for instances that haven't been checked yet
+	RingHash string              `json:",omitempty"` // the member's ring, empty if it hasn't reported it yet
+	NumKeys  int                 // the keys that the member has limiters for, as of its last health check
+	Health   *cluster.PeerHealth `json:",omitempty"` // the health checks of other instances
+}
+
+// ClusterStatusResponse is the state of the cluster, as this instance sees it
+type ClusterStatusResponse struct {
+	Distributed    bool
+	Self           string
+	Since          time.Time // when the members last changed
+	RingVersion    uint64    // counts the changes of the members on this instance, starting at 1
+	RingHash       string    // the fingerprint of the members, their weights and --virtual-nodes
+	RingsAgree     bool      // all members that reported their ring have the same one as this instance
+	PeerDownPolicy string    // how requests on keys whose owner is down are decided
+	Degraded       bool      // some members are down, so their keys are decided by replicas or PeerDownPolicy
+	Replication    int       // the number of replicas of each key, the --replication-factor
+	NumReplicas    int       // the replicas of other instances' keys kept here
+	NumKeys        int       // the keys that this instance has limiters for
+	Members        []ClusterMemberStatus
+}
+
+// HandleClusterStatusRequest returns the members of the cluster, their health, and whether they agree on the ring
+func HandleClusterStatusRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		if _, authErr := auth.Authenticate(bearerToken(c)); authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
+		result := ClusterStatusResponse{Members: []ClusterMemberStatus{}, NumKeys: limiterManager.NumKeys()}
+		if cfg.DistributedMode() {
+			view := cfg.Cluster.View()
+			result.Distributed = true
+			result.Since = view.Since
+			result.RingVersion = view.Version
+			result.RingHash = view.Ring.Fingerprint()
+			result.RingsAgree = true
+			result.PeerDownPolicy = cfg.PeerDownPolicy.Value()
+			result.Replication = cfg.ReplicationFactor.Value()
+			result.NumReplicas = cfg.Replicas.Len()
+			if self := view.SelfUrl(); self != nil {
+				result.Self = self.String()
+			}
+			health := map[string]cluster.PeerHealth{}
+			for _, peer := range cfg.Health.Peers() {
+				health[peer.Url] = peer
+			}
+			for _, member := range view.Members() {
+				status := ClusterMemberStatus{Url: member.Name, Weight: member.Weight, Self: member.Name == result.Self, Healthy: true}
+				if status.Self {
+					status.RingHash = result.RingHash
+					status.NumKeys = result.NumKeys
+				} else if peer, ok := health[member.Name]; ok {
+					status.Healthy = peer.Healthy
+					status.RingHash = peer.RingHash
+					status.NumKeys = peer.NumKeys
+					status.Health = &peer
+				}
+				result.Degraded = result.Degraded || !status.Healthy
+				result.RingsAgree = result.RingsAgree && (status.RingHash == "" || status.RingHash == result.RingHash)
+				result.Members = append(result.Members, status)
+			}
+		}
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// ClusterOwnerResponse is the instance owning a key, and the one that requests on it currently go to
+type ClusterOwnerResponse struct {
+	Key       string
+	Owner     string   // empty if not in distributed mode
+	Self      bool     // the key is owned by this instance, always true if not in distributed mode
+	Healthy   bool     // the owner is up, as far as this instance knows
+	DecidedBy string   // the instance that decides requests on the key now: the owner, or a replica while it is down
+	Replicas  []string // the instances that keep replicas of the key, with --replication-factor
+	Split     bool     // the key's limit is split between the instances, see the config file
+}
+
+// HandleClusterOwnerRequest returns the instance owning a key, as this instance sees it. With tenant auth,
+// only for keys that the tenant is allowed.
+func HandleClusterOwnerRequest(
+	cfg *config.GlobalCfgValidated,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		key := strings.TrimSpace(c.Param("key"))
+		if len(key) == 0 {
+			return c.String(http.StatusBadRequest, "empty key provided")
+		}
+		if _, authErr := auth.Authorize(bearerToken(c), key); authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
+		result := ClusterOwnerResponse{Key: key, Self: true, Healthy: true, Replicas: []string{}}
+		if cfg.DistributedMode() {
+			view := cfg.Cluster.View()
+			owner, local := view.Route(key)
+			if owner == nil {
+				return c.String(http.StatusServiceUnavailable, "no instances have been discovered yet")
+			}
+			result.Owner = owner.String()
+			result.Self = local
+			result.Healthy = local || cfg.Health.Healthy(owner)
+			decidedBy, _ := view.RouteWithFailover(key, cfg.ReplicationFactor.Value(), cfg.Health.Healthy)
+			result.DecidedBy = decidedBy.String()
+			for _, replica := range view.Successors(key, cfg.ReplicationFactor.Value()) {
+				result.Replicas = append(result.Replicas, replica.String())
+			}
+			result.Split = cfg.FromFile.Get().SplitsKey(key)
+		}
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
@@ -1,19 +1,29 @@
 package endpoints
 
 import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
 	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
-	"github.com/labstack/echo/v4"
+	"github.com/kivra/gocc/pkg/tenant_auth"
 	"net/http"
 )
 
 func HandleDebugRequest(
 	limiterManager *limiter_manager.LimiterManagerSet,
-) echo.HandlerFunc {
-	return func(c echo.Context) error {
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
 
 		key := c.Param("key")
 
+		tenant, authErr := auth.Authenticate(bearerToken(c))
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
 		if key != "" {
+			if authErr := tenant.AuthorizeKey(key); authErr != nil {
+				return writeAuthError(c, authErr)
+			}
 			snapshot := limiterManager.GetDebugSnapshot(key)
 			if snapshot != nil {
 				if snapshot.Found {
@@ -27,10 +37,24 @@ func HandleDebugRequest(
 		} else {
 			all := limiterManager.GetDebugSnapshotsAll()
 			if all != nil {
-				return c.JSON(http.StatusOK, all)
+				return c.JSON(http.StatusOK, visibleTo(tenant, all))
 			} else {
 				return c.String(http.StatusInternalServerError, "Unable to get debug snapshots, check server logs")
 			}
 		}
 	}
 }
+
+// visibleTo returns the snapshots of the keys that a tenant may use
+func visibleTo(tenant *tenant_auth.Tenant, all *limiter_api.DebugSnapshotAll) *limiter_api.DebugSnapshotAll {
+	if tenant == nil {
+		return all
+	}
+	visible := &limiter_api.DebugSnapshotAll{Instances: map[string]*limiter_api.InstanceDebugSnapshot{}}
+	for key, snapshot := range all.Instances {
+		if tenant.AllowsKey(key) {
+			visible.Instances[key] = snapshot
+		}
+	}
+	return visible
+}
@@ -0,0 +1,105 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	eventsBuffer    = 1_000 // events kept per subscriber before dropping
+	eventsHeartbeat = 15 * time.Second
+)
+
+// HandleEventsRequest streams the events of one key (?key=), or of keys matching ?prefix= and/or ?regex=,
+// as server-sent events. The stream starts with a ': subscribed' comment. Events are dropped if the client
+// doesn't keep up, and a 'dropped' event with the total number dropped so far is sent when it has caught up.
+// The number of subscriptions, in total and of each tenant, is limited, 429 is returned past the limits.
+func HandleEventsRequest(
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := auth.Authenticate(bearerToken(c))
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
+		key := strings.TrimSpace(c.QueryParam("key"))
+		prefix := c.QueryParam("prefix")
+		var regex *regexp.Regexp
+		if pattern := c.QueryParam("regex"); pattern != "" {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "invalid regex query parameter")
+			}
+			regex = compiled
+		}
+		if key != "" {
+			if authErr := tenant.AuthorizeKey(key); authErr != nil {
+				return writeAuthError(c, authErr)
+			}
+		}
+
+		matches := func(k string) bool {
+			return (key == "" || k == key) &&
+				strings.HasPrefix(k, prefix) &&
+				(regex == nil || regex.MatchString(k)) &&
+				tenant.AllowsKey(k)
+		}
+
+		owner := ""
+		if tenant != nil {
+			owner = tenant.Name
+		}
+		subscription, err := limiterManager.Subscribe(owner, matches, eventsBuffer)
+		if err != nil {
+			return c.String(http.StatusTooManyRequests, "too many event subscriptions, try again later")
+		}
+
+		done := c.Context().Done()
+
+		c.ResponseHeader().Set("Cache-Control", "no-cache")
+		c.ResponseHeader().Set("X-Accel-Buffering", "no") // or nginx holds the events back
+		return c.Stream(http.StatusOK, "text/event-stream", func(w io.Writer, flush func() error) {
+			defer subscription.Close()
+
+			heartbeat := time.NewTicker(eventsHeartbeat)
+			defer heartbeat.Stop()
+
+			_, _ = io.WriteString(w, ": subscribed\n\n")
+			if flush() != nil {
+				return
+			}
+
+			reportedDropped := int64(0)
+			for {
+				select {
+				case <-done:
+					return
+				case <-heartbeat.C:
+					_, _ = io.WriteString(w, ": keepalive\n\n")
+				case event := <-subscription.Events():
+					if dropped := subscription.Dropped(); dropped > reportedDropped {
+						_, _ = fmt.Fprintf(w, "event: dropped\ndata: {\"Dropped\":%d}\n\n", dropped)
+						reportedDropped = dropped
+					}
+					data, _ := json.Marshal(event)
+					_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+				}
+				if err := flush(); err != nil {
+					slog.Debug(fmt.Sprintf("events client went away: %v", err))
+					return
+				}
+			}
+		})
+	}
+}
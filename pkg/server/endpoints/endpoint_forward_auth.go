@@ -0,0 +1,176 @@
+package endpoints
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/keytemplate"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HandleForwardAuthRequest lets reverse proxies use gocc as an external decision point, e.g.
+// nginx auth_request, Traefik forwardAuth or Caddy forward_auth. Keys are built from the forwarded
+// request's headers using the configured key templates, and all resulting keys must be within limits.
+// Answers 200 or the configured deny status, with rate limit headers the proxy can pass on.
+// With tenant auth, the proxy's own credentials are sent in ForwardAuthCredentialsHeader.
+func HandleForwardAuthRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+
+	templates := make([]*keytemplate.Template, 0, len(cfg.ForwardAuthKeyTemplates.Value()))
+	for _, raw := range cfg.ForwardAuthKeyTemplates.Value() {
+		template, err := keytemplate.Parse(raw)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid forward auth key template: %v", err))
+		}
+		templates = append(templates, template)
+	}
+	denyStatus := cfg.ForwardAuthDenyStatus.Value()
+
+	return func(c Request) error {
+
+		ctx := c.Context()
+		ctx = logctx.Add(ctx, "correlation-id", getCorrelationID(c))
+
+		canWait, err := parseOptionalBoolParam(c.QueryParam("canWait"), false)
+		if err != nil {
+			slog.Warn("failed to parse canWait query parameter", logctx.GetAll(ctx)...)
+			return c.String(http.StatusBadRequest, "failed to parse canWait query parameter")
+		}
+
+		token := tenant_auth.BearerToken(c.Header(ForwardAuthCredentialsHeader))
+		tenant, authErr := auth.Authenticate(token)
+		if authErr != nil {
+			slog.Warn(authErr.Msg, logctx.GetAll(ctx)...)
+			return writeAuthError(c, authErr)
+		}
+
+		lookup := forwardedRequestLookup(c)
+
+		// The most restrictive status of all keys is reported back
+		var reported *limiter_api.PermissionResponse
+
+		for _, template := range templates {
+			key, err := template.Execute(lookup)
+			if err != nil {
+				slog.Debug(fmt.Sprintf("key template not applicable: %v", err), logctx.GetAll(ctx)...)
+				continue
+			}
+			key = strings.TrimSpace(key)
+			if len(key) == 0 {
+				continue
+			}
+			keyCtx := logctx.Add(ctx, "key", key)
+
+			if authErr := tenant.AuthorizeKey(key); authErr != nil {
+				slog.Warn(authErr.Msg, logctx.GetAll(keyCtx)...)
+				return writeAuthError(c, authErr)
+			}
+
+			var result *limiter_api.PermissionResponse
+			if owner, remote := getRemoteOwner(c, cfg, key); remote {
+				result = askSplitKey(keyCtx, cfg, key, owner)
+				if result == nil && cfg.Peers != nil {
+					result, _ = askPeer(keyCtx, cfg, owner, key, canWait, limiter_api.NoChange, limiter_api.NoChange)
+				} else if result == nil && cfg.Health.Healthy(owner) {
+					slog.Debug(fmt.Sprintf("asking correct instance %s", owner.String()), logctx.GetAll(keyCtx)...)
+					result, err = askRemoteOwner(keyCtx, forwardingClient(cfg), owner, key, canWait, token)
+					if err != nil {
+						slog.Warn(fmt.Sprintf("failed to forward request to correct instance: %v", err), logctx.GetAll(keyCtx)...)
+					}
+				}
+				if result == nil {
+					result, _ = askWhileOwnerDown(keyCtx, c, cfg, limiterManager, key, canWait, limiter_api.NoChange, limiter_api.NoChange)
+				}
+			} else {
+				takeOverReplica(keyCtx, cfg, limiterManager, key)
+				result, _ = limiterManager.AskPermissionWithStatus(keyCtx, key, canWait, limiter_api.NoChange, limiter_api.NoChange, limiter_api.NoChange)
+			}
+
+			switch result.RespCode {
+			case limiter_api.Approved:
+				if reported == nil || result.Status.Remaining() < reported.Status.Remaining() {
+					reported = result
+				}
+			case limiter_api.Denied:
+				setRateLimitHeaders(c.ResponseHeader(), &result.Status, true)
+				return c.NoContent(denyStatus)
+			case limiter_api.ClientGaveUp:
+				return c.NoContent(499) // will never be returned to the client, so just pick a random status code
+			default:
+				slog.Error("unexpected response from limiter", append(logctx.GetAll(keyCtx), slog.String("response", string(result.RespCode)))...)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+
+		if reported != nil {
+			setRateLimitHeaders(c.ResponseHeader(), &reported.Status, false)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// forwardedRequestLookup resolves key template placeholders from the headers that
+// nginx (X-Original-*) and Traefik/Caddy (X-Forwarded-*) send along with auth requests.
+func forwardedRequestLookup(c Request) func(string) (string, bool) {
+	firstHeader := func(names ...string) (string, bool) {
+		for _, name := range names {
+			if value := strings.TrimSpace(c.Header(name)); value != "" {
+				return value, true
+			}
+		}
+		return "", false
+	}
+	return func(name string) (string, bool) {
+		switch {
+		case name == "client-ip":
+			// Only the address the proxy appended to X-Forwarded-For can be trusted. The entries before it
+			// come from the client, and could be anything.
+			if xff := c.Header("X-Forwarded-For"); xff != "" {
+				if last := strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:]); last != "" {
+					return last, true
+				}
+			}
+			if realIP, ok := firstHeader("X-Real-IP"); ok {
+				return realIP, true
+			}
+			host, _, err := net.SplitHostPort(c.RemoteAddr())
+			if err != nil {
+				return c.RemoteAddr(), true
+			}
+			return host, true
+		case name == "uri":
+			return firstHeader("X-Original-URI", "X-Forwarded-Uri")
+		case name == "path":
+			uri, ok := firstHeader("X-Original-URI", "X-Forwarded-Uri")
+			path, _, _ := strings.Cut(uri, "?")
+			return path, ok
+		case name == "method":
+			return firstHeader("X-Original-Method", "X-Forwarded-Method")
+		case name == "host":
+			return firstHeader("X-Forwarded-Host", "X-Original-Host")
+		case name == "authorization":
+			// hashed, so that credentials don't end up in keys, logs and debug output
+			authorization, ok := firstHeader("Authorization")
+			if !ok {
+				return "", false
+			}
+			sum := sha256.Sum256([]byte(authorization))
+			return hex.EncodeToString(sum[:16]), true
+		case strings.HasPrefix(name, "header:"):
+			return firstHeader(strings.TrimPrefix(name, "header:"))
+		default:
+			return "", false
+		}
+	}
+}
@@ -1,11 +1,26 @@
 package endpoints
 
 import (
-	"github.com/labstack/echo/v4"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"strconv"
+)
+
+// Headers of /healthz responses, with which instances tell the others that check them about themselves
+const (
+	HeaderRingHash = "X-Gocc-Ring-Hash" // the fingerprint of the instance's ring, in distributed mode
+	HeaderNumKeys  = "X-Gocc-Keys"      // the number of keys that the instance has limiters for
 )
 
 func HandleHealthRequest(
-	c echo.Context,
-) error {
-	return c.NoContent(200)
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+) Handler {
+	return func(c Request) error {
+		if cfg.DistributedMode() {
+			c.ResponseHeader().Set(HeaderRingHash, cfg.Cluster.View().Ring.Fingerprint())
+		}
+		c.ResponseHeader().Set(HeaderNumKeys, strconv.Itoa(limiterManager.NumKeys()))
+		return c.NoContent(200)
+	}
 }
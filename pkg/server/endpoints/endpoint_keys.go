@@ -0,0 +1,99 @@
+package endpoints
+
+import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultKeyListLimit = 100
+	maxKeyListLimit     = 1000
+)
+
+// keyListFields are the fields that ?fields= can select, named as in the debug snapshots
+var keyListFields = map[string]func(s *limiter_api.InstanceDebugSnapshot) any{
+	"Key":                   func(s *limiter_api.InstanceDebugSnapshot) any { return s.Key },
+	"Config":                func(s *limiter_api.InstanceDebugSnapshot) any { return s.Config },
+	"NumApprovedThisWindow": func(s *limiter_api.InstanceDebugSnapshot) any { return s.NumApprovedThisWindow },
+	"NumDeniedThisWindow":   func(s *limiter_api.InstanceDebugSnapshot) any { return s.NumDeniedThisWindow },
+	"NumWaiting":            func(s *limiter_api.InstanceDebugSnapshot) any { return s.NumWaiting },
+}
+
+// KeyListResponse is a page of keys. Keys are debug snapshots, or maps of the selected fields.
+type KeyListResponse struct {
+	Keys       []any
+	NextCursor string `json:",omitempty"` // pass as ?cursor= to get the next page
+}
+
+// HandleKeyListRequest lists the keys of this instance, a page at a time. Unlike /debug, it doesn't
+// ask every limiter instance for a snapshot, so it doesn't hold up the instances. Each page still scans all keys.
+// Query parameters: prefix, regex, sort (key, denied, waiting, approved), limit, cursor and fields.
+func HandleKeyListRequest(
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := auth.Authenticate(bearerToken(c))
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
+		query := &limiter_api.KeyListQuery{
+			Prefix: c.QueryParam("prefix"),
+			SortBy: limiter_api.KeySort(c.QueryParam("sort")),
+			Cursor: c.QueryParam("cursor"),
+		}
+		if tenant != nil {
+			query.Allow = tenant.AllowsKey
+		}
+
+		if regex := c.QueryParam("regex"); regex != "" {
+			compiled, err := regexp.Compile(regex)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "invalid regex query parameter")
+			}
+			query.Regex = compiled
+		}
+
+		limit, err := parseOptionalInt32Param(c.QueryParam("limit"), defaultKeyListLimit)
+		if err != nil || limit < 1 || limit > maxKeyListLimit {
+			return c.String(http.StatusBadRequest, "limit query parameter must be between 1 and 1000")
+		}
+		query.Limit = limit
+
+		var fields []string
+		if selected := strings.TrimSpace(c.QueryParam("fields")); selected != "" {
+			for _, field := range strings.Split(selected, ",") {
+				field = strings.TrimSpace(field)
+				if keyListFields[field] == nil {
+					return c.String(http.StatusBadRequest, "unknown field '"+field+"' in fields query parameter")
+				}
+				fields = append(fields, field)
+			}
+		}
+
+		page, err := limiterManager.ListKeys(query)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		response := &KeyListResponse{Keys: make([]any, 0, len(page.Keys)), NextCursor: page.NextCursor}
+		for _, snapshot := range page.Keys {
+			if fields == nil {
+				response.Keys = append(response.Keys, snapshot)
+				continue
+			}
+			selected := make(map[string]any, len(fields))
+			for _, field := range fields {
+				selected[field] = keyListFields[field](snapshot)
+			}
+			response.Keys = append(response.Keys, selected)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
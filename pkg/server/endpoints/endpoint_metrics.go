@@ -0,0 +1,20 @@
+package endpoints
+
+import (
+	"fmt"
+	"github.com/kivra/gocc/pkg/metrics"
+	"log/slog"
+	"net/http"
+)
+
+// HandleMetricsRequest serves the prometheus metrics. There are no keys in them, so no tenant credentials are needed.
+func HandleMetricsRequest(
+	c Request,
+) error {
+	body, contentType, err := metrics.Gather()
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to gather metrics: %v", err))
+		return c.String(http.StatusInternalServerError, "Unable to gather metrics, check server logs")
+	}
+	return c.Blob(http.StatusOK, contentType, body)
+}
@@ -1,17 +1,23 @@
 package endpoints
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/kivra/gocc/pkg/config"
 	"github.com/kivra/gocc/pkg/limiter/limiter_api"
 	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
 	"github.com/kivra/gocc/pkg/logging/logctx"
-	"github.com/labstack/echo/v4"
+	"github.com/kivra/gocc/pkg/metrics"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"github.com/kivra/gocc/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/http2"
-	"hash/fnv"
 	"io"
 	"log/slog"
 	"net"
@@ -19,11 +25,17 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Clients for requests to other instances have no overall timeout, since requests may wait in the
+// owner's queue. Requests are bounded by their context instead, see proxyToInstance.
+var http1Client = &http.Client{}
 var http2Client = newHttp2Client()
 
+var forwardingDialer = &net.Dialer{Timeout: 5 * time.Second}
+
 func newHttp2Client() *http.Client {
 	client := &http.Client{
 		//Transport: http2.ConfigureTransport(http.DefaultTransport.(*http.Transport)),
@@ -32,53 +44,96 @@ func newHttp2Client() *http.Client {
 			// Pretend we are dialing a TLS endpoint.
 			// Note, we ignore the passed tls.Config
 			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-				return net.Dial("tcp", addr)
+				return forwardingDialer.DialContext(ctx, "tcp", addr)
 			},
 		},
 		//Transport: http.DefaultTransport,
-		Timeout: 10 * time.Second,
 	}
 
 	return client
 }
 
-func hashKey(key string) uint32 {
-	h := fnv.New32a()
-	_, err := h.Write([]byte(key))
-	if err != nil {
-		panic(fmt.Sprintf("BUG: Failed to hash %s", key))
+// tlsForwardingClients are created per tls config, and reused so that connections to other instances are kept
+var tlsForwardingClients sync.Map // *config.TlsCerts -> *http.Client
+
+// forwardingClient returns a client for requests to other instances. All instances are
+// expected to run the same server type, and only echo-http2 speaks http2.
+func forwardingClient(cfg *config.GlobalCfgValidated) *http.Client {
+	useHttp2 := config.ServerType(cfg.ServerType.Value()) == config.ServerTypeEchohttp2
+	if cfg.Tls != nil {
+		if client, ok := tlsForwardingClients.Load(cfg.Tls); ok {
+			return client.(*http.Client)
+		}
+		client, _ := tlsForwardingClients.LoadOrStore(cfg.Tls, newTlsClient(cfg.Tls, useHttp2))
+		return client.(*http.Client)
 	}
-	return h.Sum32()
+	if useHttp2 {
+		return http2Client
+	}
+	return http1Client
 }
 
-func getInstance(cfg *config.GlobalCfgValidated, key string) *url.URL {
-	if !cfg.DistributedMode() {
-		panic("getInstanceIndex called in non-distributed mode")
+// newTlsClient creates a client for https instance urls. Certificates are looked up for each new
+// connection, so that reloaded certificates are used without recreating the client.
+func newTlsClient(tlsCerts *config.TlsCerts, useHttp2 bool) *http.Client {
+	dial := func(ctx context.Context, network, addr string, nextProto string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &tls.Dialer{NetDialer: forwardingDialer, Config: tlsCerts.ClientConfig(host, nextProto)}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if useHttp2 {
+		return &http.Client{
+			Transport: &http2.Transport{
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return dial(ctx, network, addr, "h2")
+				},
+			},
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx, network, addr, "http/1.1")
+			},
+		},
 	}
-
-	hash := hashKey(key)
-	return cfg.Instances[int(hash)%len(cfg.Instances)]
 }
 
 func HandleRateRequest(
 	cfg *config.GlobalCfgValidated,
 	limiterManager *limiter_manager.LimiterManagerSet,
-) echo.HandlerFunc {
+	auth *tenant_auth.Authenticator,
+) Handler {
 
-	return func(c echo.Context) error {
+	return func(c Request) error {
 
 		key := strings.TrimSpace(c.Param("key"))
 
 		// Set up log context
-		ctx := c.Request().Context()
+		ctx := c.Context()
 		ctx = logctx.Add(ctx, "correlation-id", getCorrelationID(c))
 		ctx = logctx.Add(ctx, "key", key)
 
+		ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, c.Header), "HandleRateRequest",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("gocc.key", key)),
+		)
+		defer span.End()
+
 		if len(key) == 0 {
 			slog.Warn("empty key provided", logctx.GetAll(ctx)...)
 			return c.String(http.StatusBadRequest, "empty key provided")
 		}
 
+		tenant, authErr := auth.Authorize(bearerToken(c), key)
+		if authErr != nil {
+			slog.Warn(authErr.Msg, logctx.GetAll(ctx)...)
+			return writeAuthError(c, authErr)
+		}
+
 		canWait, err := parseOptionalBoolParam(c.QueryParam("canWait"), false)
 		if err != nil {
 			slog.Warn("failed to parse canWait query parameter", logctx.GetAll(ctx)...)
@@ -91,54 +146,49 @@ func HandleRateRequest(
 			return c.String(http.StatusBadRequest, "failed to parse maxRequests query parameter")
 		}
 
-		if maxRequests != limiter_api.NoChange && !cfg.RequestsCanSetRate.Value() {
-			slog.Warn("maxRequests query parameter is disabled", logctx.GetAll(ctx)...)
-			return c.String(http.StatusForbidden, "maxRequests query parameter is disabled")
-		}
-
 		maxRequestsInQueue, err := parseOptionalInt32Param(c.QueryParam("maxRequestsInQueue"), limiter_api.NoChange)
 		if err != nil {
 			slog.Warn("failed to parse maxRequestsInQueue query parameter", logctx.GetAll(ctx)...)
 			return c.String(http.StatusBadRequest, "failed to parse maxRequestsInQueue query parameter")
 		}
 
-		if maxRequestsInQueue != limiter_api.NoChange && !cfg.RequestsCanModQueue.Value() {
-			slog.Warn("maxRequestsInQueue query parameter is disabled", logctx.GetAll(ctx)...)
-			return c.String(http.StatusForbidden, "maxRequestsInQueue query parameter is disabled")
+		if err := ValidateOverrides(cfg, tenant, key, maxRequests, maxRequestsInQueue, limiter_api.NoChange); err != nil {
+			slog.Warn(err.Msg, logctx.GetAll(ctx)...)
+			return c.String(err.Status, err.Msg)
 		}
 
-		if maxRequests != limiter_api.NoChange {
-			if err := cfg.MaxRequests.CustomValidator(maxRequests); err != nil {
-				slog.Warn("maxRequests out of bounds", logctx.GetAll(ctx)...)
-				return c.String(http.StatusBadRequest, "maxRequests out of bounds")
+		// Check if we are the instance responsible for this key.
+		// Otherwise, forward the request to the correct instance, if it is up, unless the key's limit is split.
+		var result *limiter_api.PermissionResponse
+		var requestID string
+		if owner, remote := getRemoteOwner(c, cfg, key); remote {
+			if result = askSplitKey(ctx, cfg, key, owner); result == nil && cfg.Peers != nil {
+				result, requestID = askPeer(ctx, cfg, owner, key, canWait, maxRequests, maxRequestsInQueue)
+			} else if result == nil {
+				if err, reached := forwardToOwner(c, cfg, owner, ctx); reached {
+					return err
+				}
 			}
-		}
-
-		if maxRequestsInQueue != limiter_api.NoChange {
-			if err := cfg.MaxRequestsInQueue.CustomValidator(maxRequestsInQueue); err != nil {
-				slog.Warn("maxRequestsInQueue out of bounds", logctx.GetAll(ctx)...)
-				return c.String(http.StatusBadRequest, "maxRequestsInQueue out of bounds")
+			if result == nil {
+				result, requestID = askWhileOwnerDown(ctx, c, cfg, limiterManager, key, canWait, maxRequests, maxRequestsInQueue)
 			}
+		} else {
+			takeOverReplica(ctx, cfg, limiterManager, key)
+			result, requestID = limiterManager.AskPermissionWithStatus(ctx, key, canWait, maxRequests, maxRequestsInQueue, limiter_api.NoChange)
 		}
+		span.SetAttributes(attribute.String("gocc.decision", string(result.RespCode)))
 
-		// Check if we are the instance responsible for this key.
-		// Otherwise, forward the request to the correct instance.
-		err, forwarded := maybeForwardToCorrectInstance(c, cfg, key, ctx)
-		if forwarded {
-			return err
-		}
-
-		result, requestID := limiterManager.AskPermission(ctx, key, canWait, maxRequests, maxRequestsInQueue)
-
-		switch result {
+		switch result.RespCode {
 		case limiter_api.Approved:
+			setRateLimitHeaders(c.ResponseHeader(), &result.Status, false)
 			return c.String(http.StatusOK, requestID)
 		case limiter_api.Denied:
+			setRateLimitHeaders(c.ResponseHeader(), &result.Status, true)
 			return c.NoContent(http.StatusTooManyRequests)
 		case limiter_api.ClientGaveUp:
 			return c.NoContent(499) // will never be returned to the client, so just pick a random status code
 		default:
-			slog.Error("unexpected response from limiter", append(logctx.GetAll(ctx), slog.String("response", string(result)))...)
+			slog.Error("unexpected response from limiter", append(logctx.GetAll(ctx), slog.String("response", string(result.RespCode)))...)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 
@@ -148,15 +198,16 @@ func HandleRateRequest(
 func HandleReleaseRequest(
 	cfg *config.GlobalCfgValidated,
 	limiterManager *limiter_manager.LimiterManagerSet,
-) echo.HandlerFunc {
+	auth *tenant_auth.Authenticator,
+) Handler {
 
-	return func(c echo.Context) error {
+	return func(c Request) error {
 
 		key := strings.TrimSpace(c.Param("key"))
 		id := strings.TrimSpace(c.Param("id"))
 
 		// Set up log context
-		ctx := c.Request().Context()
+		ctx := c.Context()
 		ctx = logctx.Add(ctx, "correlation-id", getCorrelationID(c))
 		ctx = logctx.Add(ctx, "key", key)
 
@@ -170,11 +221,26 @@ func HandleReleaseRequest(
 			return c.String(http.StatusBadRequest, "empty id provided")
 		}
 
+		if _, authErr := auth.Authorize(bearerToken(c), key); authErr != nil {
+			slog.Warn(authErr.Msg, logctx.GetAll(ctx)...)
+			return writeAuthError(c, authErr)
+		}
+
 		// Check if we are the instance responsible for this key.
 		// Otherwise, forward the request to the correct instance.
-		err, forwarded := maybeForwardToCorrectInstance(c, cfg, key, ctx)
-		if forwarded {
-			return err
+		if owner, remote := getRemoteOwner(c, cfg, key); remote {
+			if cfg.Peers != nil {
+				if releaseAtPeer(ctx, cfg, owner, key, id) {
+					return c.NoContent(http.StatusOK)
+				}
+			} else if err, reached := forwardToOwner(c, cfg, owner, ctx); reached {
+				return err
+			}
+			if cfg.PeerDownPolicy.Value() != config.PeerDownLocal {
+				return c.String(http.StatusBadGateway, "failed to forward request to correct instance")
+			}
+			// The request was approved here while the owner was down
+			c.ResponseHeader().Set(HeaderDegraded, config.PeerDownLocal)
 		}
 
 		limiterManager.Release(ctx, key, id)
@@ -183,48 +249,204 @@ func HandleReleaseRequest(
 	}
 }
 
-func maybeForwardToCorrectInstance(c echo.Context, cfg *config.GlobalCfgValidated, key string, ctx context.Context) (error, bool) {
+// getRemoteOwner returns the instance owning the key, if it is another instance than this one.
+// Only the ring decides, not how the request reached this instance (service, ip or alias). With
+// --replication-factor, a healthy replica of the key stands in for its owner while the owner is down.
+func getRemoteOwner(c Request, cfg *config.GlobalCfgValidated, key string) (*url.URL, bool) {
 	if cfg.DistributedMode() && c.QueryParam("ik") != "true" {
-		correctInstance := getInstance(cfg, key)
-		correctHostname := correctInstance.Hostname()
-		requestHostName, _ := splitHostPort(c.Request().Host)
-		if correctHostname != requestHostName {
-			path := c.Request().URL.Path
-			method := c.Request().Method
-			slog.Debug(fmt.Sprintf("forwarding %s %s to correct instance %s", method, path, correctInstance.String()), logctx.GetAll(ctx)...)
-			// We make a request ourselves to the correct instance
-			query := "?ik=true" // avoid loops if we have a routing bug :S
-			if len(c.Request().URL.RawQuery) > 0 {
-				for k, vs := range c.Request().URL.Query() {
-					if k != "ik" {
-						for _, v := range vs {
-							query += "&" + k + "=" + v
-						}
-					}
-				}
-			}
-			uri := correctInstance.Scheme + "://" + correctInstance.Host + path + query
-			req, err := http.NewRequest(method, uri, nil)
-			if err != nil {
-				slog.Warn(fmt.Sprintf("failed to forward request to correct instance: %v", err), logctx.GetAll(ctx)...)
-				return c.String(http.StatusBadGateway, "failed to forward request to correct instance"), true
-			}
-			resp, err := http2Client.Do(req)
-			if err != nil {
-				slog.Warn(fmt.Sprintf("failed to forward request to correct instance: %v", err), logctx.GetAll(ctx)...)
-				return c.String(http.StatusBadGateway, "failed to forward request to correct instance"), true
-			} else {
-				_, _ = io.Copy(io.Discard, resp.Body)
-				_ = resp.Body.Close()
-				return c.NoContent(resp.StatusCode), true
-			}
+		if owner, local := cfg.Cluster.View().RouteWithFailover(key, cfg.ReplicationFactor.Value(), cfg.Health.Healthy); !local {
+			return owner, true
 		}
 	}
 	return nil, false
 }
 
-func getCorrelationID(c echo.Context) string {
-	correlationId := c.Request().Header.Get("X-Correlation-ID")
+// forwardToOwner forwards a request to the owner of its key, and answers with the owner's response. Returns
+// false, without answering, if the owner is down or couldn't be reached.
+func forwardToOwner(c Request, cfg *config.GlobalCfgValidated, owner *url.URL, ctx context.Context) (error, bool) {
+	if !cfg.Health.Healthy(owner) {
+		return nil, false
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "maybeForwardToCorrectInstance",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("gocc.instance", owner.Host)),
+	)
+	defer span.End()
+	err, reached := tryProxyToInstance(c, cfg, owner, ctx)
+	if !reached {
+		span.SetStatus(codes.Error, "failed to reach the owner")
+	}
+	return err, reached
+}
+
+// proxyToInstance forwards a request to another instance, and answers with its response, or 502 if
+// the instance couldn't be reached
+func proxyToInstance(c Request, cfg *config.GlobalCfgValidated, instance *url.URL, ctx context.Context) error {
+	if err, reached := tryProxyToInstance(c, cfg, instance, ctx); reached {
+		return err
+	}
+	return c.String(http.StatusBadGateway, "failed to forward request to correct instance")
+}
+
+// tryProxyToInstance forwards a request to another instance, and answers with its response: the same
+// status, body and end-to-end headers, e.g. the request id and rate limit headers of /rate. Returns
+// false, without answering, if the instance couldn't be reached. A client that goes away is not the
+// instance's fault, so that is answered like a client giving up on a local request.
+func tryProxyToInstance(c Request, cfg *config.GlobalCfgValidated, instance *url.URL, ctx context.Context) (error, bool) {
+	clientCtx := ctx
+	if canWait, _ := strconv.ParseBool(c.QueryParam("canWait")); !canWait {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultForwardTimeout)
+		defer cancel()
+	}
+	resp, err := forwardToInstance(c, cfg, instance, ctx)
+	if err != nil {
+		if clientCtx.Err() != nil {
+			slog.Debug(fmt.Sprintf("client went away while forwarding to instance %s", instance), logctx.GetAll(ctx)...)
+			return c.NoContent(499), true // will never be returned to the client, so just pick a random status code
+		}
+		slog.Warn(fmt.Sprintf("failed to forward request to correct instance %s: %v", instance, err), logctx.GetAll(ctx)...)
+		return nil, false
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if clientCtx.Err() != nil {
+			slog.Debug(fmt.Sprintf("client went away while reading the response of instance %s", instance), logctx.GetAll(ctx)...)
+			return c.NoContent(499), true
+		}
+		metrics.ForwardingFailed(instance.Host)
+		slog.Warn(fmt.Sprintf("failed to read response from correct instance %s: %v", instance, err), logctx.GetAll(ctx)...)
+		return nil, false
+	}
+	for name, values := range resp.Header {
+		if !notProxiedHeaders[http.CanonicalHeaderKey(name)] {
+			c.ResponseHeader()[name] = values
+		}
+	}
+	if len(body) == 0 {
+		return c.NoContent(resp.StatusCode), true
+	}
+	return c.Blob(resp.StatusCode, resp.Header.Get("Content-Type"), body), true
+}
+
+// notProxiedHeaders are the response headers of other instances that are not passed on to clients:
+// hop-by-hop headers, and the ones the server sets itself
+var notProxiedHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Date":                true,
+}
+
+// defaultForwardTimeout bounds forwarded requests that can't wait in a queue. Requests that can are
+// only bounded by the client going away, like requests served locally.
+const defaultForwardTimeout = 10 * time.Second
+
+// forwardToInstance makes the same request to another instance, with the same method, path, query and body.
+// The correlation id, credentials and trace context are passed on. The caller must close the response body.
+func forwardToInstance(c Request, cfg *config.GlobalCfgValidated, instance *url.URL, ctx context.Context) (*http.Response, error) {
+	method := c.Method()
+	slog.Debug(fmt.Sprintf("forwarding %s %s to correct instance %s", method, c.Path(), instance.String()), logctx.GetAll(ctx)...)
+
+	query, err := url.ParseQuery(c.RawQuery())
+	if err != nil {
+		return nil, fmt.Errorf("invalid query string: %w", err)
+	}
+	query.Set("ik", "true") // avoid loops if we have a routing bug :S
+	uri := instance.Scheme + "://" + instance.Host + c.Path() + "?" + query.Encode()
+
+	body, err := c.Body()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"Authorization", "Content-Type", "Accept"} {
+		if value := c.Header(name); value != "" {
+			req.Header.Set(name, value) // the correct instance checks the credentials again
+		}
+	}
+	if correlationId := logctx.Get(ctx, "correlation-id"); correlationId != "" {
+		req.Header.Set("X-Correlation-ID", correlationId) // including generated ones, so both instances log the same
+	}
+	if clientIp, _, splitErr := net.SplitHostPort(c.RemoteAddr()); splitErr == nil {
+		if forwardedFor := c.Header("X-Forwarded-For"); forwardedFor != "" {
+			clientIp = forwardedFor + ", " + clientIp
+		}
+		req.Header.Set("X-Forwarded-For", clientIp)
+	}
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := forwardingClient(cfg).Do(req)
+	if err != nil && !errors.Is(ctx.Err(), context.Canceled) { // canceled is the client going away, not the instance failing
+		metrics.ForwardingFailed(instance.Host)
+	}
+	return resp, err
+}
+
+// askRemoteOwner asks another instance for permission on behalf of a client, using its /rate endpoint.
+// The limit status is reconstructed from the rate limit headers of the response.
+// token is the client's bearer token, if any, which the other instance checks again.
+// A client that goes away is answered with ClientGaveUp, rather than an error that blames the instance.
+func askRemoteOwner(ctx context.Context, client *http.Client, instance *url.URL, key string, canWait bool, token string) (*limiter_api.PermissionResponse, error) {
+	clientCtx := ctx
+	query := url.Values{}
+	query.Set("ik", "true")
+	query.Set("canWait", strconv.FormatBool(canWait))
+	uri := instance.Scheme + "://" + instance.Host + "/rate/" + url.PathEscape(key) + "?" + query.Encode()
+	if !canWait {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultForwardTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if correlationId := logctx.Get(ctx, "correlation-id"); correlationId != "" {
+		req.Header.Set("X-Correlation-ID", correlationId)
+	}
+	tracing.Inject(ctx, req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		if clientCtx.Err() != nil {
+			return &limiter_api.PermissionResponse{RespCode: limiter_api.ClientGaveUp}, nil
+		}
+		metrics.ForwardingFailed(instance.Host)
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	result := &limiter_api.PermissionResponse{Status: parseRateLimitHeaders(resp.Header)}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		result.RespCode = limiter_api.Approved
+	case http.StatusTooManyRequests:
+		result.RespCode = limiter_api.Denied
+	default:
+		metrics.ForwardingFailed(instance.Host)
+		return nil, fmt.Errorf("unexpected status code %d from instance %s", resp.StatusCode, instance.String())
+	}
+	return result, nil
+}
+
+func getCorrelationID(c Request) string {
+	correlationId := c.Header("X-Correlation-ID")
 	if correlationId == "" {
 		correlationId = "gcc-" + uuid.New().String()
 	}
@@ -250,40 +472,3 @@ func parseOptionalInt32Param(raw string, defaultValue int) (int, error) {
 	}
 	return defaultValue, nil
 }
-
-// Copy pasta below
-
-// splitHostPort separates host and port. If the port is not valid, it returns
-// the entire input as host, and it doesn't check the validity of the host.
-// Unlike net.SplitHostPort, but per RFC 3986, it requires ports to be numeric.
-func splitHostPort(hostPort string) (host, port string) {
-	host = hostPort
-
-	colon := strings.LastIndexByte(host, ':')
-	if colon != -1 && validOptionalPort(host[colon:]) {
-		host, port = host[:colon], host[colon+1:]
-	}
-
-	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
-		host = host[1 : len(host)-1]
-	}
-
-	return
-}
-
-// validOptionalPort reports whether port is either an empty string
-// or matches /^:\d*$/
-func validOptionalPort(port string) bool {
-	if port == "" {
-		return true
-	}
-	if port[0] != ':' {
-		return false
-	}
-	for _, b := range port[1:] {
-		if b < '0' || b > '9' {
-			return false
-		}
-	}
-	return true
-}
@@ -0,0 +1,99 @@
+package endpoints
+
+import (
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"net/http"
+)
+
+// OverrideError is returned when a client tries to override a key's limits in a way that isn't allowed.
+// Status is the http status code to use, for frontends speaking http.
+type OverrideError struct {
+	Status int
+	Msg    string
+}
+
+func (e *OverrideError) Error() string {
+	return e.Msg
+}
+
+// ValidateOverrides checks client supplied overrides of a key's limits against the global configuration,
+// the key's override policy in the config file, and the rights of the client's tenant, if tenant auth
+// is enabled (tenant is nil otherwise).
+// limiter_api.NoChange means that the client didn't try to override that value.
+// Shared by all frontends, so that the same rules apply regardless of protocol.
+func ValidateOverrides(
+	cfg *config.GlobalCfgValidated,
+	tenant *tenant_auth.Tenant,
+	key string,
+	maxRequests int,
+	maxRequestsInQueue int,
+	windowMillis int,
+) *OverrideError {
+
+	if maxRequests == limiter_api.NoChange && maxRequestsInQueue == limiter_api.NoChange && windowMillis == limiter_api.NoChange {
+		return nil // the common case, no need to look up the key's policy
+	}
+	policy := cfg.FromFile.Get().OverridesFor(key)
+
+	if (maxRequests != limiter_api.NoChange || windowMillis != limiter_api.NoChange) && !allowed(policy.AllowSetRate, cfg.RequestsCanSetRate.Value()) {
+		return &OverrideError{Status: http.StatusForbidden, Msg: "maxRequests query parameter is disabled"}
+	}
+
+	if maxRequestsInQueue != limiter_api.NoChange && !allowed(policy.AllowModQueue, cfg.RequestsCanModQueue.Value()) {
+		return &OverrideError{Status: http.StatusForbidden, Msg: "maxRequestsInQueue query parameter is disabled"}
+	}
+
+	if tenant != nil && (maxRequests != limiter_api.NoChange || windowMillis != limiter_api.NoChange) && !tenant.CanSetRate {
+		return &OverrideError{Status: http.StatusForbidden, Msg: "maxRequests query parameter is not allowed for tenant " + tenant.Name}
+	}
+
+	if tenant != nil && maxRequestsInQueue != limiter_api.NoChange && !tenant.CanModQueue {
+		return &OverrideError{Status: http.StatusForbidden, Msg: "maxRequestsInQueue query parameter is not allowed for tenant " + tenant.Name}
+	}
+
+	if maxRequests != limiter_api.NoChange {
+		if err := cfg.MaxRequests.CustomValidator(maxRequests); err != nil {
+			return &OverrideError{Status: http.StatusBadRequest, Msg: "maxRequests out of bounds"}
+		}
+		if err := policy.MaxRequests.Check(maxRequests); err != nil {
+			return &OverrideError{Status: http.StatusBadRequest, Msg: "maxRequests out of bounds for this key: " + err.Error()}
+		}
+	}
+
+	if maxRequestsInQueue != limiter_api.NoChange {
+		if err := cfg.MaxRequestsInQueue.CustomValidator(maxRequestsInQueue); err != nil {
+			return &OverrideError{Status: http.StatusBadRequest, Msg: "maxRequestsInQueue out of bounds"}
+		}
+		if err := policy.MaxRequestsInQueue.Check(maxRequestsInQueue); err != nil {
+			return &OverrideError{Status: http.StatusBadRequest, Msg: "maxRequestsInQueue out of bounds for this key: " + err.Error()}
+		}
+	}
+
+	if windowMillis != limiter_api.NoChange {
+		if err := cfg.WindowMillis.CustomValidator(windowMillis); err != nil {
+			return &OverrideError{Status: http.StatusBadRequest, Msg: "windowMillis out of bounds"}
+		}
+		if err := policy.WindowMillis.Check(windowMillis); err != nil {
+			return &OverrideError{Status: http.StatusBadRequest, Msg: "windowMillis out of bounds for this key: " + err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// CanSetRate returns true if a client may override the rate of a key, for frontends
+// that fall back to the key's configured rate instead of rejecting the request
+func CanSetRate(cfg *config.GlobalCfgValidated, tenant *tenant_auth.Tenant, key string) bool {
+	policy := cfg.FromFile.Get().OverridesFor(key)
+	return allowed(policy.AllowSetRate, cfg.RequestsCanSetRate.Value()) && (tenant == nil || tenant.CanSetRate)
+}
+
+// allowed returns the key's policy if it has one, and the global flag otherwise
+func allowed(policy *bool, global bool) bool {
+	if policy != nil {
+		return *policy
+	}
+	return global
+}
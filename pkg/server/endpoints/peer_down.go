@@ -0,0 +1,70 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"github.com/kivra/gocc/pkg/cluster"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/metrics"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// HeaderDegraded is set on responses decided by --peer-down-policy, because the key's owner was down
+const HeaderDegraded = "X-Gocc-Degraded"
+
+// ProbePeer returns a health check of other instances, with GET /healthz. The instances report their ring and
+// number of keys in its response headers.
+func ProbePeer(cfg *config.GlobalCfgValidated) cluster.Probe {
+	return func(ctx context.Context, instance *url.URL) (cluster.PeerReport, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, instance.Scheme+"://"+instance.Host+"/healthz", nil)
+		if err != nil {
+			return cluster.PeerReport{}, err
+		}
+		resp, err := forwardingClient(cfg).Do(req)
+		if err != nil {
+			return cluster.PeerReport{}, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return cluster.PeerReport{}, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		numKeys, _ := strconv.Atoi(resp.Header.Get(HeaderNumKeys))
+		return cluster.PeerReport{RingHash: resp.Header.Get(HeaderRingHash), NumKeys: numKeys}, nil
+	}
+}
+
+// askWhileOwnerDown decides a request on a key whose owner is down, by --peer-down-policy. With the local
+// policy, this instance enforces a share of the key's limit itself, until the owner is back.
+func askWhileOwnerDown(
+	ctx context.Context,
+	c Request,
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	key string,
+	canWait bool,
+	maxRequests int,
+	maxRequestsInQueue int,
+) (*limiter_api.PermissionResponse, string) {
+
+	policy := cfg.PeerDownPolicy.Value()
+	slog.Debug(fmt.Sprintf("owner of the key is down, deciding with policy %s", policy), logctx.GetAll(ctx)...)
+	c.ResponseHeader().Set(HeaderDegraded, policy)
+	metrics.DegradedDecision(policy)
+
+	switch policy {
+	case config.PeerDownFailOpen:
+		return &limiter_api.PermissionResponse{RespCode: limiter_api.Approved}, "" // nothing to release
+	case config.PeerDownLocal:
+		return limiterManager.AskPermissionWithinPercent(ctx, key, canWait, cfg.PeerDownLocalPercent.Value(), maxRequests, maxRequestsInQueue)
+	default:
+		return &limiter_api.PermissionResponse{RespCode: limiter_api.Denied}, ""
+	}
+}
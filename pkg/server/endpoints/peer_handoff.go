@@ -0,0 +1,192 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/kivra/gocc/pkg/cluster"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/metrics"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// HandoffRequest is the state of keys that have moved to the receiving instance, sent by their previous owner
+type HandoffRequest struct {
+	From string // the url of the previous owner, for logging
+	Keys []*limiter_api.KeyState
+}
+
+type HandoffResponse struct {
+	NumTakenOver int
+}
+
+// HandOffMovedKeys hands off the windows of the keys that move away from this instance when the cluster changes,
+// so that their new owners don't start them over, which would let up to twice the limit through
+func HandOffMovedKeys(cfg *config.GlobalCfgValidated, limiterManager *limiter_manager.LimiterManagerSet) {
+	cfg.Cluster.OnChange(func(before, after *cluster.View) {
+		go handOff(cfg, limiterManager, before, after)
+	})
+}
+
+func handOff(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	before *cluster.View,
+	after *cluster.View,
+) {
+	states := limiterManager.HandOff(func(key string) bool {
+		_, wasLocal := before.Route(key)
+		_, isLocal := after.Route(key)
+		return wasLocal && !isLocal
+	})
+
+	byOwner := map[*url.URL][]*limiter_api.KeyState{}
+	for _, state := range states {
+		if state.NumApprovedThisWindow > 0 || state.NumDeniedThisWindow > 0 {
+			owner, _ := after.Route(state.Key)
+			byOwner[owner] = append(byOwner[owner], state)
+		}
+	}
+
+	from := ""
+	if self := before.SelfUrl(); self != nil {
+		from = self.String()
+	}
+	for owner, keys := range byOwner {
+		go func() {
+			if err := postToPeer(cfg, owner, "/cluster/handoff", &HandoffRequest{From: from, Keys: keys}, nil); err != nil {
+				slog.Warn(fmt.Sprintf("Failed to hand off %d keys to %s, their windows start over there: %v", len(keys), owner, err))
+				return
+			}
+			metrics.HandedOffKeys("sent", len(keys))
+			slog.Info(fmt.Sprintf("Handed off %d keys to %s", len(keys), owner))
+		}()
+	}
+}
+
+// postToPeer posts a json body to another instance, with the --peer-api-key if tenant auth is used, and decodes
+// the json response into result, unless it is nil
+func postToPeer(cfg *config.GlobalCfgValidated, instance *url.URL, path string, body any, result any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultForwardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, instance.Scheme+"://"+instance.Host+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey := cfg.PeerApiKey.Value(); apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := forwardingClient(cfg).Do(req)
+	if err != nil {
+		metrics.ForwardingFailed(instance.Host)
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, msg)
+	}
+	if result == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// authorizePeer checks that a request comes from another instance. With tenant auth, it must carry the credentials
+// of an admin tenant, i.e. --peer-api-key, and the tenant is returned. Without, it must carry --peer-api-key, and the
+// tenant is nil. Client certificates don't do, with mTLS every client has one.
+func authorizePeer(c Request, cfg *config.GlobalCfgValidated, auth *tenant_auth.Authenticator) (*tenant_auth.Tenant, *tenant_auth.AuthError) {
+	if auth.Enabled() {
+		tenant, authErr := auth.Authenticate(bearerToken(c))
+		if authErr != nil {
+			return nil, authErr
+		}
+		if !tenant.Admin {
+			return nil, &tenant_auth.AuthError{Status: http.StatusForbidden, Msg: "tenant " + tenant.Name + " is not an admin"}
+		}
+		return tenant, nil
+	}
+	apiKey := cfg.PeerApiKey.Value()
+	if apiKey != "" && subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(apiKey)) == 1 {
+		return nil, nil
+	}
+	return nil, &tenant_auth.AuthError{Status: http.StatusUnauthorized, Msg: "missing or invalid peer credentials"}
+}
+
+// readKeyStates reads the states of keys sent by another instance, leaving out the keys that the tenant isn't allowed.
+// Windows must be within the bounds of --window-millis, and counts can't be negative.
+func readKeyStates(c Request, cfg *config.GlobalCfgValidated, tenant *tenant_auth.Tenant) (*HandoffRequest, error) {
+	body, err := c.Body()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	request := &HandoffRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	allowed := make([]*limiter_api.KeyState, 0, len(request.Keys))
+	for _, state := range request.Keys {
+		if state == nil || state.Key == "" || state.WindowMillis <= 0 {
+			return nil, fmt.Errorf("keys need a key and a window")
+		}
+		if err := cfg.WindowMillis.CustomValidator(state.WindowMillis); err != nil {
+			return nil, fmt.Errorf("window of key '%s' out of bounds", state.Key)
+		}
+		if state.NumApprovedThisWindow < 0 || state.NumDeniedThisWindow < 0 || state.ResetAfterMillis < 0 {
+			return nil, fmt.Errorf("negative counts for key '%s'", state.Key)
+		}
+		if !tenant.AllowsKey(state.Key) {
+			slog.Warn(fmt.Sprintf("Ignoring key '%s' from %s, it isn't allowed for tenant %s", state.Key, request.From, tenant.Name))
+			continue
+		}
+		allowed = append(allowed, state)
+	}
+	request.Keys = allowed
+	return request, nil
+}
+
+// HandleClusterHandoffRequest takes over the windows of keys that have moved here from another instance.
+// Only other instances may hand off keys, and with tenant auth, only the keys that their tenant is allowed.
+func HandleClusterHandoffRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := authorizePeer(c, cfg, auth)
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+		handoff, err := readKeyStates(c, cfg, tenant)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid handoff: %v", err))
+		}
+
+		result := HandoffResponse{}
+		for _, state := range handoff.Keys {
+			if _, err := limiterManager.TakeOver(c.Context(), state); err != nil {
+				return c.String(http.StatusServiceUnavailable, "gave up taking over keys")
+			}
+			result.NumTakenOver++
+		}
+		metrics.HandedOffKeys("received", result.NumTakenOver)
+		slog.Info(fmt.Sprintf("Took over %d keys from %s", result.NumTakenOver, handoff.From))
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
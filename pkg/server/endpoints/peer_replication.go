@@ -0,0 +1,289 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kivra/gocc/pkg/cluster"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/metrics"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ReplicasRequest asks an instance for the replicas it keeps of the keys of Owner, e.g. after Owner restarted
+type ReplicasRequest struct {
+	Owner string
+}
+
+type ReplicateResponse struct {
+	NumReplicated int
+}
+
+// sentState is what was last sent to the replicas of a key, so that keys are only sent again when they change
+type sentState struct {
+	approved int
+	denied   int
+	resetsAt time.Time
+}
+
+// ReplicateKeys sends the state of the keys owned by this instance to the next --replication-factor instances
+// on the ring every --replication-millis, until stop is called. Only keys whose counters changed are sent, and
+// replicas that are down are skipped, so replicas lag behind their owner by up to the interval.
+func ReplicateKeys(cfg *config.GlobalCfgValidated, limiterManager *limiter_manager.LimiterManagerSet) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(cfg.ReplicationMillis.Value()) * time.Millisecond)
+		defer ticker.Stop()
+		sent := map[string]sentState{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				replicateChanges(cfg, limiterManager, sent)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func replicateChanges(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	sent map[string]sentState,
+) {
+	view := cfg.Cluster.View()
+	self := view.SelfUrl()
+	if self == nil {
+		clear(sent)
+		return
+	}
+
+	now := time.Now()
+	owned := map[string]bool{}
+	byReplica := map[*url.URL][]*limiter_api.KeyState{}
+	for _, state := range limiterManager.KeyStates(func(key string) bool {
+		_, local := view.Route(key)
+		return local
+	}) {
+		owned[state.Key] = true
+		last, ok := sent[state.Key]
+		unchanged := ok && now.Before(last.resetsAt) &&
+			last.approved == state.NumApprovedThisWindow && last.denied == state.NumDeniedThisWindow
+		unused := !ok && state.NumApprovedThisWindow == 0 && state.NumDeniedThisWindow == 0
+		if unchanged || unused {
+			continue
+		}
+		sent[state.Key] = sentState{
+			approved: state.NumApprovedThisWindow,
+			denied:   state.NumDeniedThisWindow,
+			resetsAt: now.Add(time.Duration(state.ResetAfterMillis) * time.Millisecond),
+		}
+		for _, replica := range view.Successors(state.Key, cfg.ReplicationFactor.Value()) {
+			if cfg.Health.Healthy(replica) {
+				byReplica[replica] = append(byReplica[replica], state)
+			}
+		}
+	}
+	for key := range sent {
+		if !owned[key] {
+			delete(sent, key)
+		}
+	}
+
+	// Keys that failed to reach a replica are sent again next time
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	var failed []*limiter_api.KeyState
+	for replica, keys := range byReplica {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := postToPeer(cfg, replica, "/cluster/replicate", &HandoffRequest{From: self.String(), Keys: keys}, nil); err != nil {
+				slog.Debug(fmt.Sprintf("Failed to replicate %d keys to %s: %v", len(keys), replica, err))
+				failedMutex.Lock()
+				failed = append(failed, keys...)
+				failedMutex.Unlock()
+				return
+			}
+			metrics.ReplicatedKeys("sent", len(keys))
+		}()
+	}
+	wg.Wait()
+	for _, state := range failed {
+		delete(sent, state.Key)
+	}
+}
+
+// HandleClusterReplicateRequest keeps the state of keys sent by their owner, to stand in for it if it fails.
+// Only other instances may replicate keys, and with tenant auth, only the keys that their tenant is allowed.
+func HandleClusterReplicateRequest(
+	cfg *config.GlobalCfgValidated,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := authorizePeer(c, cfg, auth)
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+		if cfg.Replicas == nil {
+			return c.String(http.StatusConflict, "replication is not enabled on this instance, see --replication-factor")
+		}
+		replicated, err := readKeyStates(c, cfg, tenant)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid replication: %v", err))
+		}
+
+		cfg.Replicas.Put(replicated.From, replicated.Keys)
+		metrics.ReplicatedKeys("received", len(replicated.Keys))
+
+		return c.JSON(http.StatusOK, ReplicateResponse{NumReplicated: len(replicated.Keys)})
+	}
+}
+
+// HandleClusterReplicasRequest gives an owner back the replicas kept of its keys, and forgets them here.
+// Only other instances may take back replicas.
+func HandleClusterReplicasRequest(
+	cfg *config.GlobalCfgValidated,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := authorizePeer(c, cfg, auth)
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+		body, err := c.Body()
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+		request := &ReplicasRequest{}
+		if err := json.Unmarshal(body, request); err != nil || request.Owner == "" {
+			return c.String(http.StatusBadRequest, "expected the url of the owner")
+		}
+
+		result := HandoffRequest{Keys: cfg.Replicas.TakeAll(request.Owner, tenant.AllowsKey)}
+		if self := cfg.Cluster.View().SelfUrl(); self != nil {
+			result.From = self.String()
+		}
+		if result.Keys == nil {
+			result.Keys = []*limiter_api.KeyState{}
+		}
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// takeOverReplica continues the window of a key from its replica, if this instance keeps one, before deciding
+// requests on it here. That is the case when this instance stands in for the owner of the key while it is down.
+func takeOverReplica(
+	ctx context.Context,
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	key string,
+) {
+	state := cfg.Replicas.Take(key)
+	if state == nil {
+		return
+	}
+	slog.Debug("continuing the window of the key from its replica", logctx.GetAll(ctx)...)
+	if _, err := limiterManager.TakeOver(ctx, state); err == nil {
+		metrics.ReplicatedKeys("taken-over", 1)
+	}
+}
+
+// RecoverReplicatedKeys continues the windows of this instance's keys from their replicas on other instances
+// when it joins the cluster, e.g. after a restart. It also hands back the keys of an owner that was down,
+// to the owner, when it is up again.
+func RecoverReplicatedKeys(cfg *config.GlobalCfgValidated, limiterManager *limiter_manager.LimiterManagerSet) {
+	cfg.Cluster.OnChange(func(before, after *cluster.View) {
+		if before.Self < 0 && after.Self >= 0 {
+			go takeBackReplicas(cfg, limiterManager, after)
+		}
+	})
+	if view := cfg.Cluster.View(); view.Self >= 0 {
+		go takeBackReplicas(cfg, limiterManager, view)
+	}
+
+	cfg.Health.OnUp(func(instance *url.URL) {
+		go handBack(cfg, limiterManager, instance)
+	})
+}
+
+func takeBackReplicas(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	view *cluster.View,
+) {
+	self := view.SelfUrl()
+	for i, peer := range view.Instances {
+		if i == view.Self {
+			continue
+		}
+		go func() {
+			replicas := &HandoffRequest{}
+			if err := postToPeer(cfg, peer, "/cluster/replicas", &ReplicasRequest{Owner: self.String()}, replicas); err != nil {
+				slog.Debug(fmt.Sprintf("Failed to get the replicas of this instance's keys from %s: %v", peer, err))
+				return
+			}
+			numTakenOver := 0
+			for _, state := range replicas.Keys {
+				if _, err := limiterManager.TakeOver(context.Background(), state); err == nil {
+					numTakenOver++
+				}
+			}
+			if numTakenOver > 0 {
+				metrics.ReplicatedKeys("taken-over", numTakenOver)
+				slog.Info(fmt.Sprintf("Continued the windows of %d keys from their replicas on %s", numTakenOver, peer))
+			}
+		}()
+	}
+}
+
+// handBack hands off the keys of an instance that was down, and were decided here meanwhile, to the instance
+func handBack(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	instance *url.URL,
+) {
+	view := cfg.Cluster.View()
+	states := limiterManager.HandOff(func(key string) bool {
+		owner, local := view.Route(key)
+		return !local && owner.String() == instance.String()
+	})
+
+	var keys []*limiter_api.KeyState
+	for _, state := range states {
+		if state.NumApprovedThisWindow > 0 || state.NumDeniedThisWindow > 0 {
+			keys = append(keys, state)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	from := ""
+	if self := view.SelfUrl(); self != nil {
+		from = self.String()
+	}
+	if err := postToPeer(cfg, instance, "/cluster/handoff", &HandoffRequest{From: from, Keys: keys}, nil); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to hand back %d keys to %s, their windows start over there: %v", len(keys), instance, err))
+		return
+	}
+	metrics.HandedOffKeys("sent", len(keys))
+	slog.Info(fmt.Sprintf("Handed back %d keys to %s, which is up again", len(keys), instance))
+}
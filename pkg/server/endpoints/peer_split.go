@@ -0,0 +1,204 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/metrics"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// LendRequest asks the owner of a split key for part of the key's limit in the current window
+type LendRequest struct {
+	From   string // the url of the borrowing instance, for logging
+	Key    string
+	Shares int // the number of instances the limit is split between
+}
+
+// RepayRequest gives back requests of split keys that were borrowed and not used, by key
+type RepayRequest struct {
+	From string
+	Keys map[string]int
+}
+
+// askSplitKey decides a request on a split key owned by another instance, with requests borrowed from the owner.
+// Returns nil if the key isn't split, or if the owner is down or couldn't be reached, which leaves the request to
+// be forwarded or decided by --peer-down-policy as for other keys.
+func askSplitKey(
+	ctx context.Context,
+	cfg *config.GlobalCfgValidated,
+	key string,
+	owner *url.URL,
+) *limiter_api.PermissionResponse {
+
+	if cfg.Quotas == nil || !cfg.FromFile.Get().SplitsKey(key) {
+		return nil
+	}
+	if status, ok := cfg.Quotas.Take(key); ok {
+		return &limiter_api.PermissionResponse{RespCode: limiter_api.Approved, Status: status}
+	}
+	if !cfg.Health.Healthy(owner) {
+		return nil
+	}
+
+	status, approved, err := cfg.Quotas.Borrow(key, func() (*limiter_api.Loan, error) {
+		return borrow(cfg, owner, key)
+	})
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to borrow requests from %s: %v", owner, err), logctx.GetAll(ctx)...)
+		return nil
+	}
+	if !approved {
+		return &limiter_api.PermissionResponse{RespCode: limiter_api.Denied, Status: status}
+	}
+	return &limiter_api.PermissionResponse{RespCode: limiter_api.Approved, Status: status}
+}
+
+func borrow(cfg *config.GlobalCfgValidated, owner *url.URL, key string) (*limiter_api.Loan, error) {
+	view := cfg.Cluster.View()
+	request := &LendRequest{Key: key, Shares: len(view.Instances)}
+	if self := view.SelfUrl(); self != nil {
+		request.From = self.String()
+	}
+	loan := &limiter_api.Loan{}
+	if err := postToPeer(cfg, owner, "/cluster/lend", request, loan); err != nil {
+		return nil, err
+	}
+	metrics.SplitRequests("borrowed", loan.Granted)
+	return loan, nil
+}
+
+// RebalanceSplitKeys gives the requests of split keys that this instance borrowed and hasn't used for
+// --split-rebalance-millis back to their owners, until stop is called, so that other instances can borrow them
+func RebalanceSplitKeys(cfg *config.GlobalCfgValidated) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(cfg.SplitRebalanceMillis.Value()) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				repayUnused(cfg)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func repayUnused(cfg *config.GlobalCfgValidated) {
+	unused := cfg.Quotas.Reclaim()
+	if len(unused) == 0 {
+		return
+	}
+
+	view := cfg.Cluster.View()
+	from := ""
+	if self := view.SelfUrl(); self != nil {
+		from = self.String()
+	}
+	byOwner := map[*url.URL]map[string]int{}
+	for key, n := range unused {
+		if owner, local := view.Route(key); !local {
+			if byOwner[owner] == nil {
+				byOwner[owner] = map[string]int{}
+			}
+			byOwner[owner][key] = n
+		}
+	}
+	for owner, keys := range byOwner {
+		if err := postToPeer(cfg, owner, "/cluster/repay", &RepayRequest{From: from, Keys: keys}, nil); err != nil {
+			// The requests are lost for this window, as if they had been used
+			slog.Debug(fmt.Sprintf("Failed to give back unused requests of %d keys to %s: %v", len(keys), owner, err))
+			continue
+		}
+		for _, n := range keys {
+			metrics.SplitRequests("repaid", n)
+		}
+	}
+}
+
+// HandleClusterLendRequest lends part of the limit of a split key owned by this instance to another instance.
+// Only other instances may borrow, and with tenant auth, only for the keys that their tenant is allowed.
+func HandleClusterLendRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := authorizePeer(c, cfg, auth)
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+		body, err := c.Body()
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+		request := &LendRequest{}
+		if err := json.Unmarshal(body, request); err != nil || request.Key == "" || request.Shares <= 0 {
+			return c.String(http.StatusBadRequest, "expected a key and the number of shares")
+		}
+		if authErr := tenant.AuthorizeKey(request.Key); authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+
+		loan, err := limiterManager.Lend(c.Context(), request.Key, request.Shares)
+		if errors.Is(err, limiter_manager.ErrNotSplit) {
+			return c.String(http.StatusConflict, "the key is not split on this instance")
+		}
+		if err != nil {
+			return c.String(http.StatusServiceUnavailable, "gave up lending")
+		}
+		metrics.SplitRequests("lent", loan.Granted)
+
+		return c.JSON(http.StatusOK, loan)
+	}
+}
+
+// HandleClusterRepayRequest takes back requests of split keys owned by this instance that another instance
+// borrowed and didn't use. Only other instances may repay.
+func HandleClusterRepayRequest(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) Handler {
+	return func(c Request) error {
+
+		tenant, authErr := authorizePeer(c, cfg, auth)
+		if authErr != nil {
+			return writeAuthError(c, authErr)
+		}
+		body, err := c.Body()
+		if err != nil {
+			return c.String(http.StatusBadRequest, "failed to read body")
+		}
+		request := &RepayRequest{}
+		if err := json.Unmarshal(body, request); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid repayment: %v", err))
+		}
+
+		for key, n := range request.Keys {
+			if n > 0 && tenant.AllowsKey(key) {
+				limiterManager.Repay(key, n)
+			}
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
@@ -0,0 +1,71 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/url"
+)
+
+// askPeer asks the owner of a key for permission over the connections of --peer-transport=binary, instead of
+// forwarding the http request. Returns nil if the owner is down, couldn't be reached or didn't decide, which
+// leaves the request to --peer-down-policy, and ClientGaveUp if the client went away.
+func askPeer(
+	ctx context.Context,
+	cfg *config.GlobalCfgValidated,
+	owner *url.URL,
+	key string,
+	canWait bool,
+	maxRequests int,
+	maxRequestsInQueue int,
+) (*limiter_api.PermissionResponse, string) {
+
+	if !cfg.Health.Healthy(owner) {
+		return nil, ""
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "askPeer",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("gocc.instance", owner.Host)),
+	)
+	defer span.End()
+	clientCtx := ctx
+	if !canWait {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultForwardTimeout)
+		defer cancel()
+	}
+
+	result, requestID, err := cfg.Peers.Ask(ctx, owner, key, canWait, maxRequests, maxRequestsInQueue)
+	if err != nil {
+		if clientCtx.Err() != nil {
+			// The client went away while the owner decided, which isn't the owner's fault
+			return &limiter_api.PermissionResponse{RespCode: limiter_api.ClientGaveUp}, ""
+		}
+		span.SetStatus(codes.Error, "failed to reach the owner")
+		slog.Warn(fmt.Sprintf("failed to forward request to correct instance %s: %v", owner, err), logctx.GetAll(ctx)...)
+		return nil, ""
+	}
+	return result, requestID
+}
+
+// releaseAtPeer releases a request approved by the owner of its key, over the connections of
+// --peer-transport=binary. Returns false if the owner is down or couldn't be reached.
+func releaseAtPeer(ctx context.Context, cfg *config.GlobalCfgValidated, owner *url.URL, key string, requestID string) bool {
+	if !cfg.Health.Healthy(owner) {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultForwardTimeout)
+	defer cancel()
+	if err := cfg.Peers.Release(ctx, owner, key, requestID); err != nil {
+		slog.Warn(fmt.Sprintf("failed to forward release to correct instance %s: %v", owner, err), logctx.GetAll(ctx)...)
+		return false
+	}
+	return true
+}
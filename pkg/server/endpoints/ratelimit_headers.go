@@ -0,0 +1,56 @@
+package endpoints
+
+import (
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Rate limit headers, in both the IETF draft (RateLimit-*) and the older de facto (X-RateLimit-*) format,
+// since proxies and clients support different ones. Reset values are in whole seconds, rounded up.
+const (
+	HeaderRateLimitLimit      = "RateLimit-Limit"
+	HeaderRateLimitRemaining  = "RateLimit-Remaining"
+	HeaderRateLimitReset      = "RateLimit-Reset"
+	HeaderXRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderXRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderXRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRetryAfter          = "Retry-After"
+)
+
+func setRateLimitHeaders(h http.Header, status *limiter_api.LimitStatus, denied bool) {
+	if status == nil || status.WindowMillis <= 0 {
+		return
+	}
+	limit := strconv.Itoa(status.MaxRequestsPerWindow)
+	remaining := strconv.Itoa(status.Remaining())
+	reset := strconv.Itoa(int(math.Ceil(status.ResetAfter().Seconds())))
+	h.Set(HeaderRateLimitLimit, limit)
+	h.Set(HeaderRateLimitRemaining, remaining)
+	h.Set(HeaderRateLimitReset, reset)
+	h.Set(HeaderXRateLimitLimit, limit)
+	h.Set(HeaderXRateLimitRemaining, remaining)
+	h.Set(HeaderXRateLimitReset, reset)
+	if denied {
+		h.Set(HeaderRetryAfter, reset)
+	}
+}
+
+// parseRateLimitHeaders reconstructs (approximately) a limit status from rate limit headers
+// set by setRateLimitHeaders, e.g. in responses from other instances.
+func parseRateLimitHeaders(h http.Header) limiter_api.LimitStatus {
+	limit, errLimit := strconv.Atoi(h.Get(HeaderRateLimitLimit))
+	remaining, errRemaining := strconv.Atoi(h.Get(HeaderRateLimitRemaining))
+	reset, errReset := strconv.Atoi(h.Get(HeaderRateLimitReset))
+	if errLimit != nil || errRemaining != nil || errReset != nil {
+		return limiter_api.LimitStatus{}
+	}
+	return limiter_api.LimitStatus{
+		MaxRequestsPerWindow:  limit,
+		NumApprovedThisWindow: limit - remaining,
+		WindowMillis:          max(1, reset) * 1000, // the real window size is not known
+		WindowResetsAt:        time.Now().Add(time.Duration(reset) * time.Second),
+	}
+}
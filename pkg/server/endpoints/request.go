@@ -0,0 +1,135 @@
+package endpoints
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+)
+
+// Request is what endpoint handlers see of an http request and its response. It lets the
+// same handlers, with the same parsing and forwarding, be served by echo as well as fasthttp.
+type Request interface {
+	Context() context.Context
+	Method() string
+	Host() string // as sent by the client, including the port if any
+	Path() string // the request path as sent, still escaped, without the query string
+	RawQuery() string
+	Body() ([]byte, error) // reads the request body, can only be called once
+	RemoteAddr() string
+	Param(name string) string
+	QueryParam(name string) string
+	Header(name string) string
+	ResponseHeader() http.Header // headers set here are sent with the response
+	String(code int, s string) error
+	NoContent(code int) error
+	JSON(code int, v any) error
+	Blob(code int, contentType string, b []byte) error
+	// Stream answers with a body that is written by stream as it goes, e.g. server-sent events.
+	// stream may run after the handler has returned, so it must clean up after itself. flush sends
+	// what has been written so far, and fails when the client has gone away.
+	Stream(code int, contentType string, stream func(w io.Writer, flush func() error)) error
+}
+
+// Handler handles a request, regardless of which server type is used
+type Handler func(r Request) error
+
+// Route binds a handler to a method and a path. Paths use echo syntax, i.e. /rate/:key,
+// and an empty method matches any method.
+type Route struct {
+	Method  string
+	Path    string
+	Handler Handler
+}
+
+// RegisterEchoRoutes registers routes on an echo server
+func RegisterEchoRoutes(e *echo.Echo, routes []Route) {
+	for _, route := range routes {
+		handler := EchoHandler(route.Handler)
+		if route.Method == "" {
+			e.Any(route.Path, handler)
+		} else {
+			e.Add(route.Method, route.Path, handler)
+		}
+	}
+}
+
+// EchoHandler adapts a handler to echo
+func EchoHandler(h Handler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return h(&echoRequest{c: c})
+	}
+}
+
+type echoRequest struct {
+	c echo.Context
+}
+
+func (r *echoRequest) Context() context.Context {
+	return r.c.Request().Context()
+}
+
+func (r *echoRequest) Method() string {
+	return r.c.Request().Method
+}
+
+func (r *echoRequest) Host() string {
+	return r.c.Request().Host
+}
+
+func (r *echoRequest) Path() string {
+	return r.c.Request().URL.EscapedPath()
+}
+
+func (r *echoRequest) RawQuery() string {
+	return r.c.Request().URL.RawQuery
+}
+
+func (r *echoRequest) Body() ([]byte, error) {
+	return io.ReadAll(r.c.Request().Body)
+}
+
+func (r *echoRequest) RemoteAddr() string {
+	return r.c.Request().RemoteAddr
+}
+
+func (r *echoRequest) Param(name string) string {
+	return r.c.Param(name)
+}
+
+func (r *echoRequest) QueryParam(name string) string {
+	return r.c.QueryParam(name)
+}
+
+func (r *echoRequest) Header(name string) string {
+	return r.c.Request().Header.Get(name)
+}
+
+func (r *echoRequest) ResponseHeader() http.Header {
+	return r.c.Response().Header()
+}
+
+func (r *echoRequest) String(code int, s string) error {
+	return r.c.String(code, s)
+}
+
+func (r *echoRequest) NoContent(code int) error {
+	return r.c.NoContent(code)
+}
+
+func (r *echoRequest) JSON(code int, v any) error {
+	return r.c.JSON(code, v)
+}
+
+func (r *echoRequest) Blob(code int, contentType string, b []byte) error {
+	return r.c.Blob(code, contentType, b)
+}
+
+func (r *echoRequest) Stream(code int, contentType string, stream func(w io.Writer, flush func() error)) error {
+	resp := r.c.Response()
+	resp.Header().Set(echo.HeaderContentType, contentType)
+	resp.WriteHeader(code)
+	controller := http.NewResponseController(resp.Writer)
+	stream(resp, controller.Flush)
+	return nil
+}
@@ -0,0 +1,268 @@
+package endpoints
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/valyala/fasthttp"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// NewFastHttpHandler serves routes on fasthttp. Unknown paths and methods are answered
+// the same way as echo answers them, so that clients can't tell the server types apart.
+func NewFastHttpHandler(routes []Route) fasthttp.RequestHandler {
+
+	compiled := make([]*fastRoute, 0, len(routes))
+	for _, route := range routes {
+		compiled = append(compiled, compileFastRoute(route))
+	}
+
+	// Requests get contexts of their own, since the fasthttp.RequestCtx is reused for other requests once
+	// answered, while e.g. the limiter instance may still read the context. Done when the server shuts down.
+	var serverCtx context.Context
+	var serverCtxOnce sync.Once
+
+	return func(ctx *fasthttp.RequestCtx) {
+
+		segments := strings.Split(string(ctx.URI().PathOriginal()), "/")
+		method := string(ctx.Method())
+
+		var allowed []string
+		for _, route := range compiled {
+			values, ok := route.match(segments)
+			if !ok {
+				continue
+			}
+			if route.method != "" && route.method != method {
+				allowed = append(allowed, route.method)
+				continue
+			}
+			ctx.SetUserValue(fastRouteKey{}, &FastHttpRouteMatch{Route: route.path, names: route.paramNames, values: values})
+			serverCtxOnce.Do(func() {
+				var cancel context.CancelFunc
+				serverCtx, cancel = context.WithCancel(context.Background())
+				done := ctx.Done() // the server's, the same for all requests
+				go func() {
+					<-done
+					cancel()
+				}()
+			})
+			requestCtx, cancel := context.WithCancel(serverCtx)
+			request := &fastRequest{ctx: ctx, requestCtx: requestCtx, cancel: cancel}
+			err := route.handler(request)
+			if !request.streaming {
+				cancel()
+			}
+			if err != nil {
+				writeFastHttpError(ctx, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if len(allowed) > 0 {
+			ctx.Response.Header.Set("Allow", strings.Join(allowed, ", "))
+			writeFastHttpError(ctx, http.StatusMethodNotAllowed)
+		} else {
+			writeFastHttpError(ctx, http.StatusNotFound)
+		}
+	}
+}
+
+// FastHttpRouteMatch is the route that a fasthttp request was routed to, for logging
+type FastHttpRouteMatch struct {
+	Route  string
+	names  []string
+	values []string
+}
+
+// Params returns the path parameters of the request, by name
+func (m *FastHttpRouteMatch) Params() map[string]string {
+	params := make(map[string]string, len(m.names))
+	for i, name := range m.names {
+		params[name] = m.values[i]
+	}
+	return params
+}
+
+// GetFastHttpRouteMatch returns the route that a request was routed to, or nil if none matched
+func GetFastHttpRouteMatch(ctx *fasthttp.RequestCtx) *FastHttpRouteMatch {
+	match, _ := ctx.UserValue(fastRouteKey{}).(*FastHttpRouteMatch)
+	return match
+}
+
+type fastRouteKey struct{}
+
+type fastRoute struct {
+	method     string
+	path       string
+	segments   []string
+	paramIndex []int // index in segments of each path parameter
+	paramNames []string
+	handler    Handler
+}
+
+func compileFastRoute(route Route) *fastRoute {
+	compiled := &fastRoute{
+		method:   route.Method,
+		path:     route.Path,
+		segments: strings.Split(route.Path, "/"),
+		handler:  route.Handler,
+	}
+	for i, segment := range compiled.segments {
+		if strings.HasPrefix(segment, ":") {
+			compiled.paramIndex = append(compiled.paramIndex, i)
+			compiled.paramNames = append(compiled.paramNames, segment[1:])
+		}
+	}
+	return compiled
+}
+
+// match returns the values of the route's path parameters, if the path matches the route
+func (r *fastRoute) match(segments []string) ([]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	param := 0
+	values := make([]string, len(r.paramNames))
+	for i, segment := range r.segments {
+		if param < len(r.paramIndex) && r.paramIndex[param] == i {
+			// Unescaped like echo does, so that keys such as "a b" are the same on both server types
+			value, err := url.PathUnescape(segments[i])
+			if err != nil {
+				value = segments[i]
+			}
+			values[param] = value
+			param++
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// writeFastHttpError answers with the same body as echo's default error handler
+func writeFastHttpError(ctx *fasthttp.RequestCtx, code int) {
+	body, _ := json.Marshal(map[string]string{"message": http.StatusText(code)})
+	ctx.SetStatusCode(code)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(append(body, '\n'))
+}
+
+type fastRequest struct {
+	ctx        *fasthttp.RequestCtx
+	requestCtx context.Context
+	cancel     context.CancelFunc
+	streaming  bool        // the response is streamed after the handler returns, which cancels requestCtx when done
+	header     http.Header // response headers, copied to the fasthttp response when it's written
+}
+
+func (r *fastRequest) Context() context.Context {
+	// Done when the server shuts down, or the request has been answered. fasthttp doesn't notice clients going away.
+	return r.requestCtx
+}
+
+func (r *fastRequest) Method() string {
+	return string(r.ctx.Method())
+}
+
+func (r *fastRequest) Host() string {
+	return string(r.ctx.Host())
+}
+
+func (r *fastRequest) Path() string {
+	return string(r.ctx.URI().PathOriginal())
+}
+
+func (r *fastRequest) RawQuery() string {
+	return string(r.ctx.URI().QueryString())
+}
+
+func (r *fastRequest) Body() ([]byte, error) {
+	return r.ctx.PostBody(), nil
+}
+
+func (r *fastRequest) RemoteAddr() string {
+	return r.ctx.RemoteAddr().String()
+}
+
+func (r *fastRequest) Param(name string) string {
+	match := GetFastHttpRouteMatch(r.ctx)
+	if match == nil {
+		return ""
+	}
+	for i, paramName := range match.names {
+		if paramName == name {
+			return match.values[i]
+		}
+	}
+	return ""
+}
+
+func (r *fastRequest) QueryParam(name string) string {
+	return string(r.ctx.QueryArgs().Peek(name))
+}
+
+func (r *fastRequest) Header(name string) string {
+	return string(r.ctx.Request.Header.Peek(name))
+}
+
+func (r *fastRequest) ResponseHeader() http.Header {
+	if r.header == nil {
+		r.header = http.Header{}
+	}
+	return r.header
+}
+
+func (r *fastRequest) String(code int, s string) error {
+	r.writeHeader(code)
+	r.ctx.SetContentType("text/plain; charset=UTF-8")
+	r.ctx.SetBodyString(s)
+	return nil
+}
+
+func (r *fastRequest) NoContent(code int) error {
+	r.writeHeader(code)
+	return nil
+}
+
+func (r *fastRequest) JSON(code int, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.writeHeader(code)
+	r.ctx.SetContentType("application/json")
+	r.ctx.SetBody(append(body, '\n'))
+	return nil
+}
+
+func (r *fastRequest) Blob(code int, contentType string, b []byte) error {
+	r.writeHeader(code)
+	r.ctx.SetContentType(contentType)
+	r.ctx.SetBody(b)
+	return nil
+}
+
+func (r *fastRequest) Stream(code int, contentType string, stream func(w io.Writer, flush func() error)) error {
+	r.writeHeader(code)
+	r.ctx.SetContentType(contentType)
+	r.streaming = true
+	r.ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer r.cancel()
+		stream(w, w.Flush)
+	})
+	return nil
+}
+
+func (r *fastRequest) writeHeader(code int) {
+	for name, values := range r.header {
+		for _, value := range values {
+			r.ctx.Response.Header.Add(name, value)
+		}
+	}
+	r.ctx.SetStatusCode(code)
+}
@@ -0,0 +1,22 @@
+package endpoints
+
+import (
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"net/http"
+)
+
+// ForwardAuthCredentialsHeader carries the credentials of the reverse proxy in /auth requests,
+// since the Authorization header there belongs to the forwarded request.
+const ForwardAuthCredentialsHeader = "X-Gocc-Authorization"
+
+// bearerToken returns the credentials of a request to the /rate and /debug endpoints
+func bearerToken(c Request) string {
+	return tenant_auth.BearerToken(c.Header("Authorization"))
+}
+
+func writeAuthError(c Request, err *tenant_auth.AuthError) error {
+	if err.Status == http.StatusUnauthorized {
+		c.ResponseHeader().Set("WWW-Authenticate", `Bearer realm="gocc"`)
+	}
+	return c.String(err.Status, err.Msg)
+}
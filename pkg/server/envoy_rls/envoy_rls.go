@@ -0,0 +1,241 @@
+package envoy_rls
+
+import (
+	"context"
+	"fmt"
+	rlcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/google/uuid"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/keytemplate"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// Frontend implements the envoy.service.ratelimit.v3 RateLimitService, so that envoy
+// can use gocc directly as its external rate limit service.
+// Each descriptor in a request is mapped to a gocc key using a key template.
+// Requests never wait in queue: envoy expects an immediate answer.
+// With tenant auth, envoy sends its credentials as "authorization: Bearer ..." metadata.
+type Frontend struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	port           int
+	keyTemplate    *keytemplate.Template
+	limiterManager *limiter_manager.LimiterManagerSet
+	auth           *tenant_auth.Authenticator
+	grpcServer     *grpc.Server
+}
+
+func New(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) *Frontend {
+	keyTemplate, err := keytemplate.Parse(cfg.EnvoyRlsKeyTemplate.Value())
+	if err != nil {
+		panic(fmt.Sprintf("Invalid envoy rls key template: %v", err))
+	}
+	f := &Frontend{
+		port:           cfg.EnvoyRlsPort.Value(),
+		keyTemplate:    keyTemplate,
+		limiterManager: limiterManager,
+		auth:           auth,
+		grpcServer:     grpc.NewServer(),
+	}
+	rlsv3.RegisterRateLimitServiceServer(f.grpcServer, f)
+	return f
+}
+
+func (f *Frontend) Name() string {
+	return "envoy-rls"
+}
+
+func (f *Frontend) Port() int {
+	return f.port
+}
+
+// NextProtos makes tls listeners negotiate h2, which gRPC clients require
+func (f *Frontend) NextProtos() []string {
+	return []string{"h2"}
+}
+
+func (f *Frontend) Serve(listener net.Listener) error {
+	return f.grpcServer.Serve(listener)
+}
+
+func (f *Frontend) Close() {
+	f.grpcServer.Stop()
+}
+
+func (f *Frontend) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+
+	ctx = logctx.Add(ctx, "correlation-id", getCorrelationID(ctx))
+	ctx = logctx.Add(ctx, "domain", req.GetDomain())
+
+	tenant, authErr := f.auth.Authenticate(getBearerToken(ctx))
+	if authErr != nil {
+		slog.Warn(authErr.Msg, logctx.GetAll(ctx)...)
+		return nil, status.Error(codes.Unauthenticated, authErr.Msg)
+	}
+
+	result := &rlsv3.RateLimitResponse{
+		OverallCode: rlsv3.RateLimitResponse_OK,
+		Statuses:    make([]*rlsv3.RateLimitResponse_DescriptorStatus, 0, len(req.GetDescriptors())),
+	}
+
+	for _, descriptor := range req.GetDescriptors() {
+		status, err := f.handleDescriptor(ctx, tenant, req, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if status.Code == rlsv3.RateLimitResponse_OVER_LIMIT {
+			result.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		result.Statuses = append(result.Statuses, status)
+	}
+
+	return result, nil
+}
+
+func (f *Frontend) handleDescriptor(
+	ctx context.Context,
+	tenant *tenant_auth.Tenant,
+	req *rlsv3.RateLimitRequest,
+	descriptor *rlcommonv3.RateLimitDescriptor,
+) (*rlsv3.RateLimitResponse_DescriptorStatus, error) {
+
+	key, err := f.keyTemplate.Execute(descriptorLookup(req.GetDomain(), descriptor))
+	if err != nil {
+		// Same semantics as envoy's reference implementation: descriptors we have no mapping for are not limited
+		slog.Debug(fmt.Sprintf("descriptor not rate limited: %v", err), logctx.GetAll(ctx)...)
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}, nil
+	}
+	key = strings.TrimSpace(key)
+	if len(key) == 0 {
+		slog.Warn("descriptor mapped to an empty key, not rate limited", logctx.GetAll(ctx)...)
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}, nil
+	}
+	ctx = logctx.Add(ctx, "key", key)
+
+	if authErr := tenant.AuthorizeKey(key); authErr != nil {
+		slog.Warn(authErr.Msg, logctx.GetAll(ctx)...)
+		return nil, status.Error(codes.PermissionDenied, authErr.Msg)
+	}
+
+	hits := hitsAddend(req, descriptor)
+	resp, _ := f.limiterManager.AskPermissionForHits(ctx, key, hits, limiter_api.NoChange, limiter_api.NoChange, limiter_api.NoChange)
+
+	code := rlsv3.RateLimitResponse_OK
+	switch resp.RespCode {
+	case limiter_api.Approved:
+	case limiter_api.Denied:
+		code = rlsv3.RateLimitResponse_OVER_LIMIT
+	case limiter_api.ClientGaveUp:
+		// envoy has given up, so it won't read this anyway
+		code = rlsv3.RateLimitResponse_UNKNOWN
+	default:
+		slog.Error("unexpected response from limiter", append(logctx.GetAll(ctx), slog.String("response", string(resp.RespCode)))...)
+		code = rlsv3.RateLimitResponse_UNKNOWN
+	}
+
+	return &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:               code,
+		CurrentLimit:       toEnvoyRateLimit(key, &resp.Status),
+		LimitRemaining:     uint32(resp.Status.Remaining()),
+		DurationUntilReset: durationpb.New(resp.Status.ResetAfter()),
+	}, nil
+}
+
+// descriptorLookup resolves key template placeholders for a descriptor
+func descriptorLookup(domain string, descriptor *rlcommonv3.RateLimitDescriptor) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch {
+		case name == "domain":
+			return domain, true
+		case name == "entries":
+			parts := make([]string, 0, len(descriptor.GetEntries()))
+			for _, entry := range descriptor.GetEntries() {
+				parts = append(parts, entry.GetKey()+"="+entry.GetValue())
+			}
+			return strings.Join(parts, ","), true
+		case strings.HasPrefix(name, "entry:"):
+			entryKey := strings.TrimPrefix(name, "entry:")
+			for _, entry := range descriptor.GetEntries() {
+				if entry.GetKey() == entryKey {
+					return entry.GetValue(), true
+				}
+			}
+			return "", false
+		default:
+			return "", false
+		}
+	}
+}
+
+// hitsAddend returns how many slots a descriptor consumes. The descriptor level value
+// takes precedence over the request level one, and 0 means 1 (per envoy's api docs).
+// Values beyond any limit are capped, they are denied all the same.
+func hitsAddend(req *rlsv3.RateLimitRequest, descriptor *rlcommonv3.RateLimitDescriptor) int {
+	hits := uint64(req.GetHitsAddend())
+	if descriptor.GetHitsAddend() != nil {
+		hits = descriptor.GetHitsAddend().GetValue()
+	}
+	return int(min(max(1, hits), math.MaxInt32))
+}
+
+// toEnvoyRateLimit converts gocc's window based limit to envoy's requests per unit.
+// Windows that don't correspond exactly to an envoy time unit are reported per second.
+func toEnvoyRateLimit(key string, status *limiter_api.LimitStatus) *rlsv3.RateLimitResponse_RateLimit {
+	window := time.Duration(status.WindowMillis) * time.Millisecond
+	switch window {
+	case time.Second:
+		return &rlsv3.RateLimitResponse_RateLimit{Name: key, RequestsPerUnit: uint32(status.MaxRequestsPerWindow), Unit: rlsv3.RateLimitResponse_RateLimit_SECOND}
+	case time.Minute:
+		return &rlsv3.RateLimitResponse_RateLimit{Name: key, RequestsPerUnit: uint32(status.MaxRequestsPerWindow), Unit: rlsv3.RateLimitResponse_RateLimit_MINUTE}
+	case time.Hour:
+		return &rlsv3.RateLimitResponse_RateLimit{Name: key, RequestsPerUnit: uint32(status.MaxRequestsPerWindow), Unit: rlsv3.RateLimitResponse_RateLimit_HOUR}
+	case 24 * time.Hour:
+		return &rlsv3.RateLimitResponse_RateLimit{Name: key, RequestsPerUnit: uint32(status.MaxRequestsPerWindow), Unit: rlsv3.RateLimitResponse_RateLimit_DAY}
+	default:
+		if status.WindowMillis <= 0 {
+			return nil
+		}
+		perSecond := max(1, status.MaxRequestsPerWindow*1000/status.WindowMillis)
+		return &rlsv3.RateLimitResponse_RateLimit{Name: key, RequestsPerUnit: uint32(perSecond), Unit: rlsv3.RateLimitResponse_RateLimit_SECOND}
+	}
+}
+
+func getBearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			return tenant_auth.BearerToken(values[0])
+		}
+	}
+	return ""
+}
+
+func getCorrelationID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		for _, header := range []string{"x-correlation-id", "x-request-id"} {
+			if values := md.Get(header); len(values) > 0 && values[0] != "" {
+				return values[0]
+			}
+		}
+	}
+	return "gcc-" + uuid.New().String()
+}
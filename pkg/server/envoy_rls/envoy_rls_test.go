@@ -0,0 +1,173 @@
+package envoy_rls
+
+import (
+	"context"
+	rlcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/samber/lo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"math"
+	"net"
+	"testing"
+)
+
+func startTestFrontend(t *testing.T, keyTemplate string, maxRequests int) rlsv3.RateLimitServiceClient {
+
+	globalCfg := config.NewGlobalCfg()
+	globalCfg.EnvoyRlsPort.Default = lo.ToPtr(0)
+	globalCfg.EnvoyRlsKeyTemplate.Default = lo.ToPtr(keyTemplate)
+	cfg := &config.GlobalCfgValidated{GlobalCfg: globalCfg}
+
+	mgr := limiter_manager.NewManagerSet(&limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: maxRequests,
+		MaxRequestsInQueue:   0,
+	}, nil, nil, 1)
+	t.Cleanup(mgr.Close)
+
+	frontend := New(cfg, mgr, nil)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = frontend.Serve(listener) }()
+	t.Cleanup(frontend.Close)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create grpc client: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(kvs ...string) *rlcommonv3.RateLimitDescriptor {
+	result := &rlcommonv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		result.Entries = append(result.Entries, &rlcommonv3.RateLimitDescriptor_Entry{Key: kvs[i], Value: kvs[i+1]})
+	}
+	return result
+}
+
+func TestShouldRateLimit_over_limit(t *testing.T) {
+
+	client := startTestFrontend(t, "{domain}:{entries}", 2)
+
+	req := &rlsv3.RateLimitRequest{
+		Domain:      "envoy",
+		Descriptors: []*rlcommonv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.ShouldRateLimit(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Fatalf("expected OK, got %v", resp.OverallCode)
+		}
+		if resp.Statuses[0].LimitRemaining != uint32(1-i) {
+			t.Fatalf("expected %d remaining, got %d", 1-i, resp.Statuses[0].LimitRemaining)
+		}
+	}
+
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("expected OVER_LIMIT, got %v", resp.OverallCode)
+	}
+
+	status := resp.Statuses[0]
+	if status.CurrentLimit.RequestsPerUnit != 2 || status.CurrentLimit.Unit != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+		t.Fatalf("unexpected current limit: %v", status.CurrentLimit)
+	}
+	if status.CurrentLimit.Name != "envoy:remote_address=10.0.0.1" {
+		t.Fatalf("unexpected key: %s", status.CurrentLimit.Name)
+	}
+	if status.DurationUntilReset.AsDuration() <= 0 {
+		t.Fatalf("expected positive duration until reset, got %v", status.DurationUntilReset.AsDuration())
+	}
+}
+
+func TestShouldRateLimit_unmapped_descriptors_are_not_limited(t *testing.T) {
+
+	client := startTestFrontend(t, "{entry:user}", 1)
+
+	req := &rlsv3.RateLimitRequest{
+		Domain: "envoy",
+		Descriptors: []*rlcommonv3.RateLimitDescriptor{
+			descriptor("remote_address", "10.0.0.1"),
+			descriptor("user", "alice"),
+		},
+	}
+
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OK || len(resp.Statuses) != 2 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	resp, err = client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("expected OVER_LIMIT, got %v", resp.OverallCode)
+	}
+	if resp.Statuses[0].Code != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("expected unmapped descriptor to be OK, got %v", resp.Statuses[0].Code)
+	}
+	if resp.Statuses[1].Code != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("expected mapped descriptor to be OVER_LIMIT, got %v", resp.Statuses[1].Code)
+	}
+}
+
+func TestShouldRateLimit_hits_addend(t *testing.T) {
+
+	client := startTestFrontend(t, "{domain}:{entries}", 3)
+
+	req := &rlsv3.RateLimitRequest{
+		Domain:      "envoy",
+		Descriptors: []*rlcommonv3.RateLimitDescriptor{descriptor("k", "v")},
+		HitsAddend:  2,
+	}
+
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OK || resp.Statuses[0].LimitRemaining != 1 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	resp, err = client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("expected OVER_LIMIT, got %v", resp.OverallCode)
+	}
+
+	// Denied hits take no slots, and hits beyond any limit are denied right away
+	req.Descriptors[0].HitsAddend = wrapperspb.UInt64(math.MaxUint64)
+	resp, err = client.ShouldRateLimit(context.Background(), req)
+	if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("expected OVER_LIMIT, got %v %v", resp, err)
+	}
+	req.Descriptors[0].HitsAddend = nil
+	req.HitsAddend = 1
+	resp, err = client.ShouldRateLimit(context.Background(), req)
+	if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OK || resp.Statuses[0].LimitRemaining != 0 {
+		t.Fatalf("expected the last slot to be left, got %v %v", resp, err)
+	}
+}
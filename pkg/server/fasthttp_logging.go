@@ -0,0 +1,111 @@
+package server
+
+import (
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/server/endpoints"
+	"github.com/labstack/echo/v4"
+	slogecho "github.com/samber/slog-echo"
+	"github.com/valyala/fasthttp"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newFastHttpLogger logs requests served by fasthttp with the same levels, messages and attributes
+// as slogecho logs requests served by echo, so that log based dashboards work for all server types.
+func newFastHttpLogger(globalCfg *config.GlobalCfg, logger *slog.Logger, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+
+	// Same as slogecho.New vs slogecho.NewWithConfig in CreateNew
+	configured := globalCfg.LogFormat.Value() != "system-default"
+
+	return func(ctx *fasthttp.RequestCtx) {
+
+		start := time.Now()
+		next(ctx)
+
+		status := ctx.Response.StatusCode()
+		if configured && !shouldLogStatus(globalCfg, status) {
+			return
+		}
+		end := time.Now()
+
+		route, params := "", map[string]string{}
+		if match := endpoints.GetFastHttpRouteMatch(ctx); match != nil {
+			route, params = match.Route, match.Params()
+		}
+
+		requestAttributes := []slog.Attr{
+			slog.Time("time", start.UTC()),
+			slog.String("method", string(ctx.Method())),
+			slog.String("host", string(ctx.Host())),
+			slog.String("path", string(ctx.Path())),
+			slog.String("query", string(ctx.URI().QueryString())),
+			slog.Any("params", params),
+			slog.String("route", route),
+			slog.String("ip", fastHttpRealIP(ctx)),
+			slog.String("referer", string(ctx.Request.Header.Referer())),
+			slog.Int("length", len(ctx.Request.Body())),
+		}
+		if configured {
+			var kv []any
+			ctx.Request.Header.VisitAll(func(key, value []byte) {
+				if _, hidden := slogecho.HiddenRequestHeaders[strings.ToLower(string(key))]; !hidden {
+					kv = append(kv, slog.Any(string(key), []string{string(value)}))
+				}
+			})
+			requestAttributes = append(requestAttributes, slog.Group("header", kv...))
+		}
+
+		length := 0
+		if !ctx.Response.IsBodyStream() { // reading a streamed body here would wait for the whole stream
+			length = len(ctx.Response.Body())
+		}
+		responseAttributes := []slog.Attr{
+			slog.Time("time", end.UTC()),
+			slog.Duration("latency", end.Sub(start)),
+			slog.Int("status", status),
+			slog.Int("length", length),
+		}
+
+		attributes := []slog.Attr{
+			{Key: "request", Value: slog.GroupValue(requestAttributes...)},
+			{Key: "response", Value: slog.GroupValue(responseAttributes...)},
+		}
+		requestID := string(ctx.Request.Header.Peek(echo.HeaderXRequestID))
+		if requestID == "" {
+			requestID = string(ctx.Response.Header.Peek(echo.HeaderXRequestID))
+		}
+		if requestID != "" {
+			attributes = append(attributes, slog.String(slogecho.RequestIDKey, requestID))
+		}
+
+		level, msg := slog.LevelInfo, "Incoming request"
+		if status >= http.StatusInternalServerError {
+			level, msg = slog.LevelError, http.StatusText(status)
+		} else if status >= http.StatusBadRequest {
+			level, msg = slog.LevelWarn, http.StatusText(status)
+		}
+
+		logger.LogAttrs(ctx, level, msg, attributes...)
+	}
+}
+
+// fastHttpRealIP mirrors echo's Context.RealIP
+func fastHttpRealIP(ctx *fasthttp.RequestCtx) string {
+	if ip := string(ctx.Request.Header.Peek(echo.HeaderXForwardedFor)); ip != "" {
+		if i := strings.IndexAny(ip, ","); i > 0 {
+			xffip := strings.TrimSpace(ip[:i])
+			xffip = strings.TrimPrefix(xffip, "[")
+			return strings.TrimSuffix(xffip, "]")
+		}
+		return ip
+	}
+	if ip := string(ctx.Request.Header.Peek(echo.HeaderXRealIP)); ip != "" {
+		ip = strings.TrimPrefix(ip, "[")
+		return strings.TrimSuffix(ip, "]")
+	}
+	ra, _, _ := net.SplitHostPort(ctx.RemoteAddr().String())
+	return ra
+}
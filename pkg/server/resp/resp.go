@@ -0,0 +1,445 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/kivra/gocc/pkg/logging/logctx"
+	"github.com/kivra/gocc/pkg/server/endpoints"
+	"github.com/kivra/gocc/pkg/tenant_auth"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Frontend serves a subset of the redis protocol (RESP), so that services using redis-cell's
+// CL.THROTTLE can switch to gocc by changing their connection string.
+// Commands on a connection are processed in order, one at a time, as redis does.
+// This means that a GOCC.ASK with CANWAIT blocks its connection until it is answered, or the connection ends.
+// With tenant auth, connections authenticate with AUTH <api key or jwt>, as with a redis password.
+type Frontend struct {
+	cfg            *config.GlobalCfgValidated
+	limiterManager *limiter_manager.LimiterManagerSet
+	auth           *tenant_auth.Authenticator
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func New(
+	cfg *config.GlobalCfgValidated,
+	limiterManager *limiter_manager.LimiterManagerSet,
+	auth *tenant_auth.Authenticator,
+) *Frontend {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Frontend{
+		cfg:            cfg,
+		limiterManager: limiterManager,
+		auth:           auth,
+		conns:          map[net.Conn]struct{}{},
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+func (f *Frontend) Name() string {
+	return "resp"
+}
+
+func (f *Frontend) Port() int {
+	return f.cfg.RespPort.Value()
+}
+
+func (f *Frontend) Serve(listener net.Listener) error {
+	f.mutex.Lock()
+	f.listeners = append(f.listeners, listener)
+	f.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if f.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		f.mutex.Lock()
+		f.conns[conn] = struct{}{}
+		f.mutex.Unlock()
+		go f.serveConn(conn)
+	}
+}
+
+func (f *Frontend) Close() {
+	f.cancel()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, listener := range f.listeners {
+		_ = listener.Close()
+	}
+	for conn := range f.conns {
+		_ = conn.Close()
+	}
+}
+
+func (f *Frontend) serveConn(conn net.Conn) {
+	// Done when the connection ends, so that clients that go away give up the requests they wait for
+	connCtx, cancel := context.WithCancel(f.ctx)
+	defer func() {
+		cancel()
+		f.mutex.Lock()
+		delete(f.conns, conn)
+		f.mutex.Unlock()
+		_ = conn.Close()
+	}()
+
+	// Commands are read ahead, while the previous one is executed, so that the end of the connection is noticed
+	// while a GOCC.ASK with CANWAIT waits
+	commands := make(chan readResult, maxPipelinedCommands)
+	go func() {
+		defer close(commands)
+		reader := bufio.NewReader(conn)
+		for {
+			args, err := readCommand(reader)
+			if err != nil && !errors.Is(err, errProtocol) {
+				cancel()
+			}
+			select {
+			case commands <- readResult{args: args, err: err}:
+			case <-connCtx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	writer := bufio.NewWriter(conn)
+	session := &session{ctx: connCtx}
+
+	for command := range commands {
+		if err := command.err; err != nil {
+			if errors.Is(err, errProtocol) {
+				writeError(writer, "ERR "+err.Error())
+				_ = writer.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Debug(fmt.Sprintf("resp connection closed: %v", err))
+			}
+			return
+		}
+		if len(command.args) == 0 {
+			continue
+		}
+
+		if quit := f.handleCommand(session, writer, command.args); quit {
+			_ = writer.Flush()
+			return
+		}
+
+		// Only flush when there are no more pipelined commands waiting
+		if len(commands) == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// maxPipelinedCommands is how many commands of a connection are read ahead of the one being executed
+const maxPipelinedCommands = 16
+
+type readResult struct {
+	args []string
+	err  error
+}
+
+// session is the state of a connection
+type session struct {
+	ctx   context.Context // done when the connection ends
+	token string          // credentials given with AUTH, checked again for every command
+}
+
+// handleCommand executes one command and writes its reply. Returns true if the connection should be closed.
+func (f *Frontend) handleCommand(s *session, w *bufio.Writer, args []string) bool {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		if len(args) > 1 {
+			writeBulkString(w, args[1])
+		} else {
+			writeSimpleString(w, "PONG")
+		}
+	case "ECHO":
+		if len(args) != 2 {
+			writeWrongNumberOfArgs(w, args[0])
+		} else {
+			writeBulkString(w, args[1])
+		}
+	case "QUIT":
+		writeSimpleString(w, "OK")
+		return true
+	case "SELECT", "CLIENT":
+		// Sent by client libraries when connecting. There's only one database, and we don't track client names
+		writeSimpleString(w, "OK")
+	case "COMMAND":
+		writeArrayHeader(w, 0)
+	case "AUTH":
+		f.handleAuth(s, w, args)
+	case "CL.THROTTLE":
+		f.handleThrottle(s, w, args)
+	case "GOCC.ASK":
+		f.handleAsk(s, w, args)
+	case "GOCC.RELEASE":
+		f.handleRelease(s, w, args)
+	case "GOCC.DEBUG":
+		f.handleDebug(s, w, args)
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return false
+}
+
+// handleAuth implements AUTH [<username>] <password>, where the password is an api key or a jwt.
+// The username is ignored, since the credentials identify the tenant.
+func (f *Frontend) handleAuth(s *session, w *bufio.Writer, args []string) {
+	if len(args) != 2 && len(args) != 3 {
+		writeWrongNumberOfArgs(w, args[0])
+		return
+	}
+	if !f.auth.Enabled() {
+		writeError(w, "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	token := args[len(args)-1]
+	if _, err := f.auth.Authenticate(token); err != nil {
+		writeError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	s.token = token
+	writeSimpleString(w, "OK")
+}
+
+// authorize checks that the session's tenant may use the key, writing an error reply if not
+func (f *Frontend) authorize(s *session, w *bufio.Writer, key string) (*tenant_auth.Tenant, bool) {
+	tenant, err := f.auth.Authorize(s.token, key)
+	if err != nil {
+		if err.Status == http.StatusUnauthorized {
+			writeError(w, "NOAUTH Authentication required.")
+		} else {
+			writeError(w, "NOPERM "+err.Msg)
+		}
+		return nil, false
+	}
+	return tenant, true
+}
+
+func (f *Frontend) newRequestContext(parent context.Context, key string) context.Context {
+	ctx := logctx.Add(parent, "correlation-id", "gcc-"+uuid.New().String())
+	return logctx.Add(ctx, "key", key)
+}
+
+// handleThrottle implements redis-cell's CL.THROTTLE <key> <max_burst> <count per period> <period> [<quantity>]
+// on top of gocc's fixed windows: the window is <period> seconds long and allows <count per period> requests.
+// max_burst is accepted for compatibility, but a fixed window always allows its full count as a burst. It still
+// bounds the quantity to max_burst+1, which is approved in full or limited without consuming any, as in redis-cell.
+// Reply: [limited (0/1), limit, remaining, retry after (seconds, -1 if allowed), reset after (seconds)]
+func (f *Frontend) handleThrottle(s *session, w *bufio.Writer, args []string) {
+	if len(args) != 5 && len(args) != 6 {
+		writeWrongNumberOfArgs(w, args[0])
+		return
+	}
+	key := strings.TrimSpace(args[1])
+	if len(key) == 0 {
+		writeError(w, "ERR empty key provided")
+		return
+	}
+	tenant, ok := f.authorize(s, w, key)
+	if !ok {
+		return
+	}
+	ints := make([]int, 0, 4)
+	for _, arg := range args[2:] {
+		i, err := strconv.ParseInt(arg, 10, 32)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		ints = append(ints, int(i))
+	}
+	countPerPeriod, period, quantity := ints[1], ints[2], 1
+	if len(ints) == 4 {
+		quantity = ints[3]
+	}
+	if ints[0] < 0 || countPerPeriod <= 0 || period <= 0 {
+		writeError(w, "ERR max_burst, count per period and period must be positive")
+		return
+	}
+	if quantity < 1 || quantity > ints[0]+1 {
+		writeError(w, "ERR quantity must be between 1 and max_burst+1")
+		return
+	}
+
+	maxRequests, windowMillis := countPerPeriod, period*1000
+	if !endpoints.CanSetRate(f.cfg, tenant, key) {
+		// Clients aren't allowed to set rates, so the key's configured limits apply
+		maxRequests, windowMillis = limiter_api.NoChange, limiter_api.NoChange
+	}
+
+	ctx := f.newRequestContext(f.ctx, key)
+	if err := endpoints.ValidateOverrides(f.cfg, tenant, key, maxRequests, limiter_api.NoChange, windowMillis); err != nil {
+		slog.Warn(err.Msg, logctx.GetAll(ctx)...)
+		writeError(w, "ERR "+err.Msg)
+		return
+	}
+
+	resp, _ := f.limiterManager.AskPermissionForHits(ctx, key, quantity, maxRequests, limiter_api.NoChange, windowMillis)
+
+	resetAfter := int64(math.Ceil(resp.Status.ResetAfter().Seconds()))
+	limited, retryAfter := int64(0), int64(-1)
+	if resp.RespCode != limiter_api.Approved {
+		limited, retryAfter = 1, resetAfter
+	}
+
+	writeArrayHeader(w, 5)
+	writeInt(w, limited)
+	writeInt(w, int64(resp.Status.MaxRequestsPerWindow))
+	writeInt(w, int64(resp.Status.Remaining()))
+	writeInt(w, retryAfter)
+	writeInt(w, resetAfter)
+}
+
+// handleAsk implements GOCC.ASK <key> [CANWAIT] [MAXREQUESTS <n>] [MAXREQUESTSINQUEUE <n>],
+// the equivalent of POST /rate/:key.
+// Reply: [approved (0/1), request id (nil if not approved), limit, remaining, reset after (millis)]
+func (f *Frontend) handleAsk(s *session, w *bufio.Writer, args []string) {
+	if len(args) < 2 {
+		writeWrongNumberOfArgs(w, args[0])
+		return
+	}
+	key := strings.TrimSpace(args[1])
+	if len(key) == 0 {
+		writeError(w, "ERR empty key provided")
+		return
+	}
+	tenant, ok := f.authorize(s, w, key)
+	if !ok {
+		return
+	}
+
+	canWait := false
+	maxRequests, maxRequestsInQueue := limiter_api.NoChange, limiter_api.NoChange
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "CANWAIT":
+			canWait = true
+		case "MAXREQUESTS", "MAXREQUESTSINQUEUE":
+			if i+1 >= len(args) {
+				writeError(w, "ERR syntax error")
+				return
+			}
+			value, err := strconv.ParseInt(args[i+1], 10, 32)
+			if err != nil {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+			if strings.ToUpper(args[i]) == "MAXREQUESTS" {
+				maxRequests = int(value)
+			} else {
+				maxRequestsInQueue = int(value)
+			}
+			i++
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	// Only requests that wait give up when the connection ends. The others are answered right away, also when
+	// the client closed the connection after sending them.
+	parent := f.ctx
+	if canWait {
+		parent = s.ctx
+	}
+	ctx := f.newRequestContext(parent, key)
+	if err := endpoints.ValidateOverrides(f.cfg, tenant, key, maxRequests, maxRequestsInQueue, limiter_api.NoChange); err != nil {
+		slog.Warn(err.Msg, logctx.GetAll(ctx)...)
+		writeError(w, "ERR "+err.Msg)
+		return
+	}
+
+	resp, requestID := f.limiterManager.AskPermissionWithStatus(ctx, key, canWait, maxRequests, maxRequestsInQueue, limiter_api.NoChange)
+
+	writeArrayHeader(w, 5)
+	if resp.RespCode == limiter_api.Approved {
+		writeInt(w, 1)
+		writeBulkString(w, requestID)
+	} else {
+		writeInt(w, 0)
+		writeNil(w)
+	}
+	writeInt(w, int64(resp.Status.MaxRequestsPerWindow))
+	writeInt(w, int64(resp.Status.Remaining()))
+	writeInt(w, resp.Status.ResetAfter().Milliseconds())
+}
+
+// handleRelease implements GOCC.RELEASE <key> <request id>, the equivalent of DELETE /rate/:key/:id
+func (f *Frontend) handleRelease(s *session, w *bufio.Writer, args []string) {
+	if len(args) != 3 {
+		writeWrongNumberOfArgs(w, args[0])
+		return
+	}
+	key, id := strings.TrimSpace(args[1]), strings.TrimSpace(args[2])
+	if len(key) == 0 || len(id) == 0 {
+		writeError(w, "ERR empty key or id provided")
+		return
+	}
+	if _, ok := f.authorize(s, w, key); !ok {
+		return
+	}
+	f.limiterManager.Release(f.newRequestContext(f.ctx, key), key, id)
+	writeSimpleString(w, "OK")
+}
+
+// handleDebug implements GOCC.DEBUG <key>, the equivalent of GET /debug/:key. Replies nil if the key isn't found.
+func (f *Frontend) handleDebug(s *session, w *bufio.Writer, args []string) {
+	if len(args) != 2 {
+		writeWrongNumberOfArgs(w, args[0])
+		return
+	}
+	if _, ok := f.authorize(s, w, args[1]); !ok {
+		return
+	}
+	snapshot := f.limiterManager.GetDebugSnapshot(args[1])
+	if snapshot == nil {
+		writeError(w, "ERR unable to get debug snapshot, check server logs")
+		return
+	}
+	if !snapshot.Found {
+		writeNil(w)
+		return
+	}
+	jsBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		writeError(w, fmt.Sprintf("ERR failed to marshal debug snapshot: %v", err))
+		return
+	}
+	writeBulkString(w, string(jsBytes))
+}
+
+func writeWrongNumberOfArgs(w *bufio.Writer, command string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
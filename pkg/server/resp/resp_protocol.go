@@ -0,0 +1,108 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Minimal RESP2 (redis serialization protocol) support. Only what is needed to
+// receive commands from redis clients and write replies back.
+
+const (
+	maxInlineLen  = 64 * 1024  // of inline commands and the lines of multibulk commands, as in redis
+	maxBulkLen    = 64 * 1024  // keys and args are small, no need to accept huge payloads
+	maxCommandLen = 512 * 1024 // of all args of a command together
+)
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads one command, either as a RESP array of bulk strings (what client
+// libraries send), or as an inline command (what you type in telnet/redis-cli --no-raw).
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024 {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, max(n, 0))
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		if total += size; total > maxCommandLen {
+			return nil, fmt.Errorf("%w: too big command", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most maxInlineLen, so that clients that never end their lines can't make us buffer
+// without bounds
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLen {
+			return "", fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+}
+
+func writeSimpleString(w *bufio.Writer, s string) {
+	_, _ = w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	_, _ = w.WriteString("-" + strings.ReplaceAll(s, "\r\n", " ") + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, i int64) {
+	_, _ = w.WriteString(":" + strconv.FormatInt(i, 10) + "\r\n")
+}
+
+func writeBulkString(w *bufio.Writer, s string) {
+	_, _ = w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func writeNil(w *bufio.Writer) {
+	_, _ = w.WriteString("$-1\r\n")
+}
+
+func writeArrayHeader(w *bufio.Writer, n int) {
+	_, _ = w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,286 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"github.com/kivra/gocc/pkg/limiter/limiter_api"
+	"github.com/kivra/gocc/pkg/limiter/limiter_manager"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/lo"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTestFrontend(t *testing.T, requestsCanSetRate bool, maxRequests int) *redis.Client {
+
+	globalCfg := config.NewGlobalCfg()
+	globalCfg.RespPort.Default = lo.ToPtr(0)
+	globalCfg.RequestsCanSetRate.Default = lo.ToPtr(requestsCanSetRate)
+	globalCfg.RequestsCanModQueue.Default = lo.ToPtr(true)
+	cfg := &config.GlobalCfgValidated{GlobalCfg: globalCfg}
+
+	mgr := limiter_manager.NewManagerSet(&limiter_api.Config{
+		WindowMillis:         60_000,
+		MaxRequestsPerWindow: maxRequests,
+		MaxRequestsInQueue:   0,
+	}, nil, nil, 1)
+	t.Cleanup(mgr.Close)
+
+	frontend := New(cfg, mgr, nil)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() { _ = frontend.Serve(listener) }()
+	t.Cleanup(frontend.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func throttle(t *testing.T, client *redis.Client, args ...any) []int64 {
+	result, err := client.Do(context.Background(), append([]any{"CL.THROTTLE"}, args...)...).Int64Slice()
+	if err != nil {
+		t.Fatalf("CL.THROTTLE failed: %v", err)
+	}
+	if len(result) != 5 {
+		t.Fatalf("expected 5 values, got %v", result)
+	}
+	return result
+}
+
+func TestPing(t *testing.T) {
+
+	client := startTestFrontend(t, true, 1)
+
+	if pong, err := client.Ping(context.Background()).Result(); err != nil || pong != "PONG" {
+		t.Fatalf("expected PONG, got %s, %v", pong, err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+
+	client := startTestFrontend(t, true, 1)
+
+	// 2 per 60 seconds
+	for i := 0; i < 2; i++ {
+		result := throttle(t, client, "user123", 15, 2, 60)
+		if result[0] != 0 || result[1] != 2 || result[2] != int64(1-i) || result[3] != -1 {
+			t.Fatalf("expected request %d to be allowed, got %v", i, result)
+		}
+		if result[4] <= 0 || result[4] > 60 {
+			t.Fatalf("expected reset after within the window, got %v", result)
+		}
+	}
+
+	result := throttle(t, client, "user123", 15, 2, 60)
+	if result[0] != 1 || result[2] != 0 {
+		t.Fatalf("expected request to be limited, got %v", result)
+	}
+	if result[3] <= 0 || result[3] > 60 {
+		t.Fatalf("expected retry after within the window, got %v", result)
+	}
+}
+
+func TestThrottle_quantity(t *testing.T) {
+
+	client := startTestFrontend(t, true, 1)
+
+	result := throttle(t, client, "user123", 2, 3, 60, 2)
+	if result[0] != 0 || result[2] != 1 {
+		t.Fatalf("expected 2 to be allowed, got %v", result)
+	}
+
+	// A quantity that doesn't fit is limited without consuming what is left
+	result = throttle(t, client, "user123", 2, 3, 60, 2)
+	if result[0] != 1 || result[2] != 1 {
+		t.Fatalf("expected request to be limited, got %v", result)
+	}
+	result = throttle(t, client, "user123", 2, 3, 60, 1)
+	if result[0] != 0 || result[2] != 0 {
+		t.Fatalf("expected the last one to be allowed, got %v", result)
+	}
+}
+
+func TestThrottle_uses_configured_limits_when_rates_cant_be_set(t *testing.T) {
+
+	client := startTestFrontend(t, false, 1)
+
+	result := throttle(t, client, "user123", 15, 100, 1)
+	if result[0] != 0 || result[1] != 1 {
+		t.Fatalf("expected configured limit of 1 to apply, got %v", result)
+	}
+
+	result = throttle(t, client, "user123", 15, 100, 1)
+	if result[0] != 1 {
+		t.Fatalf("expected request to be limited, got %v", result)
+	}
+}
+
+func TestThrottle_invalid_args(t *testing.T) {
+
+	client := startTestFrontend(t, true, 1)
+
+	for _, args := range [][]any{
+		{"user123", 15, 2},
+		{"user123", 15, "two", 60},
+		{"user123", 15, 2, 0},
+		{"user123", 15, 2, 60, 0},
+		{"user123", 15, 2, 60, 17},
+		{"user123", 15, 2, 7200},
+	} {
+		err := client.Do(context.Background(), append([]any{"CL.THROTTLE"}, args...)...).Err()
+		if err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
+
+func TestAskAndRelease(t *testing.T) {
+
+	client := startTestFrontend(t, true, 1)
+	ctx := context.Background()
+
+	result, err := client.Do(ctx, "GOCC.ASK", "my-key").Slice()
+	if err != nil {
+		t.Fatalf("GOCC.ASK failed: %v", err)
+	}
+	if result[0] != int64(1) || result[1] == nil || result[2] != int64(1) || result[3] != int64(0) {
+		t.Fatalf("expected approval, got %v", result)
+	}
+	requestID := result[1].(string)
+
+	result, err = client.Do(ctx, "GOCC.ASK", "my-key").Slice()
+	if err != nil {
+		t.Fatalf("GOCC.ASK failed: %v", err)
+	}
+	if result[0] != int64(0) || result[1] != nil {
+		t.Fatalf("expected denial, got %v", result)
+	}
+
+	snapshot, err := client.Do(ctx, "GOCC.DEBUG", "my-key").Text()
+	if err != nil {
+		t.Fatalf("GOCC.DEBUG failed: %v", err)
+	}
+	var parsed limiter_api.InstanceDebugSnapshot
+	if err := json.Unmarshal([]byte(snapshot), &parsed); err != nil || !parsed.Found {
+		t.Fatalf("unexpected debug snapshot %s, %v", snapshot, err)
+	}
+
+	if err := client.Do(ctx, "GOCC.RELEASE", "my-key", requestID).Err(); err != nil {
+		t.Fatalf("GOCC.RELEASE failed: %v", err)
+	}
+
+	// Raising the limit makes room for one more
+	result, err = client.Do(ctx, "GOCC.ASK", "my-key", "MAXREQUESTS", 2).Slice()
+	if err != nil {
+		t.Fatalf("GOCC.ASK failed: %v", err)
+	}
+	if result[0] != int64(1) {
+		t.Fatalf("expected approval, got %v", result)
+	}
+
+	if err := client.Do(ctx, "GOCC.DEBUG", "unknown-key").Err(); !errors.Is(err, redis.Nil) {
+		t.Fatalf("expected nil for unknown key, got %v", err)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+
+	client := startTestFrontend(t, true, 3)
+	ctx := context.Background()
+
+	pipe := client.Pipeline()
+	cmds := make([]*redis.Cmd, 5)
+	for i := range cmds {
+		cmds[i] = pipe.Do(ctx, "GOCC.ASK", "pipelined")
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+
+	approved := 0
+	for _, cmd := range cmds {
+		result, err := cmd.Slice()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result[0] == int64(1) {
+			approved++
+		}
+	}
+	if approved != 3 {
+		t.Fatalf("expected 3 approved, got %d", approved)
+	}
+}
+
+func TestAsk_canWait_gives_up_when_the_connection_ends(t *testing.T) {
+
+	client := startTestFrontend(t, true, 1)
+	ctx := context.Background()
+
+	numWaiting := func() int {
+		snapshot, err := client.Do(ctx, "GOCC.DEBUG", "waiting").Text()
+		if err != nil {
+			t.Fatalf("GOCC.DEBUG failed: %v", err)
+		}
+		var parsed limiter_api.InstanceDebugSnapshot
+		if err := json.Unmarshal([]byte(snapshot), &parsed); err != nil {
+			t.Fatalf("unexpected debug snapshot %s, %v", snapshot, err)
+		}
+		return parsed.NumWaiting
+	}
+	awaitWaiting := func(expected int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for numWaiting() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d waiting, got %d", expected, numWaiting())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := client.Do(ctx, "GOCC.ASK", "waiting").Err(); err != nil {
+		t.Fatalf("GOCC.ASK failed: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", client.Options().Addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if _, err := conn.Write([]byte("GOCC.ASK waiting CANWAIT MAXREQUESTSINQUEUE 1\r\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	awaitWaiting(1)
+
+	// The request leaves the queue with its client, rather than taking a slot of the next window
+	_ = conn.Close()
+	awaitWaiting(0)
+}
+
+func TestReadCommand_limits(t *testing.T) {
+
+	for name, input := range map[string]string{
+		"inline line":  strings.Repeat("a", maxInlineLen+1),
+		"bulk length":  fmt.Sprintf("*1\r\n$%d\r\n", maxBulkLen+1),
+		"command size": "*9\r\n" + strings.Repeat(fmt.Sprintf("$%d\r\n%s\r\n", maxBulkLen, strings.Repeat("a", maxBulkLen)), 9),
+	} {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(input)))
+		if !errors.Is(err, errProtocol) {
+			t.Fatalf("expected a protocol error for a too long %s, got %v", name, err)
+		}
+	}
+
+	args, err := readCommand(bufio.NewReader(strings.NewReader(strings.Repeat("a", 10_000) + " b\r\n")))
+	if err != nil || len(args) != 2 || len(args[0]) != 10_000 {
+		t.Fatalf("expected a long inline command within the limit to be read, got %d args, %v", len(args), err)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/kivra/gocc/pkg/config"
@@ -9,6 +11,7 @@ import (
 	slogecho "github.com/samber/slog-echo"
 	"github.com/valyala/fasthttp"
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"log/slog"
 	"net"
 	"net/http"
@@ -16,8 +19,19 @@ import (
 )
 
 type Handle struct {
-	Port  int
-	Close func()
+	Port          int               // 0 if only listening on unix sockets
+	FrontendPorts map[string]int    // bound ports of additional frontends, by frontend name
+	SocketPaths   map[string]string // bound unix sockets, by "http" or frontend name
+	Close         func()
+}
+
+// Frontend is an additional, non-http protocol served next to the http server,
+// e.g. the envoy rate limit service gRPC API. All frontends share the same LimiterManagerSet.
+type Frontend interface {
+	Name() string
+	Port() int                         // 0 = ephemeral port
+	Serve(listener net.Listener) error // may be called for several listeners, e.g. a tcp port and a unix socket
+	Close()
 }
 
 func CreateNew(
@@ -37,17 +51,7 @@ func CreateNew(
 			Filters: []slogecho.Filter{
 				func(ctx echo.Context) bool {
 					if ctx != nil && ctx.Response() != nil {
-						switch ctx.Response().Status / 100 {
-						case 2:
-							return globalCfg.Log2xx.Value()
-						case 4:
-							return globalCfg.Log4xx.Value()
-						case 5:
-							return globalCfg.Log5xx.Value()
-						default:
-							slog.Error("Unknown status code returned internally :S", slog.Int("status", ctx.Response().Status))
-							return true
-						}
+						return shouldLogStatus(globalCfg, ctx.Response().Status)
 					} else {
 						// Should not happen?
 						slog.Error("No response context found, logging all requests", slog.String("context", fmt.Sprintf("%+v", ctx)))
@@ -65,12 +69,50 @@ func CreateNew(
 	return srv
 }
 
+// shouldLogStatus decides if a served request is logged, depending on its response status
+func shouldLogStatus(globalCfg *config.GlobalCfg, status int) bool {
+	switch status / 100 {
+	case 2:
+		return globalCfg.Log2xx.Value()
+	case 4:
+		return globalCfg.Log4xx.Value()
+	case 5:
+		return globalCfg.Log5xx.Value()
+	default:
+		slog.Error("Unknown status code returned internally :S", slog.Int("status", status))
+		return true
+	}
+}
+
 func StartListening(
-	globalCfg *config.GlobalCfg,
+	globalCfg *config.GlobalCfgValidated,
 	server *echo.Echo,
+	routes []endpoints.Route,
 	appCreatedListener chan<- Handle,
+	frontends ...Frontend,
 ) {
 
+	sockets := newUnixSockets(globalCfg.GlobalCfg)
+	frontendPorts, socketPaths, frontendListeners := startFrontends(frontends, sockets, globalCfg.Tls)
+
+	// The http server's own unix socket. In unix socket only mode it's the server's only listener,
+	// otherwise it's served next to the tcp port.
+	var httpUnixListener net.Listener
+	var httpUnixServer *http.Server
+	var fastServer *fasthttp.Server
+	if sockets != nil {
+		listener, path, err := sockets.listen("http")
+		if err != nil {
+			panic(fmt.Sprintf("Failed to bind http unix socket due to %v", err))
+		}
+		slog.Info(fmt.Sprintf("Http server bound to unix socket %s", path))
+		socketPaths["http"] = path
+		httpUnixListener = listener
+		if sockets.only {
+			server.Listener = listener
+		}
+	}
+
 	// start a goroutine that monitors the echo server and emits the port when it has been bound
 	// This is an ugly way of doing it, but unfortunately, echo offers no other way to get the port
 	// when using ephemeral ports. See https://github.com/labstack/echo/issues/1065
@@ -78,14 +120,46 @@ func StartListening(
 		for server.Listener == nil {
 			time.Sleep(100 * time.Millisecond)
 		}
+		port := 0 // no tcp port in unix socket only mode
+		if tcpAddr, ok := server.Listener.Addr().(*net.TCPAddr); ok {
+			port = tcpAddr.Port
+		}
 		appCreatedListener <- Handle{
-			Port:  server.Listener.Addr().(*net.TCPAddr).Port,
-			Close: func() { _ = server.Close() },
+			Port:          port,
+			FrontendPorts: frontendPorts,
+			SocketPaths:   socketPaths,
+			Close: func() {
+				for _, frontend := range frontends {
+					frontend.Close()
+				}
+				for _, listener := range frontendListeners {
+					_ = listener.Close()
+				}
+				_ = server.Close()
+				if fastServer != nil {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+					_ = fastServer.ShutdownWithContext(ctx)
+					cancel()
+				}
+				if httpUnixServer != nil {
+					_ = httpUnixServer.Close()
+				}
+				if httpUnixListener != nil {
+					_ = httpUnixListener.Close() // removes the socket file, also in unix socket only mode
+				}
+			},
 		}
 	}()
 
 	switch config.ServerType(globalCfg.ServerType.Value()) {
 	case config.ServerTypeEcho:
+		endpoints.RegisterEchoRoutes(server, routes)
+		if globalCfg.Tls != nil && (sockets == nil || !sockets.only) {
+			server.Listener = listenTcp(globalCfg, "http/1.1")
+		}
+		if httpUnixListener != nil && !sockets.only {
+			httpUnixServer = serveHttpOnUnixSocket(httpUnixListener, server)
+		}
 		err := server.Start(fmt.Sprintf(":%d", globalCfg.Port.Value()))
 		if err != nil {
 			if !errors.Is(err, http.ErrServerClosed) {
@@ -102,6 +176,17 @@ func StartListening(
 			MaxConcurrentStreams: 250,
 			IdleTimeout:          30 * time.Second,
 		}
+		endpoints.RegisterEchoRoutes(server, routes)
+		if globalCfg.Tls != nil && (sockets == nil || !sockets.only) {
+			// http2 over tls is negotiated with ALPN, next to h2c for plaintext connections
+			server.Listener = listenTcp(globalCfg, "h2", "http/1.1")
+			if err := http2.ConfigureServer(server.Server, http2Backend); err != nil {
+				panic(fmt.Sprintf("Failed to configure http2 over tls: %v", err))
+			}
+		}
+		if httpUnixListener != nil && !sockets.only {
+			httpUnixServer = serveHttpOnUnixSocket(httpUnixListener, h2c.NewHandler(server, http2Backend))
+		}
 		err := server.StartH2CServer(fmt.Sprintf(":%d", globalCfg.Port.Value()), http2Backend)
 		if err != nil {
 			if !errors.Is(err, http.ErrServerClosed) {
@@ -109,20 +194,30 @@ func StartListening(
 			}
 		}
 	case config.ServerTypeFast:
-		slog.Warn("Server implementation not supported/incomplete. Just starting /healthz endpoint for performance testing", slog.String("impl", "fast"))
-
-		slog.Info("Try binding port", slog.Int("port", globalCfg.Port.Value()))
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", globalCfg.Port.Value()))
-		if err != nil {
-			panic(fmt.Sprintf("Failed to start server on port %d due to %v", globalCfg.Port.Value(), err))
+		// http1 only, but with less overhead per request than net/http
+		fastServer = &fasthttp.Server{
+			Handler:               newFastHttpLogger(globalCfg.GlobalCfg, slog.Default(), endpoints.NewFastHttpHandler(routes)),
+			NoDefaultServerHeader: true,
+			NoDefaultContentType:  true,
+			IdleTimeout:           30 * time.Second,
 		}
 
-		port := listener.Addr().(*net.TCPAddr).Port
-		slog.Info(fmt.Sprintf("Bound to port %d", port))
+		listener := httpUnixListener
+		if sockets == nil || !sockets.only {
+			listener = listenTcp(globalCfg, "http/1.1")
+
+			if httpUnixListener != nil {
+				go func() {
+					if err := fastServer.Serve(httpUnixListener); err != nil {
+						slog.Error(fmt.Sprintf("Http server on unix socket stopped: %v", err))
+					}
+				}()
+			}
+		}
 
 		// For hacky backwards compatibility with the old server in tests
 		server.Listener = listener
-		if err := fasthttp.Serve(listener, endpoints.FastHttpServerTesthandler); err != nil {
+		if err := fastServer.Serve(listener); err != nil {
 			panic(fmt.Sprintf("Failed to start server on port %d due to %v", globalCfg.Port.Value(), err))
 		}
 		slog.Info(fmt.Sprintf("Server stopped on port %d", globalCfg.Port.Value()))
@@ -130,3 +225,80 @@ func StartListening(
 		panic(fmt.Sprintf("Unknown server implementation: %v", globalCfg.ServerType.Value()))
 	}
 }
+
+// listenTcp binds the http port, with tls if configured. Unix sockets are always plaintext.
+func listenTcp(globalCfg *config.GlobalCfgValidated, nextProtos ...string) net.Listener {
+	slog.Info("Try binding port", slog.Int("port", globalCfg.Port.Value()))
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", globalCfg.Port.Value()))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to start server on port %d due to %v", globalCfg.Port.Value(), err))
+	}
+	slog.Info(fmt.Sprintf("Bound to port %d", listener.Addr().(*net.TCPAddr).Port))
+	if globalCfg.Tls != nil {
+		return tls.NewListener(listener, globalCfg.Tls.ServerConfig(nextProtos...))
+	}
+	return listener
+}
+
+// serveHttpOnUnixSocket serves the http api on a unix socket, next to the echo server's own tcp listener
+func serveHttpOnUnixSocket(listener net.Listener, handler http.Handler) *http.Server {
+	unixServer := &http.Server{Handler: handler}
+	go func() {
+		if err := unixServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(fmt.Sprintf("Http server on unix socket stopped: %v", err))
+		}
+	}()
+	return unixServer
+}
+
+// alpnFrontend is implemented by frontends whose protocol must be negotiated over tls, e.g. gRPC's h2
+type alpnFrontend interface {
+	NextProtos() []string
+}
+
+// startFrontends binds the ports (and unix sockets, if configured) of all frontends and starts serving them
+// in the background. Binding happens synchronously, so that configuration errors are detected at startup.
+// Tcp ports are served with tls if configured.
+func startFrontends(frontends []Frontend, sockets *unixSockets, tlsCerts *config.TlsCerts) (map[string]int, map[string]string, []net.Listener) {
+	ports := make(map[string]int, len(frontends))
+	socketPaths := make(map[string]string, len(frontends)+1)
+	listeners := make([]net.Listener, 0, 2*len(frontends))
+	for _, frontend := range frontends {
+		if sockets == nil || !sockets.only {
+			slog.Info("Try binding port", slog.String("frontend", frontend.Name()), slog.Int("port", frontend.Port()))
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%d", frontend.Port()))
+			if err != nil {
+				panic(fmt.Sprintf("Failed to start %s frontend on port %d due to %v", frontend.Name(), frontend.Port(), err))
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			ports[frontend.Name()] = port
+			listeners = append(listeners, listener)
+			slog.Info(fmt.Sprintf("Frontend %s bound to port %d", frontend.Name(), port))
+			if tlsCerts != nil {
+				var nextProtos []string
+				if alpn, ok := frontend.(alpnFrontend); ok {
+					nextProtos = alpn.NextProtos()
+				}
+				listener = tls.NewListener(listener, tlsCerts.ServerConfig(nextProtos...))
+			}
+			go serveFrontend(frontend, listener)
+		}
+		if sockets != nil {
+			listener, path, err := sockets.listen(frontend.Name())
+			if err != nil {
+				panic(fmt.Sprintf("Failed to bind %s frontend unix socket due to %v", frontend.Name(), err))
+			}
+			socketPaths[frontend.Name()] = path
+			listeners = append(listeners, listener)
+			slog.Info(fmt.Sprintf("Frontend %s bound to unix socket %s", frontend.Name(), path))
+			go serveFrontend(frontend, listener)
+		}
+	}
+	return ports, socketPaths, listeners
+}
+
+func serveFrontend(frontend Frontend, listener net.Listener) {
+	if err := frontend.Serve(listener); err != nil {
+		slog.Error(fmt.Sprintf("Frontend %s stopped: %v", frontend.Name(), err))
+	}
+}
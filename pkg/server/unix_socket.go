@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"github.com/kivra/gocc/pkg/config"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// unixSockets describes where unix domain sockets should be bound, if at all.
+// Sidecars talking to gocc on the same pod/host can use these instead of tcp on localhost.
+type unixSockets struct {
+	dir  string
+	mode os.FileMode
+	only bool // if true, no tcp ports are bound
+}
+
+func newUnixSockets(globalCfg *config.GlobalCfg) *unixSockets {
+	dir := globalCfg.UnixSocketDir.Value()
+	if dir == "" {
+		if globalCfg.UnixSocketOnly.Value() {
+			panic("unix socket only mode requires a unix socket dir")
+		}
+		return nil
+	}
+	mode, err := strconv.ParseUint(globalCfg.UnixSocketMode.Value(), 8, 32)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid unix socket mode %s: %v", globalCfg.UnixSocketMode.Value(), err))
+	}
+	return &unixSockets{
+		dir:  dir,
+		mode: os.FileMode(mode),
+		only: globalCfg.UnixSocketOnly.Value(),
+	}
+}
+
+// path returns the socket path for a protocol, e.g. <dir>/http.sock or <dir>/resp.sock
+func (u *unixSockets) path(name string) string {
+	return filepath.Join(u.dir, name+".sock")
+}
+
+func (u *unixSockets) listen(name string) (net.Listener, string, error) {
+	path := u.path(name)
+	listener, err := listenUnix(path, u.mode)
+	return listener, path, err
+}
+
+// listenUnix binds a unix domain socket, replacing a stale socket file left behind by a process that didn't
+// shut down cleanly. Sockets that are still in use are never replaced. The socket file is removed when the
+// returned listener is closed. The socket is bound in a directory that only this process can access, and moved
+// into place once it has its mode, so that it can't be connected to before.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, 100*time.Millisecond); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create socket dir for %s: %w", path, err)
+	}
+
+	private, err := os.MkdirTemp(filepath.Dir(path), ".sock-") // 0700
+	if err != nil {
+		return nil, fmt.Errorf("failed to create private dir for %s: %w", path, err)
+	}
+	defer func() { _ = os.RemoveAll(private) }()
+	privatePath := filepath.Join(private, filepath.Base(path))
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: privatePath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false) // it is unlinked from where it was moved to instead
+
+	if err := os.Chmod(privatePath, mode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set mode of %s: %w", path, err)
+	}
+	if err := os.Rename(privatePath, path); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to move socket to %s: %w", path, err)
+	}
+
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener removes the socket file when closed, from where it was moved to after binding
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
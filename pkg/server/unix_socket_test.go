@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix_replaces_stale_socket(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+
+	// Leave a socket file behind, like a process that was killed would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := listenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected socket with mode 0600, got %v, %v", info, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("expected only the socket to be left in its dir, got %v", entries)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("expected the moved socket to accept connections, got %v", err)
+	}
+	_ = conn.Close()
+
+	_ = listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected socket file to be removed on close, got %v", err)
+	}
+}
+
+func TestListenUnix_doesnt_replace_socket_in_use(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+
+	inUse, err := listenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = inUse.Close() }()
+
+	if _, err := listenUnix(path, 0o600); err == nil {
+		t.Fatalf("expected socket in use to be left alone")
+	}
+}
+
+func TestListenUnix_doesnt_replace_other_files(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+	if err := os.WriteFile(path, []byte("important"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	if _, err := listenUnix(path, 0o600); err == nil {
+		t.Fatalf("expected regular file to be left alone")
+	}
+}
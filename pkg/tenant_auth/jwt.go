@@ -0,0 +1,112 @@
+package tenant_auth
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// clockSkew is how far off the clocks of token issuers and gocc may be
+const clockSkew = 30 * time.Second
+
+var errInvalidJwt = errors.New("invalid jwt")
+
+// signatureAlgorithms are the algorithms jwts may be signed with. Only asymmetric ones,
+// so that e.g. an rsa public key can never be used as an hmac secret.
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// readJwks reads the public keys of a jwks file. Keys that can't be used for verifying signatures are skipped.
+func readJwks(path string) ([]jose.JSONWebKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks file %s: %w", path, err)
+	}
+	// Parsed key by key, so that one unsupported key doesn't make the others unusable
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks file %s: %w", path, err)
+	}
+	keys := make([]jose.JSONWebKey, 0, len(jwks.Keys))
+	for i, raw := range jwks.Keys {
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(raw); err != nil {
+			slog.Warn(fmt.Sprintf("Skipping key %d in jwks file %s: %v", i, path, err))
+			continue
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		public := key.Public()
+		if !public.Valid() {
+			slog.Warn(fmt.Sprintf("Skipping key '%s' in jwks file %s: not an asymmetric key", key.KeyID, path))
+			continue
+		}
+		if rsaKey, ok := public.Key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+			slog.Warn(fmt.Sprintf("Skipping key '%s' in jwks file %s: rsa keys must be at least 2048 bits", key.KeyID, path))
+			continue
+		}
+		keys = append(keys, public)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys in jwks file %s", path)
+	}
+	return keys, nil
+}
+
+// verifyJwt checks a compact serialized jwt's signature against keys, and its time, issuer and audience claims.
+// An empty issuer or audience is not checked.
+func verifyJwt(token string, keys []jose.JSONWebKey, issuer string, aud string, now time.Time) (*jwt.Claims, error) {
+
+	parsed, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidJwt, err)
+	}
+	header := parsed.Headers[0]
+
+	var claims *jwt.Claims
+	for _, key := range keys {
+		if header.KeyID != "" && key.KeyID != "" && key.KeyID != header.KeyID {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+			continue
+		}
+		var candidate jwt.Claims
+		if parsed.Claims(key.Key, &candidate) == nil {
+			claims = &candidate
+			break
+		}
+	}
+	if claims == nil {
+		return nil, fmt.Errorf("%w: no key verifies the signature (alg '%s', kid '%s')", errInvalidJwt, header.Algorithm, header.KeyID)
+	}
+
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("%w: missing exp claim", errInvalidJwt)
+	}
+	expected := jwt.Expected{Issuer: issuer, Time: now}
+	if aud != "" {
+		expected.AnyAudience = jwt.Audience{aud}
+	}
+	if err := claims.ValidateWithLeeway(expected, clockSkew); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidJwt, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub claim", errInvalidJwt)
+	}
+
+	return claims, nil
+}
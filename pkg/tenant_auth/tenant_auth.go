@@ -0,0 +1,312 @@
+package tenant_auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/kivra/gocc/pkg/config"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tenant is a client of gocc, restricted to a namespace of keys
+type Tenant struct {
+	Name        string
+	CanSetRate  bool
+	CanModQueue bool
+	Admin       bool // may use the admin endpoints
+
+	keyPrefix string
+	keyRegex  *regexp.Regexp // used instead of keyPrefix if set
+}
+
+// AllowsKey returns true if the tenant may use the key. A nil tenant, i.e. tenant auth being disabled, may use any key.
+func (t *Tenant) AllowsKey(key string) bool {
+	if t == nil {
+		return true
+	}
+	if t.keyRegex != nil {
+		return t.keyRegex.MatchString(key)
+	}
+	return strings.HasPrefix(key, t.keyPrefix)
+}
+
+// AuthorizeKey returns an error if the tenant may not use the key
+func (t *Tenant) AuthorizeKey(key string) *AuthError {
+	if !t.AllowsKey(key) {
+		return &AuthError{Status: http.StatusForbidden, Msg: "key not allowed for tenant " + t.Name}
+	}
+	return nil
+}
+
+// AuthError is returned when credentials are missing or invalid, or don't give access to a key.
+// Status is the http status code to use, for frontends speaking http.
+type AuthError struct {
+	Status int
+	Msg    string
+}
+
+func (e *AuthError) Error() string {
+	return e.Msg
+}
+
+// Authenticator resolves credentials to tenants, as configured in the config file.
+// Tenants are reloaded when the config file or the jwks file changes.
+// A nil Authenticator, or one without tenants, lets everyone in.
+type Authenticator struct {
+	state   atomic.Pointer[state]
+	enabled bool // decided by the tenants at startup, reloads can't turn tenant auth on or off
+
+	mutex       sync.Mutex // held while reloading
+	cfg         *config.CfgFromFile
+	jwksFile    string
+	jwksMonitor *config.FileChangeMonitor[string]
+}
+
+type state struct {
+	tenants   []*Tenant
+	byApiKey  map[[sha256.Size]byte]*Tenant
+	bySubject map[string]*Tenant
+	jwtKeys   []jose.JSONWebKey
+	issuer    string
+	audience  string
+}
+
+// New creates an Authenticator for the tenants in the config file, following changes until the channel is closed.
+// Invalid changes are logged and ignored, and the previous tenants are kept. Tenant auth is enabled if there are
+// tenants at startup, changes that remove all tenants, or add the first ones, are invalid.
+func New(initCfg *config.CfgFromFile, changes <-chan *config.CfgFromFile) (*Authenticator, error) {
+	a := &Authenticator{}
+	if err := a.reload(initCfg); err != nil {
+		return nil, err
+	}
+	a.enabled = len(a.state.Load().tenants) > 0
+	go func() {
+		for newCfg := range changes {
+			if err := a.reload(newCfg); err != nil {
+				slog.Error(fmt.Sprintf("Failed to reload tenants, keeping the previous ones: %v", err))
+			}
+		}
+	}()
+	return a, nil
+}
+
+// Enabled returns true if requests must carry the credentials of a tenant
+func (a *Authenticator) Enabled() bool {
+	return a != nil && a.enabled
+}
+
+// Authenticate returns the tenant that a bearer token (an api key or a jwt) belongs to.
+// Returns a nil tenant if tenant auth is disabled.
+func (a *Authenticator) Authenticate(token string) (*Tenant, *AuthError) {
+	if !a.Enabled() {
+		return nil, nil
+	}
+	s := a.state.Load()
+
+	if token == "" {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Msg: "missing credentials"}
+	}
+
+	if len(s.jwtKeys) > 0 && strings.Count(token, ".") == 2 {
+		claims, err := verifyJwt(token, s.jwtKeys, s.issuer, s.audience, time.Now())
+		if err != nil {
+			slog.Debug(fmt.Sprintf("rejected jwt: %v", err))
+			return nil, &AuthError{Status: http.StatusUnauthorized, Msg: "invalid credentials"}
+		}
+		if tenant, ok := s.bySubject[claims.Subject]; ok {
+			return tenant, nil
+		}
+		slog.Debug(fmt.Sprintf("rejected jwt: no tenant for subject '%s'", claims.Subject))
+		return nil, &AuthError{Status: http.StatusUnauthorized, Msg: "invalid credentials"}
+	}
+
+	if tenant, ok := s.byApiKey[sha256.Sum256([]byte(token))]; ok {
+		return tenant, nil
+	}
+	return nil, &AuthError{Status: http.StatusUnauthorized, Msg: "invalid credentials"}
+}
+
+// Authorize authenticates a bearer token, and checks that its tenant may use the key
+func (a *Authenticator) Authorize(token string, key string) (*Tenant, *AuthError) {
+	tenant, err := a.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := tenant.AuthorizeKey(key); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// AuthorizeAdmin is like Authorize, but also requires the tenant to be an admin.
+// Everyone is forbidden if tenant auth is disabled, e.g. after the tenants were removed from the config file.
+func (a *Authenticator) AuthorizeAdmin(token string, key string) (*Tenant, *AuthError) {
+	if !a.Enabled() {
+		return nil, &AuthError{Status: http.StatusForbidden, Msg: "admin requests require tenant auth"}
+	}
+	tenant, err := a.Authorize(token, key)
+	if err != nil {
+		return nil, err
+	}
+	if !tenant.Admin {
+		return nil, &AuthError{Status: http.StatusForbidden, Msg: "tenant " + tenant.Name + " is not an admin"}
+	}
+	return tenant, nil
+}
+
+// Close stops monitoring the jwks file
+func (a *Authenticator) Close() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.jwksMonitor.Close()
+	a.jwksMonitor = nil
+}
+
+// BearerToken returns the token of an Authorization header value, or "" if it isn't a bearer token
+func BearerToken(authorization string) string {
+	scheme, token, found := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// HashApiKey returns the hex encoded sha256 of an api key, as it is written in the config file
+func HashApiKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *Authenticator) reload(cfg *config.CfgFromFile) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if cfg == nil {
+		cfg = &config.CfgFromFile{}
+	}
+	s, err := newState(cfg)
+	if err != nil {
+		return err
+	}
+	if a.cfg != nil && a.enabled && len(s.tenants) == 0 {
+		return fmt.Errorf("no tenants left, turning tenant auth off takes a restart")
+	}
+	if a.cfg != nil && !a.enabled && len(s.tenants) > 0 {
+		return fmt.Errorf("tenants added, turning tenant auth on takes a restart")
+	}
+	a.cfg = cfg
+	a.state.Store(s)
+
+	jwksFile := ""
+	if cfg.Jwt != nil && len(cfg.Tenants) > 0 {
+		jwksFile = cfg.Jwt.JwksFile
+	}
+	if jwksFile != a.jwksFile {
+		a.jwksMonitor.Close()
+		a.jwksMonitor = nil
+		a.jwksFile = jwksFile
+		if jwksFile != "" {
+			a.jwksMonitor = config.MonitorFileUpdates(jwksFile)
+			go a.followJwksChanges(a.jwksMonitor)
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) followJwksChanges(monitor *config.FileChangeMonitor[string]) {
+	for range monitor.Changes() {
+		a.mutex.Lock()
+		s, err := newState(a.cfg)
+		if err == nil {
+			a.state.Store(s)
+		}
+		a.mutex.Unlock()
+		if err != nil {
+			// Typically the file is mid-update. Next change will fix it.
+			slog.Warn(fmt.Sprintf("Failed to reload jwks file, keeping the previous keys: %v", err))
+		} else {
+			slog.Info("Reloaded jwks file")
+		}
+	}
+}
+
+func newState(cfg *config.CfgFromFile) (*state, error) {
+
+	s := &state{
+		byApiKey:  map[[sha256.Size]byte]*Tenant{},
+		bySubject: map[string]*Tenant{},
+	}
+
+	names := map[string]bool{}
+	for _, t := range cfg.Tenants {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tenants must have a name")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate tenant name '%s'", t.Name)
+		}
+		names[t.Name] = true
+
+		// An empty pattern would match all keys, so that has to be asked for explicitly
+		if t.KeyPattern == "" {
+			return nil, fmt.Errorf("tenant '%s' has no key pattern, use \"*\" for all keys", t.Name)
+		}
+		tenant := &Tenant{Name: t.Name, CanSetRate: t.CanSetRate, CanModQueue: t.CanModQueue, Admin: t.Admin, keyPrefix: t.KeyPattern}
+		if t.KeyPattern == "*" && !t.KeyPatternIsRegex {
+			tenant.keyPrefix = ""
+		} else if t.KeyPatternIsRegex {
+			regex, err := regexp.Compile(t.KeyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key pattern of tenant '%s': %w", t.Name, err)
+			}
+			tenant.keyRegex = regex
+		}
+
+		if len(t.ApiKeySha256) == 0 && len(t.JwtSubjects) == 0 {
+			return nil, fmt.Errorf("tenant '%s' has no api keys or jwt subjects", t.Name)
+		}
+		for _, hexHash := range t.ApiKeySha256 {
+			hash, err := hex.DecodeString(strings.TrimSpace(hexHash))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("api key of tenant '%s' is not a hex encoded sha256", t.Name)
+			}
+			if _, exists := s.byApiKey[[sha256.Size]byte(hash)]; exists {
+				return nil, fmt.Errorf("api key of tenant '%s' is used by another tenant", t.Name)
+			}
+			s.byApiKey[[sha256.Size]byte(hash)] = tenant
+		}
+		for _, subject := range t.JwtSubjects {
+			if cfg.Jwt == nil || cfg.Jwt.JwksFile == "" {
+				return nil, fmt.Errorf("tenant '%s' has jwt subjects, but no jwks file is configured", t.Name)
+			}
+			if _, exists := s.bySubject[subject]; exists {
+				return nil, fmt.Errorf("jwt subject '%s' of tenant '%s' is used by another tenant", subject, t.Name)
+			}
+			s.bySubject[subject] = tenant
+		}
+
+		s.tenants = append(s.tenants, tenant)
+	}
+
+	if cfg.Jwt != nil && cfg.Jwt.JwksFile != "" && len(s.tenants) > 0 {
+		keys, err := readJwks(cfg.Jwt.JwksFile)
+		if err != nil {
+			return nil, err
+		}
+		s.jwtKeys = keys
+		s.issuer = cfg.Jwt.Issuer
+		s.audience = cfg.Jwt.Audience
+	}
+
+	return s, nil
+}
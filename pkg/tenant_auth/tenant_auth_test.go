@@ -0,0 +1,394 @@
+package tenant_auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/kivra/gocc/pkg/config"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate_disabled_without_tenants(t *testing.T) {
+
+	auth, err := New(&config.CfgFromFile{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if auth.Enabled() {
+		t.Fatalf("expected tenant auth to be disabled")
+	}
+	tenant, authErr := auth.Authorize("", "any-key")
+	if tenant != nil || authErr != nil {
+		t.Fatalf("expected everyone to be let in, got %v, %v", tenant, authErr)
+	}
+	if _, authErr := auth.AuthorizeAdmin("", "any-key"); authErr == nil || authErr.Status != http.StatusForbidden {
+		t.Fatalf("expected admin requests to be forbidden, got %v", authErr)
+	}
+
+	// Tenants added later don't turn tenant auth on
+	changes := make(chan *config.CfgFromFile, 1)
+	defer close(changes)
+	auth, err = New(&config.CfgFromFile{}, changes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	changes <- &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("a")}}}}
+	time.Sleep(50 * time.Millisecond)
+	if tenant, authErr := auth.Authorize("", "any-key"); auth.Enabled() || tenant != nil || authErr != nil {
+		t.Fatalf("expected everyone to still be let in, got %v, %v", tenant, authErr)
+	}
+
+	var nilAuth *Authenticator
+	if nilAuth.Enabled() {
+		t.Fatalf("expected a nil authenticator to be disabled")
+	}
+}
+
+func TestAuthorize_api_keys(t *testing.T) {
+
+	auth, err := New(&config.CfgFromFile{
+		Tenants: []config.CfgFromFileTenant{
+			{Name: "billing", ApiKeySha256: []string{HashApiKey("secret-1")}, KeyPattern: "billing:"},
+			{Name: "search", ApiKeySha256: []string{HashApiKey("secret-2")}, KeyPattern: "^search:[a-z]+$", KeyPatternIsRegex: true, CanSetRate: true},
+			{Name: "all", ApiKeySha256: []string{HashApiKey("secret-4")}, KeyPattern: "*"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		key    string
+		tenant string
+		status int
+	}{
+		{name: "prefix match", token: "secret-1", key: "billing:user-1", tenant: "billing"},
+		{name: "regex match", token: "secret-2", key: "search:abc", tenant: "search"},
+		{name: "all keys", token: "secret-4", key: "anything", tenant: "all"},
+		{name: "outside prefix", token: "secret-1", key: "search:abc", status: http.StatusForbidden},
+		{name: "outside regex", token: "secret-2", key: "search:abc1", status: http.StatusForbidden},
+		{name: "missing credentials", token: "", key: "billing:user-1", status: http.StatusUnauthorized},
+		{name: "unknown api key", token: "secret-3", key: "billing:user-1", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tenant, authErr := auth.Authorize(test.token, test.key)
+			if test.status != 0 {
+				if authErr == nil || authErr.Status != test.status {
+					t.Fatalf("expected status %d, got %v, %v", test.status, tenant, authErr)
+				}
+				return
+			}
+			if authErr != nil || tenant.Name != test.tenant {
+				t.Fatalf("expected tenant %s, got %v, %v", test.tenant, tenant, authErr)
+			}
+		})
+	}
+
+	tenant, _ := auth.Authenticate("secret-2")
+	if !tenant.CanSetRate || tenant.CanModQueue {
+		t.Fatalf("expected the tenant's rights from the config file, got %+v", tenant)
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+
+	auth, err := New(&config.CfgFromFile{
+		Tenants: []config.CfgFromFileTenant{
+			{Name: "ops", ApiKeySha256: []string{HashApiKey("secret-1")}, KeyPattern: "billing:", Admin: true},
+			{Name: "billing", ApiKeySha256: []string{HashApiKey("secret-2")}, KeyPattern: "billing:"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tenant, authErr := auth.AuthorizeAdmin("secret-1", "billing:user-1"); authErr != nil || tenant.Name != "ops" {
+		t.Fatalf("expected the admin tenant, got %v, %v", tenant, authErr)
+	}
+	if _, authErr := auth.AuthorizeAdmin("secret-1", "search:abc"); authErr == nil || authErr.Status != http.StatusForbidden {
+		t.Fatalf("expected admins to be limited to their keys, got %v", authErr)
+	}
+	if _, authErr := auth.AuthorizeAdmin("secret-2", "billing:user-1"); authErr == nil || authErr.Status != http.StatusForbidden {
+		t.Fatalf("expected non admins to be forbidden, got %v", authErr)
+	}
+	if _, authErr := auth.AuthorizeAdmin("", "billing:user-1"); authErr == nil || authErr.Status != http.StatusUnauthorized {
+		t.Fatalf("expected missing credentials to be unauthorized, got %v", authErr)
+	}
+}
+
+func TestAuthenticate_jwts(t *testing.T) {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	dir := t.TempDir()
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJwks(t, jwksFile,
+		map[string]string{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+		// Skipped: symmetric and unsupported keys
+		map[string]string{"kty": "oct", "kid": "hmac", "k": b64([]byte("secret"))},
+		map[string]string{"kty": "EC", "kid": "unsupported", "crv": "P-192", "x": "AA", "y": "AA"},
+	)
+
+	auth, err := New(&config.CfgFromFile{
+		Jwt: &config.CfgFromFileJwt{JwksFile: jwksFile, Issuer: "https://issuer", Audience: "gocc"},
+		Tenants: []config.CfgFromFileTenant{
+			{Name: "billing", JwtSubjects: []string{"billing-svc"}, KeyPattern: "billing:"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(auth.Close)
+
+	now := time.Now().Unix()
+	valid := map[string]any{"sub": "billing-svc", "iss": "https://issuer", "aud": []string{"other", "gocc"}, "exp": now + 60}
+	with := func(key string, value any) map[string]any {
+		claims := map[string]any{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{name: "RS256", token: signJwt(t, "RS256", "rsa", rsaKey, valid), ok: true},
+		{name: "PS256", token: signJwt(t, "PS256", "rsa", rsaKey, valid), ok: true},
+		{name: "ES256", token: signJwt(t, "ES256", "ec", ecKey, valid), ok: true},
+		{name: "EdDSA", token: signJwt(t, "EdDSA", "ed", edKey, valid), ok: true},
+		{name: "no kid", token: signJwt(t, "ES256", "", ecKey, valid), ok: true},
+		{name: "string audience", token: signJwt(t, "ES256", "ec", ecKey, with("aud", "gocc")), ok: true},
+		{name: "wrong kid", token: signJwt(t, "ES256", "rsa", ecKey, valid)},
+		{name: "expired", token: signJwt(t, "ES256", "ec", ecKey, with("exp", now-120))},
+		{name: "missing exp", token: signJwt(t, "ES256", "ec", ecKey, with("exp", nil))},
+		{name: "not valid yet", token: signJwt(t, "ES256", "ec", ecKey, with("nbf", now+120))},
+		{name: "wrong issuer", token: signJwt(t, "ES256", "ec", ecKey, with("iss", "https://other"))},
+		{name: "wrong audience", token: signJwt(t, "ES256", "ec", ecKey, with("aud", "other"))},
+		{name: "unknown subject", token: signJwt(t, "ES256", "ec", ecKey, with("sub", "search-svc"))},
+		{name: "alg none", token: unsignedJwt(t, "none", valid, nil)},
+		{name: "hmac with the public key", token: unsignedJwt(t, "HS256", valid, []byte("anything"))},
+		{name: "tampered claims", token: tamper(t, signJwt(t, "ES256", "ec", ecKey, valid), with("sub", "billing-svc-2"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tenant, authErr := auth.Authenticate(test.token)
+			if test.ok && (authErr != nil || tenant.Name != "billing") {
+				t.Fatalf("expected the jwt to be accepted, got %v, %v", tenant, authErr)
+			}
+			if !test.ok && (authErr == nil || authErr.Status != http.StatusUnauthorized) {
+				t.Fatalf("expected the jwt to be rejected, got %v, %v", tenant, authErr)
+			}
+		})
+	}
+}
+
+func TestNew_rejects_invalid_tenants(t *testing.T) {
+
+	tests := []struct {
+		name string
+		cfg  *config.CfgFromFile
+	}{
+		{name: "no name", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{ApiKeySha256: []string{HashApiKey("a")}, KeyPattern: "*"}}}},
+		{name: "no credentials", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*"}}}},
+		{name: "empty key pattern", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", ApiKeySha256: []string{HashApiKey("a")}}}}},
+		{name: "empty key regex", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", ApiKeySha256: []string{HashApiKey("a")}, KeyPatternIsRegex: true}}}},
+		{name: "not a sha256", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", ApiKeySha256: []string{"secret"}}}}},
+		{name: "invalid regex", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", ApiKeySha256: []string{HashApiKey("a")}, KeyPattern: "(", KeyPatternIsRegex: true}}}},
+		{name: "jwt subjects without jwks", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", JwtSubjects: []string{"a"}}}}},
+		{name: "shared api key", cfg: &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{
+			{Name: "a", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("a")}},
+			{Name: "b", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("a")}},
+		}}},
+		{name: "missing jwks file", cfg: &config.CfgFromFile{
+			Jwt:     &config.CfgFromFileJwt{JwksFile: filepath.Join(t.TempDir(), "missing.json")},
+			Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", JwtSubjects: []string{"a"}}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New(test.cfg, nil); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestNew_follows_config_changes(t *testing.T) {
+
+	changes := make(chan *config.CfgFromFile, 1)
+	defer close(changes)
+
+	auth, err := New(&config.CfgFromFile{
+		Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("old")}}},
+	}, changes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Invalid changes are ignored
+	changes <- &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*"}}}
+	changes <- &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("new")}}}}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, oldErr := auth.Authenticate("old")
+		_, newErr := auth.Authenticate("new")
+		if oldErr != nil && newErr == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the new api key to replace the old one")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNew_keeps_tenant_auth_enabled(t *testing.T) {
+
+	changes := make(chan *config.CfgFromFile, 1)
+	defer close(changes)
+
+	auth, err := New(&config.CfgFromFile{
+		Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("old")}}},
+	}, changes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A change that leaves no tenants is ignored, rather than letting everyone in
+	changes <- &config.CfgFromFile{}
+	changes <- &config.CfgFromFile{Tenants: []config.CfgFromFileTenant{{Name: "a", KeyPattern: "*", ApiKeySha256: []string{HashApiKey("new")}}}}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, newErr := auth.Authenticate("new"); newErr == nil {
+			break
+		}
+		if !auth.Enabled() {
+			t.Fatalf("expected tenant auth to stay enabled")
+		}
+		if _, authErr := auth.Authenticate(""); authErr == nil {
+			t.Fatalf("expected requests without credentials to stay unauthorized")
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the new api key to be loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, authErr := auth.Authenticate(""); !auth.Enabled() || authErr == nil {
+		t.Fatalf("expected tenant auth to stay enabled")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for header, expected := range map[string]string{
+		"Bearer abc":  "abc",
+		"bearer  abc": "abc",
+		"Basic abc":   "",
+		"abc":         "",
+		"":            "",
+	} {
+		if token := BearerToken(header); token != expected {
+			t.Fatalf("expected '%s' for '%s', got '%s'", expected, header, token)
+		}
+	}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJwks(t *testing.T, path string, keys ...map[string]string) {
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatalf("failed to marshal jwks: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+}
+
+func encodeJwtParts(t *testing.T, header map[string]any, claims map[string]any) string {
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("failed to marshal header: %v", err)
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	return b64(headerJson) + "." + b64(claimsJson)
+}
+
+func signJwt(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeJwtParts(t, header, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	default:
+		t.Fatalf("unsupported alg %s", alg)
+	}
+	if err != nil {
+		t.Fatalf("failed to sign jwt: %v", err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func unsignedJwt(t *testing.T, alg string, claims map[string]any, signature []byte) string {
+	return encodeJwtParts(t, map[string]any{"alg": alg}, claims) + "." + b64(signature)
+}
+
+// tamper replaces the claims of a signed jwt, keeping its header and signature
+func tamper(t *testing.T, token string, claims map[string]any) string {
+	parts := strings.Split(token, ".")
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	return parts[0] + "." + b64(claimsJson) + "." + parts[2]
+}
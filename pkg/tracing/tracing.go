@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"sync/atomic"
+)
+
+const tracerName = "github.com/kivra/gocc"
+
+var tracer atomic.Pointer[trace.Tracer]
+
+// Tracer creates gocc's spans. Until a provider is set up with Setup or Use, spans aren't recorded,
+// and starting them is cheap.
+func Tracer() trace.Tracer {
+	return *tracer.Load()
+}
+
+func init() {
+	noopTracer := noop.NewTracerProvider().Tracer(tracerName)
+	tracer.Store(&noopTracer)
+
+	// Without tracing set up, incoming trace context is still passed on to other instances
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Setup exports spans over OTLP (gRPC) to endpoint, e.g. "localhost:4317". The standard
+// OTEL_EXPORTER_OTLP_* environment variables apply on top, e.g. for tls and headers.
+// The returned function flushes and stops the export.
+func Setup(endpoint string, serviceName string) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+	}
+	return Use(sdktrace.NewBatchSpanProcessor(exporter), serviceName), nil
+}
+
+// Use records all spans, passing them to processor. Tests use it with an in memory exporter:
+//
+//	exporter := tracetest.NewInMemoryExporter()
+//	shutdown := tracing.Use(sdktrace.NewSimpleSpanProcessor(exporter), "gocc")
+func Use(processor sdktrace.SpanProcessor, serviceName string) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	providerTracer := provider.Tracer(tracerName)
+	tracer.Store(&providerTracer) // not otel.Tracer, whose tracers stick to the first provider set
+	return provider.Shutdown
+}
+
+// Extract returns ctx with the trace context of incoming request headers, if any
+func Extract(ctx context.Context, header func(name string) string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier(header))
+}
+
+// Inject adds the trace context of ctx to the headers of an outgoing request
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Traced returns true if ctx is part of a trace. Used to not start traces of internal work by itself.
+func Traced(ctx context.Context) bool {
+	return ctx != nil && trace.SpanContextFromContext(ctx).IsValid()
+}
+
+// headerCarrier reads trace context from request headers. Only the propagator's own fields are read,
+// so Keys isn't needed.
+type headerCarrier func(name string) string
+
+func (h headerCarrier) Get(key string) string { return h(key) }
+func (h headerCarrier) Set(string, string)    {}
+func (h headerCarrier) Keys() []string        { return nil }
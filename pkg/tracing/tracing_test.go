@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+)
+
+func TestExtractAndInject(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := Use(sdktrace.NewSimpleSpanProcessor(exporter), "gocc-test")
+	defer func() { _ = shutdown(context.Background()) }()
+
+	if Traced(context.Background()) || Traced(Extract(context.Background(), func(string) string { return "" })) {
+		t.Fatalf("expected no trace without incoming trace context")
+	}
+
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), incoming.Get)
+	if !Traced(ctx) {
+		t.Fatalf("expected the incoming trace context to be extracted")
+	}
+
+	ctx, span := Tracer().Start(ctx, "test")
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	span.End()
+
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.SpanContext().SpanID().String() + "-01"
+	if outgoing.Get("traceparent") != expected {
+		t.Fatalf("expected traceparent %s, got %s", expected, outgoing.Get("traceparent"))
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "test" || spans[0].Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("expected a span with the incoming parent, got %+v", spans)
+	}
+}